@@ -0,0 +1,126 @@
+package oplog
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// auditQueueSize defines the number of audit events waiting to be recorded after which
+// the new events are dropped
+const auditQueueSize = 1000
+
+// Types of the audit events
+const (
+	// AuditAuthSuccess is recorded when a client authenticates
+	AuditAuthSuccess = "auth_success"
+	// AuditAuthFailure is recorded when a client fails to authenticate or is not granted
+	// the scope of the endpoint
+	AuditAuthFailure = "auth_failure"
+	// AuditStreamStart is recorded when a stream starts tailing the oplog
+	AuditStreamStart = "stream_start"
+	// AuditStreamEnd is recorded when a started stream ends
+	AuditStreamEnd = "stream_end"
+)
+
+// AuditEvent records who accessed the oplog, from where and how
+type AuditEvent struct {
+	// Type is one of AuditAuthSuccess, AuditAuthFailure, AuditStreamStart or AuditStreamEnd
+	Type string    `bson:"type" json:"type"`
+	Time time.Time `bson:"ts" json:"time"`
+	// RemoteAddr is the address of the client
+	RemoteAddr string `bson:"remote_addr" json:"remote_addr"`
+	// User is the name of the authenticated principal, or the username given by a client
+	// failing to authenticate
+	User string `bson:"user,omitempty" json:"user,omitempty"`
+	// Path is the requested path
+	Path string `bson:"path" json:"path"`
+	// Filter is the filter of the stream
+	Filter *Filter `bson:"filter,omitempty" json:"filter,omitempty"`
+	// LastEventID is the event id the stream resumed from, if any
+	LastEventID string `bson:"last_event_id,omitempty" json:"last_event_id,omitempty"`
+	// Mode tells how the stream started: "live", "replication" or "fallback"
+	Mode string `bson:"mode,omitempty" json:"mode,omitempty"`
+	// Duration is the duration of the stream in milliseconds
+	Duration int64 `bson:"duration,omitempty" json:"duration,omitempty"`
+	// EventsSent is the number of operations sent by the stream
+	EventsSent int64 `bson:"events_sent,omitempty" json:"events_sent,omitempty"`
+	// Reason is why the authentication failed or why the stream ended
+	Reason string `bson:"reason,omitempty" json:"reason,omitempty"`
+}
+
+// AuditSink records the audit events. Events are given one at a time, from a single
+// goroutine, so a sink can take its time without slowing the streams down.
+type AuditSink interface {
+	Record(event AuditEvent)
+}
+
+// MongoAuditSink is an AuditSink inserting the events into the oplog_audit collection of
+// the oplog database
+type MongoAuditSink struct {
+	ol *OpLog
+}
+
+// NewMongoAuditSink creates an AuditSink recording the events in the oplog database
+func NewMongoAuditSink(ol *OpLog) *MongoAuditSink {
+	return &MongoAuditSink{ol: ol}
+}
+
+// Record inserts the event into the oplog_audit collection
+func (s *MongoAuditSink) Record(event AuditEvent) {
+	db := s.ol.db()
+	defer db.Session.Close()
+	if err := db.C("oplog_audit").Insert(event); err != nil {
+		log.Warnf("AUDIT can't record %s event of %s: %s", event.Type, event.RemoteAddr, err)
+	}
+}
+
+// audit queues the event for the AuditSink, if any. The queue never blocks: when the sink
+// is lagging, the event is dropped and counted.
+func (daemon *SSEDaemon) audit(event AuditEvent) {
+	if daemon.AuditSink == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	daemon.auditOnce.Do(func() {
+		daemon.auditQueue = make(chan AuditEvent, auditQueueSize)
+		go daemon.recordAudit(daemon.auditQueue)
+	})
+	select {
+	case daemon.auditQueue <- event:
+	default:
+		daemon.logger().Warnf("AUDIT queue full, dropping %s event of %s", event.Type, event.RemoteAddr)
+		daemon.ol.Stats.AuditDropped.Add(1)
+	}
+}
+
+// recordAudit feeds the AuditSink with the queued events
+func (daemon *SSEDaemon) recordAudit(queue <-chan AuditEvent) {
+	for event := range queue {
+		daemon.AuditSink.Record(event)
+	}
+}
+
+// auditStream records the start or the end of a stream
+func (daemon *SSEDaemon) auditStream(eventType string, info ConnectionInfo, mode, reason string) {
+	if daemon.AuditSink == nil {
+		return
+	}
+	event := AuditEvent{
+		Type:        eventType,
+		RemoteAddr:  info.RemoteAddr,
+		User:        info.User,
+		Path:        info.Path,
+		Filter:      &info.Filter,
+		LastEventID: info.LastEventID,
+		Mode:        mode,
+		Reason:      reason,
+	}
+	if eventType == AuditStreamEnd {
+		event.Duration = int64(time.Since(info.Started) / time.Millisecond)
+		event.EventsSent = info.EventsSent
+	}
+	daemon.audit(event)
+}
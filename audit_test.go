@@ -0,0 +1,133 @@
+package oplog
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// recordingSink is an AuditSink sending the events to a channel
+type recordingSink chan AuditEvent
+
+func (s recordingSink) Record(event AuditEvent) {
+	s <- event
+}
+
+func (s recordingSink) next(t *testing.T) AuditEvent {
+	t.Helper()
+	select {
+	case event := <-s:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no audit event recorded")
+		return AuditEvent{}
+	}
+}
+
+func TestAuditStream(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.Authenticator = Credentials{"alice": {Password: "secret"}}
+	sink := make(recordingSink, 10)
+	daemon.AuditSink = sink
+	ops := newTestOperations(3)
+	daemon.hasID = func(id LastID) (bool, error) {
+		return true, nil
+	}
+	sent := make(chan struct{})
+	daemon.tail = func(lastID LastID, filter Filter, opts TailOptions, out chan<- GenericEvent, stop <-chan bool) {
+		for _, op := range ops {
+			select {
+			case out <- op:
+			case <-stop:
+				return
+			}
+		}
+		close(sent)
+		<-stop
+	}
+
+	// Failed authentication
+	req := newTestSSERequest(context.Background())
+	req.SetBasicAuth("alice", "wrong")
+	rec := httptest.NewRecorder()
+	daemon.ServeHTTP(flushResponseWriter{rec}, req)
+	if rec.Code != 401 {
+		t.Fatalf("expected 401, got %d", rec.Code)
+	}
+	event := sink.next(t)
+	if event.Type != AuditAuthFailure || event.User != "alice" || event.Path != "/ops" || event.Reason != "invalid credentials" || event.Time.IsZero() {
+		t.Errorf("invalid auth failure event: %#v", event)
+	}
+
+	// Full connect, stream and disconnect cycle
+	lastEventID := bson.NewObjectId().Hex()
+	ctx, cancel := context.WithCancel(context.Background())
+	req = httptest.NewRequest("GET", "/ops?types=video&last_event_id="+lastEventID, nil).WithContext(ctx)
+	req.Header.Set("Accept", "text/event-stream")
+	req.SetBasicAuth("alice", "secret")
+	req.RemoteAddr = "10.0.0.1:1234"
+	rec = httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		daemon.ServeHTTP(flushResponseWriter{rec}, req)
+		close(done)
+	}()
+	event = sink.next(t)
+	if event.Type != AuditAuthSuccess || event.User != "alice" || event.RemoteAddr != "10.0.0.1" {
+		t.Errorf("invalid auth success event: %#v", event)
+	}
+	event = sink.next(t)
+	if event.Type != AuditStreamStart || event.User != "alice" || event.Mode != "live" || event.LastEventID != lastEventID {
+		t.Errorf("invalid stream start event: %#v", event)
+	}
+	if event.Filter == nil || len(event.Filter.Types) != 1 || event.Filter.Types[0] != "video" {
+		t.Errorf("invalid stream start filter: %#v", event.Filter)
+	}
+	<-sent
+	cancel()
+	<-done
+	event = sink.next(t)
+	if event.Type != AuditStreamEnd || event.User != "alice" || event.Mode != "live" {
+		t.Errorf("invalid stream end event: %#v", event)
+	}
+	if event.EventsSent != 3 {
+		t.Errorf("expected 3 events sent, got %d", event.EventsSent)
+	}
+	if event.Reason != "client_closed" {
+		t.Errorf("expected client_closed reason, got %q", event.Reason)
+	}
+	select {
+	case event := <-sink:
+		t.Errorf("unexpected audit event: %#v", event)
+	default:
+	}
+}
+
+// blockingSink is an AuditSink blocking until released
+type blockingSink chan struct{}
+
+func (s blockingSink) Record(event AuditEvent) {
+	<-s
+}
+
+func TestAuditDropped(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	sink := make(blockingSink)
+	defer close(sink)
+	daemon.AuditSink = sink
+
+	dropped := daemon.ol.Stats.AuditDropped.Value()
+	start := time.Now()
+	for i := 0; i < auditQueueSize+2; i++ {
+		daemon.audit(AuditEvent{Type: AuditAuthSuccess})
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("recording blocked with a lagging sink")
+	}
+	if daemon.ol.Stats.AuditDropped.Value()-dropped < 1 {
+		t.Errorf("expected dropped events to be counted")
+	}
+}
@@ -0,0 +1,508 @@
+package oplog
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// authGuardMaxClients defines the maximum number of client IPs tracked by the auth guard,
+// the least recently failing ones being forgotten first
+const authGuardMaxClients = 10000
+
+// authGuard bans the client IPs failing to authenticate too many times within a window,
+// so the passwords can't be brute-forced.
+type authGuard struct {
+	mu      sync.Mutex
+	clients map[string]*list.Element
+	// lru orders the clients from the most to the least recently failing
+	lru *list.List
+	max int
+}
+
+// authClient stores the authentication failures of a client IP
+type authClient struct {
+	ip          string
+	failures    int
+	windowStart time.Time
+	bannedUntil time.Time
+}
+
+func newAuthGuard(max int) *authGuard {
+	return &authGuard{clients: map[string]*list.Element{}, lru: list.New(), max: max}
+}
+
+// banned returns the remaining time of the ban of ip, if any
+func (g *authGuard) banned(ip string, now time.Time) (time.Duration, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	e, found := g.clients[ip]
+	if !found {
+		return 0, false
+	}
+	c := e.Value.(*authClient)
+	if !now.Before(c.bannedUntil) {
+		return 0, false
+	}
+	return c.bannedUntil.Sub(now), true
+}
+
+// fail records an authentication failure of ip and returns true if the failure gets it
+// banned, i.e.: it failed maxFailures times within window.
+func (g *authGuard) fail(ip string, now time.Time, maxFailures int, window, ban time.Duration) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var c *authClient
+	if e, found := g.clients[ip]; found {
+		g.lru.MoveToFront(e)
+		c = e.Value.(*authClient)
+	} else {
+		c = &authClient{ip: ip}
+		g.clients[ip] = g.lru.PushFront(c)
+		for g.lru.Len() > g.max {
+			oldest := g.lru.Back()
+			g.lru.Remove(oldest)
+			delete(g.clients, oldest.Value.(*authClient).ip)
+		}
+	}
+	if now.Sub(c.windowStart) > window {
+		c.failures = 0
+		c.windowStart = now
+	}
+	c.failures++
+	if c.failures < maxFailures {
+		return false
+	}
+	c.failures = 0
+	c.bannedUntil = now.Add(ban)
+	return true
+}
+
+// succeed forgets the failures of ip once it authenticated
+func (g *authGuard) succeed(ip string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if e, found := g.clients[ip]; found {
+		g.lru.Remove(e)
+		delete(g.clients, ip)
+	}
+}
+
+// Scopes granted to the clients
+const (
+	// ScopeRead allows to consume the operations
+	ScopeRead = "read"
+	// ScopeWrite allows to post operations
+	ScopeWrite = "write"
+	// ScopeAdmin allows to see the connected clients on /status and the metrics
+	ScopeAdmin = "admin"
+)
+
+// defaultScopes are granted to the credentials not giving their scopes
+var defaultScopes = []string{ScopeRead}
+
+// Authenticator checks the credentials given by the clients thru HTTP basic
+// authentication
+type Authenticator interface {
+	Authenticate(user, password string) bool
+}
+
+// ScopedAuthenticator is an Authenticator granting each user its own scopes. Users of
+// other authenticators are granted the read scope.
+type ScopedAuthenticator interface {
+	Authenticator
+	Scopes(user string) []string
+}
+
+// Credential is the password of a user, given in plaintext or hashed with bcrypt or
+// argon2id, along with the scopes it grants and the policy restricting the operations it
+// can consume
+type Credential struct {
+	Password string
+	// Scopes default to the read scope
+	Scopes []string
+	Policy Policy
+}
+
+// Credentials is a ScopedAuthenticator and a PolicyAuthenticator checking the clients
+// against a password per username
+type Credentials map[string]Credential
+
+// Authenticate checks the password of user
+func (c Credentials) Authenticate(user, password string) bool {
+	credential, found := c[user]
+	// The comparison is performed even for unknown users so they can't be guessed
+	return passwordMatches(credential.Password, password) && found
+}
+
+// Scopes returns the scopes granted to user
+func (c Credentials) Scopes(user string) []string {
+	return c[user].Scopes
+}
+
+// Policy returns the policy of user
+func (c Credentials) Policy(user string) Policy {
+	return c[user].Policy
+}
+
+// RevocableAuthenticator is an Authenticator whose users can be removed while the daemon
+// is running, see RevokeUser
+type RevocableAuthenticator interface {
+	Authenticator
+	Remove(user string)
+}
+
+// CredentialStore is a RevocableAuthenticator checking the clients against Credentials
+// which can be updated while the daemon is running
+type CredentialStore struct {
+	mu          sync.RWMutex
+	credentials Credentials
+	onRemove    []func(user string)
+}
+
+// NewCredentialStore creates a store holding a copy of the credentials
+func NewCredentialStore(c Credentials) *CredentialStore {
+	s := &CredentialStore{credentials: Credentials{}}
+	for user, credential := range c {
+		s.credentials[user] = credential
+	}
+	return s
+}
+
+// Authenticate checks the password of user
+func (s *CredentialStore) Authenticate(user, password string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.credentials.Authenticate(user, password)
+}
+
+// Scopes returns the scopes granted to user
+func (s *CredentialStore) Scopes(user string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.credentials.Scopes(user)
+}
+
+// Policy returns the policy of user
+func (s *CredentialStore) Policy(user string) Policy {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.credentials.Policy(user)
+}
+
+// Set adds or replaces the credential of user
+func (s *CredentialStore) Set(user string, credential Credential) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.credentials[user] = credential
+}
+
+// Remove removes the credential of user, then calls the OnRemove callbacks
+func (s *CredentialStore) Remove(user string) {
+	s.mu.Lock()
+	delete(s.credentials, user)
+	callbacks := s.onRemove
+	s.mu.Unlock()
+	for _, f := range callbacks {
+		f(user)
+	}
+}
+
+// OnRemove registers f to be called with each user removed from the store. The SSEDaemon
+// using the store registers itself to end the streams of the removed users.
+func (s *CredentialStore) OnRemove(f func(user string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onRemove = append(s.onRemove[:len(s.onRemove):len(s.onRemove)], f)
+}
+
+// removalNotifier is implemented by the authenticators telling when a user is removed,
+// like CredentialStore
+type removalNotifier interface {
+	OnRemove(f func(user string))
+}
+
+// watchRemovals registers the daemon to the Authenticator, once, when it notifies the
+// removal of its users, so their running streams end as with RevokeUser
+func (daemon *SSEDaemon) watchRemovals() {
+	notifier, ok := daemon.Authenticator.(removalNotifier)
+	if !ok {
+		return
+	}
+	daemon.removalsMu.Lock()
+	defer daemon.removalsMu.Unlock()
+	if daemon.removals == notifier {
+		return
+	}
+	daemon.removals = notifier
+	notifier.OnRemove(func(user string) {
+		n := daemon.DisconnectClients(func(info ConnectionInfo) bool {
+			return info.User == user
+		})
+		if n > 0 {
+			daemon.logger().Warnf("AUTH %q removed from the credentials, %d streams ended", user, n)
+		}
+	})
+}
+
+// ReadCredentials reads credentials given as
+// "username:password [scope,scope…] [types=type,type…] [parents=prefix,prefix…]" lines.
+// Empty lines and lines starting with # are ignored.
+func ReadCredentials(r io.Reader) (Credentials, error) {
+	c := Credentials{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		pair := strings.SplitN(fields[0], ":", 2)
+		if len(pair) != 2 || pair[0] == "" || pair[1] == "" {
+			return nil, fmt.Errorf("invalid credentials on line %d", n)
+		}
+		scopes, policy, err := parseGrants(fields[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid credentials on line %d: %s", n, err)
+		}
+		c[pair[0]] = Credential{Password: pair[1], Scopes: scopes, Policy: policy}
+	}
+	return c, scanner.Err()
+}
+
+// hasScope tells if p is granted scope
+func (p Principal) hasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	// errNoCredentials is returned for requests without an Authorization header
+	errNoCredentials = errors.New("no credentials")
+	// errMalformedAuthorization is returned for Authorization headers that can't be parsed
+	errMalformedAuthorization = errors.New("malformed authorization header")
+)
+
+// principal returns the principal authenticated by the Authorization header of r, either
+// thru a bearer token checked by the TokenValidator or HTTP basic authentication. Basic
+// authentication credentials are checked by the Authenticator and against the passwords
+// of the daemon, each granting a scope: Password the read scope, IngestPassword the write
+// scope and MetricsPassword the admin scope. When a CertAuthorizer is set, the principal
+// is given by the client certificate instead.
+func (daemon *SSEDaemon) principal(r *http.Request) (Principal, error) {
+	if daemon.CertAuthorizer != nil {
+		return daemon.certPrincipal(r)
+	}
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return Principal{}, errNoCredentials
+	}
+	s := strings.SplitN(header, " ", 2)
+	if strings.EqualFold(s[0], "Bearer") {
+		token := ""
+		if len(s) == 2 {
+			token = strings.TrimSpace(s[1])
+		}
+		if token == "" {
+			return Principal{}, errMalformedAuthorization
+		}
+		if daemon.TokenValidator == nil {
+			return Principal{}, errors.New("bearer tokens not accepted")
+		}
+		p, err := daemon.TokenValidator.Validate(token)
+		if err == nil && len(p.Scopes) == 0 {
+			p.Scopes = defaultScopes
+		}
+		return p, err
+	}
+
+	user, password, found := r.BasicAuth()
+	if !found {
+		return Principal{}, errMalformedAuthorization
+	}
+	p := Principal{Name: user}
+	if auth := daemon.Authenticator; auth != nil && auth.Authenticate(user, password) {
+		if scoped, ok := auth.(ScopedAuthenticator); ok {
+			p.Scopes = append(p.Scopes, scoped.Scopes(user)...)
+		}
+		if len(p.Scopes) == 0 {
+			p.Scopes = append(p.Scopes, defaultScopes...)
+		}
+		if restricted, ok := auth.(PolicyAuthenticator); ok {
+			p.Policy = restricted.Policy(user)
+		}
+	}
+	for _, shared := range []struct {
+		password, scope string
+	}{
+		{daemon.Password, ScopeRead},
+		{daemon.UnthrottledPassword, ScopeRead},
+		{daemon.IngestPassword, ScopeWrite},
+		{daemon.MetricsPassword, ScopeAdmin},
+	} {
+		granted := p.hasScope(shared.scope)
+		if shared.scope == ScopeRead && p.Policy.restricted() {
+			// The shared password may lift the restrictions of the policy
+			granted = false
+		}
+		if shared.password == "" || granted || !passwordMatches(shared.password, password) {
+			continue
+		}
+		if !p.hasScope(shared.scope) {
+			p.Scopes = append(p.Scopes, shared.scope)
+		}
+		if shared.scope == ScopeRead {
+			// Shared passwords are not restricted by any policy
+			p.Policy = Policy{}
+		}
+	}
+	if len(p.Scopes) == 0 {
+		return Principal{}, errors.New("invalid credentials")
+	}
+	return p, nil
+}
+
+// authRequired tells if credentials are required for scope. The scopes of the shared
+// passwords are only required when they are set, every scope is required once an
+// Authenticator, a TokenValidator or a CertAuthorizer is set.
+func (daemon *SSEDaemon) authRequired(scope string) bool {
+	if daemon.Authenticator != nil || daemon.TokenValidator != nil || daemon.CertAuthorizer != nil {
+		return true
+	}
+	switch scope {
+	case ScopeRead:
+		return daemon.Password != ""
+	case ScopeWrite:
+		return daemon.IngestPassword != ""
+	case ScopeAdmin:
+		return daemon.MetricsPassword != ""
+	}
+	return true
+}
+
+// authorized tells if r carries credentials granted scope, without recording failures
+func (daemon *SSEDaemon) authorized(r *http.Request, scope string) bool {
+	if !daemon.authRequired(scope) {
+		return true
+	}
+	p, err := daemon.principal(r)
+	return err == nil && p.hasScope(scope)
+}
+
+// authenticate checks the credentials of r are granted one of the scopes, and returns r
+// with the authenticated principal attached to its context. Credentials are checked as
+// soon as one of the scopes requires them. When the credentials are invalid, an error is
+// answered and false is returned: 401 for invalid credentials, 403 for valid credentials
+// not granted any of the scopes. Clients failing too many times are banned for
+// AuthBanDuration and get a 429 error without their credentials being checked.
+func (daemon *SSEDaemon) authenticate(w http.ResponseWriter, r *http.Request, scopes ...string) (*http.Request, bool) {
+	required := false
+	for _, scope := range scopes {
+		required = required || daemon.authRequired(scope)
+	}
+	if !required {
+		return r, true
+	}
+	daemon.watchRemovals()
+	ip := daemon.clientIP(r)
+	if daemon.MaxAuthFailures > 0 {
+		if retryAfter, banned := daemon.authGuard.banned(ip, time.Now()); banned {
+			daemon.logger().Warnf("AUTH[%s] banned client trying to authenticate", ip)
+			daemon.ol.Stats.AuthBanned.Add(1)
+			daemon.auditAuth(r, ip, AuditAuthFailure, "", "banned")
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			writeError(w, 429, "too_many_auth_failures", "too many authentication failures, retry later")
+			return r, false
+		}
+	}
+	principal, err := daemon.principal(r)
+	if err != nil {
+		daemon.logger().Warnf("AUTH[%s] authentication failed on %s: %s", ip, r.URL.Path, err)
+		daemon.countAuthFailure(err)
+		daemon.auditAuth(r, ip, AuditAuthFailure, "", err.Error())
+		if daemon.MaxAuthFailures > 0 && daemon.authGuard.fail(ip, time.Now(), daemon.MaxAuthFailures, daemon.AuthFailureWindow, daemon.AuthBanDuration) {
+			daemon.logger().Warnf("AUTH[%s] too many authentication failures, banned for %s", ip, daemon.AuthBanDuration)
+			daemon.ol.Stats.AuthBans.Add(1)
+		}
+		if err == errMalformedAuthorization {
+			writeError(w, 401, "unauthorized", err.Error())
+		} else {
+			writeError(w, 401, "unauthorized", "invalid credentials")
+		}
+		return r, false
+	}
+	if daemon.MaxAuthFailures > 0 {
+		daemon.authGuard.succeed(ip)
+	}
+	granted := false
+	for _, scope := range scopes {
+		granted = granted || principal.hasScope(scope)
+	}
+	if !granted {
+		scope := strings.Join(scopes, " or ")
+		daemon.logger().Warnf("AUTH[%s] %q not granted the %s scope on %s", ip, principal.Name, scope, r.URL.Path)
+		daemon.ol.Stats.AuthzDeniedScope.Add(1)
+		daemon.auditAuth(r, ip, AuditAuthFailure, principal.Name, fmt.Sprintf("%s scope not granted", scope))
+		writeError(w, 403, "forbidden", fmt.Sprintf("credentials not granted the %s scope", scope))
+		return r, false
+	}
+	daemon.ol.Stats.AuthSuccesses.Add(1)
+	daemon.auditAuth(r, ip, AuditAuthSuccess, principal.Name, "")
+	return r.WithContext(withPrincipal(r.Context(), principal)), true
+}
+
+// countAuthFailure counts a failed authentication by reason
+func (daemon *SSEDaemon) countAuthFailure(err error) {
+	stats := daemon.ol.Stats
+	stats.AuthFailures.Add(1)
+	switch {
+	case err == errNoCredentials || err == errNoCertificate:
+		stats.AuthFailuresMissing.Add(1)
+	case err == errMalformedAuthorization:
+		stats.AuthFailuresMalformed.Add(1)
+	case errors.Is(err, ErrExpiredToken):
+		stats.AuthFailuresExpired.Add(1)
+	default:
+		stats.AuthFailuresInvalid.Add(1)
+	}
+}
+
+// auditAuth records an authentication event of r. Without a known principal, the
+// username given thru basic authentication, if any, is recorded.
+func (daemon *SSEDaemon) auditAuth(r *http.Request, ip, eventType, user, reason string) {
+	if daemon.AuditSink == nil {
+		return
+	}
+	if user == "" {
+		user, _, _ = r.BasicAuth()
+	}
+	daemon.audit(AuditEvent{
+		Type:       eventType,
+		RemoteAddr: ip,
+		User:       user,
+		Path:       r.URL.Path,
+		Reason:     reason,
+	})
+}
+
+// secureCompare compares a password with the expected one. Hashes are compared so
+// neither the content nor the length of the password leak thru the comparison time.
+func secureCompare(expected, password string) bool {
+	e := sha256.Sum256([]byte(expected))
+	p := sha256.Sum256([]byte(password))
+	return subtle.ConstantTimeCompare(e[:], p[:]) == 1
+}
@@ -0,0 +1,351 @@
+package oplog
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckPassword(t *testing.T) {
+	tests := []struct {
+		password string
+		given    string
+		auth     bool
+		valid    bool
+	}{
+		{"", "", false, true},
+		{"secret", "", false, false},
+		{"secret", "secret", true, true},
+		{"secret", "secreT", true, false},
+		{"secret", "secret2", true, false},
+		{"secret", "", true, false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/ops", nil)
+		if test.auth {
+			r.SetBasicAuth("user", test.given)
+		}
+		if valid := checkPassword(r, test.password); valid != test.valid {
+			t.Errorf("%q/%q: expected %v, got %v", test.password, test.given, test.valid, valid)
+		}
+	}
+}
+
+// authenticatorFunc is an Authenticator calling a function
+type authenticatorFunc func(user, password string) bool
+
+func (f authenticatorFunc) Authenticate(user, password string) bool {
+	return f(user, password)
+}
+
+func TestReadCredentials(t *testing.T) {
+	c, err := ReadCredentials(strings.NewReader("# consumers\nalice:s3cret\n\n  bob:pass:word  read,write \n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c) != 2 || c["alice"].Password != "s3cret" || c["alice"].Scopes != nil || c["bob"].Password != "pass:word" || strings.Join(c["bob"].Scopes, ",") != "read,write" {
+		t.Errorf("invalid credentials: %#v", c)
+	}
+	for _, invalid := range []string{"alice", "alice:", ":s3cret", "alice:s3cret read write"} {
+		if _, err := ReadCredentials(strings.NewReader(invalid)); err == nil {
+			t.Errorf("%q: expected an error", invalid)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	tests := []struct {
+		name          string
+		password      string
+		authenticator Authenticator
+		user, given   string
+		status        int
+		authUser      string
+	}{
+		{"no auth", "", nil, "", "", 200, ""},
+		// The legacy shared password is accepted with any username
+		{"legacy", "secret", nil, "anyone", "secret", 200, "anyone"},
+		{"legacy no user", "secret", nil, "", "secret", 200, ""},
+		{"legacy wrong password", "secret", nil, "anyone", "wrong", 401, ""},
+		{"multi-user", "", Credentials{"alice": {Password: "a"}, "bob": {Password: "b"}}, "bob", "b", 200, "bob"},
+		{"wrong user right password", "", Credentials{"alice": {Password: "a"}, "bob": {Password: "b"}}, "alice", "b", 401, ""},
+		{"unknown user", "", Credentials{"alice": {Password: "a"}}, "eve", "a", 401, ""},
+		{"multi-user with legacy", "secret", Credentials{"alice": {Password: "a"}}, "eve", "secret", 200, "eve"},
+		{"custom", "", authenticatorFunc(func(user, password string) bool { return user == password }), "carol", "carol", 200, "carol"},
+		{"custom refused", "", authenticatorFunc(func(user, password string) bool { return user == password }), "carol", "dave", 401, ""},
+	}
+	for _, test := range tests {
+		daemon := newTestSSEDaemonHandler("")
+		daemon.Password = test.password
+		daemon.Authenticator = test.authenticator
+		rec := httptest.NewRecorder()
+		req := newTestSSERequest(context.Background())
+		if test.user != "" || test.given != "" {
+			req.SetBasicAuth(test.user, test.given)
+		}
+		req, ok := daemon.authenticate(rec, req, ScopeRead)
+		if status := rec.Code; ok != (test.status == 200) || (!ok && status != test.status) {
+			t.Errorf("%s: expected status %d, got %v/%d", test.name, test.status, ok, status)
+		}
+		if principal, _ := PrincipalFromContext(req.Context()); principal.Name != test.authUser {
+			t.Errorf("%s: expected user %q, got %q", test.name, test.authUser, principal.Name)
+		}
+	}
+}
+
+func TestConnectionUser(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.Authenticator = Credentials{"alice": {Password: "a"}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req := newTestSSERequest(ctx)
+	req.SetBasicAuth("alice", "a")
+	done := make(chan struct{})
+	go func() {
+		daemon.ServeHTTP(flushResponseWriter{httptest.NewRecorder()}, req)
+		close(done)
+	}()
+	defer func() { cancel(); <-done }()
+
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		if conns := daemon.Connections(); len(conns) == 1 {
+			if conns[0].User != "alice" || conns[0].Auth != "ok" {
+				t.Errorf("invalid connection info: %#v", conns[0])
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("connection not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestScopes(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.EnableMetrics = true
+	daemon.append = func(ctx context.Context, ops []*Operation) {}
+	daemon.Authenticator = Credentials{
+		"reader":   {Password: "r"},
+		"producer": {Password: "p", Scopes: []string{ScopeWrite}},
+		"ops":      {Password: "o", Scopes: []string{ScopeRead, ScopeWrite, ScopeAdmin}},
+	}
+	daemon.TokenValidator = Tokens{"admin-token": {Name: "monitoring", Scopes: []string{ScopeAdmin}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	do := func(req *http.Request, user, password string) int {
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		} else if password != "" {
+			req.Header.Set("Authorization", "Bearer "+password)
+		}
+		rec := httptest.NewRecorder()
+		daemon.ServeHTTP(flushResponseWriter{rec}, req)
+		return rec.Code
+	}
+	post := func() *http.Request {
+		return newTestPostOpsRequest(`{"event":"insert","type":"video","id":"1"}`, "")
+	}
+	tests := []struct {
+		name     string
+		req      func() *http.Request
+		user     string
+		password string
+		status   int
+	}{
+		// A read-only credential streams fine but can't post operations
+		{"reader stream", func() *http.Request { return newTestSSERequest(ctx) }, "reader", "r", 200},
+		{"reader poll", func() *http.Request { return httptest.NewRequest("GET", "/ops/poll?since_id=1423995187898", nil) }, "reader", "r", 200},
+		{"reader post", post, "reader", "r", 403},
+		{"reader metrics", func() *http.Request { return httptest.NewRequest("GET", "/metrics", nil) }, "reader", "r", 403},
+		{"producer post", post, "producer", "p", 201},
+		{"producer stream", func() *http.Request { return newTestSSERequest(ctx) }, "producer", "p", 403},
+		{"ops stream", func() *http.Request { return newTestSSERequest(ctx) }, "ops", "o", 200},
+		{"ops post", post, "ops", "o", 201},
+		{"ops metrics", func() *http.Request { return httptest.NewRequest("GET", "/metrics", nil) }, "ops", "o", 200},
+		{"token metrics", func() *http.Request { return httptest.NewRequest("GET", "/metrics", nil) }, "", "admin-token", 200},
+		{"token post", post, "", "admin-token", 403},
+		{"wrong password post", post, "producer", "r", 401},
+	}
+	for _, test := range tests {
+		if status := do(test.req(), test.user, test.password); status != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.status, status)
+		}
+	}
+
+	// The connected clients are only detailed to admins
+	status := func(user, password string) bool {
+		req := httptest.NewRequest("GET", "/status", nil)
+		req.SetBasicAuth(user, password)
+		rec := httptest.NewRecorder()
+		daemon.ServeHTTP(rec, req)
+		return strings.Contains(rec.Body.String(), "connected_clients")
+	}
+	if status("reader", "r") {
+		t.Error("clients detailed to a reader")
+	}
+	if !status("ops", "o") {
+		t.Error("clients not detailed to an admin")
+	}
+}
+
+func TestAuthGuard(t *testing.T) {
+	g := newAuthGuard(2)
+	now := time.Unix(0, 0)
+	if g.fail("192.0.2.1", now, 3, time.Minute, time.Hour) || g.fail("192.0.2.1", now, 3, time.Minute, time.Hour) {
+		t.Fatal("banned before reaching the max failures")
+	}
+	if _, banned := g.banned("192.0.2.1", now); banned {
+		t.Fatal("banned before reaching the max failures")
+	}
+	if !g.fail("192.0.2.1", now, 3, time.Minute, time.Hour) {
+		t.Fatal("not banned after reaching the max failures")
+	}
+	if retryAfter, banned := g.banned("192.0.2.1", now.Add(time.Minute)); !banned || retryAfter != 59*time.Minute {
+		t.Errorf("expected a ban for 59m, got %v %s", banned, retryAfter)
+	}
+	if _, banned := g.banned("192.0.2.1", now.Add(time.Hour)); banned {
+		t.Error("ban not lifted")
+	}
+
+	// Failures outside of the window are forgotten
+	g.fail("192.0.2.2", now, 2, time.Minute, time.Hour)
+	if g.fail("192.0.2.2", now.Add(2*time.Minute), 2, time.Minute, time.Hour) {
+		t.Error("banned for failures outside of the window")
+	}
+
+	// The state is bounded, the least recently failing IP is forgotten
+	g.fail("192.0.2.3", now, 3, time.Minute, time.Hour)
+	if len(g.clients) != 2 || g.lru.Len() != 2 {
+		t.Fatalf("expected 2 tracked clients, got %d", len(g.clients))
+	}
+	if _, found := g.clients["192.0.2.1"]; found {
+		t.Error("the least recently failing client should have been forgotten")
+	}
+
+	// A success forgets the failures
+	g.succeed("192.0.2.3")
+	if _, found := g.clients["192.0.2.3"]; found {
+		t.Error("failures not forgotten on success")
+	}
+}
+
+func TestAuthenticateBan(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.MaxAuthFailures = 2
+	verified := 0
+	daemon.Authenticator = authenticatorFunc(func(user, password string) bool {
+		verified++
+		return password == "secret"
+	})
+	failures := testStats.AuthFailures.Value()
+	bans := testStats.AuthBans.Value()
+	banned := testStats.AuthBanned.Value()
+
+	poll := func(password string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/ops/poll?since_id=1423995187898", nil)
+		req.SetBasicAuth("", password)
+		daemon.ServeHTTP(rec, req)
+		return rec
+	}
+	for i := 0; i < 2; i++ {
+		if rec := poll("wrong"); rec.Code != 401 {
+			t.Fatalf("expected status 401, got %d", rec.Code)
+		}
+	}
+	if verified != 2 {
+		t.Fatalf("expected 2 verifications, got %d", verified)
+	}
+
+	// Once banned, even valid credentials are refused without being verified
+	rec := poll("secret")
+	if rec.Code != 429 {
+		t.Fatalf("expected status 429, got %d", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") != "300" {
+		t.Errorf("expected a 300s Retry-After, got %q", rec.Header().Get("Retry-After"))
+	}
+	if verified != 2 {
+		t.Errorf("credentials of a banned client must not be verified, got %d verifications", verified)
+	}
+	if testStats.AuthFailures.Value()-failures != 2 || testStats.AuthBans.Value()-bans != 1 || testStats.AuthBanned.Value()-banned != 1 {
+		t.Errorf("invalid stats: %d failures, %d bans, %d banned", testStats.AuthFailures.Value()-failures, testStats.AuthBans.Value()-bans, testStats.AuthBanned.Value()-banned)
+	}
+
+	// Other clients are not affected
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/ops/poll?since_id=1423995187898", nil)
+	req.RemoteAddr = "192.0.2.2:1234"
+	req.SetBasicAuth("", "secret")
+	daemon.ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Errorf("expected status 200, got %d", rec.Code)
+	}
+}
+
+func TestAuthMetrics(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.MaxAuthFailures = 0
+	daemon.Authenticator = Credentials{
+		"alice": {Password: "a"},
+		"bob":   {Password: "b", Policy: Policy{Types: []string{"video"}}},
+	}
+	daemon.TokenValidator = tokenValidatorFunc(func(token string) (Principal, error) {
+		return Principal{}, fmt.Errorf("token of %s: %w", "carol", ErrExpiredToken)
+	})
+	daemon.DeniedCIDRs, _ = ParseCIDRs([]string{"198.51.100.1"})
+	poll := func(query string) *http.Request {
+		return httptest.NewRequest("GET", "/ops/poll?since_id=1423995187898"+query, nil)
+	}
+
+	tests := []struct {
+		name    string
+		req     *http.Request
+		auth    func(r *http.Request)
+		status  int
+		counter *Int
+	}{
+		{"success", poll(""), func(r *http.Request) { r.SetBasicAuth("alice", "a") }, 200, testStats.AuthSuccesses},
+		{"missing", poll(""), func(r *http.Request) {}, 401, testStats.AuthFailuresMissing},
+		{"malformed", poll(""), func(r *http.Request) { r.Header.Set("Authorization", "Basic !!!") }, 401, testStats.AuthFailuresMalformed},
+		{"invalid", poll(""), func(r *http.Request) { r.SetBasicAuth("alice", "wrong") }, 401, testStats.AuthFailuresInvalid},
+		{"expired", poll(""), func(r *http.Request) { r.Header.Set("Authorization", "Bearer old") }, 401, testStats.AuthFailuresExpired},
+		{"scope", newTestPostOpsRequest(`{"event":"insert","type":"video","id":"1"}`, ""), func(r *http.Request) { r.SetBasicAuth("alice", "a") }, 403, testStats.AuthzDeniedScope},
+		{"policy", poll("&types=user"), func(r *http.Request) { r.SetBasicAuth("bob", "b") }, 403, testStats.AuthzDeniedPolicy},
+		{"ip", poll(""), func(r *http.Request) { r.RemoteAddr = "198.51.100.1:1234" }, 403, testStats.BlockedRequests},
+	}
+	for _, test := range tests {
+		before := test.counter.Value()
+		test.auth(test.req)
+		rec := httptest.NewRecorder()
+		daemon.ServeHTTP(rec, test.req)
+		if rec.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.status, rec.Code)
+		}
+		if test.counter.Value()-before != 1 {
+			t.Errorf("%s: counter not incremented", test.name)
+		}
+	}
+
+	// Banned clients are throttled
+	daemon.MaxAuthFailures = 1
+	banned := testStats.AuthBanned.Value()
+	for _, status := range []int{401, 429} {
+		req := poll("")
+		req.SetBasicAuth("alice", "wrong")
+		rec := httptest.NewRecorder()
+		daemon.ServeHTTP(rec, req)
+		if rec.Code != status {
+			t.Errorf("expected status %d, got %d", status, rec.Code)
+		}
+	}
+	if testStats.AuthBanned.Value()-banned != 1 {
+		t.Error("banned request not counted")
+	}
+}
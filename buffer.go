@@ -0,0 +1,74 @@
+package oplog
+
+// SlowConsumerPolicy defines how a client which can't keep up with its stream is handled
+// once its buffer is full.
+type SlowConsumerPolicy int
+
+const (
+	// SlowConsumerDisconnect ends the stream with a final "error" event.
+	SlowConsumerDisconnect SlowConsumerPolicy = iota
+	// SlowConsumerResume drops the buffered events and closes the stream so the client
+	// reconnects and resumes from the last event it received.
+	SlowConsumerResume
+)
+
+// clientBuffer buffers the events sent by a tail to a client, so a slow client does not
+// hold the tail back. When the buffer is full, the client is considered too slow.
+type clientBuffer struct {
+	events chan GenericEvent
+	// overflow is closed once the buffer overflowed
+	overflow chan struct{}
+	// stopped is closed once the relay is stopped
+	stopped chan struct{}
+	stats   *Stats
+}
+
+// newClientBuffer creates a buffer holding up to size events
+func newClientBuffer(size int, stats *Stats) *clientBuffer {
+	return &clientBuffer{
+		events:   make(chan GenericEvent, size),
+		overflow: make(chan struct{}),
+		stopped:  make(chan struct{}),
+		stats:    stats,
+	}
+}
+
+// relay moves the events received on in into the buffer until done is closed or the
+// buffer overflows.
+func (b *clientBuffer) relay(in <-chan GenericEvent, done <-chan struct{}) {
+	defer close(b.stopped)
+	for {
+		select {
+		case ev := <-in:
+			select {
+			case b.events <- ev:
+				b.stats.ClientBuffered.Add(1)
+			default:
+				b.stats.SlowConsumerEvictions.Add(1)
+				b.stats.EventsDropped.Add(1)
+				close(b.overflow)
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// taken must be called for each event read from the buffer
+func (b *clientBuffer) taken() {
+	b.stats.ClientBuffered.Add(-1)
+}
+
+// close stops the relay and discards the buffered events, counted as dropped if the buffer
+// overflowed
+func (b *clientBuffer) close(done chan struct{}) {
+	close(done)
+	<-b.stopped
+	b.stats.ClientBuffered.Add(-int64(len(b.events)))
+	select {
+	case <-b.overflow:
+		b.stats.EventsDropped.Add(int64(len(b.events)))
+	default:
+	}
+}
@@ -0,0 +1,42 @@
+package oplog
+
+import "testing"
+
+func TestClientBufferRelay(t *testing.T) {
+	b := newClientBuffer(2, &testStats)
+	in := make(chan GenericEvent)
+	done := make(chan struct{})
+	go b.relay(in, done)
+	in <- &Event{ID: "1"}
+	in <- &Event{ID: "2"}
+	if ev := <-b.events; ev.GetEventID().String() != "1" {
+		t.Fatal("events not relayed in order")
+	}
+	b.taken()
+	select {
+	case <-b.overflow:
+		t.Fatal("buffer overflowed")
+	default:
+	}
+	b.close(done)
+}
+
+func TestClientBufferOverflow(t *testing.T) {
+	b := newClientBuffer(1, &testStats)
+	evictions := testStats.SlowConsumerEvictions.Value()
+	dropped := testStats.EventsDropped.Value()
+	in := make(chan GenericEvent)
+	done := make(chan struct{})
+	go b.relay(in, done)
+	in <- &Event{ID: "1"}
+	in <- &Event{ID: "2"}
+	<-b.overflow
+	if testStats.SlowConsumerEvictions.Value() != evictions+1 {
+		t.Fatal("eviction not counted")
+	}
+	b.close(done)
+	// The event not buffered and the one left in the buffer
+	if n := testStats.EventsDropped.Value() - dropped; n != 2 {
+		t.Fatalf("expected 2 dropped events, got %d", n)
+	}
+}
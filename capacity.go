@@ -0,0 +1,136 @@
+package oplog
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// CollectionStats describes the utilization of the capped collection
+type CollectionStats struct {
+	// Size and MaxSize are the bytes used by the operations and the maximum size of the
+	// capped collection
+	Size    int64
+	MaxSize int64
+	// Count is the number of operations in the capped collection
+	Count int64
+	// OldestOperation and NewestOperation are the insertion times of the oldest and newest
+	// operations, zero if the capped collection is empty
+	OldestOperation time.Time
+	NewestOperation time.Time
+}
+
+// collectionStats queries the utilization of the capped collection with collStats
+func (oplog *OpLog) collectionStats() (CollectionStats, error) {
+	session := oplog.s.Copy()
+	defer session.Close()
+	db := session.DB("")
+	result := struct {
+		Size    int64 `bson:"size"`
+		MaxSize int64 `bson:"maxSize"`
+		Count   int64 `bson:"count"`
+	}{}
+	if err := db.Run(bson.D{{Name: "collStats", Value: "oplog_ops"}}, &result); err != nil {
+		return CollectionStats{}, err
+	}
+	cs := CollectionStats{Size: result.Size, MaxSize: result.MaxSize, Count: result.Count}
+	var err error
+	cs.NewestOperation, cs.OldestOperation, err = operationTimes(db.C("oplog_ops"))
+	return cs, err
+}
+
+// capacitySample is the state kept by the capacity sampler between two samples to
+// estimate the ingest rate
+type capacitySample struct {
+	time     time.Time
+	ingested int64
+}
+
+// SampleCapacity starts sampling the utilization of the capped collection every interval,
+// until Close is called. See the Capped* statistics.
+func (oplog *OpLog) SampleCapacity(interval time.Duration) {
+	oplog.samplerMu.Lock()
+	defer oplog.samplerMu.Unlock()
+	if oplog.samplerStop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	oplog.samplerStop, oplog.samplerDone = stop, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		prev := capacitySample{}
+		for {
+			prev = oplog.sampleCapacity(time.Now(), prev)
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// sampleCapacity updates the Capped* statistics, estimating the retention from the
+// operations ingested since the previous sample
+func (oplog *OpLog) sampleCapacity(now time.Time, prev capacitySample) capacitySample {
+	statsFunc := oplog.collStats
+	if statsFunc == nil {
+		statsFunc = oplog.collectionStats
+	}
+	cs, err := statsFunc()
+	if err != nil {
+		oplog.warnSampled(err, "OPLOG can't sample the capped collection: %s", err)
+		return prev
+	}
+	s := oplog.Stats
+	s.CappedBytes.Set(cs.Size)
+	s.CappedMaxBytes.Set(cs.MaxSize)
+	s.CappedCount.Set(cs.Count)
+	age := func(t time.Time) int64 {
+		if t.IsZero() {
+			return 0
+		}
+		return int64(now.Sub(t) / time.Millisecond)
+	}
+	s.CappedOldestAge.Set(age(cs.OldestOperation))
+	s.CappedNewestAge.Set(age(cs.NewestOperation))
+
+	sample := capacitySample{time: now, ingested: s.EventsIngested.Value()}
+	if !prev.time.IsZero() && cs.Count > 0 {
+		// The capped collection holds MaxSize bytes of operations of the average size,
+		// flowing in at the rate they have been ingested since the previous sample
+		rate := float64(sample.ingested-prev.ingested) / float64(now.Sub(prev.time))
+		size := float64(cs.Size) / float64(cs.Count)
+		retention := int64(0)
+		if rate > 0 && size > 0 {
+			retention = int64(float64(cs.MaxSize) / size / rate / float64(time.Millisecond))
+		}
+		s.CappedRetention.Set(retention)
+	}
+	return sample
+}
+
+// Close stops the capacity sampler and the retention watchdog, if running, and closes the
+// MongoDB session
+func (oplog *OpLog) Close() {
+	oplog.samplerMu.Lock()
+	stop, done := oplog.samplerStop, oplog.samplerDone
+	watchdogStop, watchdogDone := oplog.watchdogStop, oplog.watchdogDone
+	oplog.samplerStop, oplog.samplerDone = nil, nil
+	oplog.watchdogStop, oplog.watchdogDone = nil, nil
+	oplog.samplerMu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+	if watchdogStop != nil {
+		close(watchdogStop)
+		<-watchdogDone
+	}
+	if oplog.s != nil {
+		oplog.s.Close()
+	}
+}
@@ -0,0 +1,99 @@
+package oplog
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestCapacityOpLog returns an OpLog with its own capacity statistics and a stubbed
+// collStats
+func newTestCapacityOpLog(collStats func() (CollectionStats, error)) *OpLog {
+	ol := newTestOpLog()
+	stats := testStats
+	stats.EventsIngested = new(Int)
+	stats.CappedBytes = new(Int)
+	stats.CappedMaxBytes = new(Int)
+	stats.CappedCount = new(Int)
+	stats.CappedOldestAge = new(Int)
+	stats.CappedNewestAge = new(Int)
+	stats.CappedRetention = new(Int)
+	ol.Stats = &stats
+	ol.collStats = collStats
+	return ol
+}
+
+func TestSampleCapacity(t *testing.T) {
+	now := time.Unix(1423995187, 0)
+	var err error
+	ol := newTestCapacityOpLog(func() (CollectionStats, error) {
+		return CollectionStats{
+			Size:            1000000,
+			MaxSize:         10000000,
+			Count:           10000,
+			OldestOperation: now.Add(-time.Hour),
+			NewestOperation: now.Add(-time.Second),
+		}, err
+	})
+	s := ol.Stats
+
+	prev := ol.sampleCapacity(now, capacitySample{})
+	if s.CappedBytes.Value() != 1000000 || s.CappedMaxBytes.Value() != 10000000 || s.CappedCount.Value() != 10000 {
+		t.Errorf("invalid utilization: %s %s %s", s.CappedBytes, s.CappedMaxBytes, s.CappedCount)
+	}
+	if s.CappedOldestAge.Value() != 3600000 || s.CappedNewestAge.Value() != 1000 {
+		t.Errorf("invalid ages: %s %s", s.CappedOldestAge, s.CappedNewestAge)
+	}
+	if s.CappedRetention.Value() != 0 {
+		t.Errorf("retention estimated without an ingest rate: %s", s.CappedRetention)
+	}
+
+	// 10 operations of 100 bytes per second fill 10MB in 10000 seconds
+	s.EventsIngested.Add(100)
+	prev = ol.sampleCapacity(now.Add(10*time.Second), prev)
+	if s.CappedRetention.Value() != 10000000 {
+		t.Errorf("expected a retention of 10000000ms, got %s", s.CappedRetention)
+	}
+
+	// A failed sample leaves the statistics as they are
+	err = errors.New("unreachable")
+	if next := ol.sampleCapacity(now.Add(20*time.Second), prev); next != prev {
+		t.Errorf("failed sample changed the previous one: %#v", next)
+	}
+	if s.CappedRetention.Value() != 10000000 {
+		t.Errorf("failed sample changed the retention: %s", s.CappedRetention)
+	}
+
+	// Nothing ingested
+	err = nil
+	ol.sampleCapacity(now.Add(30*time.Second), prev)
+	if s.CappedRetention.Value() != 0 {
+		t.Errorf("expected no retention without ingestion, got %s", s.CappedRetention)
+	}
+}
+
+func TestSampleCapacityClose(t *testing.T) {
+	var samples int64
+	ol := newTestCapacityOpLog(func() (CollectionStats, error) {
+		atomic.AddInt64(&samples, 1)
+		return CollectionStats{}, nil
+	})
+	ol.SampleCapacity(time.Millisecond)
+	// Starting the sampler twice has no effect
+	ol.SampleCapacity(time.Millisecond)
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt64(&samples) < 2; {
+		if time.Now().After(deadline) {
+			t.Fatal("sampler not running")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	ol.Close()
+	n := atomic.LoadInt64(&samples)
+	time.Sleep(10 * time.Millisecond)
+	if atomic.LoadInt64(&samples) != n {
+		t.Errorf("sampler still running after Close")
+	}
+	// Closing twice is harmless
+	ol.Close()
+}
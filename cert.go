@@ -0,0 +1,41 @@
+package oplog
+
+import (
+	"crypto/x509"
+	"errors"
+	"net/http"
+)
+
+// CertAuthorizer maps the verified certificate of a client to its principal. An error
+// refuses the client.
+type CertAuthorizer func(cert *x509.Certificate) (Principal, error)
+
+// CertCommonName is a CertAuthorizer naming the principal after the common name of the
+// certificate, or its first DNS name when it has no common name. The principal is granted
+// the read scope.
+func CertCommonName(cert *x509.Certificate) (Principal, error) {
+	name := cert.Subject.CommonName
+	if name == "" && len(cert.DNSNames) > 0 {
+		name = cert.DNSNames[0]
+	}
+	if name == "" {
+		return Principal{}, errors.New("certificate without name")
+	}
+	return Principal{Name: name}, nil
+}
+
+// errNoCertificate is returned for requests without a verified client certificate
+var errNoCertificate = errors.New("no verified client certificate")
+
+// certPrincipal returns the principal of the client certificate of r, which must have
+// been verified during the TLS handshake.
+func (daemon *SSEDaemon) certPrincipal(r *http.Request) (Principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return Principal{}, errNoCertificate
+	}
+	p, err := daemon.CertAuthorizer(r.TLS.VerifiedChains[0][0])
+	if err == nil && len(p.Scopes) == 0 {
+		p.Scopes = defaultScopes
+	}
+	return p, err
+}
@@ -0,0 +1,152 @@
+package oplog
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestCert creates a certificate signed by parent, or self-signed if parent is nil
+func newTestCert(t *testing.T, name string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, interface{}(key)
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestCertAuthorizer(t *testing.T) {
+	ca := newTestCert(t, "test CA", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	daemon := newTestSSEDaemonHandler(addr)
+	daemon.Password = "secret"
+	daemon.CertAuthorizer = CertCommonName
+	config := &tls.Config{
+		Certificates: []tls.Certificate{newTestCert(t, "oplog", &ca)},
+		ClientCAs:    pool,
+		// Let clients without certificate in so they get a 401 error
+		ClientAuth: tls.VerifyClientCertIfGiven,
+	}
+	go daemon.Serve(tls.NewListener(l, config))
+	defer daemon.Shutdown(context.Background())
+
+	client := func(cert *tls.Certificate) *http.Client {
+		config := &tls.Config{RootCAs: pool}
+		if cert != nil {
+			config.Certificates = []tls.Certificate{*cert}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	}
+	get := func(c *http.Client, password string) (int, error) {
+		req, _ := http.NewRequest("GET", "https://"+addr+"/ops?since=1423995187000", nil)
+		req.Header.Set("Accept", "text/event-stream")
+		if password != "" {
+			req.SetBasicAuth("", password)
+		}
+		res, err := c.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		res.Body.Close()
+		return res.StatusCode, nil
+	}
+
+	service := newTestCert(t, "search-service", &ca)
+	req, _ := http.NewRequest("GET", "https://"+addr+"/ops?since=1423995187000", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	res, err := client(&service).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		if conns := daemon.Connections(); len(conns) == 1 && conns[0].User == "search-service" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("principal not mapped from the certificate: %#v", daemon.Connections())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	res.Body.Close()
+
+	// Without certificate, basic auth is not accepted
+	if status, err := get(client(nil), "secret"); err != nil || status != 401 {
+		t.Errorf("expected status 401, got %d %v", status, err)
+	}
+	// Certificates not signed by the CA are refused, either during the handshake or
+	// because the client doesn't present them
+	rogue := newTestCert(t, "rogue", nil)
+	if status, err := get(client(&rogue), ""); err == nil && status != 401 {
+		t.Errorf("expected the certificate to be refused, got %d", status)
+	}
+
+	// The principal feeds the scopes
+	c := client(&service)
+	req, _ = http.NewRequest("POST", "https://"+addr+"/ops", strings.NewReader(`{"event":"insert","type":"video","id":"1"}`))
+	req.Header.Set("Content-Type", "application/json")
+	res, err = c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 403 {
+		t.Errorf("expected status 403, got %d", res.StatusCode)
+	}
+}
+
+func TestCertCommonName(t *testing.T) {
+	if p, err := CertCommonName(&x509.Certificate{Subject: pkix.Name{CommonName: "a"}, DNSNames: []string{"b"}}); err != nil || p.Name != "a" {
+		t.Errorf("expected a, got %#v %v", p, err)
+	}
+	if p, err := CertCommonName(&x509.Certificate{DNSNames: []string{"b"}}); err != nil || p.Name != "b" {
+		t.Errorf("expected b, got %#v %v", p, err)
+	}
+	if _, err := CertCommonName(&x509.Certificate{}); err == nil {
+		t.Error("expected an error")
+	}
+}
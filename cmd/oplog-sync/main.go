@@ -19,7 +19,8 @@
 // command does not need an oplogd agent to be running.
 //
 // BE CAREFUL, any object absent of the dump having a timestamp lower than the most recent timestamp
-// present in the dump will be deleted from the oplog.
+// present in the dump will be deleted from the oplog. When the dump only covers some object types,
+// list them with --types so the objects of the other types are left untouched.
 package main
 
 import (
@@ -28,6 +29,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/dailymotion/oplog"
@@ -39,6 +41,7 @@ var (
 	mongoURL             = flag.String("mongo-url", "", "MongoDB URL to connect to.")
 	cappedCollectionSize = flag.Int("capped-collection-size", 1048576, "Size of the created MongoDB capped collection size in bytes (default 1MB).")
 	maxQueuedEvents      = flag.Uint64("max-queued-events", 100000, "Number of events to queue before starting throwing UDP messages.")
+	types                = flag.String("types", "", "Comma separated object types covered by the dump, the objects of the other types being left untouched (default all).")
 )
 
 func main() {
@@ -63,6 +66,13 @@ func main() {
 		log.Fatal(err)
 	}
 
+	filter := oplog.Filter{}
+	if *types != "" {
+		if filter, err = oplog.NewFilter().Types(strings.Split(*types, ",")...).Build(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	createMap := make(map[string]oplog.OperationData)
 	updateMap := make(map[string]oplog.OperationData)
 	deleteMap := make(map[string]oplog.OperationData)
@@ -100,7 +110,7 @@ func main() {
 
 	// Scan the oplog db and generate the diff
 	log.Debugf("SYNC generating the diff")
-	if err := ol.Diff(createMap, updateMap, deleteMap); err != nil {
+	if err := ol.Diff(filter, createMap, updateMap, deleteMap); err != nil {
 		log.Fatalf("SYNC diff error: %s", err)
 	}
 
@@ -5,26 +5,127 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/dailymotion/oplog"
+	"github.com/dailymotion/oplog/statsd"
 )
 
 var (
 	debug                = flag.Bool("debug", false, "Show debug log messages.")
+	oplogLogLevel        = flag.String("oplog-log-level", "", "Log level of the oplog and of its tails: debug, info, warning or error. Empty for the level set by --debug.")
+	sseLogLevel          = flag.String("sse-log-level", "", "Log level of the SSE daemon: debug, info, warning or error. Empty for the level of the oplog.")
+	logSampleWindow      = flag.Duration("log-sample-window", oplog.DefaultLogSampleWindow, "Window in which the warnings repeated by the MongoDB retries are collapsed into a single line, 0 to log them all.")
 	version              = flag.Bool("version", false, "Show oplog version.")
 	listenAddr           = flag.String("listen", ":8042", "The address to listen on. Same address is used for both SSE(HTTP) and UDP APIs.")
 	mongoURL             = flag.String("mongo-url", os.Getenv("OPLOGD_MONGO_URL"), "MongoDB URL to connect to.")
 	cappedCollectionSize = flag.Int("capped-collection-size", 1048576, "Size of the created MongoDB capped collection size in bytes (default 1MB).")
 	maxQueuedEvents      = flag.Int("max-queued-events", 100000, "Number of events to queue before starting throwing UDP messages.")
 	password             = flag.String("password", os.Getenv("OPLOGD_PASSWORD"), "Password protecting the global SSE stream.")
+	credentialsFile      = flag.String("credentials-file", os.Getenv("OPLOGD_CREDENTIALS_FILE"), "File of \"username:password\" lines giving each SSE client its own credentials.")
+	tokensFile           = flag.String("tokens-file", os.Getenv("OPLOGD_TOKENS_FILE"), "File of \"<token> <name> [<scopes>]\" lines listing the bearer tokens accepted from SSE clients.")
+	allowQueryToken      = flag.Bool("allow-query-token", false, "Accept the bearer token of SSE clients in the access_token query-string parameter, for browsers' EventSource.")
+	audit                = flag.Bool("audit", false, "Record the authentications and the SSE streams started and ended in the oplog_audit collection.")
 	ingestPassword       = flag.String("ingest-password", os.Getenv("OPLOGD_INGEST_PASSWORD"), "Password protecting the HTTP ingest endpoint.")
-	objectURL            = flag.String("object-url", os.Getenv("OPLOGD_OBJECT_URL"), "A URL template to reference objects. If this option is set, SSE events will have an \"ref\" field with the URL to the object. The URL should contain {{type}} and {{id}} variables (i.e.: http://api.mydomain.com/{{type}}/{{id}})")
+	maxIngestSize        = flag.Int64("max-ingest-size", 1<<20, "Maximum size in bytes of a body posted to the HTTP ingest endpoint.")
+	maxMetaKeys          = flag.Int("max-meta-keys", 0, "Maximum number of meta keys of an ingested operation, 0 for no limit.")
+	maxMetaSize          = flag.Int("max-meta-size", 0, "Maximum size in bytes of the meta keys and values of an ingested operation, 0 for no limit.")
+	fallbackRewind       = flag.Duration("fallback-rewind", oplog.DefaultFallbackRewind, "Margin subtracted from the time of an evicted event id to get the time the fallback replication starts from.")
+	touchCreatesState    = flag.Bool("touch-creates-state", false, "Store the state of the objects touched without state, or deleted, as an insert would.")
+	maxParents           = flag.Int("max-parents", 0, "Maximum number of parents of an ingested operation, 0 for no limit.")
+	strictParents        = flag.Bool("strict-parents", false, "Refuse the ingested operations with parents not in the type/id format.")
+	maxPayloadSize       = flag.Int("max-payload-size", oplog.DefaultMaxPayloadSize, "Maximum size in bytes of the payload of an ingested operation once encoded in BSON, 0 for no limit.")
+	maxConcurrentTails   = flag.Int("max-concurrent-tails", 0, "Maximum number of concurrent SSE streams, 0 for no limit.")
+	replicationWeight    = flag.Int("replication-tail-weight", 1, "Number of streams a full replication counts for against --max-concurrent-tails.")
+	maxReplications      = flag.Int("max-concurrent-replications", 0, "Maximum number of concurrent full replications, others wait in queue. 0 for no limit.")
+	replicationTimeout   = flag.Duration("replication-queue-timeout", 0, "Maximum time a full replication can wait in queue, 0 for no limit.")
+	replicationFeedback  = flag.Duration("replication-queue-feedback", 10*time.Second, "Interval at which queued replications are notified of their position.")
+	capacityInterval     = flag.Duration("capacity-sample-interval", 0, "Interval at which the utilization and the retention of the capped collection are sampled, 0 to disable.")
+	slowReplicationPage  = flag.Duration("slow-replication-page", 10*time.Second, "Time spent by MongoDB on a replication page above which it is logged as a warning, 0 to disable.")
+	retentionInterval    = flag.Duration("retention-check-interval", 0, "Interval at which the newest operation recorded at the previous check is checked to still be in the capped collection, 0 to disable.")
+	sharedTail           = flag.Bool("shared-tail", false, "Share a single MongoDB cursor between all the live SSE streams.")
+	normalizeTypes       = flag.Bool("normalize-types", false, "Store the object types in lowercase and match the requested types in lowercase.")
+	normalizeParentTypes = flag.Bool("normalize-parent-types", false, "Store and match the type of the parents in lowercase too, requires --normalize-types.")
+	maxStatsTypes        = flag.Int("max-stats-types", 100, "Maximum number of object types counted separately in the statistics, the others being counted as \"other\", 0 for no limit.")
+	normalizeExisting    = flag.Bool("normalize-existing-types", false, "Normalize the types of the object states already stored, then exit.")
+	existingParents      = flag.Bool("normalize-existing-parents", false, "Trim and deduplicate the parents of the object states already stored, then exit.")
+	clientBufferSize     = flag.Int("client-buffer-size", 0, "Number of events buffered per SSE client before it is considered too slow, 0 to disable.")
+	slowConsumerPolicy   = flag.String("slow-consumer-policy", "disconnect", "What to do with too slow SSE clients: \"disconnect\" with an error event or close the stream for \"resume\".")
+	filterFingerprint    = flag.Bool("filter-fingerprint", false, "Include a fingerprint of the stream filter in SSE event ids to detect filter changes on resume.")
+	filterChangePolicy   = flag.String("filter-change-policy", "ignore", "What to do with SSE clients resuming with a different filter: \"ignore\", \"reject\" or \"resync\".")
+	signingKey           = flag.String("signing-key", os.Getenv("OPLOGD_SIGNING_KEY"), "Secret key signing the event ids so SSE clients can only resume from the ids they were sent.")
+	verificationKeys     = flag.String("verification-keys", os.Getenv("OPLOGD_VERIFICATION_KEYS"), "Comma separated list of previous signing keys still accepted to verify the event ids.")
+	unsignedIDPolicy     = flag.String("unsigned-id-policy", "reject", "What to do with SSE clients resuming from an id without a valid signature: \"reject\" or \"ignore\".")
+	policyMode           = flag.String("policy-mode", "reject", "What to do with SSE clients asking for types or parents outside of the policy of their credentials: \"reject\" or \"constrain\".")
+	tlsCert              = flag.String("tls-cert", "", "Certificate file to serve the SSE API over HTTPS, requires --tls-key.")
+	tlsKey               = flag.String("tls-key", "", "Private key file to serve the SSE API over HTTPS, requires --tls-cert.")
+	tlsClientCA          = flag.String("tls-client-ca", "", "CA certificates file to authenticate SSE clients by their certificate instead of passwords, requires --tls-cert.")
+	readHeaderTimeout    = flag.Duration("read-header-timeout", 10*time.Second, "Maximum time to read HTTP request headers, 0 for no limit.")
+	idleTimeout          = flag.Duration("idle-timeout", 60*time.Second, "Maximum time to wait for the next request on a keep-alive HTTP connection, 0 for no limit.")
+	reconnectDelay       = flag.Duration("reconnect-delay", 0, "Reconnection delay advertised to SSE clients, 0 to let clients use their default.")
+	keepaliveInterval    = flag.Duration("keepalive-interval", 25*time.Second, "Time without event after which an heartbeat is sent on SSE streams, 0 to disable.")
+	maxConnDuration      = flag.Duration("max-connection-duration", 0, "Time after which SSE streams are closed so clients reconnect and resume, 0 for no limit.")
+	lagRefreshInterval   = flag.Duration("lag-refresh-interval", 5*time.Second, "Interval at which the lag of the live SSE streams behind the most recent operation is refreshed, 0 to disable.")
+	maxLimit             = flag.Int("max-limit", 100000, "Maximum number of events SSE clients can request with the limit parameter.")
+	maxIdleTimeout       = flag.Duration("max-idle-timeout", time.Hour, "Maximum delay SSE clients can request with the idle_timeout parameter.")
+	maxFilterValues      = flag.Int("max-filter-values", oplog.DefaultMaxFilterValues, "Maximum number of values of each filter parameter (types, parents...), 0 for no limit.")
+	maxFilterValueLength = flag.Int("max-filter-value-length", oplog.DefaultMaxFilterValueLength, "Maximum length of each value of the filter parameters, 0 for no limit.")
+	filterPresetsFile    = flag.String("filter-presets-file", "", "File of \"<name> <query-string>\" lines defining the filter presets SSE clients can select with the filter parameter.")
+	filterableFields     = flag.String("filterable-fields", "", "Comma separated list of data fields clients can filter on with field.<name> parameters, each should be indexed.")
+	maxPollWait          = flag.Duration("max-poll-wait", time.Minute, "Maximum time long-polling clients can wait for events with the wait parameter.")
+	maxConnsPerIP        = flag.Int("max-connections-per-ip", 0, "Maximum number of concurrent connections per client IP, 0 for no limit.")
+	connectionRate       = flag.Float64("connection-rate", 0, "Number of connection attempts per second allowed per client IP, 0 for no limit.")
+	connectionBurst      = flag.Int("connection-burst", 10, "Number of connection attempts a client IP can make in a burst when --connection-rate is set.")
+	trustedProxyDepth    = flag.Int("trusted-proxy-depth", 0, "Number of trusted proxies in front of the daemon setting the X-Forwarded-For header.")
+	allowedCIDRs         = flag.String("allowed-cidrs", "", "Comma separated list of networks (i.e.: 10.0.0.0/8) clients must connect from, empty to allow any.")
+	deniedCIDRs          = flag.String("denied-cidrs", "", "Comma separated list of networks clients can't connect from.")
+	corsOrigins          = flag.String("cors-origins", "*", "Comma separated list of origins allowed to access the API from a browser, \"*\" for any origin.")
+	corsMaxAge           = flag.Duration("cors-max-age", 0, "Time browsers can cache the result of a CORS preflight request, 0 to let browsers use their default.")
+	corsCredentials      = flag.Bool("cors-allow-credentials", false, "Let browsers send credentials with cross-origin requests.")
+	maxAuthFailures      = flag.Int("max-auth-failures", 10, "Number of authentication failures within --auth-failure-window after which a client IP is banned, 0 to disable.")
+	authFailureWindow    = flag.Duration("auth-failure-window", time.Minute, "Window in which authentication failures are counted.")
+	authBanDuration      = flag.Duration("auth-ban-duration", 5*time.Minute, "Time a client IP failing to authenticate too many times is banned for.")
+	protectStatus        = flag.Bool("protect-status", true, "Require the SSE or metrics credentials on the status and metrics endpoints.")
+	redactedVars         = flag.String("redacted-vars", "cmdline", "Comma separated list of expvars, or patterns, masked on the status endpoint.")
+	maxStatusClients     = flag.Int("max-status-clients", 100, "Maximum number of connected clients detailed by the status endpoint, 0 to hide them.")
+	maxBandwidth         = flag.Int64("max-bandwidth", 0, "Maximum number of bytes per second sent on each SSE stream, 0 for no limit.")
+	minBandwidth         = flag.Int64("min-bandwidth", 0, "Lowest number of bytes per second SSE clients can ask their stream to be throttled to.")
+	unthrottledPassword  = flag.String("unthrottled-password", os.Getenv("OPLOGD_UNTHROTTLED_PASSWORD"), "Password of privileged SSE clients whose streams are not throttled.")
+	hello                = flag.Bool("hello", false, "Start SSE streams with a \"hello\" event giving the server time and the newest operation.")
+	helloFilter          = flag.Bool("hello-filter", false, "Give the effective filter of the stream in the \"hello\" event, requires --hello.")
+	helloFilteredHead    = flag.Bool("hello-filtered-head", false, "Give the newest operation matching the filter of the stream in the \"hello\" event, requires --hello.")
+	shutdownTimeout      = flag.Duration("shutdown-timeout", 10*time.Second, "Maximum time to wait for SSE streams to end on shutdown.")
+	drainDelay           = flag.Duration("drain-delay", 0, "Time to wait on shutdown between failing the readiness probe and closing the listener.")
+	enableMetrics        = flag.Bool("metrics", false, "Expose the statistics in the Prometheus text format on /metrics.")
+	metricsPassword      = flag.String("metrics-password", os.Getenv("OPLOGD_METRICS_PASSWORD"), "Password protecting the metrics endpoint.")
+	statsdAddr           = flag.String("statsd-addr", "", "Address of a statsd server to send the statistics to, tagged in the DogStatsD format, empty to disable.")
+	statsdPrefix         = flag.String("statsd-prefix", "oplog.", "Prefix of the metrics sent to statsd.")
+	objectURL            = flag.String("object-url", os.Getenv("OPLOGD_OBJECT_URL"), "A URL template to reference objects. If this option is set, SSE events will have an \"ref\" field with the URL to the object. The URL is a text/template given .Type, .ID, .Parents and .Timestamp (i.e.: http://api.mydomain.com/{{.Type}}/{{.ID}}), {{type}} and {{id}} being still supported.")
+	objectURLsFile       = flag.String("object-urls-file", "", "File of \"<type> <template>\" lines defining the URL templates of the types whose objects aren't referenced by --object-url.")
 )
 
+// leveledLogger returns a logger writing like the standard logger at the given level
+func leveledLogger(flagName, level string) oplog.Logger {
+	l, err := log.ParseLevel(level)
+	if err != nil {
+		log.Fatalf("%s: %s", flagName, err)
+	}
+	std := log.StandardLogger()
+	return &log.Logger{Out: std.Out, Formatter: std.Formatter, Hooks: std.Hooks, Level: l}
+}
+
 // Test
 func main() {
 	flag.Parse()
@@ -40,11 +141,80 @@ func main() {
 
 	log.Infof("Starting oplog %s", oplog.Version)
 
-	ol, err := oplog.New(*mongoURL, *cappedCollectionSize)
+	var sink oplog.MetricsSink
+	if *statsdAddr != "" {
+		statsdSink, err := statsd.New(*statsdAddr, *statsdPrefix)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer statsdSink.Close()
+		sink = statsdSink
+	}
+	ol, err := oplog.NewWithMetrics(*mongoURL, *cappedCollectionSize, sink)
 	if err != nil {
 		log.Fatal(err)
 	}
-	ol.ObjectURL = *objectURL
+	if *oplogLogLevel != "" {
+		ol.Logger = leveledLogger("--oplog-log-level", *oplogLogLevel)
+	}
+	ol.LogSampleWindow = *logSampleWindow
+	if err := ol.SetObjectURL(*objectURL, nil); err != nil {
+		log.Fatalf("--object-url: %s", err)
+	}
+	if *objectURLsFile != "" {
+		f, err := os.Open(*objectURLsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		objectURLs, err := oplog.ReadObjectURLs(f)
+		f.Close()
+		if err == nil {
+			err = ol.SetObjectURLs(objectURLs, nil)
+		}
+		if err != nil {
+			log.Fatalf("%s: %s", *objectURLsFile, err)
+		}
+	}
+	ol.MaxConcurrentTails = *maxConcurrentTails
+	ol.ReplicationTailWeight = *replicationWeight
+	ol.SharedTail = *sharedTail
+	ol.MaxConcurrentReplications = *maxReplications
+	ol.ReplicationQueueTimeout = *replicationTimeout
+	ol.ReplicationQueueFeedback = *replicationFeedback
+	ol.NormalizeTypes = *normalizeTypes
+	ol.NormalizeParentTypes = *normalizeParentTypes
+	ol.FallbackRewind = *fallbackRewind
+	ol.TouchCreatesState = *touchCreatesState
+	ol.MaxParents = *maxParents
+	ol.StrictParents = *strictParents
+	ol.MaxMetaKeys = *maxMetaKeys
+	ol.MaxMetaSize = *maxMetaSize
+	ol.MaxPayloadSize = *maxPayloadSize
+	ol.MaxStatsTypes = *maxStatsTypes
+	ol.SlowReplicationPage = *slowReplicationPage
+	if *normalizeExisting {
+		n, err := ol.NormalizeExistingTypes()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Normalized %d object states", n)
+		return
+	}
+	if *existingParents {
+		n, err := ol.NormalizeExistingParents()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Normalized the parents of %d object states", n)
+		return
+	}
+
+	if *capacityInterval > 0 {
+		ol.SampleCapacity(*capacityInterval)
+	}
+	if *retentionInterval > 0 {
+		ol.WatchRetention(*retentionInterval)
+	}
 
 	log.Infof("Listening on %s (UDP/TCP)", *listenAddr)
 
@@ -54,7 +224,199 @@ func main() {
 	}()
 
 	ssed := oplog.NewSSEDaemon(*listenAddr, ol)
+	if *sseLogLevel != "" {
+		ssed.Logger = leveledLogger("--sse-log-level", *sseLogLevel)
+	}
+	ssed.LogSampleWindow = *logSampleWindow
 	ssed.Password = *password
+	if *credentialsFile != "" {
+		f, err := os.Open(*credentialsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		credentials, err := oplog.ReadCredentials(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("%s: %s", *credentialsFile, err)
+		}
+		ssed.Authenticator = oplog.NewCredentialStore(credentials)
+	}
+	if *tokensFile != "" {
+		f, err := os.Open(*tokensFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tokens, err := oplog.ReadTokens(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("%s: %s", *tokensFile, err)
+		}
+		ssed.TokenValidator = tokens
+	}
+	ssed.AllowQueryToken = *allowQueryToken
+	if *audit {
+		ssed.AuditSink = oplog.NewMongoAuditSink(ol)
+	}
 	ssed.IngestPassword = *ingestPassword
-	log.Fatal(ssed.Run())
+	ssed.MaxIngestSize = *maxIngestSize
+	ssed.EnableMetrics = *enableMetrics
+	ssed.MetricsPassword = *metricsPassword
+	ssed.ClientBufferSize = *clientBufferSize
+	ssed.ReconnectDelay = *reconnectDelay
+	ssed.KeepaliveInterval = *keepaliveInterval
+	ssed.MaxConnectionDuration = *maxConnDuration
+	ssed.LagRefreshInterval = *lagRefreshInterval
+	ssed.MaxLimit = *maxLimit
+	ssed.MaxIdleTimeout = *maxIdleTimeout
+	ssed.MaxPollWait = *maxPollWait
+	ssed.MaxFilterValues = *maxFilterValues
+	ssed.MaxFilterValueLength = *maxFilterValueLength
+	for _, name := range strings.Split(*filterableFields, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			if err := oplog.ValidateField(name); err != nil {
+				log.Fatalf("--filterable-fields: %s", err)
+			}
+			ssed.FilterableFields = append(ssed.FilterableFields, name)
+		}
+	}
+	if *filterPresetsFile != "" {
+		f, err := os.Open(*filterPresetsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		presets, err := oplog.ReadFilterPresets(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("%s: %s", *filterPresetsFile, err)
+		}
+		ssed.FilterPresets = presets
+	}
+	ssed.ProtectStatus = *protectStatus
+	ssed.RedactedVars = nil
+	for _, name := range strings.Split(*redactedVars, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			ssed.RedactedVars = append(ssed.RedactedVars, name)
+		}
+	}
+	ssed.MaxStatusClients = *maxStatusClients
+	ssed.MaxAuthFailures = *maxAuthFailures
+	ssed.AuthFailureWindow = *authFailureWindow
+	ssed.AuthBanDuration = *authBanDuration
+	ssed.Hello = *hello
+	ssed.HelloFilter = *helloFilter
+	ssed.HelloFilteredHead = *helloFilteredHead
+	ssed.MaxBandwidth = *maxBandwidth
+	ssed.MinBandwidth = *minBandwidth
+	ssed.UnthrottledPassword = *unthrottledPassword
+	ssed.MaxConnectionsPerIP = *maxConnsPerIP
+	ssed.ConnectionRate = *connectionRate
+	ssed.ConnectionBurst = *connectionBurst
+	ssed.TrustedProxyDepth = *trustedProxyDepth
+	for _, cidrs := range []struct {
+		flag string
+		list *string
+		nets *[]*net.IPNet
+	}{
+		{"--allowed-cidrs", allowedCIDRs, &ssed.AllowedCIDRs},
+		{"--denied-cidrs", deniedCIDRs, &ssed.DeniedCIDRs},
+	} {
+		if *cidrs.list == "" {
+			continue
+		}
+		if *cidrs.nets, err = oplog.ParseCIDRs(strings.Split(*cidrs.list, ",")); err != nil {
+			log.Fatalf("%s: %s", cidrs.flag, err)
+		}
+	}
+	ssed.CORS.AllowedOrigins = nil
+	for _, origin := range strings.Split(*corsOrigins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			ssed.CORS.AllowedOrigins = append(ssed.CORS.AllowedOrigins, origin)
+		}
+	}
+	ssed.CORS.MaxAge = *corsMaxAge
+	ssed.CORS.AllowCredentials = *corsCredentials
+	ssed.ReadHeaderTimeout = *readHeaderTimeout
+	ssed.IdleTimeout = *idleTimeout
+	ssed.DrainDelay = *drainDelay
+	switch *slowConsumerPolicy {
+	case "disconnect":
+		ssed.SlowConsumerPolicy = oplog.SlowConsumerDisconnect
+	case "resume":
+		ssed.SlowConsumerPolicy = oplog.SlowConsumerResume
+	default:
+		log.Fatalf("Invalid slow consumer policy: %s", *slowConsumerPolicy)
+	}
+	ssed.FilterFingerprint = *filterFingerprint
+	switch *filterChangePolicy {
+	case "ignore":
+		ssed.FilterChangePolicy = oplog.FilterChangeIgnore
+	case "reject":
+		ssed.FilterChangePolicy = oplog.FilterChangeReject
+	case "resync":
+		ssed.FilterChangePolicy = oplog.FilterChangeResync
+	default:
+		log.Fatalf("Invalid filter change policy: %s", *filterChangePolicy)
+	}
+	if *signingKey != "" {
+		ssed.SigningKey = []byte(*signingKey)
+		for _, key := range strings.Split(*verificationKeys, ",") {
+			if key != "" {
+				ssed.VerificationKeys = append(ssed.VerificationKeys, []byte(key))
+			}
+		}
+	}
+	switch *unsignedIDPolicy {
+	case "reject":
+		ssed.UnsignedIDPolicy = oplog.UnsignedIDReject
+	case "ignore":
+		ssed.UnsignedIDPolicy = oplog.UnsignedIDIgnore
+	default:
+		log.Fatalf("Invalid unsigned id policy: %s", *unsignedIDPolicy)
+	}
+	switch *policyMode {
+	case "reject":
+		ssed.PolicyMode = oplog.PolicyReject
+	case "constrain":
+		ssed.PolicyMode = oplog.PolicyConstrain
+	default:
+		log.Fatalf("Invalid policy mode: %s", *policyMode)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		// Gracefully stop streaming on SIGINT or SIGTERM
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		log.Info("Shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		ssed.Shutdown(ctx)
+		close(stopped)
+	}()
+
+	if *tlsClientCA != "" {
+		pem, err := ioutil.ReadFile(*tlsClientCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Fatalf("%s: no certificate found", *tlsClientCA)
+		}
+		ssed.TLSConfig = &tls.Config{ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert}
+		ssed.CertAuthorizer = oplog.CertCommonName
+	}
+
+	if *tlsCert != "" || *tlsKey != "" {
+		err = ssed.RunTLS(*tlsCert, *tlsKey)
+	} else {
+		err = ssed.Run()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	// The listener is closed, wait for the streams to end
+	<-stopped
+	ol.Close()
 }
@@ -0,0 +1,337 @@
+package oplog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// ConnectionInfo summarizes a stream connection
+type ConnectionInfo struct {
+	// RemoteAddr is the address of the client
+	RemoteAddr string `json:"remote_addr"`
+	// Host is the IP of the client, its RemoteAddr without port
+	Host string `json:"-"`
+	// ClientName is the name given by the client thru the client_name query-string
+	// parameter, if any
+	ClientName string `json:"client_name,omitempty"`
+	// Path is the requested path
+	Path string `json:"path"`
+	// Query is the requested query-string, with the access token redacted
+	Query string `json:"query,omitempty"`
+	// Filter is the filter of the stream
+	Filter Filter `json:"filter"`
+	// Preset is the name of the filter preset selected by the client, if any
+	Preset string `json:"preset,omitempty"`
+	// LastEventID is the event id the client resumed from, if any
+	LastEventID string `json:"last_event_id,omitempty"`
+	// Auth tells if the client authenticated: "none" when no password is required, "ok"
+	// or "failed"
+	Auth string `json:"auth"`
+	// User is the username the client authenticated with
+	User string `json:"user,omitempty"`
+	// Started is the time the connection started
+	Started time.Time `json:"started"`
+	// EventsSent and BytesSent count the operations and the bytes sent to the client
+	EventsSent int64 `json:"events_sent"`
+	BytesSent  int64 `json:"bytes_sent"`
+	// BytesUncompressed counts the bytes of a compressed stream before their compression
+	BytesUncompressed int64 `json:"bytes_uncompressed,omitempty"`
+	// Bandwidth is the rate in bytes per second the stream is throttled to, if any
+	Bandwidth int64 `json:"bandwidth,omitempty"`
+	// ThrottleWait is the time in milliseconds the stream waited because of its throttling
+	ThrottleWait int64 `json:"throttle_wait,omitempty"`
+	// LastSentID is the id of the last event sent to the client
+	LastSentID string `json:"last_sent_id,omitempty"`
+	// Status is the HTTP status of the response
+	Status int `json:"status"`
+	// EndReason tells why the connection ended, empty while the connection is running
+	EndReason string `json:"end_reason,omitempty"`
+	// Mode tells if the stream sends live operations or replicates object states:
+	// "live", "replication" or "fallback", empty until the stream started
+	Mode string `json:"mode,omitempty"`
+	// Lag is the time in milliseconds between the last operation sent and the most
+	// recent operation of the oplog, only computed for live streams, see
+	// SSEDaemon.LagRefreshInterval
+	Lag int64 `json:"lag,omitempty"`
+
+	// lastEventTime is the time of the last operation sent
+	lastEventTime time.Time
+}
+
+// connection tracks the state of a stream connection
+type connection struct {
+	mu   sync.Mutex
+	info ConnectionInfo
+	// revoked is closed to end the stream, see DisconnectClients
+	revoked    chan struct{}
+	revokeOnce sync.Once
+}
+
+// remoteHost returns the host part of an address, the address itself when it has no port
+func remoteHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+func newConnection(remoteAddr string, r *http.Request) *connection {
+	return &connection{info: ConnectionInfo{
+		RemoteAddr: remoteAddr,
+		Host:       remoteHost(remoteAddr),
+		ClientName: r.URL.Query().Get("client_name"),
+		Preset:     r.URL.Query().Get("filter"),
+		Path:       r.URL.Path,
+		Query:      redactQuery(r.URL),
+		Auth:       "none",
+		Started:    time.Now(),
+	}, revoked: make(chan struct{})}
+}
+
+// revoke ends the stream of the connection
+func (c *connection) revoke() {
+	c.revokeOnce.Do(func() { close(c.revoked) })
+}
+
+// update modifies the connection info under lock
+func (c *connection) update(f func(info *ConnectionInfo)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f(&c.info)
+}
+
+// sent records an event sent to the client, technical events don't count as sent
+// operations
+func (c *connection) sent(id string, operation bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if operation {
+		c.info.EventsSent++
+	}
+	if id != "" {
+		c.info.LastSentID = id
+	}
+}
+
+// snapshot returns a copy of the connection info
+func (c *connection) snapshot() ConnectionInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.info
+}
+
+// logEnd writes the access log line of the connection
+func (c *connection) logEnd(prefix string) {
+	info := c.snapshot()
+	log.WithFields(log.Fields{
+		"remote_addr":        info.RemoteAddr,
+		"client_name":        info.ClientName,
+		"path":               info.Path,
+		"query":              info.Query,
+		"types":              info.Filter.Types,
+		"parents":            info.Filter.Parents,
+		"preset":             info.Preset,
+		"last_event_id":      info.LastEventID,
+		"auth":               info.Auth,
+		"user":               info.User,
+		"duration":           time.Since(info.Started).String(),
+		"events_sent":        info.EventsSent,
+		"bytes_sent":         info.BytesSent,
+		"bytes_uncompressed": info.BytesUncompressed,
+		"bandwidth":          info.Bandwidth,
+		"throttle_wait":      info.ThrottleWait,
+		"last_sent_id":       info.LastSentID,
+		"status":             info.Status,
+		"end_reason":         info.EndReason,
+	}).Infof("%s[%s] connection ended", prefix, info.RemoteAddr)
+}
+
+// countingResponseWriter counts the bytes written to a connection, and in total in the
+// stats, and records the status of the response
+type countingResponseWriter struct {
+	http.ResponseWriter
+	conn  *connection
+	stats *Stats
+}
+
+func (cw *countingResponseWriter) WriteHeader(status int) {
+	cw.conn.update(func(info *ConnectionInfo) {
+		if info.Status == 0 {
+			info.Status = status
+		}
+	})
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *countingResponseWriter) Write(b []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(b)
+	cw.conn.update(func(info *ConnectionInfo) {
+		if info.Status == 0 {
+			info.Status = 200
+		}
+		info.BytesSent += int64(n)
+	})
+	cw.stats.BytesSent.Add(int64(n))
+	return n, err
+}
+
+// uncompressedCounter counts the bytes written to a compressed stream before their
+// compression
+type uncompressedCounter struct {
+	http.ResponseWriter
+	conn *connection
+}
+
+func (uc *uncompressedCounter) Write(b []byte) (int, error) {
+	n, err := uc.ResponseWriter.Write(b)
+	uc.conn.update(func(info *ConnectionInfo) { info.BytesUncompressed += int64(n) })
+	return n, err
+}
+
+// Flush flushes the underlying response if it supports it
+func (cw *countingResponseWriter) Flush() {
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// register adds a running stream to the list returned by Connections
+func (daemon *SSEDaemon) register(c *connection) {
+	daemon.connsMu.Lock()
+	defer daemon.connsMu.Unlock()
+	daemon.connsSeq++
+	daemon.conns[c] = daemon.connsSeq
+	if daemon.lagStop == nil && daemon.LagRefreshInterval > 0 {
+		daemon.lagStop = make(chan struct{})
+		go daemon.monitorLags(daemon.lagStop)
+	}
+}
+
+func (daemon *SSEDaemon) unregister(c *connection) {
+	daemon.connsMu.Lock()
+	defer daemon.connsMu.Unlock()
+	delete(daemon.conns, c)
+	if len(daemon.conns) == 0 && daemon.lagStop != nil {
+		close(daemon.lagStop)
+		daemon.lagStop = nil
+	}
+}
+
+// Connections returns the summary of the running streams, oldest first
+func (daemon *SSEDaemon) Connections() []ConnectionInfo {
+	daemon.connsMu.Lock()
+	conns := make([]*connection, 0, len(daemon.conns))
+	for c := range daemon.conns {
+		conns = append(conns, c)
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		return daemon.conns[conns[i]] < daemon.conns[conns[j]]
+	})
+	daemon.connsMu.Unlock()
+	infos := make([]ConnectionInfo, 0, len(conns))
+	for _, c := range conns {
+		infos = append(infos, c.snapshot())
+	}
+	return infos
+}
+
+// DisconnectClients ends the running streams whose summary matches predicate with an
+// "error" event carrying "revoked", and returns the number of streams ended.
+func (daemon *SSEDaemon) DisconnectClients(predicate func(ConnectionInfo) bool) int {
+	daemon.connsMu.Lock()
+	conns := make([]*connection, 0, len(daemon.conns))
+	for c := range daemon.conns {
+		conns = append(conns, c)
+	}
+	daemon.connsMu.Unlock()
+	n := 0
+	for _, c := range conns {
+		if predicate(c.snapshot()) {
+			c.revoke()
+			n++
+		}
+	}
+	return n
+}
+
+// RevokeUser removes user from the Authenticator, when it is a RevocableAuthenticator, and
+// ends its running streams. It returns the number of streams ended.
+func (daemon *SSEDaemon) RevokeUser(user string) int {
+	// The streams are counted before the removal, which ends them too when the
+	// Authenticator notifies it, see watchRemovals
+	n := daemon.DisconnectClients(func(info ConnectionInfo) bool {
+		return info.User == user
+	})
+	if auth, ok := daemon.Authenticator.(RevocableAuthenticator); ok {
+		auth.Remove(user)
+	}
+	return n
+}
+
+// disconnectRequest is the body of a request to the disconnect endpoint
+type disconnectRequest struct {
+	User       string `json:"user"`
+	RemoteAddr string `json:"remote_addr"`
+	// Revoke removes the credentials of the user as well
+	Revoke bool `json:"revoke"`
+}
+
+// Disconnect exposes an admin endpoint ending the streams of a user and/or client IP,
+// given as a JSON object. The number of streams ended is returned.
+func (daemon *SSEDaemon) Disconnect(w http.ResponseWriter, r *http.Request) {
+	if !daemon.authRequired(ScopeAdmin) {
+		daemon.ol.Stats.AuthzDeniedScope.Add(1)
+		writeError(w, 403, "forbidden", "admin credentials are required to disconnect clients")
+		return
+	}
+	if _, ok := daemon.authenticate(w, r, ScopeAdmin); !ok {
+		return
+	}
+	var req disconnectRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&req); err != nil {
+		writeError(w, 400, "invalid_body", fmt.Sprintf("invalid body: %s", err))
+		return
+	}
+	if req.User == "" && req.RemoteAddr == "" {
+		writeError(w, 400, "invalid_body", "user or remote_addr is required")
+		return
+	}
+	if req.Revoke && req.User == "" {
+		writeError(w, 400, "invalid_body", "revoke requires a user")
+		return
+	}
+	n := daemon.DisconnectClients(func(info ConnectionInfo) bool {
+		return (req.User == "" || info.User == req.User) &&
+			(req.RemoteAddr == "" || info.Host == remoteHost(req.RemoteAddr))
+	})
+	if req.Revoke {
+		if auth, ok := daemon.Authenticator.(RevocableAuthenticator); ok {
+			auth.Remove(req.User)
+		}
+	}
+	daemon.logger().Warnf("ADMIN[%s] disconnected %d clients matching user %q and address %q", daemon.clientIP(r), n, req.User, req.RemoteAddr)
+	res, _ := json.Marshal(map[string]int{"disconnected": n})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(res)
+}
+
+// Use adds a middleware around the handlers of the daemon. Middlewares are applied in the
+// order they are added, the first one being the outermost. Use must be called before the
+// daemon starts serving. Middlewares wrapping the http.ResponseWriter must preserve its
+// http.Flusher implementation for the streams, and http.Hijacker for WebSockets.
+func (daemon *SSEDaemon) Use(middleware func(http.Handler) http.Handler) {
+	daemon.middlewares = append(daemon.middlewares, middleware)
+	var h http.Handler = http.HandlerFunc(daemon.route)
+	for i := len(daemon.middlewares) - 1; i >= 0; i-- {
+		h = daemon.middlewares[i](h)
+	}
+	daemon.handler = h
+}
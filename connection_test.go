@@ -0,0 +1,521 @@
+package oplog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUse(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	calls := []string{}
+	for _, name := range []string{"first", "second"} {
+		name := name
+		daemon.Use(func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls = append(calls, name)
+				next.ServeHTTP(w, r)
+			})
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	daemon.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != 200 {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	if strings.Join(calls, ",") != "first,second" {
+		t.Errorf("middlewares not applied in order: %v", calls)
+	}
+}
+
+func TestUseNoFlusher(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.tail = func(lastID LastID, filter Filter, opts TailOptions, out chan<- GenericEvent, stop <-chan bool) {
+		t.Error("no tail should be started without flusher")
+		<-stop
+	}
+	// A middleware hiding the flusher of the response writer
+	daemon.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(plainResponseWriter{w}, r)
+		})
+	})
+
+	rec := httptest.NewRecorder()
+	daemon.ServeHTTP(rec, newTestSSERequest(context.Background()))
+	if rec.Code != 500 {
+		t.Fatalf("expected status 500, got %d", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "streaming_not_supported") {
+		t.Errorf("invalid error: %s", rec.Body.String())
+	}
+}
+
+func TestConnections(t *testing.T) {
+	ops := newTestOperations(2)
+	daemon := newTestSSEOpsDaemon(ops)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req := httptest.NewRequest("GET", "/ops?types=video&last_event_id=1423995187898", nil).WithContext(ctx)
+	req.Header.Set("Accept", "text/event-stream")
+	done := make(chan struct{})
+	go func() {
+		daemon.ServeHTTP(flushResponseWriter{httptest.NewRecorder()}, req)
+		close(done)
+	}()
+
+	var info ConnectionInfo
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		if conns := daemon.Connections(); len(conns) == 1 && conns[0].EventsSent == 2 && conns[0].LastSentID == ops[1].ID.Hex() {
+			info = conns[0]
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("connection not registered: %#v", daemon.Connections())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if info.Path != "/ops" || info.LastEventID != "1423995187898" || strings.Join(info.Filter.Types, ",") != "video" {
+		t.Errorf("invalid connection info: %#v", info)
+	}
+	if info.Auth != "none" || info.Status != 200 || info.BytesSent == 0 || info.EndReason != "" {
+		t.Errorf("invalid connection info: %#v", info)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("stream not ended")
+	}
+	if conns := daemon.Connections(); len(conns) != 0 {
+		t.Errorf("connection not unregistered: %#v", conns)
+	}
+}
+
+func TestConnectionsRejected(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.Password = "secret"
+	rec := httptest.NewRecorder()
+	daemon.ServeHTTP(rec, newTestSSERequest(context.Background()))
+	if rec.Code != 401 {
+		t.Fatalf("expected status 401, got %d", rec.Code)
+	}
+	if conns := daemon.Connections(); len(conns) != 0 {
+		t.Errorf("rejected connections must not be registered: %#v", conns)
+	}
+}
+
+// testStatusClients returns the names of the connected clients detailed by /status
+func testStatusClients(t *testing.T, addr string, auth bool) []string {
+	req, _ := http.NewRequest("GET", "http://"+addr+"/status", nil)
+	if auth {
+		req.SetBasicAuth("", "secret")
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	status := struct {
+		Clients *[]ConnectionInfo `json:"connected_clients"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Clients == nil {
+		return nil
+	}
+	names := []string{}
+	for _, c := range *status.Clients {
+		names = append(names, c.ClientName)
+	}
+	return names
+}
+
+func TestStatusConnectedClients(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	daemon := newTestSSEDaemonHandler(addr)
+	daemon.Password = "secret"
+	go daemon.Serve(l)
+	defer daemon.Shutdown(context.Background())
+
+	waitClients := func(expected string) {
+		for deadline := time.Now().Add(2 * time.Second); ; {
+			names := testStatusClients(t, addr, true)
+			if strings.Join(names, ",") == expected {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected clients %q, got %v", expected, names)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	connect := func(name string) context.CancelFunc {
+		ctx, cancel := context.WithCancel(context.Background())
+		req, _ := http.NewRequest("GET", "http://"+addr+"/ops?since=1423995187000&client_name="+name, nil)
+		req.Header.Set("Accept", "text/event-stream")
+		req.SetBasicAuth("", "secret")
+		res, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != 200 {
+			t.Fatalf("expected status 200, got %d", res.StatusCode)
+		}
+		return cancel
+	}
+
+	closeA := connect("a")
+	waitClients("a")
+	closeB := connect("b")
+	waitClients("a,b")
+	if names := testStatusClients(t, addr, false); names != nil {
+		t.Errorf("clients must not be detailed without authentication, got %v", names)
+	}
+
+	// The WebSocket streams are listed as well
+	ws := dialTestWSAuth(t, addr, "?last_event_id=1423995187898&client_name=c", "", "secret")
+	waitClients("a,b,c")
+
+	closeA()
+	waitClients("b,c")
+	closeB()
+	waitClients("c")
+	ws.conn.Close()
+	waitClients("")
+}
+
+func TestStatusConnectedClientsLimit(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.MaxStatusClients = 2
+	for _, name := range []string{"a", "b", "c"} {
+		daemon.register(newConnection("192.0.2.1", httptest.NewRequest("GET", "/ops?client_name="+name, nil)))
+	}
+	rec := httptest.NewRecorder()
+	daemon.ServeHTTP(rec, httptest.NewRequest("GET", "/status", nil))
+	status := struct {
+		Clients []ConnectionInfo `json:"connected_clients"`
+	}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Clients) != 2 || status.Clients[0].ClientName != "a" || status.Clients[1].ClientName != "b" {
+		t.Errorf("expected the 2 oldest clients, got %#v", status.Clients)
+	}
+}
+
+func TestDisconnectClients(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	daemon := newTestSSEDaemonHandler(addr)
+	store := NewCredentialStore(Credentials{
+		"alice": {Password: "a"},
+		"bob":   {Password: "b"},
+		"admin": {Password: "x", Scopes: []string{ScopeAdmin}},
+	})
+	daemon.Authenticator = store
+	go daemon.Serve(l)
+	defer daemon.Shutdown(context.Background())
+
+	stream := func(user, password string) *http.Response {
+		req, _ := http.NewRequest("GET", "http://"+addr+"/ops?since=1423995187000", nil)
+		req.Header.Set("Accept", "text/event-stream")
+		req.SetBasicAuth(user, password)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	alice := stream("alice", "a")
+	defer alice.Body.Close()
+	bob := stream("bob", "b")
+	defer bob.Body.Close()
+	for deadline := time.Now().Add(2 * time.Second); len(daemon.Connections()) != 2; {
+		if time.Now().After(deadline) {
+			t.Fatalf("streams not registered: %#v", daemon.Connections())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	disconnect := func(body, user, password string) (int, string) {
+		req, _ := http.NewRequest("POST", "http://"+addr+"/admin/disconnect", strings.NewReader(body))
+		req.SetBasicAuth(user, password)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(b)
+	}
+	if status, _ := disconnect(`{"user":"alice"}`, "bob", "b"); status != 403 {
+		t.Errorf("expected 403 for a reader, got %d", status)
+	}
+	if status, _ := disconnect(`{}`, "admin", "x"); status != 400 {
+		t.Errorf("expected 400 without predicate, got %d", status)
+	}
+	status, body := disconnect(`{"user":"alice","revoke":true}`, "admin", "x")
+	if status != 200 || body != `{"disconnected":1}` {
+		t.Fatalf("unexpected response: %d %s", status, body)
+	}
+
+	// The revoked stream ends right away with an error event
+	ended := make(chan string)
+	go func() {
+		b, _ := ioutil.ReadAll(alice.Body)
+		ended <- string(b)
+	}()
+	select {
+	case b := <-ended:
+		if !strings.HasSuffix(b, "event: error\ndata: revoked\n\n") {
+			t.Errorf("missing revoked event: %q", b)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("revoked stream not ended")
+	}
+	if conns := daemon.Connections(); len(conns) != 1 || conns[0].User != "bob" {
+		t.Errorf("expected bob to stay connected: %#v", conns)
+	}
+
+	// The revoked credentials are removed
+	res := stream("alice", "a")
+	res.Body.Close()
+	if res.StatusCode != 401 {
+		t.Errorf("expected 401 once revoked, got %d", res.StatusCode)
+	}
+
+	if n := daemon.DisconnectClients(func(info ConnectionInfo) bool { return info.Host == "127.0.0.1" }); n != 1 {
+		t.Errorf("expected 1 client disconnected by address, got %d", n)
+	}
+}
+
+func TestCredentialStoreRemove(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	daemon := newTestSSEDaemonHandler(addr)
+	store := NewCredentialStore(Credentials{
+		"alice": {Password: "a"},
+		"bob":   {Password: "b"},
+	})
+	daemon.Authenticator = store
+	go daemon.Serve(l)
+	defer daemon.Shutdown(context.Background())
+
+	stream := func(user, password string) *http.Response {
+		req, _ := http.NewRequest("GET", "http://"+addr+"/ops?since=1423995187000", nil)
+		req.Header.Set("Accept", "text/event-stream")
+		req.SetBasicAuth(user, password)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	alice := stream("alice", "a")
+	defer alice.Body.Close()
+	bob := stream("bob", "b")
+	defer bob.Body.Close()
+	for deadline := time.Now().Add(2 * time.Second); len(daemon.Connections()) != 2; {
+		if time.Now().After(deadline) {
+			t.Fatalf("streams not registered: %#v", daemon.Connections())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Removing the user from the store, without going through the daemon, ends its streams
+	store.Remove("alice")
+	ended := make(chan string)
+	go func() {
+		b, _ := ioutil.ReadAll(alice.Body)
+		ended <- string(b)
+	}()
+	select {
+	case b := <-ended:
+		if !strings.HasSuffix(b, "event: error\ndata: revoked\n\n") {
+			t.Errorf("missing revoked event: %q", b)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("stream of the removed user not ended")
+	}
+	if conns := daemon.Connections(); len(conns) != 1 || conns[0].User != "bob" {
+		t.Errorf("expected bob to stay connected: %#v", conns)
+	}
+
+	// The daemon registers only once to the store
+	daemon.RevokeUser("bob")
+	if n := len(store.onRemove); n != 1 {
+		t.Errorf("expected a single removal callback, got %d", n)
+	}
+}
+
+func TestConnectionHost(t *testing.T) {
+	r := httptest.NewRequest("GET", "/ops", nil)
+	for addr, host := range map[string]string{
+		"127.0.0.1:53412": "127.0.0.1",
+		"[::1]:53412":     "::1",
+		"10.0.0.1":        "10.0.0.1",
+	} {
+		if info := newConnection(addr, r).info; info.Host != host || info.RemoteAddr != addr {
+			t.Errorf("%s: invalid host %s", addr, info.Host)
+		}
+	}
+}
+
+func TestBytesSent(t *testing.T) {
+	for _, compressed := range []bool{false, true} {
+		ops := newTestOperations(2)
+		daemon := newTestSSEDaemonHandler("")
+		daemon.KeepaliveInterval = 5 * time.Millisecond
+		daemon.tail = func(lastID LastID, filter Filter, opts TailOptions, out chan<- GenericEvent, stop <-chan bool) {
+			for _, op := range ops {
+				select {
+				case out <- op:
+				case <-stop:
+					return
+				}
+				// Let keepalives be sent between the events
+				time.Sleep(20 * time.Millisecond)
+			}
+			<-stop
+		}
+		stats := *daemon.ol.Stats
+		stats.BytesSent = new(Int)
+		daemon.ol.Stats = &stats
+		server := httptest.NewServer(daemon)
+
+		req, _ := http.NewRequest("GET", server.URL+"/ops?since=1423995187000&limit=2", nil)
+		req.Header.Set("Accept", "text/event-stream")
+		// Set explicitly so the client doesn't ask for a compressed response, or decompress it
+		req.Header.Set("Accept-Encoding", "identity")
+		if compressed {
+			req.Header.Set("Accept-Encoding", "gzip")
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		server.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compressed != (res.Header.Get("Content-Encoding") == "gzip") {
+			t.Fatalf("compressed %v: unexpected Content-Encoding %q", compressed, res.Header.Get("Content-Encoding"))
+		}
+		plain := body
+		if compressed {
+			gz, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if plain, err = ioutil.ReadAll(gz); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !bytes.Contains(plain, []byte(":\n")) || !bytes.Contains(plain, []byte(ops[1].ID.Hex())) {
+			t.Fatalf("compressed %v: expected events and keepalives, got %q", compressed, plain)
+		}
+		if n := stats.BytesSent.Value(); n != int64(len(body)) {
+			t.Errorf("compressed %v: counted %d bytes, client received %d", compressed, n, len(body))
+		}
+	}
+}
+
+func TestCountingResponseWriterCompressed(t *testing.T) {
+	conn := newConnection("10.0.0.1", httptest.NewRequest("GET", "/ops", nil))
+	stats := testStats
+	stats.BytesSent = new(Int)
+	rec := httptest.NewRecorder()
+	var w http.ResponseWriter = &countingResponseWriter{rec, conn, &stats}
+	gw := newGzipResponseWriter(w, flushResponseWriter{rec})
+	w = &uncompressedCounter{gw, conn}
+	payload := strings.Repeat("event: insert\ndata: {}\n\n", 100)
+	w.Write([]byte(payload))
+	gw.Close()
+
+	info := conn.snapshot()
+	if info.BytesUncompressed != int64(len(payload)) {
+		t.Errorf("expected %d uncompressed bytes, got %d", len(payload), info.BytesUncompressed)
+	}
+	if info.BytesSent != int64(rec.Body.Len()) || stats.BytesSent.Value() != int64(rec.Body.Len()) {
+		t.Errorf("expected %d bytes sent, got %d (total %d)", rec.Body.Len(), info.BytesSent, stats.BytesSent.Value())
+	}
+	if info.BytesSent >= info.BytesUncompressed {
+		t.Errorf("compressed size %d not lower than %d", info.BytesSent, info.BytesUncompressed)
+	}
+}
+
+func TestStreamsEnded(t *testing.T) {
+	daemon := newTestSSEOpsDaemon(newTestOperations(2))
+	stats := *daemon.ol.Stats
+	stats.StreamsEnded = new(Map)
+	daemon.ol.Stats = &stats
+	sink := make(recordingSink, 10)
+	daemon.AuditSink = sink
+
+	// Limit reached
+	req := httptest.NewRequest("GET", "/ops?since=1423995187000&limit=1", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	daemon.ServeHTTP(flushResponseWriter{httptest.NewRecorder()}, req)
+	sink.next(t) // stream start
+	if event := sink.next(t); event.Type != AuditStreamEnd || event.Reason != "limit_reached" {
+		t.Errorf("expected a limit_reached stream end, got %#v", event)
+	}
+
+	// Client closed
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		daemon.ServeHTTP(flushResponseWriter{httptest.NewRecorder()}, newTestSSERequest(ctx))
+		close(done)
+	}()
+	sink.next(t)
+	cancel()
+	<-done
+	if event := sink.next(t); event.Type != AuditStreamEnd || event.Reason != "client_closed" {
+		t.Errorf("expected a client_closed stream end, got %#v", event)
+	}
+
+	// Backend error
+	daemon.lastID = func() (LastID, error) {
+		return nil, errors.New("no reachable servers")
+	}
+	req = httptest.NewRequest("GET", "/ops", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	rec := httptest.NewRecorder()
+	daemon.ServeHTTP(flushResponseWriter{rec}, req)
+	if rec.Code != 503 {
+		t.Fatalf("expected 503, got %d", rec.Code)
+	}
+
+	for reason, expected := range map[string]string{"limit_reached": "1", "client_closed": "1", "backend_error": "1", "other": "<nil>"} {
+		if v := fmt.Sprint(stats.StreamsEnded.Get(reason)); v != expected {
+			t.Errorf("expected %s %s streams ended, got %s", expected, reason, v)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package oplog
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORS defines the Cross-Origin Resource Sharing policy applied to all the endpoints of
+// the daemon. Requests from an origin which is not allowed get no CORS header, so
+// browsers refuse to expose the response.
+type CORS struct {
+	// AllowedOrigins lists the origins (i.e.: https://www.example.com) allowed to access
+	// the daemon. The "*" origin allows any origin.
+	AllowedOrigins []string
+	// AllowOriginFunc optionally allows origins in addition to AllowedOrigins.
+	AllowOriginFunc func(origin string) bool
+	// AllowedHeaders lists the request headers browsers are allowed to send.
+	AllowedHeaders []string
+	// MaxAge defines how long browsers can cache the result of a preflight request. A
+	// value of 0 lets browsers use their default.
+	MaxAge time.Duration
+	// AllowCredentials lets browsers send credentials (cookies, Authorization header).
+	AllowCredentials bool
+}
+
+// exposedHeaders lists the response headers browsers are allowed to read
+const exposedHeaders = "Retry-After, X-Oplog-Next-ID"
+
+// allowOrigin tells if origin is allowed and returns the value of the
+// Access-Control-Allow-Origin header to answer
+func (c CORS) allowOrigin(origin string) (string, bool) {
+	if origin == "" {
+		return "", false
+	}
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			// The wildcard is not accepted by browsers with credentials
+			if c.AllowCredentials {
+				return origin, true
+			}
+			return "*", true
+		}
+		if strings.EqualFold(o, origin) {
+			return origin, true
+		}
+	}
+	if c.AllowOriginFunc != nil && c.AllowOriginFunc(origin) {
+		return origin, true
+	}
+	return "", false
+}
+
+// writeHeaders sets the CORS headers of the response to r if its origin is allowed and
+// returns true if so.
+func (c CORS) writeHeaders(w http.ResponseWriter, r *http.Request) bool {
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	allowed, ok := c.allowOrigin(r.Header.Get("Origin"))
+	if !ok {
+		return false
+	}
+	h.Set("Access-Control-Allow-Origin", allowed)
+	if c.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	h.Set("Access-Control-Expose-Headers", exposedHeaders)
+	return true
+}
+
+// isPreflight tells if r is a CORS preflight request
+func isPreflight(r *http.Request) bool {
+	return r.Method == "OPTIONS" && r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// preflight answers a CORS preflight request for an endpoint accepting the sorted methods
+func (c CORS) preflight(w http.ResponseWriter, r *http.Request, methods []string) {
+	if c.writeHeaders(w, r) {
+		h := w.Header()
+		h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+		if len(c.AllowedHeaders) > 0 {
+			h.Set("Access-Control-Allow-Headers", strings.Join(c.AllowedHeaders, ", "))
+		}
+		if c.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge/time.Second)))
+		}
+	}
+	w.WriteHeader(204)
+}
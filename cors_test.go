@@ -0,0 +1,142 @@
+package oplog
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testCORSRequest(daemon *SSEDaemon, method, path, origin string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Origin", origin)
+	req.Header.Set("Accept", "text/event-stream")
+	if method == "OPTIONS" {
+		req.Header.Set("Access-Control-Request-Method", "GET")
+		req.Header.Set("Access-Control-Request-Headers", "authorization")
+	}
+	daemon.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCORSAllowedOrigin(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.CORS = CORS{AllowedOrigins: []string{"https://www.example.com"}}
+
+	rec := testCORSRequest(daemon, "GET", "/status", "https://www.example.com")
+	if rec.Code != 200 {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	if o := rec.Header().Get("Access-Control-Allow-Origin"); o != "https://www.example.com" {
+		t.Errorf("the allowed origin must be reflected, got %q", o)
+	}
+	if v := rec.Header().Get("Vary"); v != "Origin" {
+		t.Errorf("expected Vary: Origin, got %q", v)
+	}
+	if c := rec.Header().Get("Access-Control-Allow-Credentials"); c != "" {
+		t.Errorf("credentials not allowed, got %q", c)
+	}
+}
+
+func TestCORSDisallowedOrigin(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.CORS = CORS{
+		AllowedOrigins: []string{"https://www.example.com"},
+		AllowOriginFunc: func(origin string) bool {
+			return origin == "https://admin.example.com"
+		},
+	}
+
+	rec := testCORSRequest(daemon, "GET", "/status", "https://evil.example.net")
+	if rec.Code != 200 {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	for _, header := range []string{"Access-Control-Allow-Origin", "Access-Control-Allow-Credentials", "Access-Control-Expose-Headers"} {
+		if v := rec.Header().Get(header); v != "" {
+			t.Errorf("no %s header expected for a disallowed origin, got %q", header, v)
+		}
+	}
+
+	rec = testCORSRequest(daemon, "GET", "/status", "https://admin.example.com")
+	if o := rec.Header().Get("Access-Control-Allow-Origin"); o != "https://admin.example.com" {
+		t.Errorf("origin allowed by the func must be reflected, got %q", o)
+	}
+}
+
+func TestCORSWildcardOrigin(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+
+	// Any origin is allowed by default
+	rec := testCORSRequest(daemon, "GET", "/status", "https://www.example.com")
+	if o := rec.Header().Get("Access-Control-Allow-Origin"); o != "*" {
+		t.Errorf("expected the wildcard origin, got %q", o)
+	}
+
+	// Browsers refuse the wildcard with credentials, the origin must be reflected
+	daemon.CORS.AllowCredentials = true
+	rec = testCORSRequest(daemon, "GET", "/status", "https://www.example.com")
+	if o := rec.Header().Get("Access-Control-Allow-Origin"); o != "https://www.example.com" {
+		t.Errorf("the origin must be reflected with credentials, got %q", o)
+	}
+	if c := rec.Header().Get("Access-Control-Allow-Credentials"); c != "true" {
+		t.Errorf("expected credentials to be allowed, got %q", c)
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.Password = "secret"
+	daemon.CORS = CORS{
+		AllowedOrigins: []string{"https://www.example.com"},
+		AllowedHeaders: []string{"Authorization", "Last-Event-ID"},
+		MaxAge:         10 * time.Minute,
+	}
+	daemon.tail = func(lastID LastID, filter Filter, opts TailOptions, out chan<- GenericEvent, stop <-chan bool) {
+		t.Error("a preflight must not start a tail")
+		<-stop
+	}
+
+	rec := testCORSRequest(daemon, "OPTIONS", "/ops", "https://www.example.com")
+	if rec.Code != 204 {
+		t.Fatalf("expected status 204, got %d", rec.Code)
+	}
+	h := rec.Header()
+	expected := map[string]string{
+		"Access-Control-Allow-Origin":  "https://www.example.com",
+		"Access-Control-Allow-Methods": "GET, HEAD, OPTIONS, POST",
+		"Access-Control-Allow-Headers": "Authorization, Last-Event-ID",
+		"Access-Control-Max-Age":       "600",
+	}
+	for header, value := range expected {
+		if h.Get(header) != value {
+			t.Errorf("expected %s: %s, got %q", header, value, h.Get(header))
+		}
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("a preflight response must have no body, got %q", rec.Body.String())
+	}
+
+	// The preflight is answered without headers for a disallowed origin, the browser
+	// then refuses to send the actual request
+	rec = testCORSRequest(daemon, "OPTIONS", "/ops", "https://evil.example.net")
+	if rec.Code != 204 {
+		t.Fatalf("expected status 204, got %d", rec.Code)
+	}
+	if o := rec.Header().Get("Access-Control-Allow-Origin"); o != "" {
+		t.Errorf("no allowed origin expected, got %q", o)
+	}
+
+	// Preflights for unknown endpoints are not found
+	if rec = testCORSRequest(daemon, "OPTIONS", "/unknown", "https://www.example.com"); rec.Code != 404 {
+		t.Errorf("expected status 404, got %d", rec.Code)
+	}
+
+	// Errors of the actual request carry the CORS headers so the browser can read them
+	rec = testCORSRequest(daemon, "GET", "/ops", "https://www.example.com")
+	if rec.Code != 401 {
+		t.Fatalf("expected status 401, got %d", rec.Code)
+	}
+	if o := rec.Header().Get("Access-Control-Allow-Origin"); o != "https://www.example.com" {
+		t.Errorf("expected the origin to be allowed on errors, got %q", o)
+	}
+}
@@ -0,0 +1,215 @@
+package oplog
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// DiffAction is the action fixing an object of the oplog so it matches the source
+// database, see DiffStream
+type DiffAction int
+
+const (
+	// DiffCreate is decided for the objects of the source missing from the oplog
+	DiffCreate DiffAction = iota
+	// DiffUpdate is decided for the objects more recent in the source than in the oplog
+	DiffUpdate
+	// DiffDelete is decided for the objects of the oplog missing from the source
+	DiffDelete
+)
+
+// String returns the event of the operation performing the action
+func (a DiffAction) String() string {
+	switch a {
+	case DiffCreate:
+		return "create"
+	case DiffUpdate:
+		return "update"
+	case DiffDelete:
+		return "delete"
+	}
+	return fmt.Sprintf("DiffAction(%d)", int(a))
+}
+
+// rawStateIterator decodes the object states of a MongoDB iterator with
+// decodeObjectState, stopping at the first one which can't be decoded
+type rawStateIterator struct {
+	iter *mgo.Iter
+	err  error
+}
+
+// Next decodes the next object state into result, an *objectState
+func (it *rawStateIterator) Next(result interface{}) bool {
+	raw := bson.Raw{}
+	if !it.iter.Next(&raw) {
+		return false
+	}
+	obj, err := decodeObjectState(raw)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	*result.(*objectState) = *obj
+	return true
+}
+
+// Close closes the MongoDB iterator and returns its error or the decoding one
+func (it *rawStateIterator) Close() error {
+	if err := it.iter.Close(); err != nil {
+		return err
+	}
+	return it.err
+}
+
+// DiffStream decides like Diff the actions fixing the delta between the source database
+// and the oplog, without holding the source in memory. The objects of the source must be
+// sent sorted by their OperationData.GetID, "<type>/<id>", in byte-wise order, as they
+// are merged with a scan of the object states sorted by id. An error is returned when
+// the source is not sorted, or has duplicates.
+//
+// The handler is called with each action as soon as it is decided, in the order of the
+// ids, except for the deletions of the objects modified after the most recent object of
+// the source read so far: as the objects absent from the source are only deleted if
+// older than its most recent object, their deletion is decided once the source is
+// closed. The deletion is given the data of the object state.
+//
+// The diff is restricted to the objects matching the filter, with the semantics of the
+// filter of Tail, the other objects of the oplog being left untouched. The objects of the
+// source must match it too, an error being returned otherwise as they would be created
+// again. As a diff applies to objects rather than to operations, the filter can't have
+// events.
+//
+// DiffStream stops at the first error of the handler and returns it, without reading the
+// rest of the source: the sender must not block on it forever.
+func (oplog *OpLog) DiffStream(filter Filter, source <-chan OperationData, handler func(action DiffAction, data OperationData) error) error {
+	if len(filter.Events) > 0 {
+		return errors.New("a diff filter can't have events")
+	}
+	query := bson.M{}
+	filter.apply(&query)
+	var iter stateIterator
+	if oplog.openStates != nil {
+		iter = oplog.openStates(query)
+	} else {
+		db := oplog.db()
+		defer db.Session.Close()
+		iter = &rawStateIterator{iter: db.C("oplog_states").Find(query).Sort("_id").Iter()}
+	}
+	start := time.Now()
+	defer func() {
+		oplog.observeMongo("diff", time.Since(start))
+	}()
+
+	// The iterator is closed once exhausted so its errors are known before deciding the
+	// creation of the objects following the last state
+	var obs *objectState
+	more := true
+	next := func() error {
+		obs = &objectState{}
+		if more = iter.Next(obs); !more {
+			if err := iter.Close(); err != nil {
+				oplog.countUnknownVersion(err)
+				return err
+			}
+		}
+		return nil
+	}
+	if err := next(); err != nil {
+		return err
+	}
+	// The most recent timestamp of the source read so far
+	dumpTime := time.Unix(0, 0)
+	// The objects only in the oplog modified after dumpTime, decided at the end
+	pending := []OperationData{}
+	onlyInOplog := func(obs *objectState) error {
+		if obs.Event == "delete" {
+			return nil
+		}
+		// The object is only deleted if older than the most recent object of the source
+		// in order to ensure we don't delete an object which have been created between
+		// the dump creation and the sync
+		if !obs.Data.Timestamp.Before(dumpTime) {
+			pending = append(pending, *obs.Data)
+			return nil
+		}
+		return handler(DiffDelete, *obs.Data)
+	}
+	inBoth := func(obs *objectState, obd OperationData) error {
+		if obs.Event == "delete" {
+			// If the object is present in the dump but deleted in the oplog, it means that
+			// it has been deleted between the dump creation and the sync (if the oplog
+			// version is more recent)
+			if obd.Timestamp.Before(obs.Data.Timestamp) {
+				return nil
+			}
+			return handler(DiffCreate, obd)
+		}
+		// If the dump object is newer than oplog's, it must be updated
+		if obs.Data.Timestamp.Before(obd.Timestamp) {
+			return handler(DiffUpdate, obd)
+		}
+		return nil
+	}
+
+	fail := func(err error) error {
+		if more {
+			iter.Close()
+		}
+		return err
+	}
+	prev := ""
+	for obd := range source {
+		id := obd.GetID()
+		if !filter.match(&obd) {
+			return fail(fmt.Errorf("source object %s outside of the filter", id))
+		}
+		if prev != "" && id <= prev {
+			return fail(fmt.Errorf("source not sorted by id: %s after %s", id, prev))
+		}
+		prev = id
+		if obd.Timestamp.After(dumpTime) {
+			dumpTime = obd.Timestamp
+		}
+		for more && obs.ID < id {
+			if err := onlyInOplog(obs); err != nil {
+				return fail(err)
+			}
+			if err := next(); err != nil {
+				return err
+			}
+		}
+		if !more || obs.ID != id {
+			if err := handler(DiffCreate, obd); err != nil {
+				return fail(err)
+			}
+			continue
+		}
+		if err := inBoth(obs, obd); err != nil {
+			return fail(err)
+		}
+		if err := next(); err != nil {
+			return err
+		}
+	}
+	for more {
+		if err := onlyInOplog(obs); err != nil {
+			return fail(err)
+		}
+		if err := next(); err != nil {
+			return err
+		}
+	}
+
+	for _, obd := range pending {
+		if obd.Timestamp.Before(dumpTime) {
+			if err := handler(DiffDelete, obd); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
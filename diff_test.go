@@ -0,0 +1,235 @@
+package oplog
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// newTestDiffOpLog returns an oplog whose object states are the given ones
+func newTestDiffOpLog(states []objectState) *OpLog {
+	ol := newTestOpLog()
+	stats := *ol.Stats
+	stats.MongoDurations = NewHistograms(mongoBuckets...)
+	ol.Stats = &stats
+	sorted := append([]objectState{}, states...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+	ol.openStates = func(query bson.M) stateIterator {
+		return &slowStateIterator{states: sorted}
+	}
+	return ol
+}
+
+// sendSource sends the objects to a buffered source channel and closes it
+func sendSource(objects ...OperationData) chan OperationData {
+	source := make(chan OperationData, len(objects))
+	for _, obd := range objects {
+		source <- obd
+	}
+	close(source)
+	return source
+}
+
+// diffTestData returns the data of a video modified at the given second
+func diffTestData(id string, sec int64) OperationData {
+	return OperationData{Timestamp: time.Unix(sec, 0), Type: "video", ID: id}
+}
+
+// diffTestState returns the state of an object given its data
+func diffTestState(event string, data OperationData) objectState {
+	return objectState{ID: data.GetID(), Event: event, Timestamp: data.Timestamp, Data: &data}
+}
+
+func TestDiffStream(t *testing.T) {
+	user := OperationData{Timestamp: time.Unix(15, 0), Type: "user", ID: "1"}
+	ol := newTestDiffOpLog([]objectState{
+		diffTestState("insert", user),
+		diffTestState("insert", diffTestData("1", 10)),
+		diffTestState("insert", diffTestData("2", 10)),
+		diffTestState("insert", diffTestData("4", 5)),
+		diffTestState("insert", diffTestData("5", 100)),
+		diffTestState("delete", diffTestData("6", 30)),
+		diffTestState("delete", diffTestData("7", 10)),
+		diffTestState("insert", diffTestData("9", 25)),
+	})
+	source := []OperationData{
+		// Identical on both sides
+		diffTestData("1", 10),
+		// More recent in the source
+		diffTestData("2", 20),
+		// Only in the source
+		diffTestData("3", 20),
+		// Deleted after the dump
+		diffTestData("6", 20),
+		// Deleted before the dump
+		diffTestData("7", 20),
+		diffTestData("8", 30),
+	}
+	actions := []string{}
+	err := ol.DiffStream(Filter{}, sendSource(source...), func(action DiffAction, data OperationData) error {
+		actions = append(actions, action.String()+" "+data.GetID())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"update video/2",
+		"create video/3",
+		// Older than the most recent object of the source read so far
+		"delete video/4",
+		"create video/7",
+		"create video/8",
+		"delete video/9",
+		// Modified after the most recent object read before it, decided at the end;
+		// video/5 is more recent than the whole source
+		"delete user/1",
+	}
+	if !reflect.DeepEqual(actions, expected) {
+		t.Errorf("invalid actions:\n%q\nexpected:\n%q", actions, expected)
+	}
+
+	// Diff takes the same decisions from the maps
+	createMap := map[string]OperationData{}
+	for _, obd := range source {
+		createMap[obd.GetID()] = obd
+	}
+	updateMap := map[string]OperationData{}
+	deleteMap := map[string]OperationData{}
+	if err := ol.Diff(Filter{}, createMap, updateMap, deleteMap); err != nil {
+		t.Fatal(err)
+	}
+	keys := func(m map[string]OperationData) []string {
+		ids := []string{}
+		for id := range m {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+	if ids := keys(createMap); !reflect.DeepEqual(ids, []string{"video/3", "video/7", "video/8"}) {
+		t.Errorf("invalid creates: %v", ids)
+	}
+	if ids := keys(updateMap); !reflect.DeepEqual(ids, []string{"video/2"}) || !updateMap["video/2"].Timestamp.Equal(time.Unix(20, 0)) {
+		t.Errorf("invalid updates: %v", updateMap)
+	}
+	if ids := keys(deleteMap); !reflect.DeepEqual(ids, []string{"user/1", "video/4", "video/9"}) || !reflect.DeepEqual(deleteMap["user/1"], user) {
+		t.Errorf("invalid deletes: %v", deleteMap)
+	}
+}
+
+func TestDiffStreamUnsorted(t *testing.T) {
+	ol := newTestDiffOpLog([]objectState{diffTestState("insert", diffTestData("1", 10))})
+	for _, test := range []struct {
+		source  []OperationData
+		actions int
+		err     string
+	}{
+		{[]OperationData{diffTestData("2", 10), diffTestData("1", 10)}, 1, "source not sorted by id: video/1 after video/2"},
+		{[]OperationData{diffTestData("1", 10), diffTestData("3", 10), diffTestData("3", 20)}, 1, "source not sorted by id: video/3 after video/3"},
+		// The ids are compared byte-wise, as sorted by MongoDB
+		{[]OperationData{diffTestData("a", 10), diffTestData("B", 10)}, 1, "source not sorted by id: video/B after video/a"},
+	} {
+		actions := 0
+		err := ol.DiffStream(Filter{}, sendSource(test.source...), func(action DiffAction, data OperationData) error {
+			actions++
+			return nil
+		})
+		if err == nil || err.Error() != test.err {
+			t.Errorf("expected %s, got %v", test.err, err)
+		}
+		if actions != test.actions {
+			t.Errorf("%s: expected %d actions before the error, got %d", test.err, test.actions, actions)
+		}
+	}
+}
+
+func TestDiffStreamHandlerError(t *testing.T) {
+	ol := newTestDiffOpLog([]objectState{diffTestState("insert", diffTestData("2", 5))})
+	source := sendSource(diffTestData("1", 10), diffTestData("3", 10), diffTestData("4", 10))
+	errAbort := errors.New("abort")
+	actions := []string{}
+	err := ol.DiffStream(Filter{}, source, func(action DiffAction, data OperationData) error {
+		actions = append(actions, action.String()+" "+data.GetID())
+		return errAbort
+	})
+	if err != errAbort {
+		t.Errorf("expected the handler error, got %v", err)
+	}
+	if !reflect.DeepEqual(actions, []string{"create video/1"}) {
+		t.Errorf("invalid actions: %q", actions)
+	}
+	// The rest of the source is not read
+	if len(source) != 2 {
+		t.Errorf("expected 2 objects left in the source, got %d", len(source))
+	}
+}
+
+func TestDiffStreamFilter(t *testing.T) {
+	filter, err := NewFilter().Types("video").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := OperationData{Timestamp: time.Unix(5, 0), Type: "user", ID: "1"}
+	ol := newTestDiffOpLog([]objectState{
+		diffTestState("insert", user),
+		diffTestState("insert", diffTestData("1", 5)),
+		diffTestState("insert", diffTestData("2", 10)),
+	})
+	unfiltered := ol.openStates
+	ol.openStates = func(query bson.M) stateIterator {
+		// The states are queried like the operations of a tail with the same filter
+		tl := ol.newTailer(filter, TailOptions{}, nil, false)
+		if expected := tl.prepareLiveQuery(nil); !reflect.DeepEqual(query, expected) {
+			t.Errorf("invalid query %v, expected %v", query, expected)
+		}
+		states := []objectState{}
+		for it := unfiltered(query).(*slowStateIterator); len(it.states) > 0; it.states = it.states[1:] {
+			if filter.match(it.states[0].Data) {
+				states = append(states, it.states[0])
+			}
+		}
+		return &slowStateIterator{states: states}
+	}
+	diff := func(filter Filter, source ...OperationData) ([]string, error) {
+		actions := []string{}
+		err := ol.DiffStream(filter, sendSource(source...), func(action DiffAction, data OperationData) error {
+			actions = append(actions, action.String()+" "+data.GetID())
+			return nil
+		})
+		return actions, err
+	}
+
+	// The objects of the other types are left untouched
+	actions, err := diff(filter, diffTestData("2", 10), diffTestData("3", 20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"delete video/1", "create video/3"}; !reflect.DeepEqual(actions, expected) {
+		t.Errorf("invalid actions %q, expected %q", actions, expected)
+	}
+	ol.openStates = unfiltered
+	if actions, _ := diff(Filter{}, diffTestData("2", 10), diffTestData("3", 20)); len(actions) != 3 || actions[0] != "delete user/1" {
+		t.Errorf("invalid unfiltered actions %q", actions)
+	}
+
+	// The source must match the filter
+	if _, err := diff(filter, diffTestData("2", 10), OperationData{Timestamp: time.Unix(20, 0), Type: "user", ID: "3"}); err == nil || err.Error() != "source object user/3 outside of the filter" {
+		t.Errorf("expected an out of filter error, got %v", err)
+	}
+	eventsFilter, _ := NewFilter().Types("video").Events("insert").Build()
+	if _, err := diff(eventsFilter, diffTestData("2", 10)); err == nil {
+		t.Error("expected an error for a filter with events")
+	}
+
+	// Diff applies the filter too
+	createMap := map[string]OperationData{"video/2": diffTestData("2", 10), "user/3": {Timestamp: time.Unix(20, 0), Type: "user", ID: "3"}}
+	deleteMap := map[string]OperationData{}
+	if err := ol.Diff(filter, createMap, map[string]OperationData{}, deleteMap); err == nil || len(createMap) != 2 || len(deleteMap) != 0 {
+		t.Errorf("expected an error leaving the maps as is, got %v, %v, %v", err, createMap, deleteMap)
+	}
+}
@@ -0,0 +1,190 @@
+package oplog
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Encoder frames the events of a stream for the clients, see SSEDaemon.RegisterEncoder.
+// The events are framed from their id, name and data, see GenericEvent, their ids being
+// already signed or fingerprinted. Encode must transmit the id of the events having one,
+// the clients resuming from the last id they received with the Last-Event-ID header or
+// the last_event_id query-string parameter. The events without id, like the heartbeats
+// sent after KeepaliveInterval without events, must not change the resume point.
+type Encoder interface {
+	// ContentType returns the Content-Type of the streams, its media type being matched
+	// against the Accept header of the requests
+	ContentType() string
+	// Encode writes an event to the stream
+	Encode(ev GenericEvent, w io.Writer) error
+}
+
+// sseEncoder is the Server Sent Event framing, see writeSSE
+type sseEncoder struct{}
+
+// ContentType returns the SSE Content-Type
+func (sseEncoder) ContentType() string {
+	return "text/event-stream; charset=utf-8"
+}
+
+// Encode writes the SSE representation of the event
+func (sseEncoder) Encode(ev GenericEvent, w io.Writer) error {
+	_, err := writeSSE(w, ev)
+	return err
+}
+
+// writeSSE frames an event as a SSE message with a single write: an id field if the event
+// has an id, the event field and a data field per line of its data. The events without
+// name are written as comments, the heartbeats as a single colon line.
+func writeSSE(w io.Writer, ev GenericEvent) (int64, error) {
+	data, err := ev.EventData()
+	if err != nil {
+		return 0, err
+	}
+	b := bytes.Buffer{}
+	name := ev.EventName()
+	switch {
+	case name == "" && len(data) == 0:
+		b.WriteString(":\n")
+	case name == "":
+		b.WriteString(": ")
+		b.Write(data)
+		b.WriteString("\n\n")
+	default:
+		if id := ev.GetEventID().String(); id != "" {
+			b.WriteString("id: ")
+			b.WriteString(id)
+			b.WriteByte('\n')
+		}
+		b.WriteString("event: ")
+		b.WriteString(name)
+		b.WriteByte('\n')
+		if len(data) > 0 {
+			for _, line := range bytes.Split(data, []byte{'\n'}) {
+				b.WriteString("data: ")
+				b.Write(line)
+				b.WriteByte('\n')
+			}
+		}
+		b.WriteByte('\n')
+	}
+	n, err := w.Write(b.Bytes())
+	return int64(n), err
+}
+
+// ndjsonEncoder writes each event as a line of JSON with its id, event and data fields,
+// as the WebSocket messages. The events without JSON representation, like the
+// heartbeats, are written as empty lines.
+type ndjsonEncoder struct{}
+
+// ContentType returns the NDJSON Content-Type
+func (ndjsonEncoder) ContentType() string {
+	return "application/x-ndjson"
+}
+
+// Encode writes the event as a line of JSON
+func (ndjsonEncoder) Encode(ev GenericEvent, w io.Writer) error {
+	msg, err := eventJSON(ev)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(msg, '\n'))
+	return err
+}
+
+// heartbeat is sent after KeepaliveInterval without events to keep the connection open.
+// It is serialized as an empty SSE comment.
+type heartbeat struct{}
+
+// GetEventID returns an empty id as a heartbeat must not be used for resume
+func (heartbeat) GetEventID() LastID {
+	i := genericLastID("")
+	return &i
+}
+
+// EventName returns an empty name as a heartbeat is a comment
+func (heartbeat) EventName() string {
+	return ""
+}
+
+// EventData returns no data as a heartbeat is an empty comment
+func (heartbeat) EventData() ([]byte, error) {
+	return nil, nil
+}
+
+// WriteTo serializes a heartbeat as a SSE comment
+func (h heartbeat) WriteTo(w io.Writer) (int64, error) {
+	return writeSSE(w, h)
+}
+
+// notice is a technical event without id with a plain text data, like the "goodbye"
+// event sent on shutdown
+type notice struct {
+	event string
+	data  string
+}
+
+// GetEventID returns an empty id as a notice must not be used for resume
+func (n notice) GetEventID() LastID {
+	i := genericLastID("")
+	return &i
+}
+
+// EventName returns the name of the notice
+func (n notice) EventName() string {
+	return n.event
+}
+
+// EventData returns the plain text data of the notice
+func (n notice) EventData() ([]byte, error) {
+	return []byte(n.data), nil
+}
+
+// WriteTo serializes a notice as a SSE compatible message
+func (n notice) WriteTo(w io.Writer) (int64, error) {
+	return writeSSE(w, n)
+}
+
+// RegisterEncoder registers an encoder the clients can select by name with the format
+// query-string parameter, or by its media type with the Accept header. The "sse" and
+// "ndjson" encoders are registered by default, the SSE retry directives being only sent
+// by the built-in "sse" encoder. It must be called before the daemon starts serving.
+func (daemon *SSEDaemon) RegisterEncoder(name string, enc Encoder) {
+	daemon.encoders[name] = enc
+}
+
+// encoder returns the encoder of a stream, selected by the format query-string parameter
+// or else by the Accept header
+func (daemon *SSEDaemon) encoder(r *http.Request) (Encoder, *streamError) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		enc, found := daemon.encoders[format]
+		if !found {
+			return nil, &streamError{400, "invalid_parameter", fmt.Sprintf("invalid format: %s", format)}
+		}
+		return enc, nil
+	}
+	names := make([]string, 0, len(daemon.encoders))
+	for name := range daemon.encoders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	mediaTypes := make([]string, 0, len(names))
+	for _, name := range names {
+		mediaType, _, _ := mime.ParseMediaType(daemon.encoders[name].ContentType())
+		mediaTypes = append(mediaTypes, mediaType)
+	}
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		accepted, _, _ = mime.ParseMediaType(accepted)
+		for i, mediaType := range mediaTypes {
+			if accepted != "" && accepted == mediaType {
+				return daemon.encoders[names[i]], nil
+			}
+		}
+	}
+	return nil, &streamError{406, "not_acceptable", "the Accept header must be one of " + strings.Join(mediaTypes, ", ")}
+}
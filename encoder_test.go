@@ -0,0 +1,110 @@
+package oplog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// lineEncoder is a toy encoder writing "<id> <event>" lines, ignoring the data
+type lineEncoder struct{}
+
+func (lineEncoder) ContentType() string {
+	return "text/x-oplog-lines"
+}
+
+func (lineEncoder) Encode(ev GenericEvent, w io.Writer) error {
+	if ev.EventName() == "" {
+		return nil
+	}
+	id := ev.GetEventID().String()
+	if id == "" {
+		id = "-"
+	}
+	_, err := fmt.Fprintf(w, "%s %s\n", id, ev.EventName())
+	return err
+}
+
+func TestGetOpsCustomEncoder(t *testing.T) {
+	ops := newTestOperations(2)
+	daemon := newTestSSEOpsDaemon(ops)
+	daemon.SigningKey = []byte("key")
+	daemon.ReconnectDelay = time.Second
+	daemon.RegisterEncoder("lines", lineEncoder{})
+	expected := signID(daemon.SigningKey, "1") + " reset\n" + signID(daemon.SigningKey, ops[0].ID.Hex()) + " insert\n" + signID(daemon.SigningKey, ops[1].ID.Hex()) + " insert\n"
+
+	for _, test := range []struct {
+		query  string
+		accept string
+	}{
+		{"", "text/x-oplog-lines"},
+		{"", "application/json, text/x-oplog-lines; q=0.9"},
+		{"&format=lines", ""},
+		{"&format=lines", "text/event-stream"},
+	} {
+		req := httptest.NewRequest("GET", "/ops?since=1423995187000&limit=2"+test.query, nil)
+		req.Header.Set("Accept", test.accept)
+		rec := httptest.NewRecorder()
+		daemon.ServeHTTP(rec, req)
+		if rec.Code != 200 || rec.Header().Get("Content-Type") != "text/x-oplog-lines" {
+			t.Errorf("%s %s: invalid response: %d %s", test.query, test.accept, rec.Code, rec.Header().Get("Content-Type"))
+		}
+		// The stream ends with an "end" event giving the last id to resume from, without
+		// SSE retry directive
+		if body := rec.Body.String(); body != expected+signID(daemon.SigningKey, ops[1].ID.Hex())+" end\n" {
+			t.Errorf("%s %s: invalid stream:\n%s", test.query, test.accept, body)
+		}
+	}
+}
+
+func TestGetOpsNDJSON(t *testing.T) {
+	ops := newTestOperations(1)
+	daemon := newTestSSEOpsDaemon(ops)
+	req := httptest.NewRequest("GET", "/ops?since=1423995187000&limit=1", nil)
+	req.Header.Set("Accept", "application/x-ndjson")
+	rec := httptest.NewRecorder()
+	daemon.ServeHTTP(rec, req)
+	if rec.Code != 200 || rec.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("invalid response: %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	op, _ := json.Marshal(ops[0])
+	expected := `{"id":"1","event":"reset"}` + "\n" + string(op) + "\n" + `{"id":"` + ops[0].ID.Hex() + `","event":"end"}` + "\n"
+	if rec.Body.String() != expected {
+		t.Errorf("invalid stream:\n%s\nexpected:\n%s", rec.Body.String(), expected)
+	}
+
+	// Heartbeats are empty lines, notices have a string data
+	b := &bytes.Buffer{}
+	ndjsonEncoder{}.Encode(heartbeat{}, b)
+	ndjsonEncoder{}.Encode(notice{"goodbye", "shutdown"}, b)
+	if b.String() != "\n"+`{"event":"goodbye","data":"shutdown"}`+"\n" {
+		t.Errorf("invalid technical events: %q", b.String())
+	}
+}
+
+func TestEncoderSelectionErrors(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	for _, test := range []struct {
+		query   string
+		accept  string
+		status  int
+		message string
+	}{
+		{"", "text/html", 406, "the Accept header must be one of application/x-ndjson, text/event-stream"},
+		{"", "", 406, "the Accept header must be one of application/x-ndjson, text/event-stream"},
+		{"?format=msgpack", "text/event-stream", 400, "invalid format: msgpack"},
+	} {
+		req := httptest.NewRequest("GET", "/ops"+test.query, nil)
+		req.Header.Set("Accept", test.accept)
+		rec := httptest.NewRecorder()
+		daemon.ServeHTTP(rec, req)
+		if rec.Code != test.status || !strings.Contains(rec.Body.String(), test.message) {
+			t.Errorf("%s %s: expected %d %s, got %d %s", test.query, test.accept, test.status, test.message, rec.Code, rec.Body.String())
+		}
+	}
+}
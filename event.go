@@ -1,25 +1,59 @@
 package oplog
 
 import (
-	"fmt"
+	"encoding/json"
 	"io"
+	"strconv"
 	"time"
 )
 
-// GenericEvent is an interface used by the oplog to send different kinds of
-// SSE compatible events
+// GenericEvent is an interface used by the oplog to send different kinds of events to
+// the clients, whatever their transport. The transports frame the events from their id,
+// name and data, WriteTo serializing them as SSE messages, see writeSSE.
 type GenericEvent interface {
 	io.WriterTo
+	// GetEventID returns the id the clients resume from, empty for the events which must
+	// not change their resume point
 	GetEventID() LastID
+	// EventName returns the name of the event, empty for the events only sent as SSE
+	// comments, like the heartbeats
+	EventName() string
+	// EventData returns the data of the event, JSON but for the notices and comments
+	// given as plain text, nil if the event has none
+	EventData() ([]byte, error)
 }
 
+// The events sent to the clients
+var (
+	_ GenericEvent = Operation{}
+	_ GenericEvent = objectState{}
+	_ GenericEvent = Event{}
+	_ GenericEvent = Checkpoint{}
+	_ GenericEvent = Fallback{}
+	_ GenericEvent = Queued{}
+	_ GenericEvent = Warning{}
+	_ GenericEvent = Hello{}
+	_ GenericEvent = heartbeat{}
+	_ GenericEvent = notice{}
+	_ GenericEvent = fingerprinted{}
+	_ GenericEvent = withPayload{}
+	_ GenericEvent = signed{}
+)
+
 // genericLastID stores an arbitrary event id
 type genericLastID string
 
-// Event is used to send "technical" events with no data like "reset" or "live"
+// Event is used to send "technical" events like "reset" or "live"
 type Event struct {
 	ID    string
 	Event string
+	// Data is sent as the JSON data of the event when not nil, like the number of
+	// replication pages in the "live" event ending a replication. Without data, the
+	// event has no data field.
+	Data interface{}
+	// Metadata is sent as the JSON data of the event when Data is nil and it is not
+	// empty. It is kept for compatibility, Data being preferred.
+	Metadata map[string]interface{}
 }
 
 // GetEventID returns an SSE event id
@@ -28,10 +62,270 @@ func (e Event) GetEventID() LastID {
 	return &i
 }
 
+// EventName returns the name of the event
+func (e Event) EventName() string {
+	return e.Event
+}
+
+// EventData returns the data of the event, or else its metadata, if any
+func (e Event) EventData() ([]byte, error) {
+	if e.Data != nil {
+		return json.Marshal(e.Data)
+	}
+	if len(e.Metadata) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(e.Metadata)
+}
+
 // WriteTo serializes an event as a SSE compatible message
 func (e Event) WriteTo(w io.Writer) (int64, error) {
-	n, err := fmt.Fprintf(w, "id: %s\nevent: %s\n\n", e.GetEventID(), e.Event)
-	return int64(n), err
+	return writeSSE(w, e)
+}
+
+// Checkpoint is periodically sent during live tailing to let consumers persist their
+// resume point and measure their lag even when no operation is streamed. Its id is
+// the id of the last streamed event so it does not disturb the resume logic.
+type Checkpoint struct {
+	ID   string
+	Time time.Time
+}
+
+// GetEventID returns an SSE event id
+func (c Checkpoint) GetEventID() LastID {
+	i := genericLastID(c.ID)
+	return &i
+}
+
+// EventName returns the name of the checkpoint events
+func (c Checkpoint) EventName() string {
+	return "checkpoint"
+}
+
+// EventData returns the time of the checkpoint
+func (c Checkpoint) EventData() ([]byte, error) {
+	return json.Marshal(struct {
+		Time time.Time `json:"time"`
+	}{c.Time})
+}
+
+// WriteTo serializes a checkpoint as a SSE compatible message
+func (c Checkpoint) WriteTo(w io.Writer) (int64, error) {
+	return writeSSE(w, c)
+}
+
+// Fallback is sent before a fallback replication, when the operation id to resume from
+// is no longer in the capped collection. The object states modified since the fallback
+// time are then sent, deleted ones included, before switching back to live updates. Its
+// id is the requested id so the fallback is performed again if the stream is interrupted
+// before any object state is received.
+type Fallback struct {
+	ID   string
+	Time time.Time
+}
+
+// GetEventID returns an SSE event id
+func (f Fallback) GetEventID() LastID {
+	i := genericLastID(f.ID)
+	return &i
+}
+
+// EventName returns the name of the fallback events
+func (f Fallback) EventName() string {
+	return "fallback"
+}
+
+// EventData returns the requested id and the time the fallback replication starts from
+func (f Fallback) EventData() ([]byte, error) {
+	return json.Marshal(struct {
+		RequestedID string    `json:"requested_id"`
+		Time        time.Time `json:"time"`
+	}{f.ID, f.Time})
+}
+
+// WriteTo serializes a fallback event as a SSE compatible message
+func (f Fallback) WriteTo(w io.Writer) (int64, error) {
+	return writeSSE(w, f)
+}
+
+// Queued is periodically sent while a replication waits for a slot to be released,
+// giving its position in the replication queue. It is serialized as an SSE comment so
+// it does not change the consumer's resume point.
+type Queued struct {
+	Position int
+}
+
+// GetEventID returns an empty id as a Queued event must not be used for resume
+func (q Queued) GetEventID() LastID {
+	i := genericLastID("")
+	return &i
+}
+
+// EventName returns an empty name as a Queued event is a comment
+func (q Queued) EventName() string {
+	return ""
+}
+
+// EventData returns the text of the comment
+func (q Queued) EventData() ([]byte, error) {
+	return []byte("queued " + strconv.Itoa(q.Position)), nil
+}
+
+// WriteTo serializes a Queued event as a SSE comment
+func (q Queued) WriteTo(w io.Writer) (int64, error) {
+	return writeSSE(w, q)
+}
+
+// Warning notifies the client that its request is not honored as is, without ending the
+// stream. It has no id so it does not change the consumer's resume point.
+type Warning struct {
+	Code    string
+	Message string
+}
+
+// GetEventID returns an empty id as a Warning event must not be used for resume
+func (e Warning) GetEventID() LastID {
+	i := genericLastID("")
+	return &i
+}
+
+// EventName returns the name of the warning events
+func (e Warning) EventName() string {
+	return "warning"
+}
+
+// EventData returns the code and message of the warning
+func (e Warning) EventData() ([]byte, error) {
+	return json.Marshal(struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}{e.Code, e.Message})
+}
+
+// WriteTo serializes a Warning event as a SSE compatible message
+func (e Warning) WriteTo(w io.Writer) (int64, error) {
+	return writeSSE(w, e)
+}
+
+// Hello is sent at the start of a stream to let the client know the server time, the
+// head of the oplog and how the stream starts (live, replication or fallback). It has no
+// id so it does not change the consumer's resume point.
+type Hello struct {
+	Time       time.Time
+	NewestID   string
+	NewestTime time.Time
+	Mode       string
+	// Filter is the effective filter of the stream, if it is to be given
+	Filter *Filter
+	// FilteredNewestID and FilteredNewestTime give the newest operation matching the
+	// filter of the stream, if it is to be given
+	FilteredNewestID   string
+	FilteredNewestTime time.Time
+}
+
+// GetEventID returns an empty id as a Hello event must not be used for resume
+func (h Hello) GetEventID() LastID {
+	i := genericLastID("")
+	return &i
+}
+
+// EventName returns the name of the hello events
+func (h Hello) EventName() string {
+	return "hello"
+}
+
+// EventData returns the server time, the head of the oplog and the mode of the stream
+func (h Hello) EventData() ([]byte, error) {
+	hello := struct {
+		ServerTime         time.Time  `json:"server_time"`
+		NewestID           string     `json:"newest_id,omitempty"`
+		NewestTime         *time.Time `json:"newest_time,omitempty"`
+		Mode               string     `json:"mode"`
+		Filter             *Filter    `json:"filter,omitempty"`
+		FilteredNewestID   string     `json:"filtered_newest_id,omitempty"`
+		FilteredNewestTime *time.Time `json:"filtered_newest_time,omitempty"`
+	}{ServerTime: h.Time, NewestID: h.NewestID, Mode: h.Mode, Filter: h.Filter, FilteredNewestID: h.FilteredNewestID}
+	if !h.NewestTime.IsZero() {
+		hello.NewestTime = &h.NewestTime
+	}
+	if !h.FilteredNewestTime.IsZero() {
+		hello.FilteredNewestTime = &h.FilteredNewestTime
+	}
+	return json.Marshal(hello)
+}
+
+// WriteTo serializes a Hello event as a SSE compatible message
+func (h Hello) WriteTo(w io.Writer) (int64, error) {
+	return writeSSE(w, h)
+}
+
+// fingerprinted wraps an event to append the fingerprint of the stream filter to its id,
+// so the filter change can be detected when a client resumes the stream.
+type fingerprinted struct {
+	GenericEvent
+	fingerprint string
+}
+
+// GetEventID returns the "<id>.<fingerprint>" id of the wrapped event, if it has an id
+func (f fingerprinted) GetEventID() LastID {
+	return rewriteID(f.GenericEvent, func(id string) string {
+		return id + "." + f.fingerprint
+	})
+}
+
+// WriteTo serializes the wrapped event with its fingerprinted id
+func (f fingerprinted) WriteTo(w io.Writer) (int64, error) {
+	return writeSSE(w, f)
+}
+
+// withPayload wraps an event to serialize the operation or object state with the payload
+// of its data, see OperationData.Payload
+type withPayload struct {
+	GenericEvent
+}
+
+// EventData returns the data of the wrapped event with its payload
+func (p withPayload) EventData() ([]byte, error) {
+	switch ev := p.GenericEvent.(type) {
+	case Operation:
+		return ev.Data.marshal(true)
+	case objectState:
+		return ev.Data.marshal(true)
+	}
+	return p.GenericEvent.EventData()
+}
+
+// WriteTo serializes the wrapped event with its payload
+func (p withPayload) WriteTo(w io.Writer) (int64, error) {
+	return writeSSE(w, p)
+}
+
+// signed wraps an event to append the signature of its id, see SSEDaemon.SigningKey
+type signed struct {
+	GenericEvent
+	key []byte
+}
+
+// GetEventID returns the "<id>.<signature>" id of the wrapped event, if it has an id
+func (s signed) GetEventID() LastID {
+	return rewriteID(s.GenericEvent, func(id string) string {
+		return signID(s.key, id)
+	})
+}
+
+// WriteTo serializes the wrapped event with its signed id
+func (s signed) WriteTo(w io.Writer) (int64, error) {
+	return writeSSE(w, s)
+}
+
+// rewriteID returns the id of an event replaced by rewrite(id), if it has an id
+func rewriteID(ev GenericEvent, rewrite func(id string) string) LastID {
+	id := ev.GetEventID()
+	if id.String() == "" {
+		return id
+	}
+	i := genericLastID(rewrite(id.String()))
+	return &i
 }
 
 func (gid genericLastID) String() string {
@@ -1,6 +1,13 @@
 package oplog
 
-import "testing"
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
 
 // Version of bytes.Buffer that checks whether WriteTo was called or not
 type writeChecker struct {
@@ -15,7 +22,7 @@ func (wt *writeChecker) Write(b []byte) (int, error) {
 }
 
 func TestOplogEventOutput(t *testing.T) {
-	e := Event{"a", "b"}
+	e := Event{ID: "a", Event: "b"}
 	w := &writeChecker{}
 	n, err := e.WriteTo(w)
 	if err != nil {
@@ -33,8 +40,277 @@ func TestOplogEventOutput(t *testing.T) {
 }
 
 func TestOplogEventId(t *testing.T) {
-	e := Event{"a", "b"}
+	e := Event{ID: "a", Event: "b"}
 	if e.GetEventID().String() != "a" {
 		t.FailNow()
 	}
 }
+
+func TestCheckpointOutput(t *testing.T) {
+	c := Checkpoint{"a", time.Date(2015, 2, 15, 10, 13, 7, 0, time.UTC)}
+	w := &writeChecker{}
+	if _, err := c.WriteTo(w); err != nil {
+		t.Fatal(err)
+	}
+	if string(w.written) != "id: a\nevent: checkpoint\ndata: {\"time\":\"2015-02-15T10:13:07Z\"}\n\n" {
+		t.Fatalf("invalid output: %s", string(w.written))
+	}
+	if c.GetEventID().String() != "a" {
+		t.Fatal("invalid id")
+	}
+}
+
+func TestQueuedOutput(t *testing.T) {
+	q := Queued{3}
+	w := &writeChecker{}
+	if _, err := q.WriteTo(w); err != nil {
+		t.Fatal(err)
+	}
+	if string(w.written) != ": queued 3\n\n" {
+		t.Fatalf("invalid output: %s", string(w.written))
+	}
+}
+
+func TestWarningOutput(t *testing.T) {
+	e := Warning{Code: "events_filter_overridden", Message: "deletes sent"}
+	w := &writeChecker{}
+	if _, err := e.WriteTo(w); err != nil {
+		t.Fatal(err)
+	}
+	if string(w.written) != "event: warning\ndata: {\"code\":\"events_filter_overridden\",\"message\":\"deletes sent\"}\n\n" {
+		t.Fatalf("invalid output: %s", string(w.written))
+	}
+	if id := e.GetEventID().String(); id != "" {
+		t.Errorf("warning must not have an id, got %q", id)
+	}
+}
+
+func TestFingerprintedNoID(t *testing.T) {
+	w := &writeChecker{}
+	// Without id field, the clients keep their resume point
+	fingerprinted{Event{Event: "live"}, "0a1b2c3d"}.WriteTo(w)
+	if string(w.written) != "event: live\n\n" {
+		t.Fatalf("empty id fingerprinted: %s", string(w.written))
+	}
+	w = &writeChecker{}
+	fingerprinted{Queued{1}, "0a1b2c3d"}.WriteTo(w)
+	if string(w.written) != ": queued 1\n\n" {
+		t.Fatalf("comment fingerprinted: %s", string(w.written))
+	}
+}
+
+func TestFallbackOutput(t *testing.T) {
+	f := Fallback{"545b55c7f095528dd0f3863c", time.Date(2014, 11, 6, 11, 4, 39, 0, time.UTC)}
+	w := &writeChecker{}
+	if _, err := f.WriteTo(w); err != nil {
+		t.Fatal(err)
+	}
+	expected := "id: 545b55c7f095528dd0f3863c\nevent: fallback\ndata: {\"requested_id\":\"545b55c7f095528dd0f3863c\",\"time\":\"2014-11-06T11:04:39Z\"}\n\n"
+	if string(w.written) != expected {
+		t.Fatalf("invalid output: %s", string(w.written))
+	}
+}
+
+// TestSSEEventNames checks every event kind is serialized with its name in the SSE
+// event field, so EventSource clients can dispatch them with addEventListener.
+func TestSSEEventNames(t *testing.T) {
+	id := bson.ObjectIdHex("545b55c7f095528dd0f3863c")
+	ts := time.Date(2015, 2, 15, 10, 13, 7, 0, time.UTC)
+	data := &OperationData{Timestamp: ts, Parents: []string{"user/1"}, Type: "video", ID: "x1"}
+	tests := []struct {
+		ev     GenericEvent
+		output string
+	}{
+		{Operation{ID: &id, Event: "insert", Data: data}, "id: 545b55c7f095528dd0f3863c\nevent: insert\ndata: {\"timestamp\":\"2015-02-15T10:13:07.000Z\",\"parents\":[\"user/1\"],\"type\":\"video\",\"id\":\"x1\"}\n\n"},
+		{Operation{ID: &id, Event: "update", Data: data}, "id: 545b55c7f095528dd0f3863c\nevent: update\ndata: {\"timestamp\":\"2015-02-15T10:13:07.000Z\",\"parents\":[\"user/1\"],\"type\":\"video\",\"id\":\"x1\"}\n\n"},
+		{Operation{ID: &id, Event: "delete", Data: data}, "id: 545b55c7f095528dd0f3863c\nevent: delete\ndata: {\"timestamp\":\"2015-02-15T10:13:07.000Z\",\"parents\":[\"user/1\"],\"type\":\"video\",\"id\":\"x1\"}\n\n"},
+		{objectState{ID: "video/x1", Event: "insert", Timestamp: ts, Data: data}, "id: 1423995187000:dmlkZW8veDE\nevent: insert\ndata: {\"timestamp\":\"2015-02-15T10:13:07.000Z\",\"parents\":[\"user/1\"],\"type\":\"video\",\"id\":\"x1\"}\n\n"},
+		{objectState{ID: "video/x1", Event: "delete", Timestamp: ts, Data: data}, "id: 1423995187000:dmlkZW8veDE\nevent: delete\ndata: {\"timestamp\":\"2015-02-15T10:13:07.000Z\",\"parents\":[\"user/1\"],\"type\":\"video\",\"id\":\"x1\"}\n\n"},
+		{Event{ID: "1", Event: "reset"}, "id: 1\nevent: reset\n\n"},
+		{Event{ID: "545b55c7f095528dd0f3863c", Event: "live"}, "id: 545b55c7f095528dd0f3863c\nevent: live\n\n"},
+		{Event{ID: "545b55c7f095528dd0f3863c", Event: "live", Metadata: map[string]interface{}{"pages": 3}}, "id: 545b55c7f095528dd0f3863c\nevent: live\ndata: {\"pages\":3}\n\n"},
+	}
+	for _, test := range tests {
+		b := bytes.Buffer{}
+		if _, err := test.ev.WriteTo(&b); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != test.output {
+			t.Errorf("invalid output:\n%q\nexpected:\n%q", b.String(), test.output)
+		}
+	}
+}
+
+func TestHelloWriteTo(t *testing.T) {
+	now := time.Date(2015, 2, 15, 10, 13, 7, 0, time.UTC)
+	tests := []struct {
+		hello  Hello
+		output string
+	}{
+		{Hello{Time: now, NewestID: "545b55c7f095528dd0f3863c", NewestTime: now.Add(-time.Second), Mode: "live"}, "event: hello\ndata: {\"server_time\":\"2015-02-15T10:13:07Z\",\"newest_id\":\"545b55c7f095528dd0f3863c\",\"newest_time\":\"2015-02-15T10:13:06Z\",\"mode\":\"live\"}\n\n"},
+		// Empty oplog
+		{Hello{Time: now, Mode: "replication"}, "event: hello\ndata: {\"server_time\":\"2015-02-15T10:13:07Z\",\"mode\":\"replication\"}\n\n"},
+		// Effective filter
+		{Hello{Time: now, Mode: "live", Filter: &Filter{Types: []string{"video", "playlist"}, ParentPrefixes: []string{"user/"}}}, "event: hello\ndata: {\"server_time\":\"2015-02-15T10:13:07Z\",\"mode\":\"live\",\"filter\":{\"types\":[\"playlist\",\"video\"],\"parent_prefixes\":[\"user/\"]}}\n\n"},
+		{Hello{Time: now, Mode: "live", Filter: &Filter{}}, "event: hello\ndata: {\"server_time\":\"2015-02-15T10:13:07Z\",\"mode\":\"live\",\"filter\":{}}\n\n"},
+		// Filtered head
+		{Hello{Time: now, Mode: "live", FilteredNewestID: "545b55c7f095528dd0f3863c", FilteredNewestTime: now.Add(-time.Second)}, "event: hello\ndata: {\"server_time\":\"2015-02-15T10:13:07Z\",\"mode\":\"live\",\"filtered_newest_id\":\"545b55c7f095528dd0f3863c\",\"filtered_newest_time\":\"2015-02-15T10:13:06Z\"}\n\n"},
+	}
+	for _, test := range tests {
+		b := bytes.Buffer{}
+		if _, err := test.hello.WriteTo(&b); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != test.output {
+			t.Errorf("invalid output:\n%q\nexpected:\n%q", b.String(), test.output)
+		}
+	}
+	if id := (Hello{}).GetEventID().String(); id != "" {
+		t.Errorf("hello must not have an id, got %q", id)
+	}
+}
+
+// TestGenericEventContract pins the id, name and data of each event kind, and their SSE
+// and JSON framings derived from them
+func TestGenericEventContract(t *testing.T) {
+	id := bson.ObjectIdHex("545b55c7f095528dd0f3863c")
+	ts := time.Date(2015, 2, 15, 10, 13, 7, 0, time.UTC)
+	data := &OperationData{Timestamp: ts, Type: "video", ID: "x1", Payload: map[string]interface{}{"title": "cat"}}
+	op := Operation{ID: &id, Event: "insert", Data: data}
+	tests := []struct {
+		ev   GenericEvent
+		id   string
+		name string
+		data string
+		sse  string
+		json string
+	}{
+		{op, "545b55c7f095528dd0f3863c", "insert", `{"timestamp":"2015-02-15T10:13:07.000Z","parents":[],"type":"video","id":"x1"}`,
+			"id: 545b55c7f095528dd0f3863c\nevent: insert\ndata: {\"timestamp\":\"2015-02-15T10:13:07.000Z\",\"parents\":[],\"type\":\"video\",\"id\":\"x1\"}\n\n",
+			`{"id":"545b55c7f095528dd0f3863c","event":"insert","data":{"timestamp":"2015-02-15T10:13:07.000Z","parents":[],"type":"video","id":"x1"}}`},
+		{objectState{ID: "video/x1", Event: "update", Timestamp: ts, Data: data}, "1423995187000:dmlkZW8veDE", "update", `{"timestamp":"2015-02-15T10:13:07.000Z","parents":[],"type":"video","id":"x1"}`,
+			"id: 1423995187000:dmlkZW8veDE\nevent: update\ndata: {\"timestamp\":\"2015-02-15T10:13:07.000Z\",\"parents\":[],\"type\":\"video\",\"id\":\"x1\"}\n\n",
+			`{"id":"1423995187000:dmlkZW8veDE","event":"update","data":{"timestamp":"2015-02-15T10:13:07.000Z","parents":[],"type":"video","id":"x1"}}`},
+		{withPayload{op}, "545b55c7f095528dd0f3863c", "insert", `{"timestamp":"2015-02-15T10:13:07.000Z","parents":[],"type":"video","id":"x1","payload":{"title":"cat"}}`,
+			"id: 545b55c7f095528dd0f3863c\nevent: insert\ndata: {\"timestamp\":\"2015-02-15T10:13:07.000Z\",\"parents\":[],\"type\":\"video\",\"id\":\"x1\",\"payload\":{\"title\":\"cat\"}}\n\n",
+			`{"id":"545b55c7f095528dd0f3863c","event":"insert","data":{"timestamp":"2015-02-15T10:13:07.000Z","parents":[],"type":"video","id":"x1","payload":{"title":"cat"}}}`},
+		{&Event{ID: "1", Event: "reset"}, "1", "reset", "",
+			"id: 1\nevent: reset\n\n",
+			`{"id":"1","event":"reset"}`},
+		{Event{Event: "retry-later"}, "", "retry-later", "",
+			"event: retry-later\n\n",
+			`{"event":"retry-later"}`},
+		{&Checkpoint{ID: "1", Time: ts}, "1", "checkpoint", `{"time":"2015-02-15T10:13:07Z"}`,
+			"id: 1\nevent: checkpoint\ndata: {\"time\":\"2015-02-15T10:13:07Z\"}\n\n",
+			`{"id":"1","event":"checkpoint","data":{"time":"2015-02-15T10:13:07Z"}}`},
+		{Warning{Code: "c", Message: "m"}, "", "warning", `{"code":"c","message":"m"}`,
+			"event: warning\ndata: {\"code\":\"c\",\"message\":\"m\"}\n\n",
+			`{"event":"warning","data":{"code":"c","message":"m"}}`},
+		{notice{"error", "too slow"}, "", "error", "too slow",
+			"event: error\ndata: too slow\n\n",
+			`{"event":"error","data":"too slow"}`},
+		{Queued{2}, "", "", "queued 2", ": queued 2\n\n", ""},
+		{heartbeat{}, "", "", "", ":\n", ""},
+		{signed{fingerprinted{op, "fp"}, []byte("key")}, signID([]byte("key"), id.Hex()+".fp"), "insert", `{"timestamp":"2015-02-15T10:13:07.000Z","parents":[],"type":"video","id":"x1"}`,
+			"id: " + signID([]byte("key"), id.Hex()+".fp") + "\nevent: insert\ndata: {\"timestamp\":\"2015-02-15T10:13:07.000Z\",\"parents\":[],\"type\":\"video\",\"id\":\"x1\"}\n\n",
+			`{"id":"` + signID([]byte("key"), id.Hex()+".fp") + `","event":"insert","data":{"timestamp":"2015-02-15T10:13:07.000Z","parents":[],"type":"video","id":"x1"}}`},
+		{signed{Warning{Code: "c"}, []byte("key")}, "", "warning", `{"code":"c","message":""}`,
+			"event: warning\ndata: {\"code\":\"c\",\"message\":\"\"}\n\n",
+			`{"event":"warning","data":{"code":"c","message":""}}`},
+	}
+	for _, test := range tests {
+		data, err := test.ev.EventData()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id := test.ev.GetEventID().String(); id != test.id || test.ev.EventName() != test.name || string(data) != test.data {
+			t.Errorf("%T: invalid event: %q %q %q", test.ev, id, test.ev.EventName(), data)
+		}
+		b := bytes.Buffer{}
+		if _, err := test.ev.WriteTo(&b); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != test.sse {
+			t.Errorf("%T: invalid SSE message:\n%q\nexpected:\n%q", test.ev, b.String(), test.sse)
+		}
+		if msg, err := eventJSON(test.ev); err != nil || string(msg) != test.json {
+			t.Errorf("%T: invalid JSON message: %s, expected %s", test.ev, msg, test.json)
+		}
+	}
+
+	// Data spanning several lines is sent in as many data fields
+	b := bytes.Buffer{}
+	notice{"error", "a\nb"}.WriteTo(&b)
+	if b.String() != "event: error\ndata: a\ndata: b\n\n" {
+		t.Errorf("invalid multi-line data: %q", b.String())
+	}
+}
+
+// TestEventDataGolden pins the framings of the synthetic events, with and without data
+func TestEventDataGolden(t *testing.T) {
+	ts := time.Date(2015, 2, 15, 10, 13, 7, 0, time.UTC)
+	tests := []struct {
+		ev     Event
+		sse    string
+		ndjson string
+	}{
+		{Event{ID: "1", Event: "reset"},
+			"id: 1\nevent: reset\n\n",
+			`{"id":"1","event":"reset"}`},
+		{Event{ID: "1", Event: "reset", Data: struct {
+			Reason string `json:"reason"`
+		}{"full"}},
+			"id: 1\nevent: reset\ndata: {\"reason\":\"full\"}\n\n",
+			`{"id":"1","event":"reset","data":{"reason":"full"}}`},
+		{Event{ID: "1423995187000", Event: "live"},
+			"id: 1423995187000\nevent: live\n\n",
+			`{"id":"1423995187000","event":"live"}`},
+		{Event{ID: "1423995187000", Event: "live", Data: map[string]interface{}{"pages": 3}},
+			"id: 1423995187000\nevent: live\ndata: {\"pages\":3}\n\n",
+			`{"id":"1423995187000","event":"live","data":{"pages":3}}`},
+		{Event{ID: "545b55c7f095528dd0f3863c", Event: "end"},
+			"id: 545b55c7f095528dd0f3863c\nevent: end\n\n",
+			`{"id":"545b55c7f095528dd0f3863c","event":"end"}`},
+		{Event{ID: "545b55c7f095528dd0f3863c", Event: "end", Data: map[string]interface{}{"until": ts}},
+			"id: 545b55c7f095528dd0f3863c\nevent: end\ndata: {\"until\":\"2015-02-15T10:13:07Z\"}\n\n",
+			`{"id":"545b55c7f095528dd0f3863c","event":"end","data":{"until":"2015-02-15T10:13:07Z"}}`},
+		{Event{Event: "retry-later"},
+			"event: retry-later\n\n",
+			`{"event":"retry-later"}`},
+		{Event{Event: "retry-later", Data: 30},
+			"event: retry-later\ndata: 30\n\n",
+			`{"event":"retry-later","data":30}`},
+		{Event{ID: "1", Event: "resync-required"},
+			"id: 1\nevent: resync-required\n\n",
+			`{"id":"1","event":"resync-required"}`},
+		{Event{ID: "1", Event: "resync-required", Data: []string{"types"}},
+			"id: 1\nevent: resync-required\ndata: [\"types\"]\n\n",
+			`{"id":"1","event":"resync-required","data":["types"]}`},
+		// Data takes precedence over Metadata
+		{Event{ID: "1", Event: "live", Data: "done", Metadata: map[string]interface{}{"pages": 3}},
+			"id: 1\nevent: live\ndata: \"done\"\n\n",
+			`{"id":"1","event":"live","data":"done"}`},
+		{Event{ID: "1", Event: "live", Metadata: map[string]interface{}{"pages": 3}},
+			"id: 1\nevent: live\ndata: {\"pages\":3}\n\n",
+			`{"id":"1","event":"live","data":{"pages":3}}`},
+	}
+	for _, test := range tests {
+		b := bytes.Buffer{}
+		if _, err := test.ev.WriteTo(&b); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != test.sse {
+			t.Errorf("%s: invalid SSE message:\n%q\nexpected:\n%q", test.ev.Event, b.String(), test.sse)
+		}
+		b.Reset()
+		if err := (ndjsonEncoder{}).Encode(test.ev, &b); err != nil || b.String() != test.ndjson+"\n" {
+			t.Errorf("%s: invalid NDJSON line: %s, expected %s", test.ev.Event, b.String(), test.ndjson)
+		}
+		if msg, err := eventJSON(test.ev); err != nil || string(msg) != test.ndjson {
+			t.Errorf("%s: invalid WebSocket message: %s, expected %s", test.ev.Event, msg, test.ndjson)
+		}
+		if msg, err := json.Marshal(test.ev); err != nil || string(msg) != test.ndjson {
+			t.Errorf("%s: invalid JSON: %s, expected %s", test.ev.Event, msg, test.ndjson)
+		}
+	}
+}
@@ -1,11 +1,246 @@
 package oplog
 
-import "gopkg.in/mgo.v2/bson"
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// FilterChangePolicy defines how a client resuming a stream with a filter different from
+// the one its last event id has been streamed with is handled.
+type FilterChangePolicy int
+
+const (
+	// FilterChangeIgnore resumes the stream with the new filter. The mismatch is only
+	// logged and counted. Events matching a widened filter created before the resume
+	// point are never sent.
+	FilterChangeIgnore FilterChangePolicy = iota
+	// FilterChangeReject refuses the stream with a 409 Conflict error.
+	FilterChangeReject
+	// FilterChangeResync performs a full replication with the new filter.
+	FilterChangeResync
+)
+
+// ParentsMode defines how the parents of a filter are matched. Whatever the mode, the
+// types, parents and other criteria of a filter compose as an AND.
+type ParentsMode int
+
+const (
+	// ParentsAny matches the operations having any of the parents
+	ParentsAny ParentsMode = iota
+	// ParentsAll matches the operations having all the parents
+	ParentsAll
+)
+
+// Default limits of the values of each filter query-string parameter, see ParseFilter
+const (
+	DefaultMaxFilterValues      = 100
+	DefaultMaxFilterValueLength = 256
+)
 
 // Filter contains filter query
 type Filter struct {
-	Types   []string
+	// Types lists the object types to filter on. A type ending with a "*" wildcard
+	// matches all the types starting with the part before the wildcard.
+	Types []string
+	// Parents lists the parents to filter on. Like types, a parent ending with a "*"
+	// wildcard matches all the parents starting with the part before the wildcard.
 	Parents []string
+	// ParentsMode tells if the operations must have any or all the Parents
+	ParentsMode ParentsMode
+	// ParentPrefixes restricts the operations to those with a parent starting with one of
+	// the prefixes
+	ParentPrefixes []string
+	// ExcludeTypes and ExcludeParents drop the operations of any of the types, or having
+	// any of the parents
+	ExcludeTypes   []string
+	ExcludeParents []string
+	// Events lists the operation events to filter on: insert, update, delete or touch. As
+	// the replications only send inserts, they send nothing when insert is not listed.
+	Events []string
+	// Fields restricts the operations to those whose data fields, given by name, are
+	// equal to the values, i.e.: {"pl.country": "fr"} for data.pl.country. The fields are
+	// id, m.<key> or pl.<path>, see ValidateField. Only the fields allowed by the server
+	// can be requested, see SSEDaemon.FilterableFields.
+	Fields map[string]string
+
+	// none is set by Intersect when the filters have no operation in common
+	none bool
+}
+
+// FilterError is returned by ParseFilter when a filter query-string parameter is invalid
+type FilterError struct {
+	// Param is the name of the offending parameter
+	Param   string
+	Message string
+}
+
+func (e *FilterError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Param, e.Message)
+}
+
+// ParseFilter parses the types, parents and events query-string parameters, along with
+// the types_exclude and parents_exclude ones, with the default limits. Values are coma
+// separated, trimmed, and types and parents may end with a wildcard. The field.<name>
+// parameters are parsed only for the names listed in fields.
+func ParseFilter(q url.Values, fields ...string) (Filter, error) {
+	return parseFilter(q, DefaultMaxFilterValues, DefaultMaxFilterValueLength, fields)
+}
+
+// parseFilter parses the filter query-string parameters, refusing parameters with more
+// than maxValues values or values longer than maxLength, and field parameters not listed
+// in fields. A limit of 0 means no limit.
+func parseFilter(q url.Values, maxValues, maxLength int, fields []string) (Filter, error) {
+	var err error
+	filter := Filter{}
+	if filter.Types, err = parseFilterValues(q, "types", maxValues, maxLength); err != nil {
+		return filter, err
+	}
+	if filter.Parents, err = parseFilterValues(q, "parents", maxValues, maxLength); err != nil {
+		return filter, err
+	}
+	if filter.ExcludeTypes, err = parseFilterValues(q, "types_exclude", maxValues, maxLength); err != nil {
+		return filter, err
+	}
+	if filter.ExcludeParents, err = parseFilterValues(q, "parents_exclude", maxValues, maxLength); err != nil {
+		return filter, err
+	}
+	if filter.Events, err = parseFilterValues(q, "events", maxValues, maxLength); err != nil {
+		return filter, err
+	}
+	// Exclusions and events are left nil when not given so they don't show up in the logs
+	if len(filter.ExcludeTypes) == 0 {
+		filter.ExcludeTypes = nil
+	}
+	if len(filter.ExcludeParents) == 0 {
+		filter.ExcludeParents = nil
+	}
+	if len(filter.Events) == 0 {
+		filter.Events = nil
+	}
+	switch mode := strings.TrimSpace(q.Get("parents_mode")); mode {
+	case "", "any":
+	case "all":
+		filter.ParentsMode = ParentsAll
+	default:
+		return filter, &FilterError{"parents_mode", fmt.Sprintf("%q: must be any or all", mode)}
+	}
+	for param := range q {
+		if !strings.HasPrefix(param, "field.") {
+			continue
+		}
+		name := strings.TrimPrefix(param, "field.")
+		if !contains(fields, name) {
+			return filter, &FilterError{param, "field not filterable"}
+		}
+		value := strings.TrimSpace(q.Get(param))
+		if value == "" {
+			return filter, &FilterError{param, "no value given"}
+		}
+		if maxLength > 0 && len(value) > maxLength {
+			return filter, &FilterError{param, fmt.Sprintf("value of %d bytes, %d maximum", len(value), maxLength)}
+		}
+		if filter.Fields == nil {
+			filter.Fields = map[string]string{}
+		}
+		filter.Fields[name] = value
+	}
+	return filter, filter.validate()
+}
+
+// validate checks the values of the filter, the errors naming the matching query-string
+// parameter
+func (f Filter) validate() error {
+	lists := []struct {
+		param  string
+		values []string
+	}{
+		{"types", f.Types},
+		{"parents", f.Parents},
+		{"types_exclude", f.ExcludeTypes},
+		{"parents_exclude", f.ExcludeParents},
+	}
+	for _, list := range lists {
+		for _, v := range list.values {
+			if !validPattern(v) {
+				return &FilterError{list.param, fmt.Sprintf("%q: only a single trailing wildcard is allowed", v)}
+			}
+		}
+	}
+	for _, event := range f.Events {
+		switch event {
+		case "insert", "update", "delete", "touch":
+		default:
+			return &FilterError{"events", fmt.Sprintf("%q: must be insert, update, delete or touch", event)}
+		}
+	}
+	if len(f.Types) > 0 && len(f.ExcludeTypes) > 0 {
+		return &FilterError{"types_exclude", "can't be combined with types"}
+	}
+	if len(f.Parents) > 0 && len(f.ExcludeParents) > 0 {
+		return &FilterError{"parents_exclude", "can't be combined with parents"}
+	}
+	if f.ParentsMode != ParentsAny && f.ParentsMode != ParentsAll {
+		return &FilterError{"parents_mode", fmt.Sprintf("unknown mode %d", f.ParentsMode)}
+	}
+	for name := range f.Fields {
+		if err := ValidateField(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateField checks the data field with the given name can be filtered on, i.e.: is
+// id, m.<key> or pl.<path>, the fields matched the same way by MongoDB and by the live
+// streams. It is meant to check the filterable fields of the daemon at startup.
+func ValidateField(name string) error {
+	if name == "" || strings.ContainsAny(name, "$") || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".") || strings.Contains(name, "..") {
+		return &FilterError{"field." + name, "invalid field name"}
+	}
+	if name == "t" || name == "p" {
+		return &FilterError{"field." + name, "use the types and parents filters instead"}
+	}
+	if strings.HasPrefix(name, "m.") && strings.Contains(strings.TrimPrefix(name, "m."), ".") {
+		return &FilterError{"field." + name, "metadata keys have no sub-fields"}
+	}
+	if name != "id" && !strings.HasPrefix(name, "m.") && !strings.HasPrefix(name, "pl.") {
+		return &FilterError{"field." + name, "only id, m.<key> and pl.<path> can be filtered on"}
+	}
+	return nil
+}
+
+// parseFilterValues returns the trimmed values of a coma separated parameter, dropping
+// the empty ones
+func parseFilterValues(q url.Values, param string, maxValues, maxLength int) ([]string, error) {
+	values := []string{}
+	raw := q.Get(param)
+	if raw == "" {
+		return values, nil
+	}
+	for _, v := range strings.Split(raw, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	if len(values) == 0 {
+		return values, &FilterError{param, "no value given"}
+	}
+	if maxValues > 0 && len(values) > maxValues {
+		return values, &FilterError{param, fmt.Sprintf("%d values given, %d maximum", len(values), maxValues)}
+	}
+	for _, v := range values {
+		if maxLength > 0 && len(v) > maxLength {
+			return values, &FilterError{param, fmt.Sprintf("value of %d bytes, %d maximum", len(v), maxLength)}
+		}
+	}
+	return values, nil
 }
 
 // Apply applies the filters to the given query
@@ -14,17 +249,490 @@ func (f Filter) apply(query *bson.M) {
 	case 0:
 		// Do nothing
 	case 1:
-		(*query)["data.t"] = f.Types[0]
+		(*query)["data.t"] = patternValue(f.Types[0])
 	default: // > 1
-		(*query)["data.t"] = bson.M{"$in": f.Types}
+		(*query)["data.t"] = bson.M{"$in": patternValues(f.Types)}
 	}
 
+	parentsOp := "$in"
+	if f.ParentsMode == ParentsAll {
+		parentsOp = "$all"
+	}
 	switch len(f.Parents) {
 	case 0:
 		// Do nothing
 	case 1:
-		(*query)["data.p"] = f.Parents[0]
+		(*query)["data.p"] = patternValue(f.Parents[0])
+	default: // > 1
+		(*query)["data.p"] = bson.M{parentsOp: patternValues(f.Parents)}
+	}
+
+	if len(f.ParentPrefixes) > 0 {
+		prefixes := make([]string, len(f.ParentPrefixes))
+		for i, prefix := range f.ParentPrefixes {
+			prefixes[i] = regexp.QuoteMeta(prefix)
+		}
+		clause := bson.M{"$regex": "^(" + strings.Join(prefixes, "|") + ")"}
+		if len(f.Parents) > 0 {
+			// Both the parents and the prefixes must match
+			clause[parentsOp] = patternValues(f.Parents)
+		}
+		(*query)["data.p"] = clause
+	}
+
+	// Exclusions are merged with the inclusions a policy may have set on the same field
+	if len(f.ExcludeTypes) > 0 {
+		clause := bson.M{"$nin": patternValues(f.ExcludeTypes)}
+		if len(f.Types) > 0 {
+			clause["$in"] = patternValues(f.Types)
+		}
+		(*query)["data.t"] = clause
+	}
+	if len(f.ExcludeParents) > 0 {
+		clause, ok := (*query)["data.p"].(bson.M)
+		if !ok {
+			clause = bson.M{}
+			if len(f.Parents) > 0 {
+				clause[parentsOp] = patternValues(f.Parents)
+			}
+		}
+		clause["$nin"] = patternValues(f.ExcludeParents)
+		(*query)["data.p"] = clause
+	}
+
+	switch len(f.Events) {
+	case 0:
+		// Do nothing
+	case 1:
+		(*query)["event"] = f.Events[0]
 	default: // > 1
-		(*query)["data.p"] = bson.M{"$in": f.Parents}
+		(*query)["event"] = bson.M{"$in": f.Events}
+	}
+
+	for name, value := range f.Fields {
+		(*query)["data."+name] = value
+	}
+
+	if f.none {
+		// Nothing can match an empty $in
+		(*query)["data.t"] = bson.M{"$in": []string{}}
+	}
+}
+
+// matchOperation returns true if the operation matches the filter, including its event
+func (f Filter) matchOperation(op *Operation) bool {
+	if len(f.Events) > 0 && !contains(f.Events, op.Event) {
+		return false
+	}
+	return f.match(op.Data)
+}
+
+// match returns true if the operation data matches the filter, following the same
+// semantics as the query built by apply. The events are checked by matchOperation.
+func (f Filter) match(data *OperationData) bool {
+	if f.none {
+		return false
+	}
+	if len(f.Types) > 0 && !matchPattern(f.Types, data.Type) {
+		return false
+	}
+	if len(f.Parents) > 0 && !f.matchParents(data.Parents) {
+		return false
+	}
+	if len(f.ParentPrefixes) > 0 {
+		found := false
+		for _, parent := range data.Parents {
+			if hasAnyPrefix(parent, f.ParentPrefixes) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if matchPattern(f.ExcludeTypes, data.Type) {
+		return false
+	}
+	for _, parent := range data.Parents {
+		if matchPattern(f.ExcludeParents, parent) {
+			return false
+		}
+	}
+	for name, value := range f.Fields {
+		if !contains(data.field(name), value) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchParents returns true if the parents match any, or all, the parents of the filter,
+// following its ParentsMode
+func (f Filter) matchParents(parents []string) bool {
+	all := f.ParentsMode == ParentsAll
+	for _, p := range f.Parents {
+		found := false
+		for _, parent := range parents {
+			if matchPattern([]string{p}, parent) {
+				found = true
+				break
+			}
+		}
+		if found != all {
+			// Any parent found, or one of all the parents missing
+			return found
+		}
+	}
+	return all
+}
+
+// patternPrefix returns the prefix of a pattern ending with a wildcard
+func patternPrefix(p string) (string, bool) {
+	if strings.HasSuffix(p, "*") {
+		return strings.TrimSuffix(p, "*"), true
+	}
+	return p, false
+}
+
+// validPattern returns true if the value is exact or has a single trailing wildcard after
+// a non empty prefix
+func validPattern(p string) bool {
+	prefix, _ := patternPrefix(p)
+	return prefix != "" && !strings.Contains(prefix, "*")
+}
+
+// patternValue returns the value matching the pattern in a query: the value itself, or an
+// anchored regexp for a prefix, which MongoDB serves as a range on an index
+func patternValue(p string) interface{} {
+	if prefix, ok := patternPrefix(p); ok {
+		return bson.RegEx{Pattern: "^" + regexp.QuoteMeta(prefix)}
+	}
+	return p
+}
+
+// patternValues returns the values matching the patterns for an $in or $nin clause
+func patternValues(patterns []string) interface{} {
+	values := make([]interface{}, len(patterns))
+	prefixes := false
+	for i, p := range patterns {
+		values[i] = patternValue(p)
+		_, prefix := patternPrefix(p)
+		prefixes = prefixes || prefix
+	}
+	if !prefixes {
+		return patterns
+	}
+	return values
+}
+
+// matchPattern returns true if the value matches one of the exact values or patterns
+func matchPattern(patterns []string, value string) bool {
+	for _, p := range patterns {
+		if prefix, ok := patternPrefix(p); ok {
+			if strings.HasPrefix(value, prefix) {
+				return true
+			}
+		} else if p == value {
+			return true
+		}
+	}
+	return false
+}
+
+// hasAnyPrefix returns true if the value starts with one of the prefixes
+func hasAnyPrefix(value string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// contains returns true if the value is in the list
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Fingerprint returns a short hash identifying the filter. Filters with the same types
+// and parents, in any order, have the same fingerprint.
+func (f Filter) Fingerprint() string {
+	types := append([]string{}, f.Types...)
+	sort.Strings(types)
+	parents := append([]string{}, f.Parents...)
+	sort.Strings(parents)
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s|%s", strings.Join(types, ","), strings.Join(parents, ","))
+	if len(f.ParentPrefixes) > 0 {
+		prefixes := append([]string{}, f.ParentPrefixes...)
+		sort.Strings(prefixes)
+		fmt.Fprintf(h, "|%s", strings.Join(prefixes, ","))
+	}
+	if len(f.ExcludeTypes) > 0 || len(f.ExcludeParents) > 0 {
+		excludeTypes := append([]string{}, f.ExcludeTypes...)
+		sort.Strings(excludeTypes)
+		excludeParents := append([]string{}, f.ExcludeParents...)
+		sort.Strings(excludeParents)
+		fmt.Fprintf(h, "|-%s|-%s", strings.Join(excludeTypes, ","), strings.Join(excludeParents, ","))
+	}
+	if len(f.Events) > 0 {
+		events := append([]string{}, f.Events...)
+		sort.Strings(events)
+		fmt.Fprintf(h, "|e%s", strings.Join(events, ","))
+	}
+	if len(f.Fields) > 0 {
+		fields := make([]string, 0, len(f.Fields))
+		for name, value := range f.Fields {
+			fields = append(fields, name+"="+value)
+		}
+		sort.Strings(fields)
+		fmt.Fprintf(h, "|f%s", strings.Join(fields, ","))
+	}
+	if f.ParentsMode == ParentsAll {
+		fmt.Fprint(h, "|all")
+	}
+	if f.none {
+		fmt.Fprint(h, "|none")
+	}
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+// MarshalJSON serializes the filter with its values sorted and the empty criteria omitted,
+// so the same filter always gives the same JSON
+func (f Filter) MarshalJSON() ([]byte, error) {
+	sorted := func(values []string) []string {
+		if len(values) == 0 {
+			return nil
+		}
+		values = append([]string{}, values...)
+		sort.Strings(values)
+		return values
+	}
+	filter := struct {
+		Types          []string          `json:"types,omitempty"`
+		Parents        []string          `json:"parents,omitempty"`
+		ParentsMode    string            `json:"parents_mode,omitempty"`
+		ParentPrefixes []string          `json:"parent_prefixes,omitempty"`
+		ExcludeTypes   []string          `json:"types_exclude,omitempty"`
+		ExcludeParents []string          `json:"parents_exclude,omitempty"`
+		Events         []string          `json:"events,omitempty"`
+		Fields         map[string]string `json:"fields,omitempty"`
+		None           bool              `json:"none,omitempty"`
+	}{
+		Types:          sorted(f.Types),
+		Parents:        sorted(f.Parents),
+		ParentPrefixes: sorted(f.ParentPrefixes),
+		ExcludeTypes:   sorted(f.ExcludeTypes),
+		ExcludeParents: sorted(f.ExcludeParents),
+		Events:         sorted(f.Events),
+		Fields:         f.Fields,
+		None:           f.none,
+	}
+	if f.ParentsMode == ParentsAll {
+		filter.ParentsMode = "all"
+	}
+	return json.Marshal(filter)
+}
+
+// Intersect returns a filter matching only the operations matched by both filters, i.e.:
+// to restrict the filter requested by a client to a filter enforced by the server. It is
+// exact for operations with a single parent; with several parents, each of them must
+// match both parent filters, so the result may be narrower than both but never wider.
+func (f Filter) Intersect(other Filter) Filter {
+	r := Filter{none: f.none || other.none}
+	var ok [4]bool
+	r.Types, ok[0] = intersectPatterns(f.Types, other.Types)
+	r.Parents, r.ParentsMode, ok[1] = intersectParents(f, other)
+	r.ParentPrefixes, ok[2] = intersectPrefixes(f.ParentPrefixes, other.ParentPrefixes)
+	r.Events, ok[3] = intersectPatterns(f.Events, other.Events)
+	for _, ok := range ok {
+		r.none = r.none || !ok
+	}
+	r.ExcludeTypes = union(f.ExcludeTypes, other.ExcludeTypes)
+	r.ExcludeParents = union(f.ExcludeParents, other.ExcludeParents)
+	for _, fields := range []map[string]string{f.Fields, other.Fields} {
+		for name, value := range fields {
+			if r.Fields == nil {
+				r.Fields = map[string]string{}
+			}
+			if v, found := r.Fields[name]; found && v != value {
+				// A field can't be equal to two values
+				r.none = true
+			}
+			r.Fields[name] = value
+		}
+	}
+	return r
+}
+
+// patternCovered returns true if all the values matched by p, exact or pattern, are
+// matched by one of the patterns
+func patternCovered(patterns []string, p string) bool {
+	prefix, pattern := patternPrefix(p)
+	if !pattern {
+		return matchPattern(patterns, p)
+	}
+	for _, v := range patterns {
+		if vPrefix, ok := patternPrefix(v); ok && strings.HasPrefix(prefix, vPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// intersectPatterns returns the values and patterns matching only what both lists match,
+// an empty list matching anything. It returns false when nothing can match both.
+func intersectPatterns(a, b []string) ([]string, bool) {
+	if len(a) == 0 || len(b) == 0 {
+		return union(a, b), true
+	}
+	var r []string
+	for _, v := range a {
+		if patternCovered(b, v) && !contains(r, v) {
+			r = append(r, v)
+		}
+	}
+	for _, v := range b {
+		if patternCovered(a, v) && !contains(r, v) {
+			r = append(r, v)
+		}
+	}
+	return r, len(r) > 0
+}
+
+// intersectParents returns the parents matching what both filters match. When one of the
+// filters requires all its parents, the result requires them as well as those of the
+// other filter, unless they already imply them.
+func intersectParents(a, b Filter) ([]string, ParentsMode, bool) {
+	if a.ParentsMode != ParentsAll && b.ParentsMode != ParentsAll || len(a.Parents) == 0 || len(b.Parents) == 0 {
+		parents, ok := intersectPatterns(a.Parents, b.Parents)
+		mode := a.ParentsMode
+		if len(a.Parents) == 0 {
+			mode = b.ParentsMode
+		}
+		return parents, mode, ok
+	}
+	if a.ParentsMode != ParentsAll {
+		a, b = b, a
+	}
+	if b.ParentsMode != ParentsAll {
+		for _, p := range a.Parents {
+			if patternCovered(b.Parents, p) {
+				// Having all the parents of a implies having one of b
+				return union(a.Parents, nil), ParentsAll, true
+			}
+		}
+	}
+	return union(a.Parents, b.Parents), ParentsAll, true
+}
+
+// intersectPrefixes is intersectPatterns for lists of prefixes
+func intersectPrefixes(a, b []string) ([]string, bool) {
+	if len(a) == 0 || len(b) == 0 {
+		return union(a, b), true
+	}
+	var r []string
+	for _, v := range a {
+		if hasAnyPrefix(v, b) && !contains(r, v) {
+			r = append(r, v)
+		}
+	}
+	for _, v := range b {
+		if hasAnyPrefix(v, a) && !contains(r, v) {
+			r = append(r, v)
+		}
+	}
+	return r, len(r) > 0
+}
+
+// union returns the values of both lists, without duplicates
+func union(a, b []string) []string {
+	var r []string
+	for _, v := range append(append([]string{}, a...), b...) {
+		if !contains(r, v) {
+			r = append(r, v)
+		}
+	}
+	return r
+}
+
+// FilterBuilder composes a Filter, see NewFilter
+type FilterBuilder struct {
+	filter Filter
+}
+
+// NewFilter returns a builder of filters, i.e.:
+//
+//	filter, err := NewFilter().Types("video", "user").Parents("channel/42").Events("delete").Build()
+func NewFilter() *FilterBuilder {
+	return &FilterBuilder{}
+}
+
+// Types adds object types, or patterns ending with a wildcard, to filter on
+func (b *FilterBuilder) Types(types ...string) *FilterBuilder {
+	b.filter.Types = append(b.filter.Types, types...)
+	return b
+}
+
+// Parents adds parents, or patterns ending with a wildcard, to filter on
+func (b *FilterBuilder) Parents(parents ...string) *FilterBuilder {
+	b.filter.Parents = append(b.filter.Parents, parents...)
+	return b
+}
+
+// ParentPrefixes adds prefixes one of the parents must start with
+func (b *FilterBuilder) ParentPrefixes(prefixes ...string) *FilterBuilder {
+	b.filter.ParentPrefixes = append(b.filter.ParentPrefixes, prefixes...)
+	return b
+}
+
+// ExcludeTypes adds object types, or patterns, to drop
+func (b *FilterBuilder) ExcludeTypes(types ...string) *FilterBuilder {
+	b.filter.ExcludeTypes = append(b.filter.ExcludeTypes, types...)
+	return b
+}
+
+// ExcludeParents adds parents, or patterns, whose operations are dropped
+func (b *FilterBuilder) ExcludeParents(parents ...string) *FilterBuilder {
+	b.filter.ExcludeParents = append(b.filter.ExcludeParents, parents...)
+	return b
+}
+
+// Events adds operation events to filter on
+func (b *FilterBuilder) Events(events ...string) *FilterBuilder {
+	b.filter.Events = append(b.filter.Events, events...)
+	return b
+}
+
+// Field adds a data field the operations must have equal to the value
+func (b *FilterBuilder) Field(name, value string) *FilterBuilder {
+	if b.filter.Fields == nil {
+		b.filter.Fields = map[string]string{}
+	}
+	b.filter.Fields[name] = value
+	return b
+}
+
+// ParentsMode sets if the operations must have any or all the parents
+func (b *FilterBuilder) ParentsMode(mode ParentsMode) *FilterBuilder {
+	b.filter.ParentsMode = mode
+	return b
+}
+
+// Build returns the filter, or an error if one of its values is invalid, following the
+// same rules as ParseFilter
+func (b *FilterBuilder) Build() (Filter, error) {
+	f := b.filter
+	for _, prefix := range f.ParentPrefixes {
+		if prefix == "" {
+			return f, &FilterError{"parent_prefixes", "empty prefix"}
+		}
 	}
+	return f, f.validate()
 }
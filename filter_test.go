@@ -1,6 +1,12 @@
 package oplog
 
 import (
+	"encoding/json"
+	"math/rand"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
 
 	"gopkg.in/mgo.v2/bson"
@@ -57,3 +63,861 @@ func TestFilterMultiParents(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestFilterParentPrefixes(t *testing.T) {
+	q := bson.M{}
+	f := Filter{ParentPrefixes: []string{"user/", "x.y/"}}
+	f.apply(&q)
+	m, ok := q["data.p"].(bson.M)
+	if !ok {
+		t.Fatal("data.p is not a sub-bson")
+	}
+	if m["$regex"] != `^(user/|x\.y/)` {
+		t.Fatalf("invalid regex: %v", m["$regex"])
+	}
+	if _, found := m["$in"]; found {
+		t.Fatal("unexpected $in")
+	}
+
+	q = bson.M{}
+	f.Parents = []string{"user/1"}
+	f.apply(&q)
+	if m := q["data.p"].(bson.M); m["$regex"] == nil || m["$in"] == nil {
+		t.Fatalf("both parents and prefixes must be applied, got %v", m)
+	}
+}
+
+// Filter.match()
+
+func TestFilterMatchEmpty(t *testing.T) {
+	f := Filter{}
+	if !f.match(&OperationData{Type: "a"}) {
+		t.Fail()
+	}
+}
+
+func TestFilterMatchTypes(t *testing.T) {
+	f := Filter{Types: []string{"a", "b"}}
+	if !f.match(&OperationData{Type: "b"}) {
+		t.Fail()
+	}
+	if f.match(&OperationData{Type: "c"}) {
+		t.Fail()
+	}
+}
+
+func TestFilterMatchParents(t *testing.T) {
+	f := Filter{Parents: []string{"x/1", "x/2"}}
+	if !f.match(&OperationData{Parents: []string{"y/1", "x/2"}}) {
+		t.Fail()
+	}
+	if f.match(&OperationData{Parents: []string{"y/1"}}) {
+		t.Fail()
+	}
+	if f.match(&OperationData{}) {
+		t.Fail()
+	}
+}
+
+func TestFilterMatchTypesAndParents(t *testing.T) {
+	f := Filter{Types: []string{"a"}, Parents: []string{"x/1"}}
+	if !f.match(&OperationData{Type: "a", Parents: []string{"x/1"}}) {
+		t.Fail()
+	}
+	if f.match(&OperationData{Type: "b", Parents: []string{"x/1"}}) {
+		t.Fail()
+	}
+	if f.match(&OperationData{Type: "a", Parents: []string{"x/2"}}) {
+		t.Fail()
+	}
+}
+
+func TestFilterMatchParentPrefixes(t *testing.T) {
+	f := Filter{ParentPrefixes: []string{"user/", "playlist/x1"}}
+	if !f.match(&OperationData{Parents: []string{"video/1", "user/2"}}) {
+		t.Fail()
+	}
+	if !f.match(&OperationData{Parents: []string{"playlist/x12"}}) {
+		t.Fail()
+	}
+	if f.match(&OperationData{Parents: []string{"playlist/x2", "users/1"}}) {
+		t.Fail()
+	}
+	if f.match(&OperationData{}) {
+		t.Fail()
+	}
+}
+
+func TestFilterFingerprintParentPrefixes(t *testing.T) {
+	f := Filter{Types: []string{"a"}}
+	if f.Fingerprint() == (Filter{Types: []string{"a"}, ParentPrefixes: []string{"x/"}}).Fingerprint() {
+		t.Fatal("parent prefixes don't change the fingerprint")
+	}
+}
+
+func TestFilterFingerprintOrder(t *testing.T) {
+	f1 := Filter{Types: []string{"a", "b"}, Parents: []string{"x/1", "y/2"}}
+	f2 := Filter{Types: []string{"b", "a"}, Parents: []string{"y/2", "x/1"}}
+	if f1.Fingerprint() != f2.Fingerprint() {
+		t.Fatal("fingerprint depends on order")
+	}
+}
+
+func TestFilterFingerprintChange(t *testing.T) {
+	f := Filter{Types: []string{"a"}}
+	widened := Filter{Types: []string{"a", "b"}}
+	narrowed := Filter{Types: []string{"a"}, Parents: []string{"x/1"}}
+	if f.Fingerprint() == widened.Fingerprint() {
+		t.Fatal("widened filter has the same fingerprint")
+	}
+	if f.Fingerprint() == narrowed.Fingerprint() {
+		t.Fatal("narrowed filter has the same fingerprint")
+	}
+	// Types and parents are not interchangeable
+	if (Filter{Types: []string{"a"}}).Fingerprint() == (Filter{Parents: []string{"a"}}).Fingerprint() {
+		t.Fatal("types and parents share fingerprints")
+	}
+}
+
+func TestFilterFingerprintResume(t *testing.T) {
+	f := Filter{Types: []string{"a"}}
+	id := bson.NewObjectId()
+	w := &writeChecker{}
+	fingerprinted{Operation{ID: &id, Event: "insert", Data: &OperationData{}}, f.Fingerprint()}.WriteTo(w)
+	lastEventID := strings.TrimPrefix(strings.SplitN(string(w.written), "\n", 2)[0], "id: ")
+	lastID, fingerprint := splitFingerprint(lastEventID)
+	if lastID != id.Hex() {
+		t.Fatalf("invalid last id: %s", lastID)
+	}
+	if fingerprint != f.Fingerprint() {
+		t.Fatal("fingerprint doesn't match the original filter")
+	}
+	if fingerprint == (Filter{Types: []string{"a", "b"}}).Fingerprint() {
+		t.Fatal("fingerprint matches a widened filter")
+	}
+}
+
+func TestFilterExclude(t *testing.T) {
+	q := bson.M{}
+	f := Filter{ExcludeTypes: []string{"tick"}, ExcludeParents: []string{"x/1"}}
+	f.apply(&q)
+	if m, ok := q["data.t"].(bson.M); !ok || len(m) != 1 || m["$nin"] == nil {
+		t.Fatalf("invalid data.t clause: %v", q["data.t"])
+	}
+	if m, ok := q["data.p"].(bson.M); !ok || len(m) != 1 || m["$nin"] == nil {
+		t.Fatalf("invalid data.p clause: %v", q["data.p"])
+	}
+
+	// Exclusions are merged with the inclusions set by a policy
+	q = bson.M{}
+	f = Filter{Types: []string{"video", "tick"}, ExcludeTypes: []string{"tick"}, ParentPrefixes: []string{"x/"}, ExcludeParents: []string{"x/1"}}
+	f.apply(&q)
+	if m := q["data.t"].(bson.M); m["$in"] == nil || m["$nin"] == nil {
+		t.Errorf("both types and excluded types must be applied, got %v", m)
+	}
+	if m := q["data.p"].(bson.M); m["$regex"] == nil || m["$nin"] == nil {
+		t.Errorf("both prefixes and excluded parents must be applied, got %v", m)
+	}
+	q = bson.M{}
+	f = Filter{Parents: []string{"x/1", "x/2"}, ExcludeParents: []string{"x/1"}}
+	f.apply(&q)
+	if m := q["data.p"].(bson.M); m["$in"] == nil || m["$nin"] == nil {
+		t.Errorf("both parents and excluded parents must be applied, got %v", m)
+	}
+}
+
+func TestFilterMatchExclude(t *testing.T) {
+	tests := []struct {
+		filter Filter
+		data   OperationData
+		match  bool
+	}{
+		{Filter{ExcludeTypes: []string{"tick"}}, OperationData{Type: "video"}, true},
+		{Filter{ExcludeTypes: []string{"tick"}}, OperationData{Type: "tick"}, false},
+		{Filter{ExcludeParents: []string{"x/1"}}, OperationData{Parents: []string{"x/2"}}, true},
+		{Filter{ExcludeParents: []string{"x/1"}}, OperationData{Parents: []string{"x/2", "x/1"}}, false},
+		{Filter{ExcludeParents: []string{"x/1"}}, OperationData{}, true},
+		{Filter{Types: []string{"video"}, ExcludeParents: []string{"x/1"}}, OperationData{Type: "video", Parents: []string{"x/2"}}, true},
+		{Filter{Types: []string{"video"}, ExcludeParents: []string{"x/1"}}, OperationData{Type: "video", Parents: []string{"x/1"}}, false},
+		{Filter{Parents: []string{"x/2"}, ExcludeTypes: []string{"tick"}}, OperationData{Type: "tick", Parents: []string{"x/2"}}, false},
+		{Filter{ExcludeTypes: []string{"tick"}, ExcludeParents: []string{"x/1"}}, OperationData{Type: "video", Parents: []string{"x/1"}}, false},
+	}
+	for _, test := range tests {
+		if match := test.filter.match(&test.data); match != test.match {
+			t.Errorf("%#v on %#v: expected %v, got %v", test.filter, test.data, test.match, match)
+		}
+	}
+}
+
+func TestFilterFingerprintExclude(t *testing.T) {
+	f := Filter{Types: []string{"a"}}
+	if f.Fingerprint() == (Filter{Types: []string{"a"}, ExcludeParents: []string{"x/1"}}).Fingerprint() {
+		t.Error("exclusions don't change the fingerprint")
+	}
+	if (Filter{ExcludeTypes: []string{"a"}}).Fingerprint() == (Filter{ExcludeParents: []string{"a"}}).Fingerprint() {
+		t.Error("excluded types and parents have the same fingerprint")
+	}
+}
+
+// queryMatches evaluates a clause built by apply against the values of a field, following
+// the MongoDB semantics: on an array, a clause matches if any of the values matches, and
+// $nin if none of them does
+func queryMatches(t *testing.T, clause interface{}, values ...string) bool {
+	t.Helper()
+	value := func(v interface{}) bool {
+		for _, val := range values {
+			switch v := v.(type) {
+			case string:
+				if v == val {
+					return true
+				}
+			case bson.RegEx:
+				if regexp.MustCompile(v.Pattern).MatchString(val) {
+					return true
+				}
+			default:
+				t.Fatalf("unexpected value %#v", v)
+			}
+		}
+		return false
+	}
+	any := func(list interface{}) bool {
+		switch list := list.(type) {
+		case []string:
+			for _, v := range list {
+				if value(v) {
+					return true
+				}
+			}
+			return false
+		case []interface{}:
+			for _, v := range list {
+				if value(v) {
+					return true
+				}
+			}
+			return false
+		}
+		t.Fatalf("unexpected values %#v", list)
+		return false
+	}
+	switch clause := clause.(type) {
+	case nil:
+		return true
+	case bson.M:
+		if in, ok := clause["$in"]; ok && !any(in) {
+			return false
+		}
+		if nin, ok := clause["$nin"]; ok && any(nin) {
+			return false
+		}
+		if all, ok := clause["$all"]; ok {
+			values, _ := all.([]interface{})
+			if list, ok := all.([]string); ok {
+				for _, v := range list {
+					values = append(values, v)
+				}
+			}
+			for _, v := range values {
+				if !value(v) {
+					return false
+				}
+			}
+		}
+		if re, ok := clause["$regex"]; ok && !value(bson.RegEx{Pattern: re.(string)}) {
+			return false
+		}
+		return true
+	default:
+		return value(clause)
+	}
+}
+
+func TestFilterTypePatterns(t *testing.T) {
+	types := []string{"video", "video.caption", "video.thumbnail", "videos", "user", "user.video"}
+	tests := []struct {
+		filter  Filter
+		matches string
+	}{
+		{Filter{Types: []string{"video"}}, "video"},
+		{Filter{Types: []string{"video.*"}}, "video.caption,video.thumbnail"},
+		{Filter{Types: []string{"video*"}}, "video,video.caption,video.thumbnail,videos"},
+		{Filter{Types: []string{"video", "video.*"}}, "video,video.caption,video.thumbnail"},
+		{Filter{Types: []string{"user", "video.*"}}, "video.caption,video.thumbnail,user"},
+		{Filter{Types: []string{"vid.eo*"}}, ""},
+		{Filter{ExcludeTypes: []string{"video.*"}}, "video,videos,user,user.video"},
+		{Filter{Types: []string{"video*"}, ExcludeTypes: []string{"video.*", "videos"}}, "video"},
+	}
+	for _, test := range tests {
+		q := bson.M{}
+		test.filter.apply(&q)
+		matches := []string{}
+		for _, typ := range types {
+			match := test.filter.match(&OperationData{Type: typ})
+			if query := queryMatches(t, q["data.t"], typ); query != match {
+				t.Errorf("%v on %s: query matches %v but live matches %v", test.filter.Types, typ, query, match)
+			}
+			if match {
+				matches = append(matches, typ)
+			}
+		}
+		if strings.Join(matches, ",") != test.matches {
+			t.Errorf("%v %v: expected %s, got %s", test.filter.Types, test.filter.ExcludeTypes, test.matches, strings.Join(matches, ","))
+		}
+	}
+}
+
+func TestValidPattern(t *testing.T) {
+	for typ, valid := range map[string]bool{
+		"video":     true,
+		"video.*":   true,
+		"video*":    true,
+		"*":         false,
+		"video.**":  false,
+		"*.caption": false,
+		"vi*deo":    false,
+	} {
+		if validPattern(typ) != valid {
+			t.Errorf("%s: expected valid %v", typ, valid)
+		}
+	}
+}
+
+func TestFilterParentPatterns(t *testing.T) {
+	parents := map[string][]string{
+		"a": {"user/1"},
+		"b": {"user/12"},
+		"c": {"user/1/playlist/2"},
+		"d": {"video/3", "user/1/playlist/2"},
+		"e": {"video/3"},
+		"f": {},
+	}
+	tests := []struct {
+		filter  Filter
+		matches string
+	}{
+		{Filter{Parents: []string{"user/1"}}, "a"},
+		{Filter{Parents: []string{"user/1/*"}}, "c,d"},
+		{Filter{Parents: []string{"user/1*"}}, "a,b,c,d"},
+		{Filter{Parents: []string{"user/1", "user/1/*"}}, "a,c,d"},
+		{Filter{Parents: []string{"video/3", "user/12*"}}, "b,d,e"},
+		{Filter{Parents: []string{"user/1/*"}, ParentPrefixes: []string{"video/"}}, "d"},
+		{Filter{ExcludeParents: []string{"user/1/*"}}, "a,b,e,f"},
+		{Filter{Types: []string{"video"}, ExcludeParents: []string{"video/*"}}, "a,b,c,f"},
+	}
+	for _, test := range tests {
+		q := bson.M{}
+		test.filter.apply(&q)
+		matches := []string{}
+		for _, op := range []string{"a", "b", "c", "d", "e", "f"} {
+			data := OperationData{Type: "video", Parents: parents[op]}
+			match := test.filter.match(&data)
+			query := queryMatches(t, q["data.t"], data.Type) && queryMatches(t, q["data.p"], data.Parents...)
+			if q["data.p"] != nil && len(data.Parents) == 0 {
+				// Only $nin matches a missing value
+				clause, ok := q["data.p"].(bson.M)
+				query = ok && len(clause) == 1 && clause["$nin"] != nil && queryMatches(t, q["data.t"], data.Type)
+			}
+			if query != match {
+				t.Errorf("%#v on %v: query matches %v but live matches %v", test.filter, data.Parents, query, match)
+			}
+			if match {
+				matches = append(matches, op)
+			}
+		}
+		if strings.Join(matches, ",") != test.matches {
+			t.Errorf("%#v: expected %s, got %s", test.filter, test.matches, strings.Join(matches, ","))
+		}
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		query          string
+		types          string
+		parents        string
+		excludeTypes   string
+		excludeParents string
+		param          string
+	}{
+		{"", "", "", "", "", ""},
+		{"types=a", "a", "", "", "", ""},
+		{"types=a,b&parents=x/1", "a,b", "x/1", "", "", ""},
+		{"types=%20a%20,b%20", "a,b", "", "", "", ""},
+		{"types=a,,b,", "a,b", "", "", "", ""},
+		{"types=video.*,video&parents=user/1/*", "video.*,video", "user/1/*", "", "", ""},
+		{"types_exclude=a&parents_exclude=x/1,x/2", "", "", "a", "x/1,x/2", ""},
+		{"types=a&parents_exclude=x/1", "a", "", "", "x/1", ""},
+		{"types=,,,", "", "", "", "", "types"},
+		{"types=%20", "", "", "", "", "types"},
+		{"parents=,", "", "", "", "", "parents"},
+		{"types_exclude=,", "", "", "", "", "types_exclude"},
+		{"parents_exclude=%20,%20", "", "", "", "", "parents_exclude"},
+		{"types=*", "", "", "", "", "types"},
+		{"types=a**", "", "", "", "", "types"},
+		{"types=a*b", "", "", "", "", "types"},
+		{"parents=*/1", "", "", "", "", "parents"},
+		{"types_exclude=a*b", "", "", "", "", "types_exclude"},
+		{"parents_exclude=a**", "", "", "", "", "parents_exclude"},
+		{"types=a&types_exclude=b", "", "", "", "", "types_exclude"},
+		{"parents=a&parents_exclude=b", "", "", "", "", "parents_exclude"},
+		{"types=" + strings.Repeat("a,", 3), "a,a,a", "", "", "", ""},
+		{"types=" + strings.Repeat("a,", 4), "", "", "", "", "types"},
+		{"parents=" + strings.Repeat("a,", 4), "", "", "", "", "parents"},
+		{"types=" + strings.Repeat("a", 8), "aaaaaaaa", "", "", "", ""},
+		{"types=" + strings.Repeat("a", 9), "", "", "", "", "types"},
+		{"parents_exclude=x," + strings.Repeat("a", 9), "", "", "", "", "parents_exclude"},
+		{"events=delete,%20update", "", "", "", "", ""},
+		{"events=touch", "", "", "", "", ""},
+		{"events=,", "", "", "", "", "events"},
+		{"events=insert,remove", "", "", "", "", "events"},
+	}
+	for _, test := range tests {
+		q, err := url.ParseQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := parseFilter(q, 3, 8, nil)
+		if test.param != "" {
+			if ferr, ok := err.(*FilterError); !ok || ferr.Param != test.param {
+				t.Errorf("%s: expected an error on %s, got %v", test.query, test.param, err)
+			} else if !strings.Contains(err.Error(), test.param) {
+				t.Errorf("%s: error doesn't name the parameter: %s", test.query, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.query, err)
+			continue
+		}
+		if strings.Join(f.Types, ",") != test.types || strings.Join(f.Parents, ",") != test.parents ||
+			strings.Join(f.ExcludeTypes, ",") != test.excludeTypes || strings.Join(f.ExcludeParents, ",") != test.excludeParents {
+			t.Errorf("%s: invalid filter %#v", test.query, f)
+		}
+	}
+}
+
+func TestParseFilterNoLimit(t *testing.T) {
+	q := url.Values{"types": {strings.Repeat("a,", DefaultMaxFilterValues+1)}}
+	if _, err := ParseFilter(q); err == nil {
+		t.Error("expected the default limit to apply")
+	}
+	if f, err := parseFilter(q, 0, 0, nil); err != nil || len(f.Types) != DefaultMaxFilterValues+1 {
+		t.Errorf("expected no limit, got %v", err)
+	}
+}
+
+func TestParseFilterEvents(t *testing.T) {
+	f, err := ParseFilter(url.Values{"events": {"delete, update"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(f.Events, ",") != "delete,update" {
+		t.Errorf("invalid events: %v", f.Events)
+	}
+}
+
+func TestFilterBuilder(t *testing.T) {
+	f, err := NewFilter().Types("video", "user").Parents("channel/42").Events("delete").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(f.Types, ",") != "video,user" || strings.Join(f.Parents, ",") != "channel/42" || strings.Join(f.Events, ",") != "delete" {
+		t.Errorf("invalid filter: %#v", f)
+	}
+	f, err = NewFilter().Types("video.*").Types("user").ExcludeParents("x/*").ParentPrefixes("channel/").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(f.Types, ",") != "video.*,user" || strings.Join(f.ExcludeParents, ",") != "x/*" || strings.Join(f.ParentPrefixes, ",") != "channel/" {
+		t.Errorf("invalid filter: %#v", f)
+	}
+	if f, err := NewFilter().Build(); err != nil || f.Fingerprint() != (Filter{}).Fingerprint() {
+		t.Errorf("invalid empty filter: %#v, %v", f, err)
+	}
+
+	for param, b := range map[string]*FilterBuilder{
+		"types":           NewFilter().Types("video", ""),
+		"parents":         NewFilter().Parents("a**"),
+		"types_exclude":   NewFilter().Types("video").ExcludeTypes("user"),
+		"parents_exclude": NewFilter().ExcludeParents("*"),
+		"events":          NewFilter().Events("remove"),
+		"parent_prefixes": NewFilter().ParentPrefixes(""),
+	} {
+		if _, err := b.Build(); err == nil || err.(*FilterError).Param != param {
+			t.Errorf("%s: expected an error, got %v", param, err)
+		}
+	}
+}
+
+func TestFilterEvents(t *testing.T) {
+	q := bson.M{}
+	Filter{Events: []string{"delete"}}.apply(&q)
+	if q["event"] != "delete" {
+		t.Errorf("invalid event clause: %v", q["event"])
+	}
+	q = bson.M{}
+	Filter{Events: []string{"insert", "delete"}}.apply(&q)
+	if m, ok := q["event"].(bson.M); !ok || len(m["$in"].([]string)) != 2 {
+		t.Errorf("invalid event clause: %v", q["event"])
+	}
+
+	f := Filter{Types: []string{"video"}, Events: []string{"update", "delete"}}
+	for _, test := range []struct {
+		op    Operation
+		match bool
+	}{
+		{Operation{Event: "update", Data: &OperationData{Type: "video"}}, true},
+		{Operation{Event: "delete", Data: &OperationData{Type: "video"}}, true},
+		{Operation{Event: "insert", Data: &OperationData{Type: "video"}}, false},
+		{Operation{Event: "update", Data: &OperationData{Type: "user"}}, false},
+	} {
+		if f.matchOperation(&test.op) != test.match {
+			t.Errorf("%s %s: expected %v", test.op.Event, test.op.Data.Type, test.match)
+		}
+	}
+	if (Filter{Events: []string{"insert"}}).Fingerprint() == (Filter{}).Fingerprint() {
+		t.Error("events don't change the fingerprint")
+	}
+}
+
+func TestFilterIntersect(t *testing.T) {
+	tests := []struct {
+		a, b Filter
+		want Filter
+	}{
+		{Filter{}, Filter{}, Filter{}},
+		{Filter{Types: []string{"video"}}, Filter{}, Filter{Types: []string{"video"}}},
+		{Filter{}, Filter{Parents: []string{"x/1"}}, Filter{Parents: []string{"x/1"}}},
+		{Filter{Types: []string{"video", "user"}}, Filter{Types: []string{"user", "playlist"}}, Filter{Types: []string{"user"}}},
+		{Filter{Types: []string{"video.*"}}, Filter{Types: []string{"video.caption", "user"}}, Filter{Types: []string{"video.caption"}}},
+		{Filter{Types: []string{"vid*"}}, Filter{Types: []string{"video.*"}}, Filter{Types: []string{"video.*"}}},
+		{Filter{Types: []string{"video"}}, Filter{Types: []string{"user"}}, Filter{none: true}},
+		{Filter{ParentPrefixes: []string{"user/"}}, Filter{ParentPrefixes: []string{"user/1/", "x/"}}, Filter{ParentPrefixes: []string{"user/1/"}}},
+		{Filter{Parents: []string{"user/1"}}, Filter{ParentPrefixes: []string{"user/"}}, Filter{Parents: []string{"user/1"}, ParentPrefixes: []string{"user/"}}},
+		{Filter{Events: []string{"insert", "delete"}}, Filter{Events: []string{"delete"}}, Filter{Events: []string{"delete"}}},
+		{Filter{ExcludeTypes: []string{"a"}}, Filter{ExcludeTypes: []string{"b", "a"}}, Filter{ExcludeTypes: []string{"a", "b"}}},
+		{Filter{none: true}, Filter{}, Filter{none: true}},
+	}
+	for _, test := range tests {
+		got := test.a.Intersect(test.b)
+		if got.none != test.want.none || (!got.none && got.Fingerprint() != test.want.Fingerprint()) {
+			t.Errorf("%#v ∩ %#v: expected %#v, got %#v", test.a, test.b, test.want, got)
+		}
+	}
+}
+
+// randomFilter returns a random filter over small sets of types, parents and events
+func randomFilter(r *rand.Rand) Filter {
+	pick := func(values []string) []string {
+		var picked []string
+		for _, v := range values {
+			if r.Intn(4) == 0 {
+				picked = append(picked, v)
+			}
+		}
+		return picked
+	}
+	f := Filter{
+		Types:          pick([]string{"video", "video.caption", "video.*", "vid*", "user", "user.*"}),
+		Parents:        pick([]string{"user/1", "user/1/*", "user/12", "x/2", "x/*"}),
+		ParentPrefixes: pick([]string{"user/", "user/1", "x/"}),
+		Events:         pick([]string{"insert", "update", "delete"}),
+	}
+	if len(f.Types) == 0 {
+		f.ExcludeTypes = pick([]string{"video", "user.*"})
+	}
+	if len(f.Parents) == 0 {
+		f.ExcludeParents = pick([]string{"x/2", "user/1/*"})
+	}
+	if r.Intn(3) == 0 {
+		f.ParentsMode = ParentsAll
+	}
+	return f
+}
+
+func TestFilterIntersectNeverWidens(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	types := []string{"video", "video.caption", "videos", "user", "user.video", "playlist"}
+	parents := [][]string{{}, {"user/1"}, {"user/12"}, {"user/1/p/2"}, {"x/2"}, {"x/3"}, {"x/2", "user/1"}, {"x/2", "user/1", "user/12"}}
+	events := []string{"insert", "update", "delete"}
+	for i := 0; i < 2000; i++ {
+		a, b := randomFilter(r), randomFilter(r)
+		c := a.Intersect(b)
+		q := bson.M{}
+		c.apply(&q)
+		for _, typ := range types {
+			for _, p := range parents {
+				for _, event := range events {
+					op := Operation{Event: event, Data: &OperationData{Type: typ, Parents: p}}
+					match := c.matchOperation(&op)
+					both := a.matchOperation(&op) && b.matchOperation(&op)
+					if match && !both {
+						t.Fatalf("%#v ∩ %#v = %#v widens to %s %s %v", a, b, c, event, typ, p)
+					}
+					if len(p) == 1 && a.ParentsMode == ParentsAny && b.ParentsMode == ParentsAny && match != both {
+						t.Fatalf("%#v ∩ %#v = %#v narrows %s %s %v", a, b, c, event, typ, p)
+					}
+					if len(p) > 0 || q["data.p"] == nil {
+						query := queryMatches(t, q["data.t"], typ) && queryMatches(t, q["data.p"], p...) && queryMatches(t, q["event"], event)
+						if query != match {
+							t.Fatalf("%#v: query matches %v but live matches %v on %s %s %v", c, query, match, event, typ, p)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestFilterFields(t *testing.T) {
+	q, _ := url.ParseQuery("types=video&field.id=%20x1%20")
+	f, err := ParseFilter(q, "id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Fields) != 1 || f.Fields["id"] != "x1" {
+		t.Fatalf("invalid fields: %v", f.Fields)
+	}
+	query := bson.M{}
+	f.apply(&query)
+	if query["data.id"] != "x1" || query["data.t"] != "video" {
+		t.Errorf("invalid query: %v", query)
+	}
+	if !f.match(&OperationData{Type: "video", ID: "x1"}) || f.match(&OperationData{Type: "video", ID: "x2"}) {
+		t.Error("invalid match on the id field")
+	}
+	if (Filter{Fields: map[string]string{"tenant": "acme"}}).match(&OperationData{Type: "video", ID: "x1", Meta: map[string]string{"tenant": "acme"}}) {
+		t.Error("the metadata must only match thru m.<key>")
+	}
+	if f.Fingerprint() == (Filter{Types: []string{"video"}}).Fingerprint() {
+		t.Error("fields don't change the fingerprint")
+	}
+
+	for query, param := range map[string]string{
+		"field.country=fr": "field.country",
+		"field.id=x1":      "field.id",
+	} {
+		q, _ := url.ParseQuery(query)
+		if _, err := ParseFilter(q); err == nil || err.(*FilterError).Param != param {
+			t.Errorf("%s: expected a not filterable error, got %v", query, err)
+		}
+	}
+	for query, param := range map[string]string{
+		"field.id=":        "field.id",
+		"field.t=video":    "field.t",
+		"field.$where=1":   "field.$where",
+		"field.m=x":        "field.m",
+		"field.m.a.b=x":    "field.m.a.b",
+		"field.pl..a=x":    "field.pl..a",
+		"field.country=fr": "field.country",
+	} {
+		q, _ := url.ParseQuery(query)
+		if _, err := ParseFilter(q, "id", "t", "$where", "m", "m.a.b", "pl..a", "country"); err == nil || err.(*FilterError).Param != param {
+			t.Errorf("%s: expected an error, got %v", query, err)
+		}
+	}
+	for _, name := range []string{"id", "m.tenant", "pl.country", "pl.tags.0"} {
+		if err := ValidateField(name); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+
+	if f := (Filter{Fields: map[string]string{"id": "x1"}}).Intersect(Filter{Fields: map[string]string{"id": "x2"}}); !f.none {
+		t.Errorf("conflicting fields must match nothing, got %#v", f)
+	}
+	if f := (Filter{Fields: map[string]string{"id": "x1"}}).Intersect(Filter{Fields: map[string]string{"a": "b"}}); len(f.Fields) != 2 || f.none {
+		t.Errorf("fields must be merged, got %#v", f)
+	}
+}
+
+// mongoPathValues returns the values of a BSON document MongoDB compares with an equality
+// on the dotted path, the arrays being traversed
+func mongoPathValues(v interface{}, path []string) []interface{} {
+	if len(path) == 0 {
+		if list, ok := v.([]interface{}); ok {
+			return append([]interface{}{v}, list...)
+		}
+		return []interface{}{v}
+	}
+	switch v := v.(type) {
+	case bson.M:
+		return mongoPathValues(v[path[0]], path[1:])
+	case []interface{}:
+		values := []interface{}{}
+		if i, err := strconv.Atoi(path[0]); err == nil && i < len(v) {
+			values = append(values, mongoPathValues(v[i], path[1:])...)
+		}
+		for _, e := range v {
+			if doc, ok := e.(bson.M); ok {
+				values = append(values, mongoPathValues(doc, path)...)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func TestFilterFieldsQueryAndMatch(t *testing.T) {
+	data := OperationData{
+		Type: "video",
+		ID:   "x1",
+		Meta: map[string]string{"tenant": "acme"},
+		Payload: map[string]interface{}{
+			"country": "fr",
+			"owner":   map[string]interface{}{"name": "bob"},
+			"tags":    []interface{}{"cat", "dog"},
+			"items":   []interface{}{map[string]interface{}{"sku": "a1"}, map[string]interface{}{"sku": "b2"}},
+			"views":   12,
+		},
+	}
+	// The data as read from MongoDB
+	b, err := bson.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := OperationData{}
+	doc := bson.M{}
+	if err := bson.Unmarshal(b, &stored); err != nil {
+		t.Fatal(err)
+	}
+	if err := bson.Unmarshal(b, &doc); err != nil {
+		t.Fatal(err)
+	}
+	ol := newTestOpLog()
+	for _, test := range []struct {
+		name, value string
+		match       bool
+	}{
+		{"id", "x1", true},
+		{"id", "x2", false},
+		{"m.tenant", "acme", true},
+		{"m.tenant", "other", false},
+		{"m.origin", "acme", false},
+		{"pl.country", "fr", true},
+		{"pl.owner.name", "bob", true},
+		{"pl.owner", "bob", false},
+		{"pl.tags", "dog", true},
+		{"pl.tags.0", "cat", true},
+		{"pl.tags.0", "dog", false},
+		{"pl.items.sku", "b2", true},
+		{"pl.items.1.sku", "a1", false},
+		// Only the strings are matched, as the query value
+		{"pl.views", "12", false},
+		{"pl.missing", "x", false},
+	} {
+		q := url.Values{"field." + test.name: {test.value}}
+		filter, err := ParseFilter(q, test.name)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		// The query of the live updates, run by MongoDB
+		query := ol.newTailer(filter, TailOptions{}, nil, false).prepareLiveQuery(nil)
+		if len(query) != 1 || query["data."+test.name] != test.value {
+			t.Fatalf("%s: invalid query %v", test.name, query)
+		}
+		inQuery := false
+		for _, v := range mongoPathValues(doc, strings.Split(test.name, ".")) {
+			inQuery = inQuery || v == test.value
+		}
+		if inQuery != test.match {
+			t.Errorf("%s=%s: the query matches %v, expected %v", test.name, test.value, inQuery, test.match)
+		}
+		// The in-memory matching of the shared tail and of the in-process streams
+		if m := filter.match(&data); m != test.match {
+			t.Errorf("%s=%s: match returns %v, expected %v", test.name, test.value, m, test.match)
+		}
+		if m := filter.match(&stored); m != test.match {
+			t.Errorf("%s=%s: match returns %v on the stored data, expected %v", test.name, test.value, m, test.match)
+		}
+	}
+}
+
+func TestFilterParentsMode(t *testing.T) {
+	ops := map[string][]string{
+		"one":     {"user/1"},
+		"both":    {"user/1", "playlist/2"},
+		"neither": {"user/3"},
+		"none":    {},
+	}
+	tests := []struct {
+		query   string
+		matches []string
+	}{
+		{"parents=user/1,playlist/2", []string{"both", "one"}},
+		{"parents=user/1,playlist/2&parents_mode=any", []string{"both", "one"}},
+		{"parents=user/1,playlist/2&parents_mode=all", []string{"both"}},
+		{"parents=user/*,playlist/2&parents_mode=all", []string{"both"}},
+		{"parents=user/1&parents_mode=all", []string{"both", "one"}},
+		{"types=video&parents=user/1,playlist/2&parents_mode=all", []string{"both"}},
+		{"types=user&parents=user/1,playlist/2", []string{}},
+	}
+	for _, test := range tests {
+		q, _ := url.ParseQuery(test.query)
+		f, err := ParseFilter(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		query := bson.M{}
+		f.apply(&query)
+		matches := []string{}
+		for _, name := range []string{"both", "neither", "none", "one"} {
+			data := OperationData{Type: "video", Parents: ops[name]}
+			match := f.match(&data)
+			if len(data.Parents) > 0 {
+				if q := queryMatches(t, query["data.t"], data.Type) && queryMatches(t, query["data.p"], data.Parents...); q != match {
+					t.Errorf("%s on %s: query matches %v but live matches %v", test.query, name, q, match)
+				}
+			}
+			if match {
+				matches = append(matches, name)
+			}
+		}
+		if strings.Join(matches, ",") != strings.Join(test.matches, ",") {
+			t.Errorf("%s: expected %v, got %v", test.query, test.matches, matches)
+		}
+	}
+
+	q := bson.M{}
+	Filter{Parents: []string{"a/1", "b/2"}, ParentsMode: ParentsAll}.apply(&q)
+	if m, ok := q["data.p"].(bson.M); !ok || m["$all"] == nil {
+		t.Errorf("expected an $all clause, got %v", q["data.p"])
+	}
+	if _, err := ParseFilter(url.Values{"parents_mode": {"some"}}); err == nil || err.(*FilterError).Param != "parents_mode" {
+		t.Errorf("expected an invalid parents_mode error, got %v", err)
+	}
+	if (Filter{Parents: []string{"a/1", "b/2"}}).Fingerprint() == (Filter{Parents: []string{"a/1", "b/2"}, ParentsMode: ParentsAll}).Fingerprint() {
+		t.Error("the parents mode doesn't change the fingerprint")
+	}
+}
+
+func TestFilterMarshalJSON(t *testing.T) {
+	tests := []struct {
+		filter Filter
+		golden string
+	}{
+		{Filter{}, `{}`},
+		{Filter{Types: []string{}, Parents: []string{}}, `{}`},
+		{Filter{Types: []string{"video", "playlist.*"}, Parents: []string{"user/2", "user/1"}}, `{"types":["playlist.*","video"],"parents":["user/1","user/2"]}`},
+		{Filter{Parents: []string{"b/1", "a/1"}, ParentsMode: ParentsAll}, `{"parents":["a/1","b/1"],"parents_mode":"all"}`},
+		{Filter{ParentPrefixes: []string{"user/"}, ExcludeTypes: []string{"tick"}, ExcludeParents: []string{"x/*"}}, `{"parent_prefixes":["user/"],"types_exclude":["tick"],"parents_exclude":["x/*"]}`},
+		{Filter{Events: []string{"update", "delete"}, Fields: map[string]string{"id": "x1", "country": "fr"}}, `{"events":["delete","update"],"fields":{"country":"fr","id":"x1"}}`},
+		{Filter{Types: []string{"video"}}.Intersect(Filter{Types: []string{"user"}}), `{"none":true}`},
+	}
+	for _, test := range tests {
+		b, err := json.Marshal(test.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != test.golden {
+			t.Errorf("invalid JSON for %#v:\n%s\nexpected:\n%s", test.filter, b, test.golden)
+		}
+	}
+
+	// The values of the filter are not sorted in place
+	f := Filter{Types: []string{"b", "a"}}
+	json.Marshal(f)
+	if f.Types[0] != "b" {
+		t.Error("the filter has been modified")
+	}
+}
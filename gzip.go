@@ -0,0 +1,56 @@
+package oplog
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// gzipResponseWriter compresses a stream. Flushing the response flushes the pending
+// compressed data first so events aren't held until the compression window is full.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz      *gzip.Writer
+	flusher http.Flusher
+}
+
+func newGzipResponseWriter(w http.ResponseWriter, flusher http.Flusher) *gzipResponseWriter {
+	return &gzipResponseWriter{w, gzip.NewWriter(w), flusher}
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	return g.gz.Write(b)
+}
+
+// Flush flushes the compressed data and the underlying response
+func (g *gzipResponseWriter) Flush() {
+	g.gz.Flush()
+	g.flusher.Flush()
+}
+
+// Close writes the end of the compressed stream
+func (g *gzipResponseWriter) Close() error {
+	err := g.gz.Close()
+	g.flusher.Flush()
+	return err
+}
+
+// acceptsGzip checks if the client accepts gzip encoded responses
+func acceptsGzip(r *http.Request) bool {
+	for _, value := range r.Header["Accept-Encoding"] {
+		for _, encoding := range strings.Split(value, ",") {
+			params := strings.Split(encoding, ";")
+			if !strings.EqualFold(strings.TrimSpace(params[0]), "gzip") {
+				continue
+			}
+			for _, param := range params[1:] {
+				if q := strings.Replace(param, " ", "", -1); q == "q=0" || strings.HasPrefix(q, "q=0.") && strings.Trim(q[4:], "0") == "" {
+					// Explicitly refused
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+package oplog
+
+import (
+	"bufio"
+	"compress/gzip"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header  string
+		accepts bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=1.0, *;q=0.5", true},
+		{"GZIP", true},
+		{"deflate", false},
+		{"gzip;q=0", false},
+		{"gzip; q=0.000", false},
+		{"gzip;q=0.5", true},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/ops", nil)
+		if test.header != "" {
+			req.Header.Set("Accept-Encoding", test.header)
+		}
+		if acceptsGzip(req) != test.accepts {
+			t.Errorf("%q: expected %v", test.header, test.accepts)
+		}
+	}
+}
+
+func TestGetOpsGzip(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := newTestOperations(2)
+	daemon := newTestSSEOpsDaemon(ops)
+	daemon.FlushInterval = 10 * time.Millisecond
+	go daemon.Serve(l)
+	defer daemon.s.Close()
+
+	req, _ := http.NewRequest("GET", "http://"+l.Addr().String()+"/ops?since=1423995187000", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	// Setting the header disables the transparent decompression of the client
+	req.Header.Set("Accept-Encoding", "gzip")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("stream not compressed: %v", res.Header)
+	}
+
+	// The stream stays open after these events, they must be delivered without waiting
+	// for more data to compress
+	ids := make(chan []string)
+	go func() {
+		gz, err := gzip.NewReader(res.Body)
+		if err != nil {
+			t.Error(err)
+			close(ids)
+			return
+		}
+		body := bufio.NewReader(gz)
+		events := []string{}
+		for len(events) < 4 {
+			event := []string{}
+			for {
+				line, err := body.ReadString('\n')
+				if err != nil {
+					t.Error(err)
+					close(ids)
+					return
+				}
+				if line == "\n" {
+					break
+				}
+				event = append(event, strings.TrimSuffix(line, "\n"))
+			}
+			events = append(events, event[0])
+		}
+		ids <- events
+	}()
+	select {
+	case events := <-ids:
+		expected := []string{"id: 1", "id: " + ops[0].ID.Hex(), "id: " + ops[1].ID.Hex(), "id: " + ops[1].ID.Hex()}
+		if strings.Join(events, ",") != strings.Join(expected, ",") {
+			t.Fatalf("invalid events: %v", events)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("compressed events not delivered")
+	}
+}
+
+func TestGetOpsNoGzip(t *testing.T) {
+	for _, test := range []struct{ query, header string }{
+		{"", ""},
+		{"&compress=off", "gzip"},
+	} {
+		daemon := newTestSSEDaemonHandler("")
+		daemon.MaxConnectionDuration = 10 * time.Millisecond
+		req := httptest.NewRequest("GET", "/ops?since=1423995187000"+test.query, nil)
+		req.Header.Set("Accept", "text/event-stream")
+		if test.header != "" {
+			req.Header.Set("Accept-Encoding", test.header)
+		}
+		rec := httptest.NewRecorder()
+		daemon.ServeHTTP(rec, req)
+		if rec.Header().Get("Content-Encoding") != "" {
+			t.Errorf("%q: stream must not be compressed", test.query)
+		}
+		if !strings.Contains(rec.Body.String(), "event: insert") {
+			t.Errorf("%q: invalid body: %q", test.query, rec.Body.String())
+		}
+	}
+}
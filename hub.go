@@ -0,0 +1,194 @@
+package oplog
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// errSubscriberEvicted is returned when a live tail has been evicted from the shared tail
+var errSubscriberEvicted = errors.New("evicted from the shared tail")
+
+// hub shares a single tailable cursor on the oplog_ops collection between all the live
+// tails. Each operation read from the cursor is dispatched to every subscriber's queue.
+type hub struct {
+	ol   *OpLog
+	mu   sync.Mutex
+	subs map[*subscriber]bool
+	// last is the id of the last operation dispatched to the subscribers
+	last *bson.ObjectId
+	// stop is closed to stop the running tailing goroutine, nil when not running
+	stop chan struct{}
+}
+
+// subscriber is a live tail registered on the hub
+type subscriber struct {
+	// ops receives the operations dispatched by the hub. The channel is closed when
+	// the subscriber is evicted because its queue is full.
+	ops chan *Operation
+	// from is the id of the last operation dispatched before the subscription. The
+	// operations up to this id must be fetched by the subscriber itself.
+	from *bson.ObjectId
+}
+
+// newHub creates a hub for the given oplog. The hub starts tailing with its first
+// subscriber and stops with its last one.
+func newHub(ol *OpLog) *hub {
+	return &hub{
+		ol:   ol,
+		subs: make(map[*subscriber]bool),
+	}
+}
+
+// subscribe registers a new subscriber, starting the tailing goroutine if needed
+func (h *hub) subscribe() (*subscriber, error) {
+	h.mu.Lock()
+	running := h.stop != nil
+	h.mu.Unlock()
+
+	// The position is fetched outside of the lock so the dispatch isn't blocked on Mongo
+	var last *bson.ObjectId
+	if !running {
+		lastID, err := h.ol.LastID()
+		if err != nil {
+			return nil, err
+		}
+		if lastID != nil {
+			last = lastID.(*OperationLastID).ObjectId
+		}
+	}
+
+	h.mu.Lock()
+	if h.stop == nil && running {
+		// The hub stopped meanwhile, its position must be fetched again
+		h.mu.Unlock()
+		return h.subscribe()
+	}
+	defer h.mu.Unlock()
+
+	if h.stop == nil {
+		h.last = last
+		h.stop = make(chan struct{})
+		go h.run(h.last, h.stop)
+	}
+
+	queueSize := h.ol.SharedTailQueueSize
+	if queueSize < 1 {
+		queueSize = 1
+	}
+	sub := &subscriber{
+		ops:  make(chan *Operation, queueSize),
+		from: h.last,
+	}
+	h.subs[sub] = true
+	h.ol.Stats.SharedTailSubscribers.Add(1)
+	return sub, nil
+}
+
+// unsubscribe removes the subscriber from the hub, stopping the tailing goroutine if
+// it was the last one.
+func (h *hub) unsubscribe(sub *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.subs[sub] {
+		delete(h.subs, sub)
+		h.ol.Stats.SharedTailSubscribers.Add(-1)
+	}
+	if len(h.subs) == 0 && h.stop != nil {
+		close(h.stop)
+		h.stop = nil
+	}
+}
+
+// dispatch sends the operation to every subscriber. Subscribers with a full queue are
+// evicted so a slow subscriber never stalls the others. It returns false if the given
+// stop channel is not the one of the running tailing goroutine anymore.
+func (h *hub) dispatch(op *Operation, stop chan struct{}) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.stop != stop {
+		return false
+	}
+	h.last = op.ID
+	for sub := range h.subs {
+		select {
+		case sub.ops <- op:
+		default:
+			delete(h.subs, sub)
+			close(sub.ops)
+			h.ol.Stats.SharedTailSubscribers.Add(-1)
+			h.ol.Stats.SharedTailEvictions.Add(1)
+		}
+	}
+	return true
+}
+
+// run tails the oplog_ops collection after the given id and dispatches the operations
+// until the stop channel is closed.
+func (h *hub) run(last *bson.ObjectId, stop chan struct{}) {
+	h.ol.logger().Debugf("OPLOG start shared tail")
+	defer h.ol.logger().Debugf("OPLOG shared tail stopped")
+
+	db := h.ol.db()
+	defer db.Session.Close()
+
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = 0 // Retry forever
+	b.Reset()
+
+	opened := false
+	for {
+		query := bson.M{}
+		if last != nil {
+			query["_id"] = bson.M{"$gt": *last}
+		}
+		start := time.Now()
+		iter := db.C("oplog_ops").Find(query).Sort("$natural").Tail(5 * time.Second)
+		h.ol.observeMongo("tail", time.Since(start))
+		h.ol.cursorOpened(opened)
+		opened = true
+
+		for {
+			raw := bson.Raw{}
+			for iter.Next(&raw) {
+				op, err := decodeStoredOperation(raw)
+				if err != nil {
+					h.ol.undecodable(err)
+					continue
+				}
+				if !h.dispatch(op, stop) {
+					iter.Close()
+					return
+				}
+				last = op.ID
+				b.Reset()
+			}
+			if iter.Timeout() {
+				select {
+				case <-stop:
+					iter.Close()
+					return
+				default:
+					continue
+				}
+			}
+			break
+		}
+
+		if err := iter.Close(); err != nil {
+			h.ol.warnSampled(err, "OPLOG shared tail failed with error, try to reconnect: %s", err)
+		}
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		time.Sleep(b.NextBackOff())
+		h.ol.refresh(db)
+	}
+}
@@ -0,0 +1,125 @@
+package oplog
+
+import (
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestHub returns a hub marked as running so no Mongo cursor is opened
+func newTestHub(queueSize int) (*hub, chan struct{}) {
+	ol := newTestOpLog()
+	ol.SharedTailQueueSize = queueSize
+	stop := make(chan struct{})
+	ol.hub.stop = stop
+	return ol.hub, stop
+}
+
+func newTestOperation(typ string) *Operation {
+	return NewOperation("insert", time.Now(), "1", typ, nil)
+}
+
+func TestHubDispatch(t *testing.T) {
+	h, stop := newTestHub(10)
+	s1, _ := h.subscribe()
+	s2, _ := h.subscribe()
+	op := newTestOperation("a")
+	if !h.dispatch(op, stop) {
+		t.Fatal("dispatch refused")
+	}
+	if <-s1.ops != op || <-s2.ops != op {
+		t.Fatal("operation not dispatched to all subscribers")
+	}
+	if *h.last != *op.ID {
+		t.Fatal("hub position not updated")
+	}
+}
+
+func TestHubSubscribePosition(t *testing.T) {
+	h, stop := newTestHub(10)
+	op := newTestOperation("a")
+	h.dispatch(op, stop)
+	sub, _ := h.subscribe()
+	if sub.from == nil || *sub.from != *op.ID {
+		t.Fatal("subscriber position doesn't match the hub position")
+	}
+}
+
+func TestHubEvictSlowSubscriber(t *testing.T) {
+	h, stop := newTestHub(1)
+	slow, _ := h.subscribe()
+	fast, _ := h.subscribe()
+	h.dispatch(newTestOperation("a"), stop)
+	<-fast.ops
+	h.dispatch(newTestOperation("a"), stop)
+	<-fast.ops
+	if len(h.subs) != 1 || !h.subs[fast] {
+		t.Fatal("slow subscriber not evicted")
+	}
+	<-slow.ops
+	if _, ok := <-slow.ops; ok {
+		t.Fatal("slow subscriber queue not closed")
+	}
+}
+
+func TestHubStoppedDispatch(t *testing.T) {
+	h, stop := newTestHub(10)
+	sub, _ := h.subscribe()
+	h.unsubscribe(sub)
+	if h.stop != nil {
+		t.Fatal("hub not stopped with its last subscriber")
+	}
+	if h.dispatch(newTestOperation("a"), stop) {
+		t.Fatal("stopped hub dispatched an operation")
+	}
+}
+
+func BenchmarkHubDispatch100Subscribers(b *testing.B) {
+	const subscribers = 100
+	h, stop := newTestHub(1000)
+	var received int64
+	wg := sync.WaitGroup{}
+	for i := 0; i < subscribers; i++ {
+		sub, _ := h.subscribe()
+		f := Filter{Types: []string{strconv.Itoa(i % 10)}}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for op := range sub.ops {
+				f.match(op.Data)
+				atomic.AddInt64(&received, 1)
+			}
+		}()
+	}
+	ops := make([]*Operation, 10)
+	for i := range ops {
+		ops[i] = newTestOperation(strconv.Itoa(i))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.dispatch(ops[i%10], stop)
+		if i%500 == 499 {
+			// Let the subscribers drain their queue so none of them get evicted
+			for atomic.LoadInt64(&received) < int64(i+1)*subscribers {
+				runtime.Gosched()
+			}
+		}
+	}
+	for atomic.LoadInt64(&received) < int64(b.N)*subscribers {
+		runtime.Gosched()
+	}
+	b.StopTimer()
+	if len(h.subs) != subscribers {
+		b.Fatal("subscribers evicted during the benchmark")
+	}
+	h.mu.Lock()
+	for sub := range h.subs {
+		close(sub.ops)
+	}
+	h.subs = map[*subscriber]bool{}
+	h.mu.Unlock()
+	wg.Wait()
+}
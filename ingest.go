@@ -1,47 +1,63 @@
 package oplog
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"strings"
 	"time"
 )
 
-// inOperation represents an Operation ingested as JSON.
-type inOperation struct {
-	Event     string     `json:"event"`
-	Parents   []string   `json:"parents"`
-	Type      string     `json:"type"`
-	ID        string     `json:"id"`
-	Timestamp *time.Time `json:"timestamp,omniempty"`
-}
-
-// decodeOperation parses JSON data and returns an Operation on success.
+// decodeOperation parses JSON data in the wire schema and returns an Operation on
+// success. The id given by the producer, if any, is ignored and the timestamp defaults to
+// now.
 func decodeOperation(data []byte) (*Operation, error) {
-	operation := inOperation{}
-	err := json.Unmarshal(data, &operation)
-	if err != nil {
+	op := &Operation{}
+	if err := json.Unmarshal(data, op); err != nil {
 		return nil, err
 	}
-
-	// The timestamp field is optional
-	var timestamp time.Time
-	if operation.Timestamp != nil {
-		timestamp = *operation.Timestamp
-	} else {
-		timestamp = time.Now()
-	}
-
-	op := &Operation{
-		Event: strings.ToLower(operation.Event),
-		Data: &OperationData{
-			Timestamp: timestamp,
-			Parents:   operation.Parents,
-			Type:      strings.ToLower(operation.Type),
-			ID:        operation.ID,
-		},
+	op.ID = nil
+	op.Event = strings.ToLower(op.Event)
+	op.Data.Type = strings.ToLower(op.Data.Type)
+	if op.Data.Timestamp.IsZero() {
+		op.Data.Timestamp = time.Now()
 	}
 	if err := op.Validate(); err != nil {
 		return nil, err
 	}
 	return op, nil
 }
+
+// decodeOperations parses JSON data containing either a single operation or an array of
+// operations. Operations failing to decode or validate are reported in the errs map by
+// index in the batch. An error is returned if the data is not a valid JSON object or array.
+func decodeOperations(data []byte) (ops []*Operation, errs map[int]error, err error) {
+	data = bytes.TrimSpace(data)
+	items := []json.RawMessage{}
+	if len(data) > 0 && data[0] == '[' {
+		if err := json.Unmarshal(data, &items); err != nil {
+			return nil, nil, err
+		}
+		if len(items) == 0 {
+			return nil, nil, errors.New("empty batch")
+		}
+	} else {
+		items = append(items, data)
+	}
+
+	errs = map[int]error{}
+	for i, item := range items {
+		op, err := decodeOperation(item)
+		if err != nil {
+			if len(items) == 1 {
+				if _, ok := err.(*json.SyntaxError); ok {
+					return nil, nil, err
+				}
+			}
+			errs[i] = err
+			continue
+		}
+		ops = append(ops, op)
+	}
+	return ops, errs, nil
+}
@@ -0,0 +1,74 @@
+package oplog
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ParseCIDRs parses a list of networks in the CIDR notation (i.e.: 10.0.0.0/8 or fd00::/8)
+// for the AllowedCIDRs and DeniedCIDRs of the daemon. Single IPs are accepted as /32 or
+// /128 networks.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid CIDR %q", cidr)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", cidr)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// ipAllowed tells if ip is allowed by the AllowedCIDRs and DeniedCIDRs of the daemon. A
+// denied network wins over an allowed one. Invalid IPs are refused once a list is set.
+func (daemon *SSEDaemon) ipAllowed(ip string) bool {
+	if len(daemon.AllowedCIDRs) == 0 && len(daemon.DeniedCIDRs) == 0 {
+		return true
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range daemon.DeniedCIDRs {
+		if n.Contains(parsed) {
+			return false
+		}
+	}
+	if len(daemon.AllowedCIDRs) == 0 {
+		return true
+	}
+	for _, n := range daemon.AllowedCIDRs {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIP refuses the requests of the clients whose IP is not allowed with a 403 error
+func (daemon *SSEDaemon) checkIP(w http.ResponseWriter, r *http.Request) bool {
+	ip := daemon.clientIP(r)
+	if daemon.ipAllowed(ip) {
+		return true
+	}
+	daemon.logger().Warnf("IP[%s] request to %s refused by the IP filter", ip, r.URL.Path)
+	daemon.ol.Stats.BlockedRequests.Add(1)
+	writeError(w, 403, "ip_not_allowed", "client IP not allowed")
+	return false
+}
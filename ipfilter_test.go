@@ -0,0 +1,102 @@
+package oplog
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func mustParseCIDRs(t *testing.T, cidrs ...string) []*net.IPNet {
+	nets, err := ParseCIDRs(cidrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nets
+}
+
+func TestParseCIDRs(t *testing.T) {
+	nets := mustParseCIDRs(t, "10.0.0.0/8", " fd00::/8", "192.0.2.1", "2001:db8::1")
+	if len(nets) != 4 || nets[0].String() != "10.0.0.0/8" || nets[1].String() != "fd00::/8" || nets[2].String() != "192.0.2.1/32" || nets[3].String() != "2001:db8::1/128" {
+		t.Errorf("invalid networks: %v", nets)
+	}
+	for _, invalid := range []string{"10.0.0.0/33", "10.0.0", "", "example.com/8"} {
+		if _, err := ParseCIDRs([]string{"10.0.0.0/8", invalid}); err == nil || !strings.Contains(err.Error(), "invalid CIDR") {
+			t.Errorf("%q: expected an invalid CIDR error, got %v", invalid, err)
+		}
+	}
+}
+
+func TestIPAllowed(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	if !daemon.ipAllowed("203.0.113.1") || !daemon.ipAllowed("invalid") {
+		t.Fatal("IPs must be allowed without lists")
+	}
+
+	daemon.AllowedCIDRs = mustParseCIDRs(t, "10.0.0.0/8", "192.168.0.0/16", "fd00::/8")
+	daemon.DeniedCIDRs = mustParseCIDRs(t, "10.1.0.0/16", "fd00:bad::/32")
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"10.2.3.4", true},
+		{"192.168.1.1", true},
+		{"203.0.113.1", false},
+		// Denied networks win over the allowed ones they overlap
+		{"10.1.2.3", false},
+		{"fd00::1", true},
+		{"fd00:bad::1", false},
+		{"2001:db8::1", false},
+		{"::ffff:10.2.3.4", true},
+		{"invalid", false},
+	}
+	for _, test := range tests {
+		if allowed := daemon.ipAllowed(test.ip); allowed != test.allowed {
+			t.Errorf("%s: expected allowed=%v, got %v", test.ip, test.allowed, allowed)
+		}
+	}
+
+	// Without allow list, only the denied networks are refused
+	daemon.AllowedCIDRs = nil
+	if !daemon.ipAllowed("203.0.113.1") || daemon.ipAllowed("10.1.2.3") {
+		t.Error("deny list not applied alone")
+	}
+}
+
+func TestIPFilterRequests(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.AllowedCIDRs = mustParseCIDRs(t, "10.0.0.0/8")
+	daemon.TrustedProxyDepth = 1
+	blocked := testStats.BlockedRequests.Value()
+
+	get := func(path, remoteAddr, forwardedFor string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		rec := httptest.NewRecorder()
+		daemon.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if status := get("/status", "10.0.0.2:1234", ""); status != 200 {
+		t.Errorf("expected status 200, got %d", status)
+	}
+	if status := get("/status", "203.0.113.1:1234", ""); status != 403 {
+		t.Errorf("expected status 403, got %d", status)
+	}
+	// The client IP is read from the X-Forwarded-For header set by the trusted proxy
+	if status := get("/status", "10.0.0.2:1234", "203.0.113.1"); status != 403 {
+		t.Errorf("forwarded IP not filtered, got %d", status)
+	}
+	if status := get("/status", "10.0.0.2:1234", "203.0.113.1, 10.3.0.1"); status != 200 {
+		t.Errorf("forwarded IP not allowed, got %d", status)
+	}
+	// Health probes are not filtered
+	if status := get("/healthz", "203.0.113.1:1234", ""); status != 200 {
+		t.Errorf("expected status 200 for the health probe, got %d", status)
+	}
+	if n := testStats.BlockedRequests.Value() - blocked; n != 2 {
+		t.Errorf("expected 2 blocked requests, got %d", n)
+	}
+}
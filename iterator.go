@@ -0,0 +1,160 @@
+package oplog
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+var (
+	// ErrIteratorClosed is returned by Iterator.Next once the iterator has been closed
+	ErrIteratorClosed = errors.New("iterator closed")
+	// ErrTooManyTails is returned when the MaxConcurrentTails limit is reached
+	ErrTooManyTails = errors.New("too many concurrent tails")
+)
+
+// Iterator streams the oplog events with a pull API. It uses the same live and
+// replication logic as Tail, but lets the caller control the loop:
+//
+//	it := ol.Iterator(lastID, filter)
+//	defer it.Close()
+//	for {
+//		ev, err := it.Next(ctx)
+//		if err != nil {
+//			break
+//		}
+//		...
+//	}
+//
+// The Options and Retry fields must be set before the first call to Next.
+type Iterator struct {
+	// Options defines the tail options
+	Options TailOptions
+	// Retry makes the iterator retry with backoff on failures, like Tail does, instead
+	// of terminating Next with the failure cause.
+	Retry bool
+
+	ol     *OpLog
+	lastID LastID
+	filter Filter
+	// produce streams the events to out until quit is closed
+	produce func(out chan<- GenericEvent, quit chan struct{}) error
+
+	start  sync.Once
+	events chan GenericEvent
+	quit   chan struct{}
+	done   chan struct{}
+	closed sync.Once
+	err    error
+	last   GenericEvent
+}
+
+// Iterator returns an iterator over the operations after lastID matching the filter.
+// See Tail for the lastID semantics. The iterator must be closed once done.
+func (oplog *OpLog) Iterator(lastID LastID, filter Filter) *Iterator {
+	it := &Iterator{
+		ol:     oplog,
+		lastID: lastID,
+		filter: filter,
+		events: make(chan GenericEvent),
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	it.produce = it.tail
+	return it
+}
+
+// tail produces the iterator events using a tailer
+func (it *Iterator) tail(out chan<- GenericEvent, quit chan struct{}) error {
+	release, ok := it.ol.reserveTail(it.lastID)
+	if !ok {
+		it.ol.logger().Warnf("OPLOG too many concurrent tails, refusing iterator")
+		return ErrTooManyTails
+	}
+	defer release()
+	t := it.ol.newTailer(it.filter, it.Options, out, it.Retry)
+	t.quit = quit
+	return t.run(it.lastID)
+}
+
+// run starts producing the events
+func (it *Iterator) run() {
+	go func() {
+		defer close(it.done)
+		it.err = it.produce(it.events, it.quit)
+	}()
+}
+
+// Next returns the next event, waiting for it if needed. Once the stream is over, the
+// error which terminated it is returned, or io.EOF if the stream ended normally (i.e.:
+// the Until option has been reached). If the context is done before an event is
+// available, the context error is returned and the iterator can still be used.
+func (it *Iterator) Next(ctx context.Context) (GenericEvent, error) {
+	it.start.Do(it.run)
+	select {
+	case ev := <-it.events:
+		return it.returned(ev), nil
+	case <-it.done:
+		// Prefer the events sent before the end of the stream
+		select {
+		case ev := <-it.events:
+			return it.returned(ev), nil
+		default:
+		}
+		select {
+		case <-it.quit:
+			return nil, ErrIteratorClosed
+		default:
+		}
+		if it.err != nil {
+			return nil, it.err
+		}
+		return nil, io.EOF
+	case <-it.quit:
+		return nil, ErrIteratorClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// returned saves the event as the resume point if it has an id
+func (it *Iterator) returned(ev GenericEvent) GenericEvent {
+	if ev.GetEventID().String() != "" {
+		it.last = ev
+	}
+	return ev
+}
+
+// LastID returns the id of the last event returned by Next, which can be used to resume
+// the stream with a new iterator. If no event has been returned yet, the lastID the
+// iterator has been created with is returned.
+func (it *Iterator) LastID() LastID {
+	if it.last == nil {
+		return it.lastID
+	}
+	switch id := it.last.GetEventID().(type) {
+	case *OperationLastID, *ReplicationLastID:
+		return id
+	default:
+		// Special events like "reset" or "live" hold the id as a string, parse it as a
+		// consumer would do from the SSE stream
+		if lastID, err := NewLastID(id.String()); err == nil {
+			return lastID
+		}
+		return it.lastID
+	}
+}
+
+// Close stops the iterator and waits for its resources to be released. A blocked call
+// to Next returns ErrIteratorClosed.
+func (it *Iterator) Close() error {
+	it.closed.Do(func() {
+		close(it.quit)
+	})
+	it.start.Do(func() {
+		close(it.done)
+	})
+	<-it.done
+	return nil
+}
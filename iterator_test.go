@@ -0,0 +1,132 @@
+package oplog
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// newTestIterator creates an iterator producing events with the given function
+func newTestIterator(lastID LastID, produce func(lastID LastID, out chan<- GenericEvent, quit chan struct{}) error) *Iterator {
+	it := newTestOpLog().Iterator(lastID, Filter{})
+	it.produce = func(out chan<- GenericEvent, quit chan struct{}) error {
+		return produce(it.lastID, out, quit)
+	}
+	return it
+}
+
+// testOperations produces n operations after the given id then ends the stream
+func testOperations(n int) func(lastID LastID, out chan<- GenericEvent, quit chan struct{}) error {
+	return func(lastID LastID, out chan<- GenericEvent, quit chan struct{}) error {
+		ts := time.Unix(1423995187, 0)
+		if lastID != nil {
+			ts = lastID.Time().Add(time.Second)
+		}
+		for i := 0; i < n; i++ {
+			id := bson.NewObjectIdWithTime(ts.Add(time.Duration(i) * time.Second))
+			select {
+			case out <- Operation{ID: &id, Event: "insert", Data: &OperationData{ID: "1", Type: "video"}}:
+			case <-quit:
+				return nil
+			}
+		}
+		return nil
+	}
+}
+
+func TestIteratorResume(t *testing.T) {
+	it := newTestIterator(nil, testOperations(3))
+	ctx := context.Background()
+	var last GenericEvent
+	for i := 0; i < 2; i++ {
+		ev, err := it.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		last = ev
+	}
+	it.Close()
+	if it.LastID().String() != last.GetEventID().String() {
+		t.Fatal("invalid last id")
+	}
+
+	it = newTestIterator(it.LastID(), testOperations(1))
+	defer it.Close()
+	ev, err := it.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ev.GetEventID().Time().After(last.GetEventID().Time()) {
+		t.Fatal("iterator not resumed after the last id")
+	}
+	if _, err := it.Next(ctx); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestIteratorError(t *testing.T) {
+	failure := errors.New("failure")
+	it := newTestIterator(nil, func(lastID LastID, out chan<- GenericEvent, quit chan struct{}) error {
+		return failure
+	})
+	defer it.Close()
+	if _, err := it.Next(context.Background()); err != failure {
+		t.Fatalf("expected failure, got %v", err)
+	}
+}
+
+func TestIteratorCloseWhileBlocked(t *testing.T) {
+	it := newTestIterator(nil, func(lastID LastID, out chan<- GenericEvent, quit chan struct{}) error {
+		<-quit
+		return nil
+	})
+	errs := make(chan error)
+	go func() {
+		_, err := it.Next(context.Background())
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	it.Close()
+	select {
+	case err := <-errs:
+		if err != ErrIteratorClosed {
+			t.Fatalf("expected ErrIteratorClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Next still blocked after Close")
+	}
+	if _, err := it.Next(context.Background()); err != ErrIteratorClosed {
+		t.Fatalf("expected ErrIteratorClosed, got %v", err)
+	}
+}
+
+func TestIteratorContextCancel(t *testing.T) {
+	release := make(chan struct{})
+	it := newTestIterator(nil, func(lastID LastID, out chan<- GenericEvent, quit chan struct{}) error {
+		<-release
+		return testOperations(1)(lastID, out, quit)
+	})
+	defer it.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := it.Next(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	// The iterator is still usable after a cancelled call
+	close(release)
+	if _, err := it.Next(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIteratorCloseNotStarted(t *testing.T) {
+	it := newTestIterator(nil, testOperations(1))
+	it.Close()
+	if _, err := it.Next(context.Background()); err != ErrIteratorClosed {
+		t.Fatalf("expected ErrIteratorClosed, got %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+package oplog
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The operations have a single JSON wire schema, used by the events of the SSE, WebSocket
+// and long polling streams and read by the HTTP and UDP ingest endpoints:
+//
+//	{
+//	    "id": "545b55c7f095528dd0f3863c",
+//	    "event": "insert",
+//	    "data": {
+//	        "timestamp": "2014-11-06T03:04:39.041-08:00",
+//	        "parents": ["user/xl2d"],
+//	        "type": "video",
+//	        "id": "x34cd",
+//	        "ref": "http://api.mydomain.com/video/x34cd",
+//	        "meta": {"origin": "api"},
+//	        "revision": 3,
+//	        "payload": {"title": "cat"}
+//	    }
+//	}
+//
+// The timestamps are RFC 3339 dates with milliseconds, the parents are always an array and
+// the ref, meta, revision and payload fields are omitted when empty, the payload being
+// only sent to the clients asking for it. The SSE events carry the id and event as SSE
+// fields and the data as JSON. Other events, like "reset", have an id, an event and their
+// data if any.
+//
+// The ingest endpoints also accept timestamps of any precision, the operations without id
+// and the operations with their data fields at the root instead of in a data object.
+
+// wireTimeFormat is the format of the timestamps of the wire schema, RFC 3339 with
+// milliseconds
+const wireTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// wireOperationData is the wire schema of OperationData as read by UnmarshalJSON
+type wireOperationData struct {
+	Timestamp *time.Time             `json:"timestamp"`
+	Parents   []string               `json:"parents"`
+	Type      string                 `json:"type"`
+	ID        string                 `json:"id"`
+	Ref       string                 `json:"ref"`
+	Meta      map[string]string      `json:"meta"`
+	Revision  int64                  `json:"revision"`
+	Payload   map[string]interface{} `json:"payload"`
+}
+
+// wireTime is a timestamp marshalled with milliseconds
+type wireTime time.Time
+
+// MarshalJSON formats the timestamp with wireTimeFormat
+func (t wireTime) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + time.Time(t).Format(wireTimeFormat) + `"`), nil
+}
+
+// MarshalJSON returns the data in the wire schema, without its payload
+func (obd OperationData) MarshalJSON() ([]byte, error) {
+	return obd.marshal(false)
+}
+
+// marshal returns the data in the wire schema, with the payload if payload is true
+func (obd *OperationData) marshal(payload bool) ([]byte, error) {
+	if obd == nil {
+		return []byte("null"), nil
+	}
+	parents := obd.Parents
+	if parents == nil {
+		parents = []string{}
+	}
+	wire := struct {
+		Timestamp wireTime               `json:"timestamp"`
+		Parents   []string               `json:"parents"`
+		Type      string                 `json:"type"`
+		ID        string                 `json:"id"`
+		Ref       string                 `json:"ref,omitempty"`
+		Meta      map[string]string      `json:"meta,omitempty"`
+		Revision  int64                  `json:"revision,omitempty"`
+		Payload   map[string]interface{} `json:"payload,omitempty"`
+	}{wireTime(obd.Timestamp), parents, obd.Type, obd.ID, obd.Ref, obd.Meta, obd.Revision, nil}
+	if payload {
+		wire.Payload = obd.Payload
+	}
+	return json.Marshal(wire)
+}
+
+// UnmarshalJSON reads data in the wire schema, the timestamp being zero if not given
+func (obd *OperationData) UnmarshalJSON(b []byte) error {
+	wire := wireOperationData{}
+	if err := json.Unmarshal(b, &wire); err != nil {
+		return err
+	}
+	*obd = OperationData{
+		Parents:  wire.Parents,
+		Type:     wire.Type,
+		ID:       wire.ID,
+		Ref:      wire.Ref,
+		Meta:     wire.Meta,
+		Revision: wire.Revision,
+		Payload:  wire.Payload,
+	}
+	if wire.Timestamp != nil {
+		obd.Timestamp = *wire.Timestamp
+	}
+	return nil
+}
+
+// MarshalJSON returns the operation in the wire schema, its id omitted if not assigned
+func (op Operation) MarshalJSON() ([]byte, error) {
+	id := ""
+	if op.ID != nil {
+		id = op.ID.Hex()
+	}
+	return json.Marshal(struct {
+		ID    string         `json:"id,omitempty"`
+		Event string         `json:"event"`
+		Data  *OperationData `json:"data"`
+	}{id, op.Event, op.Data})
+}
+
+// UnmarshalJSON reads an operation in the wire schema. Without data object, the data
+// fields are read from the root of the operation, its id being the one of the object.
+func (op *Operation) UnmarshalJSON(b []byte) error {
+	wire := struct {
+		ID    string          `json:"id"`
+		Event string          `json:"event"`
+		Data  json.RawMessage `json:"data"`
+	}{}
+	if err := json.Unmarshal(b, &wire); err != nil {
+		return err
+	}
+	*op = Operation{Event: wire.Event, Data: &OperationData{}}
+	if len(wire.Data) == 0 || string(wire.Data) == "null" {
+		return json.Unmarshal(b, op.Data)
+	}
+	if wire.ID != "" {
+		if !bson.IsObjectIdHex(wire.ID) {
+			return errors.New("invalid operation id: " + wire.ID)
+		}
+		id := bson.ObjectIdHex(wire.ID)
+		op.ID = &id
+	}
+	return json.Unmarshal(wire.Data, op.Data)
+}
+
+// MarshalJSON returns the event in the wire schema, with its data if any, see
+// Event.EventData
+func (e Event) MarshalJSON() ([]byte, error) {
+	data, err := e.EventData()
+	if err != nil {
+		return nil, err
+	}
+	wire := struct {
+		ID    string          `json:"id,omitempty"`
+		Event string          `json:"event"`
+		Data  json.RawMessage `json:"data,omitempty"`
+	}{e.ID, e.Event, data}
+	return json.Marshal(wire)
+}
+
+// UnmarshalJSON reads an event in the wire schema. Its data is read as Metadata when it
+// is an object, as Data otherwise.
+func (e *Event) UnmarshalJSON(b []byte) error {
+	wire := struct {
+		ID    string          `json:"id"`
+		Event string          `json:"event"`
+		Data  json.RawMessage `json:"data"`
+	}{}
+	if err := json.Unmarshal(b, &wire); err != nil {
+		return err
+	}
+	*e = Event{ID: wire.ID, Event: wire.Event}
+	if len(wire.Data) == 0 || string(wire.Data) == "null" {
+		return nil
+	}
+	if wire.Data[0] == '{' {
+		return json.Unmarshal(wire.Data, &e.Metadata)
+	}
+	return json.Unmarshal(wire.Data, &e.Data)
+}
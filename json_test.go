@@ -0,0 +1,202 @@
+package oplog
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestWireSchemaGolden(t *testing.T) {
+	id := bson.ObjectIdHex("545b55c7f095528dd0f3863c")
+	pst := time.FixedZone("PST", -8*3600)
+	for _, test := range []struct {
+		name   string
+		v      interface{}
+		golden string
+	}{
+		{
+			"operation",
+			Operation{ID: &id, Event: "insert", Data: &OperationData{
+				Timestamp: time.Date(2014, 11, 6, 3, 4, 39, 41123456, pst),
+				Parents:   []string{"user/xl2d"},
+				Type:      "video",
+				ID:        "x34cd",
+				Ref:       "http://api.mydomain.com/video/x34cd",
+				Meta:      map[string]string{"origin": "api"},
+				Revision:  3,
+				Payload:   map[string]interface{}{"title": "cat"},
+			}},
+			`{"id":"545b55c7f095528dd0f3863c","event":"insert","data":{"timestamp":"2014-11-06T03:04:39.041-08:00","parents":["user/xl2d"],"type":"video","id":"x34cd","ref":"http://api.mydomain.com/video/x34cd","meta":{"origin":"api"},"revision":3}}`,
+		},
+		{
+			"minimal operation",
+			Operation{Event: "delete", Data: &OperationData{Timestamp: time.Date(2014, 11, 6, 3, 4, 39, 0, time.UTC), Type: "video", ID: "x34cd"}},
+			`{"event":"delete","data":{"timestamp":"2014-11-06T03:04:39.000Z","parents":[],"type":"video","id":"x34cd"}}`,
+		},
+		{
+			"operation without data",
+			Operation{ID: &id, Event: "insert"},
+			`{"id":"545b55c7f095528dd0f3863c","event":"insert","data":null}`,
+		},
+		{
+			"event",
+			Event{ID: "545b55c7f095528dd0f3863c", Event: "live", Metadata: map[string]interface{}{"pages": 3}},
+			`{"id":"545b55c7f095528dd0f3863c","event":"live","data":{"pages":3}}`,
+		},
+		{
+			"event without metadata",
+			&Event{Event: "reset"},
+			`{"event":"reset"}`,
+		},
+	} {
+		b, err := json.Marshal(test.v)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if string(b) != test.golden {
+			t.Errorf("%s: format changed:\n%s\nexpected:\n%s", test.name, b, test.golden)
+		}
+	}
+}
+
+func TestWireSchemaUnmarshal(t *testing.T) {
+	id := bson.ObjectIdHex("545b55c7f095528dd0f3863c")
+	ts := time.Date(2014, 11, 6, 11, 4, 39, 41000000, time.UTC)
+	for _, test := range []struct {
+		data string
+		op   Operation
+	}{
+		{
+			`{"id":"545b55c7f095528dd0f3863c","event":"insert","data":{"timestamp":"2014-11-06T03:04:39.041-08:00","parents":["user/xl2d"],"type":"video","id":"x34cd","ref":"http://a/x34cd","meta":{"origin":"api"},"revision":3,"payload":{"title":"cat"}}}`,
+			Operation{ID: &id, Event: "insert", Data: &OperationData{Timestamp: ts, Parents: []string{"user/xl2d"}, Type: "video", ID: "x34cd", Ref: "http://a/x34cd", Meta: map[string]string{"origin": "api"}, Revision: 3, Payload: map[string]interface{}{"title": "cat"}}},
+		},
+		// The ingest format, with the data fields at the root and a timestamp of any
+		// precision
+		{
+			`{"event":"update","timestamp":"2014-11-06T11:04:39.041Z","type":"video","id":"x34cd","revision":4}`,
+			Operation{Event: "update", Data: &OperationData{Timestamp: ts, Type: "video", ID: "x34cd", Revision: 4}},
+		},
+		{
+			`{"event":"delete","data":{"type":"video","id":"x34cd"}}`,
+			Operation{Event: "delete", Data: &OperationData{Type: "video", ID: "x34cd"}},
+		},
+	} {
+		op := Operation{}
+		if err := json.Unmarshal([]byte(test.data), &op); err != nil {
+			t.Fatalf("%s: %s", test.data, err)
+		}
+		if !op.Data.Timestamp.Equal(test.op.Data.Timestamp) {
+			t.Errorf("%s: invalid timestamp %s", test.data, op.Data.Timestamp)
+		}
+		op.Data.Timestamp = test.op.Data.Timestamp
+		if !reflect.DeepEqual(op, test.op) {
+			t.Errorf("%s: invalid operation %#v", test.data, op)
+		}
+	}
+
+	for _, invalid := range []string{
+		`{"id":"x34cd","event":"insert","data":{"type":"video","id":"x34cd"}}`,
+		`{"event":"insert","data":{"timestamp":"yesterday","type":"video","id":"x34cd"}}`,
+		`{"event":"insert","parents":"user/xl2d","type":"video","id":"x34cd"}`,
+	} {
+		if err := json.Unmarshal([]byte(invalid), &Operation{}); err == nil {
+			t.Errorf("%s: expected an error", invalid)
+		}
+	}
+}
+
+// randomOperation returns an operation with random fields, as read from MongoDB
+func randomOperation(r *rand.Rand) Operation {
+	id := bson.NewObjectId()
+	word := func() string {
+		return strconv.FormatInt(r.Int63(), 36)
+	}
+	data := &OperationData{
+		// MongoDB keeps the milliseconds
+		Timestamp: time.Unix(r.Int63n(1<<32), r.Int63n(1000)*1000000).In(time.FixedZone("", (r.Intn(48)-24)*1800)),
+		Parents:   []string{},
+		Type:      word(),
+		ID:        word(),
+	}
+	for i := r.Intn(3); i > 0; i-- {
+		data.Parents = append(data.Parents, word()+"/"+word())
+	}
+	if r.Intn(2) == 0 {
+		data.Ref = "http://api.mydomain.com/" + data.ID
+	}
+	if r.Intn(2) == 0 {
+		data.Meta = map[string]string{word(): word()}
+	}
+	if r.Intn(2) == 0 {
+		data.Revision = r.Int63()
+	}
+	return Operation{ID: &id, Event: []string{"insert", "update", "delete"}[r.Intn(3)], Data: data}
+}
+
+func TestWireSchemaRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		op := randomOperation(r)
+		b, err := json.Marshal(op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded := Operation{}
+		if err := json.Unmarshal(b, &decoded); err != nil {
+			t.Fatalf("%s: %s", b, err)
+		}
+		if !decoded.Data.Timestamp.Equal(op.Data.Timestamp) {
+			t.Fatalf("%s: timestamp changed to %s", b, decoded.Data.Timestamp)
+		}
+		decoded.Data.Timestamp = op.Data.Timestamp
+		if !reflect.DeepEqual(decoded, op) {
+			t.Fatalf("%s: operation changed:\n%#v\n%#v", b, decoded.Data, op.Data)
+		}
+		// Marshalling again gives the same JSON
+		if again, _ := json.Marshal(decoded); !bytes.Equal(again, b) {
+			t.Fatalf("%s: marshalled again as %s", b, again)
+		}
+
+		// The SSE, WebSocket and long polling representations carry the same JSON
+		sse := &bytes.Buffer{}
+		op.WriteTo(sse)
+		data, _ := json.Marshal(op.Data)
+		if expected := "id: " + op.ID.Hex() + "\nevent: " + op.Event + "\ndata: " + string(data) + "\n\n"; sse.String() != expected {
+			t.Fatalf("invalid SSE event:\n%s\nexpected:\n%s", sse, expected)
+		}
+		if msg, err := eventJSON(op); err != nil || !bytes.Equal(msg, b) {
+			t.Fatalf("invalid WebSocket message:\n%s\nexpected:\n%s", msg, b)
+		}
+	}
+}
+
+func TestWireSchemaEventRoundTrip(t *testing.T) {
+	for _, e := range []Event{
+		{ID: "1", Event: "reset"},
+		{ID: "545b55c7f095528dd0f3863c", Event: "live", Metadata: map[string]interface{}{"pages": float64(3)}},
+		// The data other than objects is read as Data
+		{Event: "retry-later", Data: float64(30)},
+		{ID: "1", Event: "resync-required", Data: []interface{}{"types"}},
+	} {
+		b, err := json.Marshal(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded := Event{}
+		if err := json.Unmarshal(b, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decoded, e) {
+			t.Errorf("%s: event changed: %#v", b, decoded)
+		}
+		if msg, err := eventJSON(e); err != nil || !bytes.Equal(msg, b) {
+			t.Errorf("invalid WebSocket message:\n%s\nexpected:\n%s", msg, b)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package oplog
+
+import (
+	"time"
+)
+
+// delivered records the time of an operation sent to the client and its lag behind head.
+// Object states being replicated don't tell how far behind the client is, they are not
+// recorded.
+func (c *connection) delivered(ev GenericEvent, head time.Time) {
+	switch ev.(type) {
+	case Operation, *Operation:
+	default:
+		return
+	}
+	t := ev.GetEventID().Time()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Once the replication is done, the stream goes on with the live operations
+	c.info.Mode = "live"
+	c.info.lastEventTime = t
+	c.info.Lag = lagMillis(head, t)
+}
+
+// lagMillis returns the time in milliseconds between t and head, 0 if t is after head
+func lagMillis(head, t time.Time) int64 {
+	if lag := head.Sub(t); lag > 0 {
+		return int64(lag / time.Millisecond)
+	}
+	return 0
+}
+
+// observeHead records the time of the most recent operation known by the daemon and
+// returns the most recent one
+func (daemon *SSEDaemon) observeHead(t time.Time) time.Time {
+	daemon.headMu.Lock()
+	defer daemon.headMu.Unlock()
+	if t.After(daemon.head) {
+		daemon.head = t
+	}
+	return daemon.head
+}
+
+// refreshLags updates the lag of the live streams against head and the ClientsMaxLag and
+// ClientsMeanLag statistics. Streams replicating object states or which didn't send any
+// operation yet are not counted.
+func (daemon *SSEDaemon) refreshLags(head time.Time) {
+	head = daemon.observeHead(head)
+	daemon.connsMu.Lock()
+	conns := make([]*connection, 0, len(daemon.conns))
+	for c := range daemon.conns {
+		conns = append(conns, c)
+	}
+	daemon.connsMu.Unlock()
+
+	var max, total, n int64
+	for _, c := range conns {
+		c.mu.Lock()
+		if c.info.Mode == "live" && !c.info.lastEventTime.IsZero() {
+			lag := lagMillis(head, c.info.lastEventTime)
+			c.info.Lag = lag
+			if lag > max {
+				max = lag
+			}
+			total += lag
+			n++
+		}
+		c.mu.Unlock()
+	}
+	var mean int64
+	if n > 0 {
+		mean = total / n
+	}
+	daemon.ol.Stats.ClientsMaxLag.Set(max)
+	daemon.ol.Stats.ClientsMeanLag.Set(mean)
+}
+
+// monitorLags refreshes the lags every LagRefreshInterval against the most recent
+// operation of the oplog, so the lag of the streams waiting on a slow client keeps
+// growing, until stop is closed
+func (daemon *SSEDaemon) monitorLags(stop <-chan struct{}) {
+	ticker := time.NewTicker(daemon.LagRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			var head time.Time
+			if lastID, err := daemon.lastID(); err != nil {
+				daemon.logger().Debugf("SSE can't get the last id to refresh the lags: %s", err)
+			} else if lastID != nil {
+				head = lastID.Time()
+			}
+			daemon.refreshLags(head)
+		case <-stop:
+			daemon.ol.Stats.ClientsMaxLag.Set(0)
+			daemon.ol.Stats.ClientsMeanLag.Set(0)
+			return
+		}
+	}
+}
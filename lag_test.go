@@ -0,0 +1,119 @@
+package oplog
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// heldResponseWriter holds back the writes following the one of hold until release is
+// closed, like a client not reading its stream
+type heldResponseWriter struct {
+	flushResponseWriter
+	rec     *httptest.ResponseRecorder
+	hold    string
+	release chan struct{}
+}
+
+func (w heldResponseWriter) Write(b []byte) (int, error) {
+	if strings.Contains(w.rec.Body.String(), w.hold) {
+		<-w.release
+	}
+	return w.flushResponseWriter.Write(b)
+}
+
+func TestLagRefresh(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	stats := *daemon.ol.Stats
+	stats.ClientsMaxLag = new(Int)
+	stats.ClientsMeanLag = new(Int)
+	daemon.ol.Stats = &stats
+	daemon.LagRefreshInterval = 10 * time.Millisecond
+	var headTime atomic.Value
+	headTime.Store(time.Now())
+	daemon.lastID = func() (LastID, error) {
+		id := bson.NewObjectIdWithTime(headTime.Load().(time.Time))
+		return &OperationLastID{&id}, nil
+	}
+	old := bson.NewObjectIdWithTime(time.Now().Add(-time.Minute))
+	recent := bson.NewObjectIdWithTime(time.Now().Add(time.Hour))
+	daemon.tail = func(lastID LastID, filter Filter, opts TailOptions, out chan<- GenericEvent, stop <-chan bool) {
+		for _, id := range []bson.ObjectId{old, recent} {
+			id := id
+			select {
+			case out <- Operation{ID: &id, Event: "insert", Data: &OperationData{ID: "1", Type: "video"}}:
+			case <-stop:
+				return
+			}
+		}
+		<-stop
+	}
+	rec := httptest.NewRecorder()
+	w := heldResponseWriter{flushResponseWriter{rec}, rec, old.Hex(), make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		daemon.ServeHTTP(w, newTestSSERequest(ctx))
+		close(done)
+	}()
+
+	// The client holds back the recent operation, the lag grows with the head
+	lagAbove := func(min int64) int64 {
+		t.Helper()
+		for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+			if lag := stats.ClientsMaxLag.Value(); lag > min {
+				return lag
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("lag not above %d: %d", min, stats.ClientsMaxLag.Value())
+			}
+		}
+	}
+	lag := lagAbove(50 * 1000)
+	headTime.Store(time.Now().Add(time.Minute))
+	grown := lagAbove(lag + 50*1000)
+	if mean := stats.ClientsMeanLag.Value(); mean != grown {
+		t.Errorf("expected a mean lag of %d with a single client, got %d", grown, mean)
+	}
+	if conns := daemon.Connections(); len(conns) != 1 || conns[0].Mode != "live" || conns[0].Lag != grown {
+		t.Errorf("invalid connection lag: %#v", conns)
+	}
+
+	// Once the client reads the recent operation, it is no longer lagging
+	close(w.release)
+	for deadline := time.Now().Add(time.Second); stats.ClientsMaxLag.Value() != 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("lag not reset: %d", stats.ClientsMaxLag.Value())
+		}
+	}
+	cancel()
+	<-done
+}
+
+func TestRefreshLagsReplication(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	stats := *daemon.ol.Stats
+	stats.ClientsMaxLag = new(Int)
+	stats.ClientsMeanLag = new(Int)
+	daemon.ol.Stats = &stats
+	head := time.Now()
+	live := &connection{info: ConnectionInfo{Mode: "live", lastEventTime: head.Add(-4 * time.Second)}}
+	caughtUp := &connection{info: ConnectionInfo{Mode: "live", lastEventTime: head}}
+	replication := &connection{info: ConnectionInfo{Mode: "replication"}}
+	for _, c := range []*connection{live, caughtUp, replication} {
+		daemon.register(c)
+		defer daemon.unregister(c)
+	}
+	daemon.refreshLags(head)
+	if max, mean := stats.ClientsMaxLag.Value(), stats.ClientsMeanLag.Value(); max != 4000 || mean != 2000 {
+		t.Errorf("expected max and mean lags of 4000 and 2000, got %d and %d", max, mean)
+	}
+	if lag := replication.snapshot().Lag; lag != 0 {
+		t.Errorf("expected no lag for a replication, got %d", lag)
+	}
+}
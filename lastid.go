@@ -1,8 +1,11 @@
 package oplog
 
 import (
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	"gopkg.in/mgo.v2/bson"
@@ -25,6 +28,10 @@ type OperationLastID struct {
 type ReplicationLastID struct {
 	int64
 	fallbackMode bool
+	// object is the id of the object state the id has been generated from if any, so a
+	// replication resumes precisely after it among the states of the same millisecond.
+	// It is encoded in the string representation, see parseStateID.
+	object string
 }
 
 // parseObjectID returns a bson.ObjectId from an hex representation of an object id or nil
@@ -38,11 +45,11 @@ func parseObjectID(id string) *bson.ObjectId {
 }
 
 // parseTimestampID try to find a millisecond timestamp in the string and return it or return
-// false as second value if can be parsed
+// false as second value if can be parsed. Signed numbers are not timestamps.
 func parseTimestampID(id string) (ts int64, ok bool) {
 	ts = -1
 	ok = false
-	if len(id) <= 13 {
+	if len(id) <= 13 && !strings.HasPrefix(id, "-") && !strings.HasPrefix(id, "+") {
 		if i, err := strconv.ParseInt(id, 10, 64); err == nil {
 			ts = i
 			ok = true
@@ -51,22 +58,140 @@ func parseTimestampID(id string) (ts int64, ok bool) {
 	return
 }
 
+// parseStateID parses the id of an object state, "<timestamp>:<object>" where object is
+// the _id of the state in unpadded base64url, see ReplicationLastID.String
+func parseStateID(id string) (*ReplicationLastID, bool) {
+	i := strings.IndexByte(id, ':')
+	if i == -1 {
+		return nil, false
+	}
+	ts, ok := parseTimestampID(id[:i])
+	if !ok {
+		return nil, false
+	}
+	object, err := base64.RawURLEncoding.DecodeString(id[i+1:])
+	if err != nil || len(object) == 0 {
+		return nil, false
+	}
+	return &ReplicationLastID{ts, false, string(object)}, true
+}
+
+// errInvalidLastID is returned for the last ids in none of the formats of NewLastID
+var errInvalidLastID = errors.New("Invalid last id")
+
+// maxTimestampID is the greatest millisecond timestamp of a replication id, whose string
+// representation must be parsed back by parseTimestampID
+const maxTimestampID = 9999999999999
+
+// parseTime parses a time given either as a millisecond timestamp, as an RFC 3339
+// representation or as a negative duration relative to now. An empty string returns a
+// zero time.
+func parseTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if ts, ok := parseTimestampID(value); ok {
+		return time.Unix(0, ts*1000000), nil
+	}
+	t, ok, err := parseHumanTime(value, now)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !ok {
+		return time.Time{}, fmt.Errorf("invalid time: %s", value)
+	}
+	return t, nil
+}
+
+// parseHumanTime parses the times written by humans: RFC 3339 dates, i.e.:
+// 2024-05-01T00:00:00Z, and negative durations relative to now, i.e.: -15m. ok is false
+// if value has none of these forms. The dates without time or time zone, the durations
+// without sign or unit and the times out of the range of the replication ids are refused.
+func parseHumanTime(value string, now time.Time) (t time.Time, ok bool, err error) {
+	switch {
+	case strings.HasPrefix(value, "+"):
+		return t, true, fmt.Errorf("relative time can't be in the future: %s", value)
+	case strings.HasPrefix(value, "-"):
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return t, true, fmt.Errorf("invalid relative time: %s, expected a negative duration like -15m", value)
+		}
+		t = now.Add(d)
+	case len(value) >= 10 && value[4] == '-' && value[7] == '-':
+		if t, err = time.Parse(time.RFC3339Nano, value); err != nil {
+			if _, err := time.Parse("2006-01-02", value); err == nil {
+				return t, true, fmt.Errorf("date without time: %s, expected an RFC 3339 date like %sT00:00:00Z", value, value)
+			}
+			if _, err := time.Parse("2006-01-02T15:04:05.999999999", value); err == nil {
+				return t, true, fmt.Errorf("date without time zone: %s, expected an RFC 3339 date like %sZ", value, value)
+			}
+			return t, true, fmt.Errorf("invalid date: %s, expected an RFC 3339 date like 2024-05-01T00:00:00Z", value)
+		}
+	default:
+		if _, err := time.ParseDuration(value); err == nil {
+			return t, true, fmt.Errorf("relative time without sign: %s, expected a negative duration like -%s", value, value)
+		}
+		return t, false, nil
+	}
+	if ms := timestampID(t); ms < 0 || ms > maxTimestampID {
+		return time.Time{}, true, fmt.Errorf("time out of range: %s", value)
+	}
+	return t, true, nil
+}
+
+// timestampID returns the millisecond timestamp of t
+func timestampID(t time.Time) int64 {
+	return t.Unix()*1000 + int64(t.Nanosecond()/1000000)
+}
+
+// splitFingerprint splits an event id into the last id and the filter fingerprint it has
+// been streamed with, if any. The RFC 3339 dates with fractional seconds are not split.
+func splitFingerprint(id string) (lastID, fingerprint string) {
+	if _, err := time.Parse(time.RFC3339Nano, id); err == nil {
+		return id, ""
+	}
+	if i := strings.LastIndex(id, "."); i != -1 {
+		return id[:i], id[i+1:]
+	}
+	return id, ""
+}
+
 // NewLastID creates a last id from a string containing either a operation id
-// or a replication id.
+// or a replication id. A replication id can also be given as an RFC 3339 date, i.e.:
+// 2024-05-01T00:00:00Z, or as a negative duration relative to now, i.e.: -15m. Its
+// String() representation is the millisecond timestamp in any case, followed by the
+// object state for the ids of the object states, see parseStateID.
 func NewLastID(id string) (LastID, error) {
+	return newLastID(id, time.Now())
+}
+
+// newLastID creates a last id like NewLastID, the relative durations being relative to now
+func newLastID(id string, now time.Time) (LastID, error) {
+	if rid, ok := parseStateID(id); ok {
+		return rid, nil
+	}
 	if ts, ok := parseTimestampID(id); ok {
 		// Id is a timestamp, timestamp are always valid
-		return &ReplicationLastID{ts, false}, nil
+		return &ReplicationLastID{ts, false, ""}, nil
 	}
 
-	oid := parseObjectID(id)
-	if oid == nil {
-		return nil, errors.New("Invalid last id")
+	if oid := parseObjectID(id); oid != nil {
+		return &OperationLastID{oid}, nil
+	}
+	t, ok, err := parseHumanTime(id, now)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errInvalidLastID
 	}
-	return &OperationLastID{oid}, nil
+	return &ReplicationLastID{timestampID(t), false, ""}, nil
 }
 
 func (rid ReplicationLastID) String() string {
+	if rid.object != "" {
+		return strconv.FormatInt(rid.int64, 10) + ":" + base64.RawURLEncoding.EncodeToString([]byte(rid.object))
+	}
 	return strconv.FormatInt(rid.int64, 10)
 }
 
@@ -83,5 +208,16 @@ func (oid OperationLastID) String() string {
 // the timestamp part of the Mongo ObjectId. If the id is not a valid ObjectId,
 // an error is returned.
 func (oid *OperationLastID) Fallback() LastID {
-	return &ReplicationLastID{oid.Time().UnixNano() / 1000000, true}
+	return oid.FallbackRewound(0)
+}
+
+// FallbackRewound converts an "event" id into a "replication" id like Fallback, rewound
+// by the given margin so the replication starts that much before the creation of the
+// operation, see OpLog.FallbackRewind.
+func (oid *OperationLastID) FallbackRewound(rewind time.Duration) LastID {
+	ts := timestampID(oid.Time().Add(-rewind))
+	if ts < 0 {
+		ts = 0
+	}
+	return &ReplicationLastID{ts, true, ""}
 }
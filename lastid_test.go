@@ -1,6 +1,11 @@
 package oplog
 
-import "testing"
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
 
 // parseObjectID()
 
@@ -97,6 +102,30 @@ func TestNewLastIDTimestamp(t *testing.T) {
 	}
 }
 
+func TestNewLastIDObjectState(t *testing.T) {
+	obj := objectState{ID: "video/x1:a", Timestamp: time.Unix(1423995187, 898000000)}
+	id := obj.GetEventID().String()
+	if id != "1423995187898:dmlkZW8veDE6YQ" {
+		t.Fatalf("invalid object state id: %s", id)
+	}
+	i, err := NewLastID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := i.(*ReplicationLastID); !ok || r.int64 != 1423995187898 || r.object != "video/x1:a" || r.fallbackMode {
+		t.Fatalf("invalid last id: %#v", i)
+	}
+	for _, id := range []string{"1423995187898:", "1423995187898:***", "x:dmlkZW8veDE"} {
+		if _, err := NewLastID(id); err == nil {
+			t.Errorf("%s: expected an error", id)
+		}
+	}
+	// The dates are not object state ids
+	if i, err := NewLastID("2015-02-15T10:13:07Z"); err != nil || i.String() != "1423995187000" {
+		t.Errorf("invalid date id: %v, %v", i, err)
+	}
+}
+
 // String
 
 func TestNewLastIDTimestampString(t *testing.T) {
@@ -128,3 +157,151 @@ func TestFallbackOperation(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestFallbackRewound(t *testing.T) {
+	i, err := NewLastID("54e07b75f2fcd8c74bb7bad3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oid := i.(*OperationLastID)
+	if r := oid.FallbackRewound(30 * time.Second); r.String() != "1423997783000" || !r.(*ReplicationLastID).fallbackMode {
+		t.Errorf("invalid rewound fallback: %s", r)
+	}
+	// The rewind doesn't go before the full replication
+	if r := oid.FallbackRewound(100 * 365 * 24 * time.Hour); r.String() != "0" {
+		t.Errorf("invalid rewound fallback: %s", r)
+	}
+}
+
+// parseTime()
+
+func TestParseTimeEmpty(t *testing.T) {
+	ts, err := parseTime("", time.Now())
+	if err != nil || !ts.IsZero() {
+		t.Fail()
+	}
+}
+
+func TestParseTimeTimestamp(t *testing.T) {
+	ts, err := parseTime("1423995187898", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts.UnixNano()/1000000 != 1423995187898 {
+		t.Fail()
+	}
+}
+
+func TestParseTimeRFC3339(t *testing.T) {
+	ts, err := parseTime("2015-02-15T10:13:07Z", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts.Unix() != 1423995187 {
+		t.Fail()
+	}
+}
+
+func TestParseTimeInvalid(t *testing.T) {
+	if _, err := parseTime("yesterday", time.Now()); err == nil {
+		t.Fail()
+	}
+}
+
+func TestSplitFingerprint(t *testing.T) {
+	if id, fp := splitFingerprint("545b55c7f095528dd0f3863c.0a1b2c3d"); id != "545b55c7f095528dd0f3863c" || fp != "0a1b2c3d" {
+		t.Fatalf("invalid split: %s %s", id, fp)
+	}
+	if id, fp := splitFingerprint("1423995187898"); id != "1423995187898" || fp != "" {
+		t.Fatalf("invalid split: %s %s", id, fp)
+	}
+}
+
+func TestNewLastIDFormats(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		id  string
+		str string
+		err string
+	}{
+		{"545b4f8ef095528dd0f3863b", "545b4f8ef095528dd0f3863b", ""},
+		{"1423995187898", "1423995187898", ""},
+		{"0", "0", ""},
+		{"2024-05-01T00:00:00Z", "1714521600000", ""},
+		{"2024-05-01T02:00:00+02:00", "1714521600000", ""},
+		{"2024-05-01T00:00:00.123456Z", "1714521600123", ""},
+		{"1970-01-01T00:00:00Z", "0", ""},
+		{"-15m", "1714563900000", ""},
+		{"-1h30m", "1714559400000", ""},
+		{"-0s", "1714564800000", ""},
+		{"", "", "Invalid last id"},
+		{"abcd", "", "Invalid last id"},
+		{"14199043454520", "", "Invalid last id"},
+		{"-15", "", "invalid relative time: -15, expected a negative duration like -15m"},
+		{"-1423995187898", "", "invalid relative time"},
+		{"-15 minutes", "", "invalid relative time"},
+		{"15m", "", "relative time without sign: 15m, expected a negative duration like -15m"},
+		{"+15m", "", "relative time can't be in the future: +15m"},
+		{"2024-05-01", "", "date without time: 2024-05-01, expected an RFC 3339 date like 2024-05-01T00:00:00Z"},
+		{"2024-05-01T00:00:00", "", "date without time zone: 2024-05-01T00:00:00, expected an RFC 3339 date like 2024-05-01T00:00:00Z"},
+		{"2024-05-01 00:00:00Z", "", "invalid date: 2024-05-01 00:00:00Z"},
+		{"2024-13-01T00:00:00Z", "", "invalid date"},
+		{"1969-12-31T23:59:59Z", "", "time out of range: 1969-12-31T23:59:59Z"},
+		{"2290-01-01T00:00:00Z", "", "time out of range"},
+		{"-1000000h", "", "time out of range"},
+	} {
+		id, err := newLastID(test.id, now)
+		if test.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+				t.Errorf("%q: expected error %q, got %v", test.id, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", test.id, err)
+			continue
+		}
+		// The canonical form parses back to the same id
+		if id.String() != test.str {
+			t.Errorf("%q: expected %s, got %s", test.id, test.str, id)
+		} else if again, err := NewLastID(id.String()); err != nil || again.String() != test.str {
+			t.Errorf("%q: %s doesn't round trip: %v, %v", test.id, id, again, err)
+		}
+	}
+}
+
+func TestParseTimeRelative(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if ts, err := parseTime("-15m", now); err != nil || !ts.Equal(now.Add(-15*time.Minute)) {
+		t.Errorf("invalid relative time: %s, %v", ts, err)
+	}
+	for _, value := range []string{"15m", "+15m", "-15", "2024-05-01"} {
+		if _, err := parseTime(value, now); err == nil {
+			t.Errorf("%s: expected an error", value)
+		}
+	}
+}
+
+func TestSplitFingerprintDate(t *testing.T) {
+	if id, fp := splitFingerprint("2024-05-01T00:00:00.123Z"); id != "2024-05-01T00:00:00.123Z" || fp != "" {
+		t.Errorf("date split: %s %s", id, fp)
+	}
+}
+
+func TestResolveLastIDHumanFormats(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.now = func() time.Time { return time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC) }
+	daemon.hasID = func(id LastID) (bool, error) { return true, nil }
+	lastID, _, serr := daemon.resolveLastID("ip", "-15m", Filter{}, time.Time{})
+	if serr != nil || lastID.String() != "1714563900000" {
+		t.Errorf("invalid last id: %v, %v", lastID, serr)
+	}
+
+	req := httptest.NewRequest("GET", "/ops?last_event_id=2024-05-01", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	rec := httptest.NewRecorder()
+	daemon.ServeHTTP(rec, req)
+	if rec.Code != 400 || !strings.Contains(rec.Body.String(), "invalid last event id: date without time: 2024-05-01") {
+		t.Errorf("unclear error: %d %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,247 @@
+package oplog
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// mongoBuckets defines the upper bounds of the buckets of the MongoDB calls histograms
+var mongoBuckets = []time.Duration{
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// latencyBuckets defines the upper bounds of the buckets of the delivery latency histogram
+var latencyBuckets = []time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+	time.Minute,
+}
+
+// Histogram counts durations in fixed buckets. It is an expvar.Var giving, in
+// milliseconds, the estimated quantiles, the max and the count of each bucket.
+type Histogram struct {
+	mu     sync.Mutex
+	bounds []time.Duration
+	// counts holds the count of each bucket, the last one counting the durations above
+	// the highest bound
+	counts []int64
+	total  int64
+	max    time.Duration
+	// sink receives the observed durations, if not nil
+	sink Observer
+}
+
+// NewHistogram creates a histogram with buckets up to the given bounds, in ascending order
+func NewHistogram(bounds ...time.Duration) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]int64, len(bounds)+1)}
+}
+
+// Observe adds a duration to the histogram
+func (h *Histogram) Observe(d time.Duration) {
+	if d < 0 {
+		// Clocks of the appending and the sending hosts may drift apart
+		d = 0
+	}
+	i := 0
+	for i < len(h.bounds) && d > h.bounds[i] {
+		i++
+	}
+	h.mu.Lock()
+	h.counts[i]++
+	h.total++
+	if d > h.max {
+		h.max = d
+	}
+	h.mu.Unlock()
+	if h.sink != nil {
+		h.sink.Observe(d)
+	}
+}
+
+// Quantile returns the upper bound of the bucket holding the q quantile, the max when
+// it is above the highest bound, 0 if nothing has been observed
+func (h *Histogram) Quantile(q float64) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.quantile(q)
+}
+
+func (h *Histogram) quantile(q float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	rank := int64(q*float64(h.total) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var n int64
+	for i, bound := range h.bounds {
+		n += h.counts[i]
+		if n >= rank {
+			if bound > h.max {
+				return h.max
+			}
+			return bound
+		}
+	}
+	return h.max
+}
+
+// Max returns the highest observed duration
+func (h *Histogram) Max() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.max
+}
+
+// HistogramSnapshot holds the count, the estimated quantiles and the max of a histogram in
+// milliseconds, and the count of each bucket by upper bound in milliseconds
+type HistogramSnapshot struct {
+	Count   int64            `json:"count"`
+	P50     float64          `json:"p50"`
+	P95     float64          `json:"p95"`
+	P99     float64          `json:"p99"`
+	Max     float64          `json:"max"`
+	Buckets map[string]int64 `json:"buckets"`
+}
+
+// Snapshot returns the current state of the histogram
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ms := func(d time.Duration) float64 {
+		return float64(d) / float64(time.Millisecond)
+	}
+	buckets := make(map[string]int64, len(h.counts))
+	for i, bound := range h.bounds {
+		buckets[strconv.FormatFloat(ms(bound), 'f', -1, 64)] = h.counts[i]
+	}
+	buckets["+Inf"] = h.counts[len(h.bounds)]
+	return HistogramSnapshot{h.total, ms(h.quantile(0.5)), ms(h.quantile(0.95)), ms(h.quantile(0.99)), ms(h.max), buckets}
+}
+
+// Reset empties the histogram
+func (h *Histogram) Reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := range h.counts {
+		h.counts[i] = 0
+	}
+	h.total = 0
+	h.max = 0
+}
+
+// String returns the histogram as JSON, implementing expvar.Var
+func (h *Histogram) String() string {
+	b, _ := json.Marshal(h.Snapshot())
+	return string(b)
+}
+
+// observeDelivery records the time taken by a live operation from its append to its
+// delivery. Operations appended before their append time was recorded, object states and
+// technical events are not observed.
+func (daemon *SSEDaemon) observeDelivery(ev GenericEvent) {
+	var appended time.Time
+	switch op := ev.(type) {
+	case Operation:
+		appended = op.Appended
+	case *Operation:
+		appended = op.Appended
+	}
+	if appended.IsZero() {
+		return
+	}
+	daemon.ol.Stats.DeliveryLatency.Observe(daemon.now().Sub(appended))
+}
+
+// Histograms is a set of histograms by key, like the durations of the MongoDB calls by
+// kind of operation. It is an expvar.Var giving the histogram of each key as JSON. The
+// histograms are reported to the MetricsSink, if any, tagged with their key.
+type Histograms struct {
+	mu     sync.Mutex
+	bounds []time.Duration
+	h      map[string]*Histogram
+	name   string
+	label  string
+	sink   MetricsSink
+}
+
+// NewHistograms creates a set of histograms with buckets up to the given bounds
+func NewHistograms(bounds ...time.Duration) *Histograms {
+	return &Histograms{bounds: bounds, h: map[string]*Histogram{}}
+}
+
+// Get returns the histogram of key, creating it if needed
+func (hs *Histograms) Get(key string) *Histogram {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	h, found := hs.h[key]
+	if !found {
+		h = NewHistogram(hs.bounds...)
+		if hs.sink != nil {
+			h.sink = hs.sink.Histogram(hs.name, Tag{hs.label, key})
+		}
+		hs.h[key] = h
+	}
+	return h
+}
+
+// Observe adds a duration to the histogram of key
+func (hs *Histograms) Observe(key string, d time.Duration) {
+	hs.Get(key).Observe(d)
+}
+
+// histograms returns the histogram of each key
+func (hs *Histograms) histograms() map[string]*Histogram {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	h := make(map[string]*Histogram, len(hs.h))
+	for key, histogram := range hs.h {
+		h[key] = histogram
+	}
+	return h
+}
+
+// Snapshot returns the current state of the histogram of each key
+func (hs *Histograms) Snapshot() map[string]HistogramSnapshot {
+	snapshot := map[string]HistogramSnapshot{}
+	for key, h := range hs.histograms() {
+		snapshot[key] = h.Snapshot()
+	}
+	return snapshot
+}
+
+// Reset empties the histogram of each key, the keys are kept
+func (hs *Histograms) Reset() {
+	for _, h := range hs.histograms() {
+		h.Reset()
+	}
+}
+
+// String returns the histograms as a JSON object, implementing expvar.Var
+func (hs *Histograms) String() string {
+	b, _ := json.Marshal(hs.Snapshot())
+	return string(b)
+}
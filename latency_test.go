@@ -0,0 +1,113 @@
+package oplog
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// histogramJSON is the expvar representation of a Histogram
+type histogramJSON struct {
+	Count   int64            `json:"count"`
+	P50     float64          `json:"p50"`
+	P95     float64          `json:"p95"`
+	P99     float64          `json:"p99"`
+	Max     float64          `json:"max"`
+	Buckets map[string]int64 `json:"buckets"`
+}
+
+func parseHistogram(t *testing.T, h *Histogram) histogramJSON {
+	t.Helper()
+	v := histogramJSON{}
+	if err := json.Unmarshal([]byte(h.String()), &v); err != nil {
+		t.Fatalf("invalid histogram JSON %q: %s", h.String(), err)
+	}
+	return v
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram(10*time.Millisecond, 100*time.Millisecond, time.Second)
+	if h.Quantile(0.5) != 0 || h.Max() != 0 {
+		t.Errorf("empty histogram has quantiles")
+	}
+	for i := 0; i < 90; i++ {
+		h.Observe(5 * time.Millisecond)
+	}
+	for i := 0; i < 8; i++ {
+		h.Observe(50 * time.Millisecond)
+	}
+	h.Observe(100 * time.Millisecond)
+	h.Observe(3 * time.Second)
+	h.Observe(-time.Second)
+
+	v := parseHistogram(t, h)
+	for bucket, expected := range map[string]int64{"10": 91, "100": 9, "1000": 0, "+Inf": 1} {
+		if v.Buckets[bucket] != expected {
+			t.Errorf("expected %d durations in bucket %s, got %d", expected, bucket, v.Buckets[bucket])
+		}
+	}
+	if v.Count != 101 || v.P50 != 10 || v.P95 != 100 || v.P99 != 100 || v.Max != 3000 {
+		t.Errorf("invalid histogram: %s", h)
+	}
+	if q := h.Quantile(1); q != 3*time.Second {
+		t.Errorf("expected the max above the highest bound, got %s", q)
+	}
+}
+
+func TestHistograms(t *testing.T) {
+	hs := NewHistograms(10*time.Millisecond, 100*time.Millisecond)
+	if hs.String() != "{}" {
+		t.Errorf("expected no histogram, got %s", hs)
+	}
+	hs.Observe("insert", 5*time.Millisecond)
+	hs.Observe("insert", 50*time.Millisecond)
+	hs.Observe("last_id", time.Second)
+	v := map[string]histogramJSON{}
+	if err := json.Unmarshal([]byte(hs.String()), &v); err != nil {
+		t.Fatalf("invalid histograms JSON %q: %s", hs, err)
+	}
+	if len(v) != 2 || v["insert"].Count != 2 || v["insert"].Max != 50 || v["last_id"].Buckets["+Inf"] != 1 {
+		t.Errorf("invalid histograms: %s", hs)
+	}
+	if hs.Get("insert") != hs.Get("insert") {
+		t.Error("histogram of a key created twice")
+	}
+}
+
+func TestGetOpsDeliveryLatency(t *testing.T) {
+	now := time.Unix(1423995187, 0)
+	ops := []Operation{}
+	for _, latency := range []time.Duration{3 * time.Millisecond, 40 * time.Millisecond, 2 * time.Second} {
+		id := bson.NewObjectId()
+		ops = append(ops, Operation{ID: &id, Event: "insert", Data: &OperationData{ID: "1", Type: "video"}, Appended: now.Add(-latency)})
+	}
+	// Operations appended before the append time was recorded are not observed
+	id := bson.NewObjectId()
+	ops = append(ops, Operation{ID: &id, Event: "insert", Data: &OperationData{ID: "2", Type: "video"}})
+
+	daemon := newTestSSEOpsDaemon(ops)
+	stats := *daemon.ol.Stats
+	stats.DeliveryLatency = NewHistogram(latencyBuckets...)
+	daemon.ol.Stats = &stats
+	daemon.now = func() time.Time { return now }
+	req := httptest.NewRequest("GET", "/ops?since=1423995187000&limit=4", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	daemon.ServeHTTP(httptest.NewRecorder(), req)
+
+	// The reset and checkpoint events are not observed either
+	v := parseHistogram(t, stats.DeliveryLatency)
+	if v.Count != 3 {
+		t.Fatalf("expected 3 observed operations, got %d", v.Count)
+	}
+	for bucket, expected := range map[string]int64{"5": 1, "50": 1, "2500": 1} {
+		if v.Buckets[bucket] != expected {
+			t.Errorf("expected %d operations in bucket %s, got %d", expected, bucket, v.Buckets[bucket])
+		}
+	}
+	if v.Max != 2000 || v.P50 != 50 || v.P99 != 2000 {
+		t.Errorf("invalid latency quantiles: %s", stats.DeliveryLatency)
+	}
+}
@@ -0,0 +1,133 @@
+package oplog
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/mgo.v2"
+)
+
+// DefaultLogSampleWindow is the default window in which the repeated warnings of the
+// retry paths are collapsed, see OpLog.LogSampleWindow
+const DefaultLogSampleWindow = 10 * time.Second
+
+// Logger logs the messages of the OpLog and of the daemons, implemented by the logrus
+// loggers. Giving each component its own logger lets their level be set separately.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// logger returns the Logger of the oplog, the standard logrus logger if not set
+func (oplog *OpLog) logger() Logger {
+	if oplog.Logger == nil {
+		return log.StandardLogger()
+	}
+	return oplog.Logger
+}
+
+// logger returns the Logger of the daemon, the one of its oplog if not set
+func (daemon *SSEDaemon) logger() Logger {
+	if daemon.Logger == nil {
+		return daemon.ol.logger()
+	}
+	return daemon.Logger
+}
+
+// warnSampled logs a warning of a retry path of the oplog, see logSampler
+func (oplog *OpLog) warnSampled(err error, format string, args ...interface{}) {
+	oplog.logSampler.warnf(oplog.logger(), oplog.LogSampleWindow, time.Now(), err, format, args...)
+}
+
+// warnSampled logs a warning of a retry path of the daemon, see logSampler
+func (daemon *SSEDaemon) warnSampled(err error, format string, args ...interface{}) {
+	daemon.logSampler.warnf(daemon.logger(), daemon.LogSampleWindow, time.Now(), err, format, args...)
+}
+
+// sampledLog is a warning logged by a logSampler
+type sampledLog struct {
+	// logged is the time the warning was last logged
+	logged time.Time
+	// repeated counts the times the warning was not logged since, last being the last of
+	// them
+	repeated int
+	last     string
+}
+
+// logSampler collapses the warnings repeated by the retry loops, like during a MongoDB
+// failover. A warning is logged once per window, the next line saying how many times it
+// was repeated in between. Warnings are told apart by their format and the class of their
+// error so different problems aren't hidden behind each other. Its zero value is ready to
+// use.
+type logSampler struct {
+	mu   sync.Mutex
+	logs map[string]*sampledLog
+}
+
+// warnf logs the warning at now unless it was already logged less than window ago. The
+// count of the warnings no longer repeated is logged along the next warning logged a
+// window after theirs is over. No warning is collapsed with a window of 0.
+func (s *logSampler) warnf(logger Logger, window time.Duration, now time.Time, err error, format string, args ...interface{}) {
+	if window <= 0 {
+		logger.Warnf(format, args...)
+		return
+	}
+	key := format + "\x00" + errorClass(err)
+	msg := fmt.Sprintf(format, args...)
+	s.mu.Lock()
+	if s.logs == nil {
+		s.logs = map[string]*sampledLog{}
+	}
+	l, found := s.logs[key]
+	if found && now.Sub(l.logged) < window {
+		l.repeated++
+		l.last = msg
+		s.mu.Unlock()
+		return
+	}
+	if found && l.repeated > 0 {
+		msg = fmt.Sprintf("%s (repeated %d times)", msg, l.repeated)
+	}
+	s.logs[key] = &sampledLog{logged: now}
+	// Flush the counts of the other warnings not repeated for a whole window after theirs
+	flushed := []string{}
+	for k, l := range s.logs {
+		if k == key || now.Sub(l.logged) < 2*window {
+			continue
+		}
+		if l.repeated > 0 {
+			flushed = append(flushed, fmt.Sprintf("%s (repeated %d times)", l.last, l.repeated))
+		}
+		delete(s.logs, k)
+	}
+	s.mu.Unlock()
+	sort.Strings(flushed)
+	for _, f := range flushed {
+		logger.Warnf("%s", f)
+	}
+	logger.Warnf("%s", msg)
+}
+
+// errorClass returns the class of err the warnings are sampled by. The network and
+// MongoDB errors are classed by operation and code, their message holding addresses which
+// change from one attempt to the next.
+func errorClass(err error) string {
+	switch e := err.(type) {
+	case nil:
+		return ""
+	case *net.OpError:
+		return "net " + e.Op
+	case *mgo.QueryError:
+		return "mongo query " + strconv.Itoa(e.Code)
+	case *mgo.LastError:
+		return "mongo " + strconv.Itoa(e.Code)
+	}
+	return fmt.Sprintf("%T %s", err, err)
+}
@@ -0,0 +1,113 @@
+package oplog
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+// capturingLogger is a Logger recording the logged lines prefixed by their level
+type capturingLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *capturingLogger) logf(level, format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, level+" "+fmt.Sprintf(format, args...))
+}
+
+func (l *capturingLogger) Debugf(format string, args ...interface{}) {
+	l.logf("debug", format, args...)
+}
+
+func (l *capturingLogger) Infof(format string, args ...interface{}) {
+	l.logf("info", format, args...)
+}
+
+func (l *capturingLogger) Warnf(format string, args ...interface{}) {
+	l.logf("warn", format, args...)
+}
+
+func (l *capturingLogger) Errorf(format string, args ...interface{}) {
+	l.logf("error", format, args...)
+}
+
+func TestLogSamplerOutage(t *testing.T) {
+	logger := &capturingLogger{}
+	s := &logSampler{}
+	start := time.Now()
+	// A MongoDB outage: the insert is retried every 100ms for 2.5s, failing to connect
+	// from a different port each time, while the replication fails with a query error
+	for i := 0; i < 25; i++ {
+		now := start.Add(time.Duration(i) * 100 * time.Millisecond)
+		addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 40000 + i}
+		err := &net.OpError{Op: "dial", Net: "tcp", Addr: addr, Err: errors.New("connection refused")}
+		s.warnf(logger, time.Second, now, err, "OPLOG can't insert operation, retrying: %s", err)
+		if i%5 == 0 {
+			qerr := &mgo.QueryError{Code: 13435, Message: "not master"}
+			s.warnf(logger, time.Second, now, qerr, "OPLOG can't insert operation, retrying: %s", qerr)
+		}
+	}
+	// The count of the last repeats is logged with the next warning once their window is
+	// over
+	s.warnf(logger, time.Second, start.Add(5*time.Second), nil, "OPLOG tail failed with error, try to reconnect: %s", "EOF")
+
+	expected := []string{
+		"warn OPLOG can't insert operation, retrying: dial tcp 10.0.0.1:40000: connection refused",
+		"warn OPLOG can't insert operation, retrying: not master",
+		"warn OPLOG can't insert operation, retrying: dial tcp 10.0.0.1:40010: connection refused (repeated 9 times)",
+		"warn OPLOG can't insert operation, retrying: not master (repeated 1 times)",
+		"warn OPLOG can't insert operation, retrying: dial tcp 10.0.0.1:40020: connection refused (repeated 9 times)",
+		"warn OPLOG can't insert operation, retrying: not master (repeated 1 times)",
+		"warn OPLOG can't insert operation, retrying: dial tcp 10.0.0.1:40024: connection refused (repeated 4 times)",
+		"warn OPLOG tail failed with error, try to reconnect: EOF",
+	}
+	if strings.Join(logger.lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(logger.lines, "\n"))
+	}
+}
+
+func TestLogSamplerDisabled(t *testing.T) {
+	logger := &capturingLogger{}
+	s := &logSampler{}
+	err := errors.New("no reachable servers")
+	for i := 0; i < 3; i++ {
+		s.warnf(logger, 0, time.Now(), err, "OPLOG tail failed with error, try to reconnect: %s", err)
+	}
+	if len(logger.lines) != 3 {
+		t.Errorf("expected every warning to be logged, got %q", logger.lines)
+	}
+}
+
+func TestComponentLoggers(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	oplogLogger := &capturingLogger{}
+	daemon.ol.Logger = oplogLogger
+	daemon.ol.LogSampleWindow = time.Minute
+	daemon.LogSampleWindow = time.Minute
+	err := errors.New("no reachable servers")
+
+	// The daemon logs thru the logger of its oplog unless it has its own
+	daemon.warnSampled(err, "SSE can't get last id: %s", err)
+	daemonLogger := &capturingLogger{}
+	daemon.Logger = daemonLogger
+	daemon.warnSampled(err, "SSE can't get last id: %s", err)
+	daemon.ol.warnSampled(err, "OPLOG tail failed with error, try to reconnect: %s", err)
+	daemon.warnSampled(err, "SSE health check failed: %s", err)
+
+	if expected := []string{"warn SSE can't get last id: no reachable servers", "warn OPLOG tail failed with error, try to reconnect: no reachable servers"}; strings.Join(oplogLogger.lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("invalid oplog lines: %q", oplogLogger.lines)
+	}
+	// The repeated warning is sampled by the daemon whatever its logger
+	if len(daemonLogger.lines) != 1 || daemonLogger.lines[0] != "warn SSE health check failed: no reachable servers" {
+		t.Errorf("invalid daemon lines: %q", daemonLogger.lines)
+	}
+}
@@ -0,0 +1,125 @@
+package oplog
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// metric describes a Stats value exposed in the Prometheus text format
+type metric struct {
+	name  string
+	kind  string
+	help  string
+	value func(s *Stats) *Int
+}
+
+// metrics lists the exposed metrics. Names are part of the public interface and must not
+// be changed. Counters end with _total as per Prometheus conventions.
+var metrics = []metric{
+	{"oplog_events_received_total", "counter", "Total number of events received on the ingest endpoints.", func(s *Stats) *Int { return s.EventsReceived }},
+	{"oplog_events_sent_total", "counter", "Total number of events sent thru the SSE interface.", func(s *Stats) *Int { return s.EventsSent }},
+	{"oplog_bytes_sent_total", "counter", "Total number of bytes sent on the SSE streams, after compression.", func(s *Stats) *Int { return s.BytesSent }},
+	{"oplog_checkpoints_sent_total", "counter", "Total number of checkpoint events sent thru the SSE interface.", func(s *Stats) *Int { return s.CheckpointsSent }},
+	{"oplog_events_ingested_total", "counter", "Total number of events ingested into MongoDB with success.", func(s *Stats) *Int { return s.EventsIngested }},
+	{"oplog_events_error_total", "counter", "Total number of events received with an invalid format.", func(s *Stats) *Int { return s.EventsError }},
+	{"oplog_events_discarded_total", "counter", "Total number of events discarded because the queue was full.", func(s *Stats) *Int { return s.EventsDiscarded }},
+	{"oplog_stale_revisions_total", "counter", "Total number of operations not applied on their object state because of a stale revision.", func(s *Stats) *Int { return s.StaleRevisions }},
+	{"oplog_unknown_versions_total", "counter", "Total number of operations and object states skipped because of an unknown schema version.", func(s *Stats) *Int { return s.UnknownVersions }},
+	{"oplog_queue_size", "gauge", "Current number of events in the ingestion queue.", func(s *Stats) *Int { return s.QueueSize }},
+	{"oplog_queue_max_size", "gauge", "Maximum number of events allowed in the ingestion queue.", func(s *Stats) *Int { return s.QueueMaxSize }},
+	{"oplog_queue_peak", "gauge", "Highest number of events in the ingestion queue since the start.", func(s *Stats) *Int { return s.QueuePeak }},
+	{"oplog_queue_recent_peak", "gauge", "Highest number of events in the ingestion queue over the last minute.", func(s *Stats) *Int { return s.QueueRecentPeak }},
+	{"oplog_clients", "gauge", "Number of clients connected to the SSE API.", func(s *Stats) *Int { return s.Clients }},
+	{"oplog_connections_total", "counter", "Total number of SSE connections.", func(s *Stats) *Int { return s.Connections }},
+	{"oplog_connections_rate_limited_total", "counter", "Total number of connections refused because their IP made too many attempts.", func(s *Stats) *Int { return s.ConnectionsRateLimited }},
+	{"oplog_connections_per_ip_rejected_total", "counter", "Total number of connections refused because their IP had too many connections.", func(s *Stats) *Int { return s.ConnectionsPerIPRejected }},
+	{"oplog_tails", "gauge", "Current number of running tails.", func(s *Stats) *Int { return s.Tails }},
+	{"oplog_tails_peak", "gauge", "Highest number of tails run concurrently.", func(s *Stats) *Int { return s.TailsPeak }},
+	{"oplog_tails_rejected_total", "counter", "Total number of tails refused because of the concurrent tails limit.", func(s *Stats) *Int { return s.TailsRejected }},
+	{"oplog_tails_live", "gauge", "Current number of tails streaming live operations.", func(s *Stats) *Int { return s.TailsLive }},
+	{"oplog_tails_replicating", "gauge", "Current number of tails replicating object states.", func(s *Stats) *Int { return s.TailsReplicating }},
+	{"oplog_tails_fallback", "gauge", "Current number of tails replicating object states after a fallback.", func(s *Stats) *Int { return s.TailsFallback }},
+	{"oplog_tails_max_lag_milliseconds", "gauge", "Highest lag of the running tails as of the last listing.", func(s *Stats) *Int { return s.TailsMaxLag }},
+	{"oplog_clients_max_lag_milliseconds", "gauge", "Highest lag of the live SSE streams behind the most recent operation.", func(s *Stats) *Int { return s.ClientsMaxLag }},
+	{"oplog_clients_mean_lag_milliseconds", "gauge", "Mean lag of the live SSE streams behind the most recent operation.", func(s *Stats) *Int { return s.ClientsMeanLag }},
+	{"oplog_shared_tail_subscribers", "gauge", "Current number of live tails subscribed to the shared tail.", func(s *Stats) *Int { return s.SharedTailSubscribers }},
+	{"oplog_shared_tail_evictions_total", "counter", "Total number of live tails evicted from the shared tail.", func(s *Stats) *Int { return s.SharedTailEvictions }},
+	{"oplog_replications_running", "gauge", "Current number of running replications.", func(s *Stats) *Int { return s.ReplicationsRunning }},
+	{"oplog_replications_queued", "gauge", "Current number of replications waiting for a slot.", func(s *Stats) *Int { return s.ReplicationsQueued }},
+	{"oplog_replication_queue_wait_milliseconds_total", "counter", "Total time spent by replications waiting for a slot.", func(s *Stats) *Int { return s.ReplicationQueueWait }},
+	{"oplog_replication_queue_timeouts_total", "counter", "Total number of replications which timed out waiting for a slot.", func(s *Stats) *Int { return s.ReplicationQueueTimeouts }},
+	{"oplog_resync_fallbacks_total", "counter", "Total number of live tails which fell back to replication.", func(s *Stats) *Int { return s.ResyncFallbacks }},
+	{"oplog_filter_mismatches_total", "counter", "Total number of SSE clients which resumed with a different filter.", func(s *Stats) *Int { return s.FilterMismatches }},
+	{"oplog_unsigned_ids_total", "counter", "Total number of last event ids refused or ignored because of an invalid signature.", func(s *Stats) *Int { return s.UnsignedIDs }},
+	{"oplog_client_buffered", "gauge", "Current number of events buffered for SSE clients.", func(s *Stats) *Int { return s.ClientBuffered }},
+	{"oplog_events_dropped_total", "counter", "Total number of events not sent to the SSE clients disconnected because their buffer was full.", func(s *Stats) *Int { return s.EventsDropped }},
+	{"oplog_slow_consumer_evictions_total", "counter", "Total number of SSE clients disconnected because their buffer was full.", func(s *Stats) *Int { return s.SlowConsumerEvictions }},
+	{"oplog_auth_successes_total", "counter", "Total number of successful authentications.", func(s *Stats) *Int { return s.AuthSuccesses }},
+	{"oplog_auth_failures_total", "counter", "Total number of failed authentications.", func(s *Stats) *Int { return s.AuthFailures }},
+	{"oplog_auth_failures_missing_total", "counter", "Total number of failed authentications without credentials.", func(s *Stats) *Int { return s.AuthFailuresMissing }},
+	{"oplog_auth_failures_malformed_total", "counter", "Total number of failed authentications with credentials which can't be decoded.", func(s *Stats) *Int { return s.AuthFailuresMalformed }},
+	{"oplog_auth_failures_invalid_total", "counter", "Total number of failed authentications with wrong credentials.", func(s *Stats) *Int { return s.AuthFailuresInvalid }},
+	{"oplog_auth_failures_expired_total", "counter", "Total number of failed authentications with expired tokens.", func(s *Stats) *Int { return s.AuthFailuresExpired }},
+	{"oplog_authz_denied_scope_total", "counter", "Total number of requests refused because the credentials are not granted the scope of the endpoint.", func(s *Stats) *Int { return s.AuthzDeniedScope }},
+	{"oplog_authz_denied_policy_total", "counter", "Total number of streams refused because their filter is outside of the policy of the credentials.", func(s *Stats) *Int { return s.AuthzDeniedPolicy }},
+	{"oplog_auth_bans_total", "counter", "Total number of client IPs banned for failing to authenticate too many times.", func(s *Stats) *Int { return s.AuthBans }},
+	{"oplog_auth_banned_total", "counter", "Total number of requests refused because their client IP was banned.", func(s *Stats) *Int { return s.AuthBanned }},
+	{"oplog_blocked_requests_total", "counter", "Total number of requests refused because of their client IP.", func(s *Stats) *Int { return s.BlockedRequests }},
+	{"oplog_audit_dropped_total", "counter", "Total number of audit events dropped because the audit sink was lagging.", func(s *Stats) *Int { return s.AuditDropped }},
+	{"oplog_capped_bytes", "gauge", "Bytes used by the operations of the capped collection.", func(s *Stats) *Int { return s.CappedBytes }},
+	{"oplog_capped_max_bytes", "gauge", "Maximum size of the capped collection in bytes.", func(s *Stats) *Int { return s.CappedMaxBytes }},
+	{"oplog_capped_count", "gauge", "Number of operations in the capped collection.", func(s *Stats) *Int { return s.CappedCount }},
+	{"oplog_capped_oldest_age_milliseconds", "gauge", "Age of the oldest operation of the capped collection.", func(s *Stats) *Int { return s.CappedOldestAge }},
+	{"oplog_capped_newest_age_milliseconds", "gauge", "Age of the newest operation of the capped collection.", func(s *Stats) *Int { return s.CappedNewestAge }},
+	{"oplog_capped_retention_milliseconds", "gauge", "Estimated time an operation stays in the capped collection at the current ingest rate.", func(s *Stats) *Int { return s.CappedRetention }},
+	{"oplog_retention_breaches_total", "counter", "Total number of operations recorded by the retention watchdog evicted before its next check.", func(s *Stats) *Int { return s.RetentionBreaches }},
+	{"oplog_retention_actual_milliseconds", "gauge", "Time between the oldest and newest operations of the capped collection as of the last retention check.", func(s *Stats) *Int { return s.RetentionActual }},
+	{"oplog_mongo_cursor_reopens_total", "counter", "Total number of tailable cursors opened again after the previous one expired or failed.", func(s *Stats) *Int { return s.MongoCursorReopens }},
+	{"oplog_mongo_session_refreshes_total", "counter", "Total number of MongoDB sessions refreshed after a failure.", func(s *Stats) *Int { return s.MongoSessionRefreshes }},
+	{"oplog_throttled_bytes_total", "counter", "Total number of bytes sent on throttled streams.", func(s *Stats) *Int { return s.ThrottledBytes }},
+	{"oplog_throttle_wait_milliseconds_total", "counter", "Total time spent by streams waiting for their throttling.", func(s *Stats) *Int { return s.ThrottleWait }},
+}
+
+// labeledCounter describes a Stats map exposed as a counter in the Prometheus text format,
+// with a sample per key of the map given as the value of the label
+type labeledCounter struct {
+	name  string
+	help  string
+	label string
+	value func(s *Stats) *Map
+}
+
+// labeledCounters lists the exposed labeled counters, see metrics
+var labeledCounters = []labeledCounter{
+	{"oplog_events_ingested_by_event_total", "Total number of events ingested into MongoDB by event.", "event", func(s *Stats) *Map { return s.EventsIngestedByEvent }},
+	{"oplog_events_ingested_by_type_total", "Total number of events ingested into MongoDB by object type.", "type", func(s *Stats) *Map { return s.EventsIngestedByType }},
+	{"oplog_events_sent_by_event_total", "Total number of events sent to the clients by event.", "event", func(s *Stats) *Map { return s.EventsSentByEvent }},
+	{"oplog_events_sent_by_type_total", "Total number of events sent to the clients by object type.", "type", func(s *Stats) *Map { return s.EventsSentByType }},
+	{"oplog_streams_ended_total", "Total number of ended streams by reason.", "reason", func(s *Stats) *Map { return s.StreamsEnded }},
+}
+
+// labelEscaper escapes the label values as per the Prometheus text format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeMetrics writes the stats in the Prometheus text exposition format
+func writeMetrics(w io.Writer, stats *Stats) {
+	for _, m := range metrics {
+		v := m.value(stats)
+		if v == nil {
+			continue
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.kind, m.name, v.Value())
+	}
+	for _, m := range labeledCounters {
+		v := m.value(stats)
+		if v == nil {
+			continue
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", m.name, m.help, m.name)
+		v.Do(func(kv expvar.KeyValue) {
+			fmt.Fprintf(w, "%s{%s=\"%s\"} %s\n", m.name, m.label, labelEscaper.Replace(kv.Key), kv.Value)
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package oplog
+
+import (
+	"bufio"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var metricLine = regexp.MustCompile(`^(oplog_[a-z_]+)(\{[a-z]+="(?:[^"\\]|\\.)*"\})? (-?[0-9]+)$`)
+
+func TestMetrics(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.EnableMetrics = true
+	daemon.MetricsPassword = "secret"
+	testStats.QueueMaxSize.Set(42)
+	testStats.EventsSentByType.Add(`metrics"test`, 1)
+
+	rec := httptest.NewRecorder()
+	daemon.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != 401 {
+		t.Fatalf("expected status 401 without credentials, got %d", rec.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.SetBasicAuth("", "secret")
+	rec = httptest.NewRecorder()
+	daemon.ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type: %s", rec.Header().Get("Content-Type"))
+	}
+
+	types := map[string]string{}
+	values := map[string]int64{}
+	labeled := map[string]int64{}
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "# TYPE ") {
+			fields := strings.Fields(line)
+			if len(fields) != 4 {
+				t.Fatalf("invalid TYPE line: %q", line)
+			}
+			types[fields[2]] = fields[3]
+			continue
+		}
+		if strings.HasPrefix(line, "# HELP ") {
+			continue
+		}
+		m := metricLine.FindStringSubmatch(line)
+		if m == nil {
+			t.Fatalf("invalid metric line: %q", line)
+		}
+		if _, found := types[m[1]]; !found {
+			t.Errorf("metric %s has no TYPE line", m[1])
+		}
+		v, _ := strconv.ParseInt(m[3], 10, 64)
+		if m[2] != "" {
+			labeled[m[1]+m[2]] = v
+			continue
+		}
+		values[m[1]] = v
+	}
+	if len(values) != len(metrics) {
+		t.Errorf("expected %d metrics, got %d", len(metrics), len(values))
+	}
+	if len(types) != len(metrics)+len(labeledCounters) {
+		t.Errorf("expected %d TYPE lines, got %d", len(metrics)+len(labeledCounters), len(types))
+	}
+	if labeled[`oplog_events_sent_by_type_total{type="metrics\"test"}`] < 1 {
+		t.Errorf("per type counter missing or not escaped: %v", labeled)
+	}
+	for name, kind := range types {
+		if (kind == "counter") != strings.HasSuffix(name, "_total") {
+			t.Errorf("metric %s of type %s breaks the naming convention", name, kind)
+		}
+	}
+	if values["oplog_queue_max_size"] != 42 {
+		t.Errorf("expected oplog_queue_max_size to be 42, got %d", values["oplog_queue_max_size"])
+	}
+	for _, name := range []string{"oplog_events_ingested_total", "oplog_events_sent_total", "oplog_clients", "oplog_connections_total", "oplog_queue_size"} {
+		if _, found := values[name]; !found {
+			t.Errorf("metric %s is missing", name)
+		}
+	}
+}
+
+func TestMetricsDisabled(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	rec := httptest.NewRecorder()
+	daemon.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != 404 {
+		t.Errorf("expected status 404 when metrics are disabled, got %d", rec.Code)
+	}
+}
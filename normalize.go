@@ -0,0 +1,192 @@
+package oplog
+
+import (
+	"strings"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// normalizeType returns the type in lowercase
+func normalizeType(t string) string {
+	return strings.ToLower(t)
+}
+
+// normalizeParent returns the parent reference with its type, the part before the first
+// "/", in lowercase
+func normalizeParent(parent string) string {
+	if i := strings.Index(parent, "/"); i != -1 {
+		return strings.ToLower(parent[:i]) + parent[i:]
+	}
+	return parent
+}
+
+// sameStrings returns true if a and b have the same values in the same order
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeData lowercases the type of the data, and the type of its parents if parents
+// is true. It returns true if the data changed.
+func normalizeData(data *OperationData, parents bool) bool {
+	changed := false
+	if t := normalizeType(data.Type); t != data.Type {
+		data.Type = t
+		changed = true
+	}
+	if parents {
+		for i, parent := range data.Parents {
+			if p := normalizeParent(parent); p != parent {
+				data.Parents[i] = p
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// normalize normalizes the types of an operation about to be appended, if enabled
+func (oplog *OpLog) normalize(op *Operation) {
+	if oplog.NormalizeTypes && op.Data != nil {
+		normalizeData(op.Data, oplog.NormalizeParentTypes)
+	}
+}
+
+// normalized returns the filter with its types, and the type of its parents if parents is
+// true, in lowercase so they match the normalized operations
+func (f Filter) normalized(parents bool) Filter {
+	lower := func(values []string, normalize func(string) string) []string {
+		if values == nil {
+			return nil
+		}
+		r := make([]string, len(values))
+		for i, v := range values {
+			r[i] = normalize(v)
+		}
+		return r
+	}
+	f.Types = lower(f.Types, normalizeType)
+	f.ExcludeTypes = lower(f.ExcludeTypes, normalizeType)
+	if parents {
+		f.Parents = lower(f.Parents, normalizeParent)
+		f.ParentPrefixes = lower(f.ParentPrefixes, normalizeParent)
+		f.ExcludeParents = lower(f.ExcludeParents, normalizeParent)
+	}
+	return f
+}
+
+// NormalizeExistingTypes rewrites the object states stored before NormalizeTypes was
+// enabled with their types, and the type of their parents if NormalizeParentTypes is set,
+// in lowercase. States are processed in batches of PageSize. As the id of a state embeds
+// its type, a state whose normalized id already exists is merged with it, the most recent
+// one winning. The operations of the capped collection are left as is, they will age out.
+// It returns the number of states rewritten.
+func (oplog *OpLog) NormalizeExistingTypes() (int, error) {
+	db := oplog.db()
+	defer db.Session.Close()
+	c := db.C("oplog_states")
+
+	// Only the states with an uppercase letter in their type need to be rewritten
+	query := bson.M{"data.t": bson.RegEx{Pattern: "[A-Z]"}}
+	if oplog.NormalizeParentTypes {
+		query = bson.M{"$or": []bson.M{query, {"data.p": bson.RegEx{Pattern: "^[^/]*[A-Z]"}}}}
+	}
+	iter := c.Find(query).Batch(oplog.PageSize).Iter()
+	count := 0
+	obs := objectState{}
+	for iter.Next(&obs) {
+		if obs.Data == nil || !normalizeData(obs.Data, oplog.NormalizeParentTypes) {
+			continue
+		}
+		if err := normalizeState(c, obs); err != nil {
+			iter.Close()
+			return count, err
+		}
+		count++
+		if oplog.PageSize > 0 && count%oplog.PageSize == 0 {
+			oplog.logger().Infof("OPLOG normalized %d object states", count)
+		}
+		obs = objectState{}
+	}
+	if err := iter.Close(); err != nil {
+		return count, err
+	}
+	oplog.logger().Infof("OPLOG normalized %d object states", count)
+	return count, nil
+}
+
+// NormalizeExistingParents rewrites the object states stored before the parents of the
+// appended operations were trimmed and deduplicated, see normalizeParents. States are
+// processed in batches of PageSize. MaxParents and StrictParents are not enforced on the
+// stored states. It returns the number of states rewritten.
+func (oplog *OpLog) NormalizeExistingParents() (int, error) {
+	db := oplog.db()
+	defer db.Session.Close()
+	c := db.C("oplog_states")
+
+	// Only the states with whitespace around a parent or with several parents may need
+	// to be rewritten
+	query := bson.M{"$or": []bson.M{
+		{"data.p": bson.RegEx{Pattern: `^\s|\s$`}},
+		{"data.p.1": bson.M{"$exists": true}},
+	}}
+	iter := c.Find(query).Batch(oplog.PageSize).Iter()
+	count := 0
+	obs := objectState{}
+	for iter.Next(&obs) {
+		if obs.Data == nil {
+			continue
+		}
+		parents := normalizeParents(obs.Data.Parents)
+		if sameStrings(parents, obs.Data.Parents) {
+			continue
+		}
+		if err := c.UpdateId(obs.ID, bson.M{"$set": bson.M{"data.p": parents}}); err != nil && err != mgo.ErrNotFound {
+			iter.Close()
+			return count, err
+		}
+		count++
+		if oplog.PageSize > 0 && count%oplog.PageSize == 0 {
+			oplog.logger().Infof("OPLOG normalized the parents of %d object states", count)
+		}
+		obs = objectState{}
+	}
+	if err := iter.Close(); err != nil {
+		return count, err
+	}
+	oplog.logger().Infof("OPLOG normalized the parents of %d object states", count)
+	return count, nil
+}
+
+// normalizeState stores a state whose data has been normalized under its new id, and
+// removes the state stored under its former id
+func normalizeState(c *mgo.Collection, obs objectState) error {
+	id := stateID(obs.Data)
+	if id == obs.ID {
+		return c.UpdateId(id, bson.M{"$set": bson.M{"data": obs.Data}})
+	}
+	formerID := obs.ID
+	existing := objectState{}
+	err := c.FindId(id).One(&existing)
+	if err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	if err == mgo.ErrNotFound || existing.Timestamp.Before(obs.Timestamp) {
+		obs.ID = id
+		if _, err := c.UpsertId(id, obs); err != nil {
+			return err
+		}
+	}
+	if err := c.RemoveId(formerID); err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package oplog
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeData(t *testing.T) {
+	data := OperationData{Type: "Video", Parents: []string{"User/XK1", "playlist/x2", "Root"}}
+	if !normalizeData(&data, false) {
+		t.Error("expected the data to change")
+	}
+	if data.Type != "video" || data.Parents[0] != "User/XK1" {
+		t.Errorf("invalid data normalized without parents: %#v", data)
+	}
+	if !normalizeData(&data, true) {
+		t.Error("expected the parents to change")
+	}
+	if strings.Join(data.Parents, ",") != "user/XK1,playlist/x2,Root" {
+		t.Errorf("invalid parents: %v", data.Parents)
+	}
+	if normalizeData(&data, true) {
+		t.Error("normalized data must not change")
+	}
+}
+
+func TestNormalizeOperation(t *testing.T) {
+	ol := newTestOpLog()
+	op := Operation{Event: "insert", Data: &OperationData{Type: "Video", Parents: []string{"User/1"}}}
+	ol.normalize(&op)
+	if op.Data.Type != "Video" {
+		t.Error("types must not be normalized unless enabled")
+	}
+	ol.NormalizeTypes = true
+	ol.normalize(&op)
+	if op.Data.Type != "video" || op.Data.Parents[0] != "User/1" {
+		t.Errorf("invalid normalized operation: %#v", op.Data)
+	}
+	ol.NormalizeParentTypes = true
+	ol.normalize(&op)
+	if op.Data.Parents[0] != "user/1" {
+		t.Errorf("invalid normalized parents: %#v", op.Data)
+	}
+}
+
+func TestNormalizeParentsFilter(t *testing.T) {
+	ol := newTestOpLog()
+	op := Operation{Event: "insert", Data: &OperationData{ID: "1", Type: "video", Parents: []string{"user/1 ", " user/1", "\tchannel/2", "playlist/3"}}}
+	filters := []Filter{
+		{Parents: []string{"user/1"}},
+		{Parents: []string{"user/1", "channel/2"}, ParentsMode: ParentsAll},
+		{Parents: []string{"channel/*"}},
+		{ParentPrefixes: []string{"channel/"}},
+		{Parents: []string{"playlist/3"}, ExcludeParents: []string{"user/2"}},
+	}
+	// The parents with whitespace are not matched as stored
+	for _, f := range filters[:4] {
+		if f.match(op.Data) {
+			t.Errorf("unexpected match of %q by %#v", op.Data.Parents, f)
+		}
+	}
+	if err := ol.validate(&op); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(op.Data.Parents, ",") != "user/1,channel/2,playlist/3" {
+		t.Fatalf("invalid parents: %q", op.Data.Parents)
+	}
+	for _, f := range filters {
+		if !f.match(op.Data) {
+			t.Errorf("normalized parents %q not matched by %#v", op.Data.Parents, f)
+		}
+	}
+	if f := (Filter{ExcludeParents: []string{"user/1"}}); f.match(op.Data) {
+		t.Errorf("excluded parent matched")
+	}
+}
+
+func TestSameStrings(t *testing.T) {
+	for _, test := range []struct {
+		a, b []string
+		same bool
+	}{
+		{nil, nil, true},
+		{nil, []string{}, true},
+		{[]string{"user/1", "channel/2"}, []string{"user/1", "channel/2"}, true},
+		{[]string{"user/1", "channel/2"}, []string{"channel/2", "user/1"}, false},
+		{[]string{"user/1 "}, []string{"user/1"}, false},
+		{[]string{"user/1", "user/1"}, []string{"user/1"}, false},
+	} {
+		if sameStrings(test.a, test.b) != test.same {
+			t.Errorf("%q %q: expected %v", test.a, test.b, test.same)
+		}
+	}
+}
+
+func TestNormalizeFilter(t *testing.T) {
+	daemon, filters := newTestPolicyDaemon(Credentials{"search": {Password: "s"}})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	get := func(url string) Filter {
+		req := httptest.NewRequest("GET", url, nil).WithContext(ctx)
+		req.Header.Set("Accept", "text/event-stream")
+		req.SetBasicAuth("search", "s")
+		rec := httptest.NewRecorder()
+		daemon.ServeHTTP(flushResponseWriter{rec}, req)
+		if rec.Code != 200 {
+			t.Fatalf("%s: expected status 200, got %d", url, rec.Code)
+		}
+		f := filters()
+		return f[len(f)-1]
+	}
+
+	// Mixed case operations stored before the normalization are only matched exactly
+	before := OperationData{Type: "Video", Parents: []string{"User/1"}}
+	if f := get("/ops?types=video"); strings.Join(f.Types, ",") != "video" || f.match(&before) {
+		t.Errorf("unexpected filter without normalization: %#v", f)
+	}
+
+	// Once normalized, the operations match whatever the requested case
+	daemon.ol.NormalizeTypes = true
+	daemon.ol.NormalizeParentTypes = true
+	defer func() {
+		daemon.ol.NormalizeTypes = false
+		daemon.ol.NormalizeParentTypes = false
+	}()
+	op := Operation{Event: "insert", Data: &OperationData{Type: "Video", Parents: []string{"User/1"}}}
+	daemon.ol.normalize(&op)
+	for _, url := range []string{"/ops?types=video", "/ops?types=VIDEO", "/ops?types=Vid*&parents=USER/1", "/ops?types_exclude=User"} {
+		if f := get(url); !f.match(op.Data) {
+			t.Errorf("%s: normalized operation not matched by %#v", url, f)
+		}
+	}
+	if f := get("/ops?parents=user/X1"); strings.Join(f.Parents, ",") != "user/X1" {
+		t.Errorf("the id of the parents must not be normalized: %v", f.Parents)
+	}
+}
@@ -1,11 +1,10 @@
 package oplog
 
 import (
-	"bytes"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,6 +16,14 @@ type Operation struct {
 	ID    *bson.ObjectId `bson:"_id,omitempty"`
 	Event string         `bson:"event"`
 	Data  *OperationData `bson:"data"`
+	// Appended is the time the operation has been appended, used to measure its delivery
+	// latency. It is not sent to the clients.
+	Appended time.Time `bson:"at,omitempty" json:"-"`
+	// SchemaVersion is the version of the schema of the stored operation, see
+	// decodeStoredOperation. It is not sent to the clients.
+	SchemaVersion int `bson:"v,omitempty" json:"-"`
+	// queued is the time the operation entered the ingestion queue, see OpLog.enqueue
+	queued time.Time
 }
 
 // OperationData is the data part of the SSE event for the operation.
@@ -26,11 +33,82 @@ type OperationData struct {
 	Type      string    `bson:"t" json:"type"`
 	ID        string    `bson:"id" json:"id"`
 	Ref       string    `bson:"-,omitempty" json:"ref,omitempty"`
+	// Revision is the version of the object given by the producer, increasing with each
+	// change. When set, the object state is only replaced by operations of a greater
+	// revision, so the changes produced out of order can't override the more recent ones.
+	Revision int64 `bson:"r,omitempty" json:"revision,omitempty"`
+	// Meta holds small key/value metadata about the operation, like its origin service,
+	// trace id or tenant. It is stored and streamed as is, and can be filtered on with
+	// m.<key> field filters.
+	Meta map[string]string `bson:"m,omitempty" json:"meta,omitempty"`
+	// Payload holds the full document of the object, if given by the producer. It is
+	// kept in the object state and only streamed to the clients asking for it, see
+	// marshal.
+	Payload map[string]interface{} `bson:"pl,omitempty" json:"-"`
+}
+
+// field returns the values of the data field with the given bson name, used to filter on
+// the data fields like MongoDB does with the data.<name> path: id, m.<key> for a key of
+// Meta, or pl.<path> for the string values at a dotted path of Payload. The other names
+// are refused by ValidateField.
+func (data *OperationData) field(name string) []string {
+	switch {
+	case name == "id":
+		return []string{data.ID}
+	case strings.HasPrefix(name, "m."):
+		if value, found := data.Meta[strings.TrimPrefix(name, "m.")]; found {
+			return []string{value}
+		}
+	case strings.HasPrefix(name, "pl."):
+		return payloadValues(data.Payload, strings.Split(strings.TrimPrefix(name, "pl."), "."))
+	}
+	return nil
+}
+
+// payloadValues returns the string values at the path of a payload value. As with MongoDB,
+// the arrays are traversed: their elements are matched by the rest of the path, or
+// indexed by a numeric path element, and the strings of an array at the end of the path
+// are its values.
+func payloadValues(v interface{}, path []string) []string {
+	switch v := v.(type) {
+	case string:
+		if len(path) == 0 {
+			return []string{v}
+		}
+	case map[string]interface{}:
+		if len(path) > 0 {
+			return payloadValues(v[path[0]], path[1:])
+		}
+	case bson.M:
+		return payloadValues(map[string]interface{}(v), path)
+	case []string:
+		if len(path) == 0 {
+			return v
+		}
+	case []interface{}:
+		values := []string{}
+		for _, e := range v {
+			if len(path) == 0 {
+				if s, ok := e.(string); ok {
+					values = append(values, s)
+				}
+			} else if _, ok := e.([]interface{}); !ok {
+				values = append(values, payloadValues(e, path)...)
+			}
+		}
+		if len(path) > 0 {
+			if i, err := strconv.Atoi(path[0]); err == nil && i >= 0 && i < len(v) {
+				values = append(values, payloadValues(v[i], path[1:])...)
+			}
+		}
+		return values
+	}
+	return nil
 }
 
 // NewOperation creates an new operation from given information.
 //
-// The event argument can be one of "insert", "update" or "delete". The time
+// The event argument can be one of "insert", "update", "delete" or "touch". The time
 // defines the exact modification date of the object (must be the exact same time
 // as stored in the database).
 func NewOperation(event string, time time.Time, objID, objType string, objParents []string) *Operation {
@@ -47,6 +125,50 @@ func NewOperation(event string, time time.Time, objID, objType string, objParent
 	}
 }
 
+// NewOperationFromData creates a new operation for the given event and data, validated
+// with Validate. The timestamp of the data defaults to now when zero and its parents are
+// trimmed and deduplicated, keeping their order. The ID is assigned so the operation can be
+// referenced before it is appended. It is the checked alternative to NewOperation.
+func NewOperationFromData(event string, data *OperationData) (*Operation, error) {
+	if data != nil {
+		d := *data
+		if d.Timestamp.IsZero() {
+			d.Timestamp = time.Now().UTC()
+		}
+		d.Parents = normalizeParents(d.Parents)
+		data = &d
+	}
+	id := bson.NewObjectId()
+	op := &Operation{
+		ID:    &id,
+		Event: event,
+		Data:  data,
+	}
+	if err := op.Validate(); err != nil {
+		return nil, err
+	}
+	return op, nil
+}
+
+// normalizeParents returns the parents trimmed from spaces without the duplicates, in
+// their original order
+func normalizeParents(parents []string) []string {
+	if parents == nil {
+		return nil
+	}
+	seen := make(map[string]bool, len(parents))
+	r := make([]string, 0, len(parents))
+	for _, parent := range parents {
+		parent = strings.TrimSpace(parent)
+		if seen[parent] {
+			continue
+		}
+		seen[parent] = true
+		r = append(r, parent)
+	}
+	return r
+}
+
 // GetEventID returns an SSE last event id for the operation
 func (op Operation) GetEventID() LastID {
 	return &OperationLastID{op.ID}
@@ -55,21 +177,29 @@ func (op Operation) GetEventID() LastID {
 // Validate ensures an operation has the proper syntax
 func (op Operation) Validate() error {
 	switch op.Event {
-	case "insert", "update", "delete":
+	case "insert", "update", "delete", "touch":
 	default:
 		return fmt.Errorf("invalid event name: %s", op.Event)
 	}
+	if op.Data == nil {
+		return errors.New("missing data field")
+	}
 	return op.Data.Validate()
 }
 
+// EventName returns the event of the operation
+func (op Operation) EventName() string {
+	return op.Event
+}
+
+// EventData returns the data of the operation, without its payload
+func (op Operation) EventData() ([]byte, error) {
+	return op.Data.marshal(false)
+}
+
 // WriteTo serializes an Operation as a SSE compatible message
 func (op Operation) WriteTo(w io.Writer) (int64, error) {
-	data, err := json.Marshal(op.Data)
-	if err != nil {
-		return 0, err
-	}
-	n, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", op.ID.Hex(), op.Event, data)
-	return int64(n), err
+	return writeSSE(w, op)
 }
 
 // Info returns a human readable version of the operation
@@ -78,28 +208,72 @@ func (op *Operation) Info() string {
 	if op.ID != nil {
 		id = op.ID.Hex()
 	}
+	if op.Data == nil {
+		return fmt.Sprintf("%s:%s(no data)", id, op.Event)
+	}
 	return fmt.Sprintf("%s:%s(%s:%s)", id, op.Event, op.Data.Type, op.Data.ID)
 }
 
-// genRef generates the reference URL (Ref field) from the given object URL template based on
-// the Type and Id fields.
-func (obd *OperationData) genRef(objectURL string) {
-	if objectURL == "" {
-		obd.Ref = ""
-		return
+// Clone returns a deep copy of the operation, sharing no data with it, so it can be
+// handed to a consumer while the original is still in use
+func (op Operation) Clone() Operation {
+	if op.ID != nil {
+		id := *op.ID
+		op.ID = &id
+	}
+	op.Data = op.Data.Clone()
+	return op
+}
+
+// Clone returns a deep copy of the data, its payload included, or nil for nil data
+func (obd *OperationData) Clone() *OperationData {
+	if obd == nil {
+		return nil
+	}
+	c := *obd
+	if obd.Parents != nil {
+		c.Parents = make([]string, len(obd.Parents))
+		copy(c.Parents, obd.Parents)
 	}
+	if obd.Meta != nil {
+		c.Meta = make(map[string]string, len(obd.Meta))
+		for key, value := range obd.Meta {
+			c.Meta[key] = value
+		}
+	}
+	if obd.Payload != nil {
+		c.Payload = cloneValue(obd.Payload).(map[string]interface{})
+	}
+	return &c
+}
 
-	r := strings.NewReplacer("{{type}}", obd.Type, "{{id}}", obd.ID)
-	obd.Ref = r.Replace(objectURL)
+// cloneValue returns a deep copy of a payload value, the documents, arrays and binary
+// data being copied, the other values being immutable
+func cloneValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			c[key] = cloneValue(value)
+		}
+		return c
+	case bson.M:
+		return bson.M(cloneValue(map[string]interface{}(v)).(map[string]interface{}))
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, value := range v {
+			c[i] = cloneValue(value)
+		}
+		return c
+	case []byte:
+		return append([]byte{}, v...)
+	}
+	return v
 }
 
-// GetID returns the operation id
+// GetID returns the "<type>/<id>" identity of the object, the id of its state
 func (obd OperationData) GetID() string {
-	b := bytes.Buffer{}
-	b.WriteString(obd.Type)
-	b.WriteString("/")
-	b.WriteString(obd.ID)
-	return b.String()
+	return stateID(&obd)
 }
 
 // Validate ensures an operation data has the right syntax
@@ -110,10 +284,71 @@ func (obd OperationData) Validate() error {
 	if obd.Type == "" {
 		return errors.New("missing type field")
 	}
+	if strings.Contains(obd.Type, "/") {
+		return errors.New("type can't contain /")
+	}
 	for _, parent := range obd.Parents {
 		if parent == "" {
 			return errors.New("parent can't be empty")
 		}
 	}
+	if obd.Revision < 0 {
+		return errors.New("revision can't be negative")
+	}
+	for key := range obd.Meta {
+		if key == "" {
+			return errors.New("meta key can't be empty")
+		}
+	}
+	return nil
+}
+
+// validatePayload ensures the payload takes at most maxSize bytes once stored. A limit
+// of 0 means no limit.
+func (obd OperationData) validatePayload(maxSize int) error {
+	if maxSize <= 0 || obd.Payload == nil {
+		return nil
+	}
+	b, err := bson.Marshal(obd.Payload)
+	if err != nil {
+		return fmt.Errorf("invalid payload: %s", err)
+	}
+	if len(b) > maxSize {
+		return fmt.Errorf("payload too large: %d bytes, %d maximum", len(b), maxSize)
+	}
+	return nil
+}
+
+// validateParents ensures the data has at most maxCount parents, and with strict that
+// they are all type/id references. A limit of 0 means no limit.
+func (obd OperationData) validateParents(maxCount int, strict bool) error {
+	if maxCount > 0 && len(obd.Parents) > maxCount {
+		return fmt.Errorf("too many parents: %d, %d maximum", len(obd.Parents), maxCount)
+	}
+	if strict {
+		for _, parent := range obd.Parents {
+			if i := strings.Index(parent, "/"); i <= 0 || i == len(parent)-1 {
+				return fmt.Errorf("invalid parent %s: expected a type/id reference", parent)
+			}
+		}
+	}
+	return nil
+}
+
+// validateMeta ensures the metadata has at most maxKeys keys and maxSize bytes of keys and
+// values. A limit of 0 means no limit.
+func (obd OperationData) validateMeta(maxKeys, maxSize int) error {
+	if maxKeys > 0 && len(obd.Meta) > maxKeys {
+		return fmt.Errorf("too many meta keys: %d, %d maximum", len(obd.Meta), maxKeys)
+	}
+	if maxSize > 0 {
+		size := 0
+		for key, value := range obd.Meta {
+			size += len(key) + len(value)
+		}
+		if size > maxSize {
+			return fmt.Errorf("meta too large: %d bytes, %d maximum", size, maxSize)
+		}
+	}
 	return nil
 }
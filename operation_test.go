@@ -1,6 +1,15 @@
 package oplog
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
 
 // Operation.Validate()
 
@@ -81,3 +90,377 @@ func TestOperationDataValidateEmptyParentItem(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestOperationValidateRules(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		event string
+		data  *OperationData
+		err   string
+	}{
+		{"insert", "insert", &OperationData{ID: "id", Type: "type"}, ""},
+		{"update with parents", "update", &OperationData{ID: "id", Type: "type", Parents: []string{"a/1"}}, ""},
+		{"delete", "delete", &OperationData{ID: "id", Type: "type"}, ""},
+		{"touch", "touch", &OperationData{ID: "id", Type: "type"}, ""},
+		{"unknown event", "upsert", &OperationData{ID: "id", Type: "type"}, "invalid event name: upsert"},
+		{"empty event", "", &OperationData{ID: "id", Type: "type"}, "invalid event name: "},
+		{"event case", "INSERT", &OperationData{ID: "id", Type: "type"}, "invalid event name: INSERT"},
+		{"no data", "insert", nil, "missing data field"},
+		{"no id", "insert", &OperationData{Type: "type"}, "missing id field"},
+		{"no type", "insert", &OperationData{ID: "id"}, "missing type field"},
+		{"type with slash", "insert", &OperationData{ID: "1", Type: "user/video"}, "type can't contain /"},
+		{"id with slash", "insert", &OperationData{ID: "video/1", Type: "user"}, ""},
+		{"empty parent", "insert", &OperationData{ID: "id", Type: "type", Parents: []string{"a/1", ""}}, "parent can't be empty"},
+		{"negative revision", "update", &OperationData{ID: "id", Type: "type", Revision: -1}, "revision can't be negative"},
+	} {
+		err := Operation{Event: test.event, Data: test.data}.Validate()
+		if test.err == "" && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		} else if test.err != "" && (err == nil || err.Error() != test.err) {
+			t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestNewOperationFromData(t *testing.T) {
+	ts := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, test := range []struct {
+		name    string
+		event   string
+		data    *OperationData
+		parents []string
+		err     string
+	}{
+		{"valid", "insert", &OperationData{ID: "id", Type: "type", Timestamp: ts}, nil, ""},
+		{"deduplicated parents", "update", &OperationData{ID: "id", Type: "type", Parents: []string{"b/2", "a/1", " b/2 ", "a/1"}}, []string{"b/2", "a/1"}, ""},
+		{"blank parent", "insert", &OperationData{ID: "id", Type: "type", Parents: []string{" "}}, nil, "parent can't be empty"},
+		{"invalid event", "create", &OperationData{ID: "id", Type: "type"}, nil, "invalid event name: create"},
+		{"no data", "delete", nil, nil, "missing data field"},
+		{"no id", "insert", &OperationData{Type: "type"}, nil, "missing id field"},
+		{"no type", "insert", &OperationData{ID: "id"}, nil, "missing type field"},
+	} {
+		before := time.Now()
+		op, err := NewOperationFromData(test.event, test.data)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err || op != nil {
+				t.Errorf("%s: expected error %q, got %v, %v", test.name, test.err, op, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if op.ID == nil || !op.ID.Valid() {
+			t.Errorf("%s: no id assigned", test.name)
+		}
+		if op.Data == test.data {
+			t.Errorf("%s: the given data was modified", test.name)
+		}
+		if !reflect.DeepEqual(op.Data.Parents, test.parents) {
+			t.Errorf("%s: expected parents %q, got %q", test.name, test.parents, op.Data.Parents)
+		}
+		if !test.data.Timestamp.IsZero() {
+			if !op.Data.Timestamp.Equal(test.data.Timestamp) {
+				t.Errorf("%s: timestamp changed to %s", test.name, op.Data.Timestamp)
+			}
+		} else if op.Data.Timestamp.Location() != time.UTC || op.Data.Timestamp.Before(before.Truncate(time.Second)) {
+			t.Errorf("%s: invalid default timestamp %s", test.name, op.Data.Timestamp)
+		}
+	}
+}
+
+func TestAppendInvalidOperation(t *testing.T) {
+	ol := newTestOpLog()
+	logger := &capturingLogger{}
+	ol.Logger = logger
+	// Dropped before reaching MongoDB
+	ol.AppendContext(context.Background(), &Operation{Event: "insert", Data: &OperationData{Type: "user"}})
+	ol.AppendContext(context.Background(), &Operation{Event: "insert"})
+	if len(logger.lines) != 2 {
+		t.Fatalf("expected 2 errors, got %q", logger.lines)
+	}
+	if !strings.HasPrefix(logger.lines[0], "error OPLOG dropping invalid operation (new):insert(user:): missing id field") {
+		t.Errorf("invalid error: %q", logger.lines[0])
+	}
+	if !strings.HasSuffix(logger.lines[1], "(new):insert(no data): missing data field") {
+		t.Errorf("invalid error: %q", logger.lines[1])
+	}
+}
+
+func TestOperationMetaSerialization(t *testing.T) {
+	id := bson.ObjectIdHex("545b55c7f095528dd0f3863c")
+	data := &OperationData{
+		Timestamp: time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC),
+		Parents:   []string{"user/1"},
+		Type:      "video",
+		ID:        "x1",
+		Meta:      map[string]string{"tenant": "acme", "origin": "api"},
+	}
+	op := Operation{ID: &id, Event: "insert", Data: data}
+	b := &bytes.Buffer{}
+	if _, err := op.WriteTo(b); err != nil {
+		t.Fatal(err)
+	}
+	golden := `data: {"timestamp":"2016-01-02T03:04:05.000Z","parents":["user/1"],"type":"video","id":"x1","meta":{"origin":"api","tenant":"acme"}}`
+	if expected := "id: 545b55c7f095528dd0f3863c\nevent: insert\n" + golden + "\n\n"; b.String() != expected {
+		t.Errorf("invalid operation event:\n%s\nexpected:\n%s", b, expected)
+	}
+	b.Reset()
+	if _, err := (objectState{ID: data.GetID(), Event: "insert", Timestamp: data.Timestamp, Data: data}).WriteTo(b); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "id: 1451703845000:dmlkZW8veDE\nevent: insert\n" + golden + "\n\n"; b.String() != expected {
+		t.Errorf("invalid replication event:\n%s\nexpected:\n%s", b, expected)
+	}
+
+	// Without metadata, the events are unchanged
+	b.Reset()
+	op.Data = &OperationData{Timestamp: data.Timestamp, Type: "video", ID: "x1"}
+	op.WriteTo(b)
+	if expected := "id: 545b55c7f095528dd0f3863c\nevent: insert\ndata: {\"timestamp\":\"2016-01-02T03:04:05.000Z\",\"parents\":[],\"type\":\"video\",\"id\":\"x1\"}\n\n"; b.String() != expected {
+		t.Errorf("invalid event without metadata:\n%s", b)
+	}
+
+	// The metadata is stored in the "m" field of the data of the operations and states
+	for _, doc := range []interface{}{Operation{ID: &id, Event: "insert", Data: data}, objectState{ID: data.GetID(), Event: "insert", Data: data}} {
+		raw, err := bson.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored := bson.M{}
+		if err := bson.Unmarshal(raw, &stored); err != nil {
+			t.Fatal(err)
+		}
+		if m := stored["data"].(bson.M)["m"].(bson.M); len(m) != 2 || m["tenant"] != "acme" {
+			t.Errorf("%T: invalid stored metadata: %v", doc, stored["data"])
+		}
+		state := objectState{}
+		if err := bson.Unmarshal(raw, &state); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(state.Data.Meta, data.Meta) {
+			t.Errorf("%T: metadata changed thru MongoDB: %v", doc, state.Data.Meta)
+		}
+	}
+
+	ingested, err := decodeOperation([]byte(`{"event":"insert","data":{"type":"video","id":"x1","meta":{"origin":"api","tenant":"acme"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ingested.Data.Meta, data.Meta) {
+		t.Errorf("invalid ingested metadata: %v", ingested.Data.Meta)
+	}
+}
+
+func TestOperationDataValidateMeta(t *testing.T) {
+	for _, test := range []struct {
+		meta    map[string]string
+		maxKeys int
+		maxSize int
+		err     string
+	}{
+		{nil, 1, 1, ""},
+		{map[string]string{"origin": "api"}, 0, 0, ""},
+		{map[string]string{"origin": "api", "tenant": "acme"}, 2, 19, ""},
+		{map[string]string{"origin": "api", "tenant": "acme"}, 1, 0, "too many meta keys: 2, 1 maximum"},
+		{map[string]string{"origin": "api", "tenant": "acme"}, 0, 18, "meta too large: 19 bytes, 18 maximum"},
+		{map[string]string{"": "api"}, 0, 0, "meta key can't be empty"},
+	} {
+		obd := OperationData{ID: "id", Type: "type", Meta: test.meta}
+		err := obd.Validate()
+		if err == nil {
+			err = obd.validateMeta(test.maxKeys, test.maxSize)
+		}
+		if test.err == "" && err != nil {
+			t.Errorf("%v: unexpected error: %s", test.meta, err)
+		} else if test.err != "" && (err == nil || err.Error() != test.err) {
+			t.Errorf("%v: expected error %q, got %v", test.meta, test.err, err)
+		}
+	}
+}
+
+func TestOperationDataValidateParents(t *testing.T) {
+	for _, test := range []struct {
+		parents  []string
+		maxCount int
+		strict   bool
+		err      string
+	}{
+		{nil, 1, true, ""},
+		{[]string{"user/1", "x", "/2"}, 0, false, ""},
+		{[]string{"user/1", "channel/2"}, 2, true, ""},
+		{[]string{"user/1", "channel/a/b"}, 0, true, ""},
+		{[]string{"user/1", "channel/2"}, 1, false, "too many parents: 2, 1 maximum"},
+		{[]string{"user/1", "channel"}, 0, true, "invalid parent channel: expected a type/id reference"},
+		{[]string{"/2"}, 0, true, "invalid parent /2: expected a type/id reference"},
+		{[]string{"user/"}, 0, true, "invalid parent user/: expected a type/id reference"},
+	} {
+		err := OperationData{ID: "id", Type: "type", Parents: test.parents}.validateParents(test.maxCount, test.strict)
+		if test.err == "" && err != nil {
+			t.Errorf("%v: unexpected error: %s", test.parents, err)
+		} else if test.err != "" && (err == nil || err.Error() != test.err) {
+			t.Errorf("%v: expected error %q, got %v", test.parents, test.err, err)
+		}
+	}
+}
+
+func TestAppendNormalizeParents(t *testing.T) {
+	ol := newTestOpLog()
+	logger := &capturingLogger{}
+	ol.Logger = logger
+	ol.MaxParents = 2
+	ol.StrictParents = true
+	// The parents are trimmed and deduplicated before being counted and checked
+	op := &Operation{Event: "insert", Data: &OperationData{ID: "1", Type: "video", Parents: []string{" user/1", "user/1 ", "channel/2\t"}}}
+	if err := ol.validate(op); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(op.Data.Parents, ",") != "user/1,channel/2" {
+		t.Errorf("invalid parents: %q", op.Data.Parents)
+	}
+	ol.Append(&Operation{Event: "insert", Data: &OperationData{ID: "1", Type: "video", Parents: []string{"user/1", "channel/2", "playlist/3"}}})
+	ol.Append(&Operation{Event: "insert", Data: &OperationData{ID: "1", Type: "video", Parents: []string{" user "}}})
+	ol.Append(&Operation{Event: "insert", Data: &OperationData{ID: "1", Type: "video", Parents: []string{"user/1", " "}}})
+	if len(logger.lines) != 3 ||
+		!strings.HasSuffix(logger.lines[0], "too many parents: 3, 2 maximum") ||
+		!strings.HasSuffix(logger.lines[1], "invalid parent user: expected a type/id reference") ||
+		!strings.HasSuffix(logger.lines[2], "parent can't be empty") {
+		t.Errorf("expected the operations to be dropped, got %q", logger.lines)
+	}
+}
+
+func TestOperationClone(t *testing.T) {
+	id := bson.NewObjectId()
+	op := Operation{ID: &id, Event: "insert", Data: &OperationData{
+		Parents: []string{"user/1"},
+		Type:    "video",
+		ID:      "1",
+		Meta:    map[string]string{"origin": "api"},
+		Payload: map[string]interface{}{"tags": []interface{}{"cat"}, "owner": bson.M{"name": "x"}, "raw": []byte("a")},
+	}}
+	c := op.Clone()
+	if !reflect.DeepEqual(c, op) {
+		t.Fatalf("invalid clone: %#v", c.Data)
+	}
+	*c.ID = bson.NewObjectId()
+	c.Data.ID = "2"
+	c.Data.Parents[0] = "user/2"
+	c.Data.Meta["origin"] = "ui"
+	c.Data.Payload["tags"].([]interface{})[0] = "dog"
+	c.Data.Payload["owner"].(bson.M)["name"] = "y"
+	c.Data.Payload["raw"].([]byte)[0] = 'b'
+	if *op.ID != id || op.Data.ID != "1" || op.Data.Parents[0] != "user/1" || op.Data.Meta["origin"] != "api" ||
+		op.Data.Payload["tags"].([]interface{})[0] != "cat" || op.Data.Payload["owner"].(bson.M)["name"] != "x" || string(op.Data.Payload["raw"].([]byte)) != "a" {
+		t.Errorf("original changed by its clone: %#v", op.Data)
+	}
+	if c := (Operation{Event: "insert"}).Clone(); c.ID != nil || c.Data != nil {
+		t.Errorf("invalid clone without id and data: %#v", c)
+	}
+}
+
+func TestAppendBeforeAppend(t *testing.T) {
+	ol := newTestOpLog()
+	logger := &capturingLogger{}
+	ol.Logger = logger
+	ol.MaxMetaKeys = 1
+	ol.BeforeAppend = func(op *Operation) {
+		op.Data.Meta = map[string]string{"origin": "api", "tenant": "acme"}
+	}
+	// The metadata set by the hook is validated, dropping the operation before MongoDB
+	ol.Append(&Operation{Event: "insert", Data: &OperationData{ID: "1", Type: "user"}})
+	if len(logger.lines) != 1 || !strings.HasSuffix(logger.lines[0], "too many meta keys: 2, 1 maximum") {
+		t.Errorf("expected the operation to be dropped, got %q", logger.lines)
+	}
+}
+
+func TestOperationPayloadSerialization(t *testing.T) {
+	id := bson.ObjectIdHex("545b55c7f095528dd0f3863c")
+	data := &OperationData{
+		Timestamp: time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC),
+		Type:      "video",
+		ID:        "x1",
+		Payload:   map[string]interface{}{"title": "cat", "tags": []interface{}{"a", "b"}},
+	}
+	op := Operation{ID: &id, Event: "insert", Data: data}
+	without := `{"timestamp":"2016-01-02T03:04:05.000Z","parents":[],"type":"video","id":"x1"}`
+	with := `{"timestamp":"2016-01-02T03:04:05.000Z","parents":[],"type":"video","id":"x1","payload":{"tags":["a","b"],"title":"cat"}}`
+	for _, test := range []struct {
+		ev       GenericEvent
+		expected string
+	}{
+		{op, "id: 545b55c7f095528dd0f3863c\nevent: insert\ndata: " + without + "\n\n"},
+		{withPayload{op}, "id: 545b55c7f095528dd0f3863c\nevent: insert\ndata: " + with + "\n\n"},
+		{fingerprinted{withPayload{op}, "f"}, "id: 545b55c7f095528dd0f3863c.f\nevent: insert\ndata: " + with + "\n\n"},
+		{objectState{ID: "video/x1", Event: "insert", Timestamp: data.Timestamp, Data: data}, "id: 1451703845000:dmlkZW8veDE\nevent: insert\ndata: " + without + "\n\n"},
+		{withPayload{objectState{ID: "video/x1", Event: "insert", Timestamp: data.Timestamp, Data: data}}, "id: 1451703845000:dmlkZW8veDE\nevent: insert\ndata: " + with + "\n\n"},
+		{withPayload{&Event{ID: "1", Event: "reset"}}, "id: 1\nevent: reset\n\n"},
+	} {
+		b := &bytes.Buffer{}
+		if _, err := test.ev.WriteTo(b); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != test.expected {
+			t.Errorf("%T: invalid event:\n%s\nexpected:\n%s", test.ev, b, test.expected)
+		}
+	}
+
+	// The payload is stored in the "pl" field of the data of the operations and states
+	raw, err := bson.Marshal(objectState{ID: "video/x1", Event: "insert", Data: data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := objectState{}
+	if err := bson.Unmarshal(raw, &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Data.Payload["title"] != "cat" {
+		t.Errorf("invalid stored payload: %v", state.Data.Payload)
+	}
+	b := &bytes.Buffer{}
+	withPayload{state}.WriteTo(b)
+	if !strings.Contains(b.String(), `"payload":{"tags":["a","b"],"title":"cat"}`) {
+		t.Errorf("payload changed thru MongoDB: %s", b)
+	}
+}
+
+func TestOperationDataValidatePayload(t *testing.T) {
+	for _, test := range []struct {
+		payload map[string]interface{}
+		maxSize int
+		err     string
+	}{
+		{nil, 1, ""},
+		{map[string]interface{}{"title": "cat"}, 0, ""},
+		{map[string]interface{}{"title": "cat"}, 20, ""},
+		{map[string]interface{}{"title": "cat"}, 19, "payload too large: 20 bytes, 19 maximum"},
+		{map[string]interface{}{"f": func() {}}, 100, "invalid payload: "},
+	} {
+		err := OperationData{ID: "id", Type: "type", Payload: test.payload}.validatePayload(test.maxSize)
+		if test.err == "" && err != nil {
+			t.Errorf("%v: unexpected error: %s", test.payload, err)
+		} else if test.err != "" && (err == nil || !strings.HasPrefix(err.Error(), test.err)) {
+			t.Errorf("%v: expected error %q, got %v", test.payload, test.err, err)
+		}
+	}
+}
+
+func TestOperationRevisionSerialization(t *testing.T) {
+	op, err := decodeOperation([]byte(`{"event":"update","type":"video","id":"x1","timestamp":"2016-01-02T03:04:05.000Z","revision":7}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op.Data.Revision != 7 {
+		t.Fatalf("invalid ingested revision: %d", op.Data.Revision)
+	}
+	raw, _ := bson.Marshal(objectState{ID: "video/x1", Event: "insert", Data: op.Data})
+	state := objectState{}
+	if err := bson.Unmarshal(raw, &state); err != nil {
+		t.Fatal(err)
+	}
+	b := &bytes.Buffer{}
+	state.WriteTo(b)
+	if expected := `data: {"timestamp":"2016-01-02T03:04:05.000Z","parents":[],"type":"video","id":"x1","revision":7}`; !strings.Contains(b.String(), expected) {
+		t.Errorf("revision not streamed: %s", b)
+	}
+}
@@ -8,7 +8,9 @@
 package oplog
 
 import (
+	"context"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -23,19 +25,171 @@ type OpLog struct {
 	s     *mgo.Session
 	Stats *Stats
 	// ObjectURL is a template URL to be used to generate reference URL to operation's objects.
-	// The URL can use {{type}} and {{id}} template as follow: http://api.mydomain.com/{{type}}/{{id}}.
-	// If not provided, no "ref" field will be included in oplog events.
+	// It is a text/template executed on the OperationData, i.e.:
+	// http://api.mydomain.com/{{.Type}}/{{.ID}}?parent={{index .Parents 0}}, the {{type}}
+	// and {{id}} variables being still supported. Use SetObjectURL to check the template
+	// or to give it functions. If not provided, no "ref" field will be included in oplog
+	// events.
 	ObjectURL string
+	// ObjectURLs defines the ObjectURL templates of the types living on different APIs, by
+	// type. The other types use ObjectURL. Use SetObjectURLs to check the templates.
+	ObjectURLs map[string]string
 	// Number of object to fetch from the states collection on each iteration.
 	// Too large pages may create lock contention on MongoDB, too small may slow
 	// down the iteration.
 	PageSize int
+	// MaxConcurrentTails defines the maximum number of tails allowed to run concurrently.
+	// Tails started beyond this limit are refused. A value of 0 means no limit.
+	MaxConcurrentTails int
+	// ReplicationTailWeight defines how many tails a replication counts for when checked
+	// against MaxConcurrentTails, as replications are far more expensive than live tails.
+	ReplicationTailWeight int
+	// MaxConcurrentReplications defines the maximum number of replications allowed to
+	// run concurrently. Replications beyond this limit wait for a slot in FIFO order.
+	// A value of 0 means no limit.
+	MaxConcurrentReplications int
+	// ReplicationQueueTimeout defines how long a replication can wait for a slot. Once
+	// elapsed, a "retry-later" event is sent and the tail stops streaming. A value of 0
+	// means no timeout.
+	ReplicationQueueTimeout time.Duration
+	// ReplicationQueueFeedback defines the interval at which a Queued event is sent to a
+	// waiting replication. A value of 0 disables the feedback.
+	ReplicationQueueFeedback time.Duration
+	// SharedTail makes all the live tails share a single tailable cursor on the
+	// capped collection instead of opening one cursor each. Each tail first catches
+	// up with the operations it missed, then joins the shared stream.
+	SharedTail bool
+	// SharedTailQueueSize defines the number of operations buffered per live tail when
+	// SharedTail is enabled. A tail falling further behind is evicted from the shared
+	// stream and must catch up on its own before joining it again.
+	SharedTailQueueSize int
+	// NormalizeTypes makes the appended operations have their type in lowercase, and the
+	// type of their parents too if NormalizeParentTypes is set, so consumers match them
+	// whatever the case used by the producers. The types requested by the consumers are
+	// normalized the same way. The states stored before can be normalized with
+	// NormalizeExistingTypes.
+	NormalizeTypes       bool
+	NormalizeParentTypes bool
+	// MaxStatsTypes defines the number of object types counted separately by the per type
+	// statistics, the operations of the other types being counted as "other". 0 for no
+	// limit.
+	MaxStatsTypes int
+	// Tracer traces the appends and the streams, propagating the span context of the
+	// incoming requests. No tracing is done when nil.
+	Tracer Tracer
+	// SlowReplicationPage defines the time spent by MongoDB on a replication page above
+	// which the page is logged as a warning with its range of object states. A value of 0
+	// disables the logging.
+	SlowReplicationPage time.Duration
+	// Logger logs the messages of the oplog and of its tails, the standard logrus logger
+	// when nil. Setting it lets the oplog log at its own level.
+	Logger Logger
+	// LogSampleWindow defines the window in which the repeated warnings of the retry
+	// loops, like during a MongoDB failover, are collapsed into a single line. A value of 0
+	// logs every warning.
+	LogSampleWindow time.Duration
+	// MaxParents limits the number of parents of the appended operations, once trimmed
+	// and deduplicated. With StrictParents, the parents must also be type/id references.
+	// Operations beyond are refused like the ones with too much metadata. A value of 0
+	// means no limit. The states stored before the parents were trimmed and deduplicated
+	// can be rewritten with NormalizeExistingParents.
+	MaxParents    int
+	StrictParents bool
+	// MaxMetaKeys and MaxMetaSize limit the number of keys and the size in bytes of the
+	// keys and values of the metadata of the appended operations. Operations beyond are
+	// refused by the ingest endpoints and dropped by Append. A value of 0 means no limit.
+	MaxMetaKeys int
+	MaxMetaSize int
+	// MaxPayloadSize limits the size in bytes of the payload of the appended operations
+	// once encoded in BSON. Operations beyond are refused like the ones with too much
+	// metadata. As the payloads are stored in the capped collection, large ones reduce
+	// the time operations are retained. A value of 0 means no limit.
+	MaxPayloadSize int
+	// BeforeAppend is called with each operation about to be appended, before it is
+	// validated, i.e.: to set its metadata
+	BeforeAppend func(op *Operation)
+	// FallbackRewind is subtracted from the time of an evicted operation id to get the
+	// time the fallback replication starts from. The states are timestamped by the agents
+	// appending them, so with clock skew between agents, or between the producers giving
+	// the operation ids and the agents, the state of an operation created after the
+	// evicted one may be older than its id. The rewind sends such states again instead of
+	// missing them, at the cost of sending again the objects modified during the margin:
+	// the consumers must apply the fallback replications idempotently.
+	FallbackRewind time.Duration
+	// TouchCreatesState makes the touch operations on objects without state, or deleted,
+	// store their state as an insert would. By default, such touches are only streamed.
+	TouchCreatesState bool
+
+	tailsMu      sync.Mutex
+	tailsLoad    int
+	lastAppendMu sync.Mutex
+	lastAppend   time.Time
+	// logSampler collapses the repeated warnings of the retry loops
+	logSampler logSampler
+	// queuePeaks keeps the peaks of the ingestion queue
+	queuePeaks   peakWindow
+	hub          *hub
+	replications *replicationLimiter
+	registry     tailRegistry
+	// samplerStop is closed to stop the capacity sampler, samplerDone once it stopped,
+	// watchdogStop and watchdogDone the same for the retention watchdog
+	samplerMu    sync.Mutex
+	samplerStop  chan struct{}
+	samplerDone  chan struct{}
+	watchdogStop chan struct{}
+	watchdogDone chan struct{}
+	// collStats returns the utilization of the capped collection
+	collStats func() (CollectionStats, error)
+	// retention reads the state of the capped collection checked by the retention watchdog
+	retention func(id LastID) (retentionState, error)
+	// refTemplates holds the compiled ObjectURL and ObjectURLs templates by template, see
+	// objectURLTemplate
+	refTemplates sync.Map
+	// upsert replaces or inserts an object state instead of MongoDB when set
+	upsert func(selector bson.M, state objectState) error
+	// touch updates an object state instead of MongoDB when set, returning
+	// mgo.ErrNotFound when no state matches the selector
+	touch func(selector, update bson.M) error
+	// openStatesPage queries a page of object states instead of MongoDB when set
+	openStatesPage func(query bson.M) stateIterator
+	// openStates iterates over the object states sorted by _id instead of MongoDB when
+	// set, see DiffStream
+	openStates func(query bson.M) stateIterator
+}
+
+// DefaultMaxPayloadSize is the default limit of the size of the payload of an operation,
+// see OpLog.MaxPayloadSize
+const DefaultMaxPayloadSize = 64 << 10
+
+// DefaultFallbackRewind is the default margin of the fallback replications, see
+// OpLog.FallbackRewind
+const DefaultFallbackRewind = 30 * time.Second
+
+// healthCheckTimeout defines how long the health check waits for MongoDB to answer
+const healthCheckTimeout = 2 * time.Second
+
+// Health describes the state of the oplog as seen by its health check
+type Health struct {
+	// LastAppend is the time of the last operation appended with success by this oplog,
+	// zero if none has been appended since it started
+	LastAppend time.Time
+	// NewestOperation and OldestOperation are the insertion times of the newest and
+	// oldest operations of the capped collection, zero if it is empty
+	NewestOperation time.Time
+	OldestOperation time.Time
 }
 
 // New returns an OpLog connected to the given provided mongo URL.
 // If the capped collection does not exists, it will be created with the max
 // size defined by maxBytes parameter.
 func New(mongoURL string, maxBytes int) (*OpLog, error) {
+	return NewWithMetrics(mongoURL, maxBytes, nil)
+}
+
+// NewWithMetrics returns an OpLog like New, reporting its statistics and the ones of its
+// daemons to the given sink as well as to expvar. Like New, it can only be called once as
+// the expvars are published globally.
+func NewWithMetrics(mongoURL string, maxBytes int, sink MetricsSink) (*OpLog, error) {
 	session, err := mgo.Dial(mongoURL)
 	if err != nil {
 		return nil, err
@@ -43,12 +197,21 @@ func New(mongoURL string, maxBytes int) (*OpLog, error) {
 	session.SetSyncTimeout(10 * time.Second)
 	session.SetSocketTimeout(20 * time.Second)
 	session.SetSafe(&mgo.Safe{})
-	sts := newStats()
+	sts := newStats(sink)
 	oplog := &OpLog{
-		s:        session,
-		Stats:    &sts,
-		PageSize: 1000,
+		s:                     session,
+		Stats:                 &sts,
+		PageSize:              1000,
+		ReplicationTailWeight: 1,
+		SharedTailQueueSize:   1000,
+		MaxStatsTypes:         100,
+		LogSampleWindow:       DefaultLogSampleWindow,
+		SlowReplicationPage:   10 * time.Second,
+		MaxPayloadSize:        DefaultMaxPayloadSize,
+		FallbackRewind:        DefaultFallbackRewind,
 	}
+	oplog.hub = newHub(oplog)
+	oplog.replications = newReplicationLimiter(&sts)
 	oplog.init(maxBytes)
 	// Setting monotonic before collection fails with a "not master" error
 	session.SetMode(mgo.Monotonic, true)
@@ -60,6 +223,25 @@ func (oplog *OpLog) db() *mgo.Database {
 	return oplog.s.Copy().DB("")
 }
 
+// refresh refreshes the session of db after a failure
+func (oplog *OpLog) refresh(db *mgo.Database) {
+	db.Session.Refresh()
+	oplog.Stats.MongoSessionRefreshes.Add(1)
+}
+
+// observeMongo records the duration of a MongoDB call of the given kind
+func (oplog *OpLog) observeMongo(kind string, d time.Duration) {
+	oplog.Stats.MongoDurations.Observe(kind, d)
+}
+
+// cursorOpened counts a tailable cursor opened again after the previous one expired or
+// failed
+func (oplog *OpLog) cursorOpened(reopened bool) {
+	if reopened {
+		oplog.Stats.MongoCursorReopens.Add(1)
+	}
+}
+
 // init creates capped collection if it does not exists.
 func (oplog *OpLog) init(maxBytes int) {
 	oplogExists := false
@@ -74,7 +256,7 @@ func (oplog *OpLog) init(maxBytes int) {
 		}
 	}
 	if !oplogExists {
-		log.Info("OPLOG creating capped collection")
+		oplog.logger().Infof("OPLOG creating capped collection")
 		err := oplog.s.DB("").C("oplog_ops").Create(&mgo.CollectionInfo{
 			Capped:   true,
 			MaxBytes: maxBytes,
@@ -84,24 +266,31 @@ func (oplog *OpLog) init(maxBytes int) {
 		}
 	}
 	if !objectsExists {
-		log.Info("OPLOG creating objects index")
-		c := oplog.s.DB("").C("oplog_states")
-		// Replication query
-		if err := c.EnsureIndexKey("event", "ts"); err != nil {
-			log.Fatal(err)
-		}
-		// Replication query with a filter on types
-		if err := c.EnsureIndexKey("event", "data.t", "ts"); err != nil {
-			log.Fatal(err)
-		}
-		// Fallback query
-		if err := c.EnsureIndexKey("ts"); err != nil {
-			log.Fatal(err)
-		}
-		// Fallback query with a filter on types
-		if err := c.EnsureIndexKey("data.t", "ts"); err != nil {
-			log.Fatal(err)
-		}
+		oplog.logger().Infof("OPLOG creating objects index")
+	}
+	// Indexes are ensured on every start so collections created by a previous version
+	// get the indexes needed by the current queries. Replication queries are paged by
+	// (ts, _id), hence the trailing _id.
+	c := oplog.s.DB("").C("oplog_states")
+	// Replication query
+	if err := c.EnsureIndexKey("event", "ts", "_id"); err != nil {
+		log.Fatal(err)
+	}
+	// Replication query with a filter on types
+	if err := c.EnsureIndexKey("event", "data.t", "ts", "_id"); err != nil {
+		log.Fatal(err)
+	}
+	// Fallback query
+	if err := c.EnsureIndexKey("ts", "_id"); err != nil {
+		log.Fatal(err)
+	}
+	// Fallback query with a filter on types
+	if err := c.EnsureIndexKey("data.t", "ts", "_id"); err != nil {
+		log.Fatal(err)
+	}
+	// Replication and fallback queries with a filter on parents, exact or prefixes
+	if err := c.EnsureIndexKey("data.p", "ts", "_id"); err != nil {
+		log.Fatal(err)
 	}
 }
 
@@ -109,11 +298,24 @@ func (oplog *OpLog) init(maxBytes int) {
 func (oplog *OpLog) Ingest(ops <-chan *Operation, done <-chan bool) {
 	db := oplog.db()
 	defer db.Session.Close()
+	oplog.ingest(ops, done, func(op *Operation) {
+		oplog.append(context.Background(), op, db)
+	})
+}
+
+// ingest passes the operations received thru ops to appendOp. The size of the queue is
+// sampled at least every queuePeakBucket so QueueRecentPeak decreases once idle.
+func (oplog *OpLog) ingest(ops <-chan *Operation, done <-chan bool, appendOp func(op *Operation)) {
+	ticker := time.NewTicker(queuePeakBucket)
+	defer ticker.Stop()
 	for {
 		select {
 		case op := <-ops:
-			oplog.Stats.QueueSize.Set(int64(len(ops)))
-			oplog.append(op, db)
+			oplog.dequeued(op, len(ops))
+			appendOp(op)
+		case <-ticker.C:
+			size := len(ops)
+			oplog.observeQueue(size, size)
 		case <-done:
 			return
 		}
@@ -122,53 +324,219 @@ func (oplog *OpLog) Ingest(ops <-chan *Operation, done <-chan bool) {
 
 // Append appends an operation into the OpLog
 func (oplog *OpLog) Append(op *Operation) {
-	oplog.append(op, nil)
+	oplog.AppendContext(context.Background(), op)
+}
+
+// AppendContext appends an operation into the OpLog, its span being a child of the one of
+// ctx when traced
+func (oplog *OpLog) AppendContext(ctx context.Context, op *Operation) {
+	oplog.append(ctx, op, nil)
+}
+
+// AppendBulk appends several operations into the OpLog, in order
+func (oplog *OpLog) AppendBulk(ops []*Operation) {
+	oplog.AppendBulkContext(context.Background(), ops)
 }
 
-func (oplog *OpLog) append(op *Operation, db *mgo.Database) {
+// AppendBulkContext appends several operations into the OpLog, in order, their spans
+// being children of the one of ctx when traced
+func (oplog *OpLog) AppendBulkContext(ctx context.Context, ops []*Operation) {
+	db := oplog.db()
+	defer db.Session.Close()
+	for _, op := range ops {
+		oplog.append(ctx, op, db)
+	}
+}
+
+func (oplog *OpLog) append(ctx context.Context, op *Operation, db *mgo.Database) {
+	_, span := oplog.startSpan(ctx, "oplog.append")
+	retries := 0
+	defer func() {
+		span.SetAttribute("oplog.retries", retries)
+		span.End()
+	}()
+	if oplog.BeforeAppend != nil {
+		oplog.BeforeAppend(op)
+	}
+	if err := oplog.validate(op); err != nil {
+		oplog.logger().Errorf("OPLOG dropping invalid operation %s: %s", op.Info(), err)
+		return
+	}
 	if db == nil {
 		db = oplog.db()
 		defer db.Session.Close()
 	}
-	log.Debugf("OPLOG ingest operation: %#v", op.Info())
+	oplog.normalize(op)
+	traceOperation(span, op)
+	op.Appended = time.Now()
+	op.SchemaVersion = schemaVersion
+	oplog.logger().Debugf("OPLOG ingest operation: %#v", op.Info())
 	b := backoff.NewExponentialBackOff()
 	b.MaxElapsedTime = 0 // Retry forever
 	b.Reset()
+	// Each call is timed from the end of the previous one so the hot path reads the clock
+	// once per call
+	start := op.Appended
 	for {
-		if err := db.C("oplog_ops").Insert(op); err != nil {
-			log.Warnf("OPLOG can't insert operation, retrying: %s", err)
+		err := db.C("oplog_ops").Insert(op)
+		end := time.Now()
+		oplog.observeMongo("insert", end.Sub(start))
+		if err != nil {
+			oplog.warnSampled(err, "OPLOG can't insert operation, retrying: %s", err)
+			retries++
 			// Retry with backoff
 			time.Sleep(b.NextBackOff())
-			db.Session.Refresh()
+			oplog.refresh(db)
+			start = time.Now()
 			continue
 		}
+		start = end
 		break
 	}
 	// Apply the operation on the state collection
-	event := op.Event
-	if event == "update" {
-		// Only store insert and delete events in the object stats collection as
-		// only the final stat of the object is stored.
-		event = "insert"
-	}
-	o := objectState{
-		ID:        op.Data.GetID(),
-		Event:     event,
-		Timestamp: time.Now(),
-		Data:      op.Data,
+	var upsertRetries int
+	start, upsertRetries = oplog.applyState(db, op, start)
+	retries += upsertRetries
+	oplog.appended(op, start)
+}
+
+// applyState applies an operation appended at ts on the state of its object, see
+// upsertState and touchState. It returns the time it ended and the number of retries.
+func (oplog *OpLog) applyState(db *mgo.Database, op *Operation, ts time.Time) (time.Time, int) {
+	if op.Event == "touch" {
+		return oplog.touchState(db, newObjectState(op, ts), ts)
 	}
+	return oplog.upsertState(db, newObjectState(op, ts), ts)
+}
+
+// touchState refreshes the timestamps of the inserted object state o is the touch of,
+// leaving its data as is, retrying until MongoDB answers. The timestamp of the data is
+// never moved backward. Without such a state, o is only stored if TouchCreatesState is
+// set. start is the time the call is timed from, it returns the time it ended and the
+// number of retries.
+func (oplog *OpLog) touchState(db *mgo.Database, o objectState, start time.Time) (time.Time, int) {
+	selector := bson.M{"_id": o.ID, "event": "insert"}
+	update := bson.M{
+		"$set": bson.M{"ts": o.Timestamp},
+		"$max": bson.M{"data.ts": o.Data.Timestamp},
+	}
+	touch := oplog.touch
+	if touch == nil {
+		touch = func(selector, update bson.M) error {
+			return db.C("oplog_states").Update(selector, update)
+		}
+	}
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = 0 // Retry forever
 	b.Reset()
+	retries := 0
 	for {
-		if _, err := db.C("oplog_states").Upsert(bson.M{"_id": o.ID}, o); err != nil {
-			log.Warnf("OPLOG can't upsert object, retrying: %s", err)
+		err := touch(selector, update)
+		end := time.Now()
+		oplog.observeMongo("touch", end.Sub(start))
+		if err == mgo.ErrNotFound {
+			if !oplog.TouchCreatesState {
+				oplog.logger().Debugf("OPLOG no object state to touch for %s", o.ID)
+				return end, retries
+			}
+			end, upsertRetries := oplog.upsertState(db, o, end)
+			return end, retries + upsertRetries
+		}
+		if err != nil {
+			oplog.warnSampled(err, "OPLOG can't touch object, retrying: %s", err)
+			retries++
 			// Retry with backoff
 			time.Sleep(b.NextBackOff())
-			db.Session.Refresh()
+			oplog.refresh(db)
+			start = time.Now()
 			continue
 		}
-		break
+		return end, retries
+	}
+}
+
+// stateSelector returns the selector of the object state to replace by o. With a
+// revision, it only selects a state of a lower revision, or without revision.
+func stateSelector(o objectState) bson.M {
+	if o.Data.Revision == 0 {
+		return bson.M{"_id": o.ID}
+	}
+	return bson.M{"_id": o.ID, "data.r": bson.M{"$not": bson.M{"$gte": o.Data.Revision}}}
+}
+
+// upsertState replaces the object state by o, or inserts it, retrying until MongoDB
+// answers. The state is left as is when it has a greater or equal revision than o,
+// counted in StaleRevisions. start is the time the call is timed from, it returns the
+// time it ended and the number of retries.
+func (oplog *OpLog) upsertState(db *mgo.Database, o objectState, start time.Time) (time.Time, int) {
+	selector := stateSelector(o)
+	upsert := oplog.upsert
+	if upsert == nil {
+		upsert = func(selector bson.M, state objectState) error {
+			_, err := db.C("oplog_states").Upsert(selector, state)
+			return err
+		}
+	}
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = 0 // Retry forever
+	b.Reset()
+	retries := 0
+	dup := false
+	for {
+		err := upsert(selector, o)
+		end := time.Now()
+		oplog.observeMongo("upsert", end.Sub(start))
+		if err != nil && o.Data.Revision != 0 && mgo.IsDup(err) {
+			// The selector didn't match the stored state, inserting a new one instead:
+			// its revision is more recent. Unless the state was inserted concurrently,
+			// which is told by trying again.
+			if !dup {
+				dup = true
+				start = end
+				continue
+			}
+			oplog.Stats.StaleRevisions.Add(1)
+			oplog.logger().Debugf("OPLOG skipping stale revision %d of %s", o.Data.Revision, o.ID)
+			return end, retries
+		}
+		if err != nil {
+			oplog.warnSampled(err, "OPLOG can't upsert object, retrying: %s", err)
+			retries++
+			// Retry with backoff
+			time.Sleep(b.NextBackOff())
+			oplog.refresh(db)
+			start = time.Now()
+			continue
+		}
+		return end, retries
+	}
+}
+
+// validate trims and deduplicates the parents of an operation, and ensures it has the
+// proper syntax and its parents, metadata and payload fit in the limits
+func (oplog *OpLog) validate(op *Operation) error {
+	if op.Data != nil {
+		op.Data.Parents = normalizeParents(op.Data.Parents)
 	}
+	if err := op.Validate(); err != nil {
+		return err
+	}
+	if err := op.Data.validateParents(oplog.MaxParents, oplog.StrictParents); err != nil {
+		return err
+	}
+	if err := op.Data.validateMeta(oplog.MaxMetaKeys, oplog.MaxMetaSize); err != nil {
+		return err
+	}
+	return op.Data.validatePayload(oplog.MaxPayloadSize)
+}
+
+// appended records the append of an operation into MongoDB at the given time
+func (oplog *OpLog) appended(op *Operation, at time.Time) {
+	oplog.lastAppendMu.Lock()
+	oplog.lastAppend = at
+	oplog.lastAppendMu.Unlock()
 	oplog.Stats.EventsIngested.Add(1)
+	countEvent(oplog.Stats.EventsIngestedByEvent, oplog.Stats.EventsIngestedByType, op, oplog.MaxStatsTypes)
 }
 
 // Diff finds which objects must be created or deleted in order to fix the delta
@@ -179,64 +547,91 @@ func (oplog *OpLog) append(op *Operation, db *mgo.Database) {
 // with objects that are present in the oplog database but not in the source database.
 // If an object is present in both createMap and the oplog database but timestamp of the
 // oplog object is earlier than createMap's, the object is added to the updateMap.
-func (oplog *OpLog) Diff(createMap map[string]OperationData, updateMap map[string]OperationData, deleteMap map[string]OperationData) error {
-	db := oplog.db()
-	defer db.Session.Close()
+// The maps are keyed by the OperationData.GetID of the objects, "<type>/<id>". A
+// VersionError is returned if an object state has an unknown schema version, the maps
+// being left as is on error.
+//
+// The diff is restricted to the objects matching the filter, see DiffStream which diffs
+// the source database without holding it in memory.
+func (oplog *OpLog) Diff(filter Filter, createMap map[string]OperationData, updateMap map[string]OperationData, deleteMap map[string]OperationData) error {
+	ids := make([]string, 0, len(createMap))
+	for id := range createMap {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	source := make(chan OperationData)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(source)
+		for _, id := range ids {
+			select {
+			case source <- createMap[id]:
+			case <-done:
+				return
+			}
+		}
+	}()
 
-	// Find the most recent timestamp
-	dumpTime := time.Unix(0, 0)
-	for _, obd := range createMap {
-		if obd.Timestamp.After(dumpTime) {
-			dumpTime = obd.Timestamp
+	creates := make(map[string]bool)
+	updates := []OperationData{}
+	deletes := []OperationData{}
+	err := oplog.DiffStream(filter, source, func(action DiffAction, data OperationData) error {
+		switch action {
+		case DiffCreate:
+			creates[data.GetID()] = true
+		case DiffUpdate:
+			updates = append(updates, data)
+		case DiffDelete:
+			deletes = append(deletes, data)
 		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
-
-	obs := objectState{}
-	iter := db.C("oplog_states").Find(bson.M{}).Iter()
-	for iter.Next(&obs) {
-		if obs.Event == "deleted" {
-			if obd, ok := createMap[obs.ID]; ok {
-				// If the object is present in the dump but deleted in the oplog, it means
-				// that it has been deleted between the dump creation and the sync
-				// (if the oplog version is more recent)
-				if obd.Timestamp.Before(obs.Data.Timestamp) {
-					delete(createMap, obs.ID)
-				}
-			}
-		} else {
-			if obd, ok := createMap[obs.ID]; ok {
-				// Object exists on both sides, remove it from the create map
-				delete(createMap, obs.ID)
-				// If the dump object is newer than oplog's, add it to the update map
-				if obs.Data.Timestamp.Before(obd.Timestamp) {
-					updateMap[obs.ID] = obd
-				}
-			} else {
-				// The object only exists in the oplog db, add it to the delete map
-				// if the timestamp of the found object is older than oldest object
-				// in the dump in order to ensure we don't delete an object which
-				// have been created between the dump creation and the sync.
-				if obs.Data.Timestamp.Before(dumpTime) {
-					deleteMap[obs.ID] = *obs.Data
-					delete(createMap, obs.ID)
-				}
-			}
+	// Only the objects to create are left in the createMap
+	for _, id := range ids {
+		if !creates[id] {
+			delete(createMap, id)
 		}
 	}
-	if iter.Err() != nil {
-		return iter.Err()
+	for _, data := range updates {
+		updateMap[data.GetID()] = data
+	}
+	for _, data := range deletes {
+		deleteMap[data.GetID()] = data
 	}
-
 	return nil
 }
 
-// HasID checks if an operation id is present in the capped collection.
+// fallbackID returns the replication id a fallback replication from an evicted operation
+// id starts from, rewound by FallbackRewind
+func (oplog *OpLog) fallbackID(id *OperationLastID) LastID {
+	return id.FallbackRewound(oplog.FallbackRewind)
+}
+
+// HasID checks if an operation id is present in the capped collection. An operation of
+// an unknown schema version is reported as present, the live updates resuming after it.
 func (oplog *OpLog) HasID(id LastID) (bool, error) {
 	if olid, ok := id.(*OperationLastID); ok {
 		db := oplog.db()
 		defer db.Session.Close()
-		count, err := db.C("oplog_ops").FindId(olid.ObjectId).Count()
-		return count != 0, err
+		start := time.Now()
+		raw := bson.Raw{}
+		err := db.C("oplog_ops").FindId(olid.ObjectId).Select(bson.M{"_id": 1, "v": 1}).One(&raw)
+		oplog.observeMongo("has_id", time.Since(start))
+		if err == mgo.ErrNotFound {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if _, err := decodeStoredOperation(raw); err != nil {
+			oplog.countUnknownVersion(err)
+			oplog.warnSampled(err, "OPLOG can't decode the operation of id %s: %s", olid, err)
+		}
+		return true, nil
 	}
 
 	// Replication id are always found as they are timestamps
@@ -245,10 +640,21 @@ func (oplog *OpLog) HasID(id LastID) (bool, error) {
 
 // LastID returns the most recently inserted operation id if any or nil if oplog is empty
 func (oplog *OpLog) LastID() (LastID, error) {
+	return oplog.LastIDForFilter(Filter{})
+}
+
+// LastIDForFilter returns the id of the most recently inserted operation matching the
+// filter, or nil if none does. The capped collection is scanned from its end, so the
+// query stops at the first match but may read the whole collection for rare operations.
+func (oplog *OpLog) LastIDForFilter(filter Filter) (LastID, error) {
+	query := bson.M{}
+	filter.apply(&query)
 	db := oplog.db()
 	defer db.Session.Close()
 	operation := &Operation{}
-	err := db.C("oplog_ops").Find(nil).Sort("-$natural").One(operation)
+	start := time.Now()
+	err := db.C("oplog_ops").Find(query).Sort("-$natural").One(operation)
+	oplog.observeMongo("last_id", time.Since(start))
 	if err == mgo.ErrNotFound {
 		return nil, nil
 	}
@@ -258,229 +664,46 @@ func (oplog *OpLog) LastID() (LastID, error) {
 	return nil, err
 }
 
-// Tail tails all the new operations in the oplog and send the operation in
-// the given channel. If the lastID parameter is given, all operation posted after
-// this event will be returned.
-//
-// If the lastID is a ReplicationLastID (unix timestamp in milliseconds), the tailing will
-// start by replicating all the objects last updated after the timestamp.
-//
-// Giving a lastID of 0 mean replicating all the stored objects before tailing the live updates.
-//
-// The filter argument can be used to filter on some type of objects or objects with given parrents.
-//
-// The create, update, delete events are streamed back to the sender thru the out channel
-func (oplog *OpLog) Tail(lastID LastID, filter Filter, out chan<- GenericEvent, stop <-chan bool) {
-	var lastEv GenericEvent
-
-	if lastID != nil {
-		if r, ok := lastID.(*ReplicationLastID); ok && r.int64 == 0 {
-			// When full replication is requested, start by sending a "reset" event to instruct
-			// the consumer to reset its database before processing further operations.
-			// The id is 1 so if connection is lost after this event and consumer processed the event,
-			// the connection recover won't trigger a second "reset" event.
-			out <- &Event{
-				ID:    "1",
-				Event: "reset",
-			}
-		}
-	}
-
-	done := false
-	mu := &sync.RWMutex{}
-	isDone := func() bool {
-		mu.RLock()
-		defer mu.RUnlock()
-		return done
+// Health checks MongoDB answers in a timely manner and the capped collection is readable.
+// An error describing the failure is returned if the oplog is not healthy.
+func (oplog *OpLog) Health() (Health, error) {
+	h := Health{}
+	oplog.lastAppendMu.Lock()
+	h.LastAppend = oplog.lastAppend
+	oplog.lastAppendMu.Unlock()
+
+	session := oplog.s.Copy()
+	defer session.Close()
+	session.SetSyncTimeout(healthCheckTimeout)
+	session.SetSocketTimeout(healthCheckTimeout)
+	if err := session.Ping(); err != nil {
+		return h, fmt.Errorf("can't reach MongoDB: %s", err)
 	}
+	var err error
+	h.NewestOperation, h.OldestOperation, err = operationTimes(session.DB("").C("oplog_ops"))
+	return h, err
+}
 
-	wg := sync.WaitGroup{}
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-
-		db := oplog.db()
-		defer db.Session.Close()
-
-		var iter *mgo.Iter
-		defer func() {
-			if iter != nil {
-				iter.Close()
-			}
-		}()
-
-		b := backoff.NewExponentialBackOff()
-		b.MaxElapsedTime = 0 // Retry forever
-		b.Reset()
-
-		var replicationFallbackID LastID
-
-		for {
-			var err error
-
-			if i, ok := lastID.(*OperationLastID); ok {
-				log.Debug("OPLOG start live updates")
-
-				query := bson.M{}
-				filter.apply(&query)
-				if i != nil {
-					// Resuming at given last id
-					query["_id"] = bson.M{"$gt": i.ObjectId}
-				}
-				iter = db.C("oplog_ops").Find(query).Sort("$natural").Tail(5 * time.Second)
-
-				operation := Operation{}
-				for {
-					for iter.Next(&operation) {
-						if isDone() {
-							return
-						}
-						if oplog.ObjectURL != "" {
-							// If object URL template is provided, generate it from operation's data
-							operation.Data.genRef(oplog.ObjectURL)
-						}
-						out <- operation
-						// Save current event for resume
-						lastEv = operation
-					}
-
-					if iter.Timeout() {
-						// On tail timeout, just wait again
-						continue
-					}
-					break
-				}
-
-				if isDone() {
-					return
-				}
-
-				if iter.Err() != nil {
-					log.Warnf("OPLOG tail failed with error, try to reconnect: %s", iter.Err())
-				} else if operation.ID == nil {
-					// This mostly happen when the tail cursor is on an empty collection
-					log.Debug("OPLOG ops collection is empty, retrying")
-					time.Sleep(b.NextBackOff())
-					continue
-				} else {
-					// Reset the backoff counter
-					b.Reset()
-				}
-			} else if i, ok := lastID.(*ReplicationLastID); ok {
-				log.Debug("OPLOG start replication")
-
-				// Capture the current oplog position in order to resume at this position
-				// once replication or fallback is done. This also serves a upper limit for
-				// the fetching of the data.
-				if replicationFallbackID, err = oplog.LastID(); err != nil {
-					log.Warnf("OPLOG error retriving replication fallback id: %s", err)
-					goto retry
-				}
-
-				query := bson.M{}
-				filter.apply(&query)
-				tsClause := bson.M{}
-				query["ts"] = tsClause
-				if i.int64 > 0 {
-					// Id is a timestamp, timestamp are always valid
-					tsClause["$gte"] = i.Time()
-				}
-				if replicationFallbackID != nil {
-					// Do not fetch any new object modified after the current most recent operation
-					tsClause["$lte"] = replicationFallbackID.Time()
-				}
-				if !i.fallbackMode {
-					// In replication mode, do only notify about inserts
-					// In fallback mode (when operation id is no longer in the capped collection),
-					// we must not filter deletes otherwise the consumer will get out of sync
-					query["event"] = "insert"
-				}
-
-				for {
-					// Iterate over the collection using "page" of 1000 items so we don't hold a read lock
-					// on the db for too long when the states collection is large or the reader is slow
-					iter = db.C("oplog_states").Find(query).Sort("ts").Limit(oplog.PageSize).Iter()
-
-					c := 0
-					object := objectState{}
-					for iter.Next(&object) {
-						if isDone() {
-							return
-						}
-						if oplog.ObjectURL != "" {
-							object.Data.genRef(oplog.ObjectURL)
-						}
-						out <- object
-						// Save current event for resume
-						lastEv = object
-						c++
-					}
-
-					if isDone() {
-						return
-					}
-
-					if iter.Err() != nil {
-						log.Warnf("OPLOG replication failed with error, retrying: %s", iter.Err())
-						goto retry
-					}
-
-					if lastEv != nil && c == oplog.PageSize {
-						// We consumed on page of event, go to the next page
-						tsClause["$gte"] = lastEv.GetEventID().Time()
-						continue
-					}
-
-					// When the number of returned item is lower than page size, we can assume we where
-					// on the last "page".
-					break
-				}
-
-				// Replication is done, notify and swtich to live event stream
-				//
-				// Send a "live" operation to inform the consumer it is no live event stream.
-				// We use the last event id here in order to ensure the consumer will resume
-				// the replication starting at this point in time in case of a failure after
-				// the "live" event.
-				liveID := "" // default value
-				if lastEv != nil {
-					liveID = lastEv.GetEventID().String()
-				}
-				out <- &Event{
-					ID:    liveID,
-					Event: "live",
-				}
-				// Switch to live update at the last operation id inserted before the replication
-				// was started
-				lastID = replicationFallbackID
-				replicationFallbackID = nil
-				lastEv = nil
-
-				// Reset the backoff counter
-				b.Reset()
-			} else {
-				fmt.Printf("%#v", lastID)
-				panic("Invalid last id type")
-			}
-
-		retry:
-			// Prepare for retry with backoff
-			iter.Close()
-			time.Sleep(b.NextBackOff())
-			db.Session.Refresh()
-			if lastEv != nil {
-				lastID = lastEv.GetEventID()
-			}
+// operationTimes returns the insertion times of the newest and oldest operations of the
+// capped collection, zero if it is empty
+func operationTimes(c *mgo.Collection) (newest, oldest time.Time, err error) {
+	for _, order := range []string{"-$natural", "$natural"} {
+		operation := &Operation{}
+		err := c.Find(nil).Select(bson.M{"_id": 1}).Sort(order).One(operation)
+		if err == mgo.ErrNotFound {
+			break
+		}
+		if err != nil {
+			return newest, oldest, fmt.Errorf("can't read the oplog_ops collection: %s", err)
+		}
+		if operation.ID == nil {
+			continue
+		}
+		if order == "-$natural" {
+			newest = operation.ID.Time()
+		} else {
+			oldest = operation.ID.Time()
 		}
-	}()
-
-	select {
-	case <-stop:
-		mu.Lock()
-		done = true
-		mu.Unlock()
-		wg.Wait()
-		log.Info("OPLOG tail closed")
 	}
+	return newest, oldest, nil
 }
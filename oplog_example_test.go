@@ -1,6 +1,7 @@
 package oplog_test
 
 import (
+	"context"
 	"log"
 	"os"
 	"strconv"
@@ -50,3 +51,22 @@ func ExampleOpLog_Tail() {
 	// Stop the tail
 	stop <- true
 }
+
+func ExampleOpLog_Iterator() {
+	ol, err := oplog.New("mongodb://localhost/oplog", 1048576)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Iterate over all future events with no filters
+	it := ol.Iterator(nil, oplog.Filter{})
+	defer it.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	for {
+		op, err := it.Next(ctx)
+		if err != nil {
+			break
+		}
+		op.WriteTo(os.Stdout)
+	}
+}
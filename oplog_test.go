@@ -0,0 +1,293 @@
+package oplog
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// testStats is shared by all tests as expvar variables can only be published once
+var testStats = newStats(nil)
+
+// newTestOpLog returns an OpLog with no Mongo session for tests not requiring one
+func newTestOpLog() *OpLog {
+	ol := &OpLog{
+		Stats:                 &testStats,
+		PageSize:              1000,
+		ReplicationTailWeight: 1,
+		SharedTailQueueSize:   1000,
+		MaxStatsTypes:         100,
+	}
+	ol.hub = newHub(ol)
+	ol.replications = newReplicationLimiter(&testStats)
+	return ol
+}
+
+// testStatesCollection is a states collection upserting the object states like MongoDB
+type testStatesCollection struct {
+	mu     sync.Mutex
+	states map[string]objectState
+	// racing makes the next upsert fail as if another one inserted the state concurrently
+	racing bool
+}
+
+func (c *testStatesCollection) upsert(selector bson.M, state objectState) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stored, found := c.states[selector["_id"].(string)]
+	if c.racing {
+		c.racing = false
+		found = false
+	}
+	matches := found
+	if cond, ok := selector["data.r"]; ok && found {
+		matches = !(stored.Data.Revision >= cond.(bson.M)["$not"].(bson.M)["$gte"].(int64))
+	}
+	if found && !matches {
+		// The insert of the state conflicts with the stored one
+		return &mgo.LastError{Code: 11000, Err: "E11000 duplicate key error"}
+	}
+	c.states[state.ID] = state
+	return nil
+}
+
+// touch updates the timestamps of an object state like MongoDB
+func (c *testStatesCollection) touch(selector, update bson.M) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stored, found := c.states[selector["_id"].(string)]
+	if !found || stored.Event != selector["event"] {
+		return mgo.ErrNotFound
+	}
+	data := *stored.Data
+	stored.Data = &data
+	stored.Timestamp = update["$set"].(bson.M)["ts"].(time.Time)
+	if ts := update["$max"].(bson.M)["data.ts"].(time.Time); ts.After(data.Timestamp) {
+		data.Timestamp = ts
+	}
+	c.states[stored.ID] = stored
+	return nil
+}
+
+func TestStateSelector(t *testing.T) {
+	o := objectState{ID: "video/1", Data: &OperationData{Type: "video", ID: "1"}}
+	if s := stateSelector(o); !reflect.DeepEqual(s, bson.M{"_id": "video/1"}) {
+		t.Errorf("invalid selector without revision: %v", s)
+	}
+	o.Data.Revision = 3
+	if s := stateSelector(o); !reflect.DeepEqual(s, bson.M{"_id": "video/1", "data.r": bson.M{"$not": bson.M{"$gte": int64(3)}}}) {
+		t.Errorf("invalid selector with revision: %v", s)
+	}
+}
+
+func TestUpsertStateRevisions(t *testing.T) {
+	ol := newTestOpLog()
+	stats := *ol.Stats
+	stats.StaleRevisions = new(Int)
+	stats.MongoDurations = NewHistograms(mongoBuckets...)
+	ol.Stats = &stats
+	states := &testStatesCollection{states: map[string]objectState{}}
+	ol.upsert = states.upsert
+
+	for _, op := range []struct {
+		id       string
+		revision int64
+		event    string
+	}{
+		{"1", 1, "insert"},
+		{"2", 0, "insert"},
+		{"1", 3, "insert"},
+		// Produced before revision 3 by another process
+		{"1", 2, "insert"},
+		{"2", 0, "delete"},
+		{"1", 3, "delete"},
+		{"3", 0, "insert"},
+		{"1", 5, "insert"},
+		{"3", 1, "insert"},
+		{"1", 4, "delete"},
+		{"3", 0, "delete"},
+	} {
+		o := objectState{ID: "video/" + op.id, Event: op.event, Data: &OperationData{Type: "video", ID: op.id, Revision: op.revision}}
+		ol.upsertState(nil, o, time.Now())
+	}
+
+	for id, expected := range map[string]struct {
+		revision int64
+		event    string
+	}{
+		"video/1": {5, "insert"},
+		// Operations without revision always replace the state
+		"video/2": {0, "delete"},
+		"video/3": {0, "delete"},
+	} {
+		if s := states.states[id]; s.Data.Revision != expected.revision || s.Event != expected.event {
+			t.Errorf("%s: expected %s at revision %d, got %s at %d", id, expected.event, expected.revision, s.Event, s.Data.Revision)
+		}
+	}
+	if stale := stats.StaleRevisions.Value(); stale != 3 {
+		t.Errorf("expected 3 stale revisions, got %d", stale)
+	}
+
+	// A state inserted concurrently doesn't make a more recent revision stale
+	states.racing = true
+	ol.upsertState(nil, objectState{ID: "video/1", Event: "delete", Data: &OperationData{Type: "video", ID: "1", Revision: 6}}, time.Now())
+	if s := states.states["video/1"]; s.Data.Revision != 6 || stats.StaleRevisions.Value() != 3 {
+		t.Errorf("revision 6 not applied: %d, %d stale", s.Data.Revision, stats.StaleRevisions.Value())
+	}
+}
+
+func TestTouchState(t *testing.T) {
+	ol := newTestOpLog()
+	stats := *ol.Stats
+	stats.MongoDurations = NewHistograms(mongoBuckets...)
+	ol.Stats = &stats
+	states := &testStatesCollection{states: map[string]objectState{}}
+	ol.upsert = states.upsert
+	ol.touch = states.touch
+
+	ts := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	appended := ts.Add(time.Minute)
+	for _, op := range []*Operation{
+		{Event: "insert", Data: &OperationData{Timestamp: ts, Type: "video", ID: "1", Parents: []string{"user/1"}, Payload: map[string]interface{}{"title": "cat"}}},
+		{Event: "delete", Data: &OperationData{Timestamp: ts, Type: "video", ID: "3"}},
+	} {
+		ol.applyState(nil, op, appended)
+	}
+	touch := func(id string, ts time.Time) *Operation {
+		return &Operation{Event: "touch", Data: &OperationData{Timestamp: ts, Type: "video", ID: id}}
+	}
+
+	// The timestamps of an existing object are refreshed, its data left as is
+	ol.applyState(nil, touch("1", ts.Add(time.Hour)), appended.Add(time.Hour))
+	s := states.states["video/1"]
+	if s.Event != "insert" || !s.Timestamp.Equal(appended.Add(time.Hour)) || !s.Data.Timestamp.Equal(ts.Add(time.Hour)) {
+		t.Errorf("state not touched: %s %s %s", s.Event, s.Timestamp, s.Data.Timestamp)
+	}
+	if len(s.Data.Parents) != 1 || s.Data.Payload["title"] != "cat" {
+		t.Errorf("data of the touched state changed: %#v", s.Data)
+	}
+	// A late touch doesn't move the timestamp of the data backward
+	ol.applyState(nil, touch("1", ts), appended.Add(2*time.Hour))
+	if s := states.states["video/1"]; !s.Timestamp.Equal(appended.Add(2*time.Hour)) || !s.Data.Timestamp.Equal(ts.Add(time.Hour)) {
+		t.Errorf("invalid timestamps after a late touch: %s %s", s.Timestamp, s.Data.Timestamp)
+	}
+
+	// Unknown and deleted objects are left as is
+	ol.applyState(nil, touch("2", ts), appended)
+	ol.applyState(nil, touch("3", ts.Add(time.Hour)), appended.Add(time.Hour))
+	if _, found := states.states["video/2"]; found || len(states.states) != 2 {
+		t.Errorf("state created by a touch: %v", states.states)
+	}
+	if s := states.states["video/3"]; s.Event != "delete" || !s.Timestamp.Equal(appended) {
+		t.Errorf("deleted state touched: %s %s", s.Event, s.Timestamp)
+	}
+
+	// Unless touches create the states
+	ol.TouchCreatesState = true
+	ol.applyState(nil, touch("2", ts), appended)
+	ol.applyState(nil, touch("3", ts.Add(time.Hour)), appended.Add(time.Hour))
+	for _, id := range []string{"video/2", "video/3"} {
+		if s := states.states[id]; s.Event != "insert" || s.Data == nil || stateID(s.Data) != id {
+			t.Errorf("%s: state not created by the touch: %#v", id, s)
+		}
+	}
+
+	// The touches are streamed as is, and the touched states replicated as inserts
+	ol.openStatesPage = func(query bson.M) stateIterator {
+		return &slowStateIterator{states: []objectState{states.states["video/1"]}}
+	}
+	out := make(chan GenericEvent, 10)
+	tl := ol.newTailer(Filter{Events: []string{"insert", "touch"}}, TailOptions{}, out, false)
+	tl.replicated = map[string]time.Time{}
+	tl.handoff = appended.Add(time.Hour)
+	if _, err := tl.replicatePage(nil, bson.M{}, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	op := touch("1", ts.Add(3*time.Hour))
+	id := bson.NewObjectIdWithTime(appended.Add(3 * time.Hour))
+	op.ID = &id
+	if !tl.filter.matchOperation(op) {
+		t.Fatal("touch not matched by the events filter")
+	}
+	tl.emitOperation(*op)
+	close(out)
+	expected := []string{
+		"id: 1451711105000:dmlkZW8vMQ\nevent: insert\ndata: {\"timestamp\":\"2016-01-02T04:04:05.000Z\",\"parents\":[\"user/1\"],\"type\":\"video\",\"id\":\"1\"}\n\n",
+		"id: " + id.Hex() + "\nevent: touch\ndata: {\"timestamp\":\"2016-01-02T06:04:05.000Z\",\"parents\":[],\"type\":\"video\",\"id\":\"1\"}\n\n",
+	}
+	i := 0
+	for ev := range out {
+		b := &bytes.Buffer{}
+		ev.WriteTo(b)
+		if i >= len(expected) || b.String() != expected[i] {
+			t.Errorf("invalid event %d: %q", i, b)
+		}
+		i++
+	}
+	if i != len(expected) {
+		t.Errorf("expected %d events, got %d", len(expected), i)
+	}
+}
+
+func TestObjectStatesAcrossTypes(t *testing.T) {
+	ol := newTestOpLog()
+	stats := *ol.Stats
+	stats.MongoDurations = NewHistograms(mongoBuckets...)
+	ol.Stats = &stats
+	states := &testStatesCollection{states: map[string]objectState{}}
+	ol.upsert = states.upsert
+
+	// Objects of different types sharing an id
+	ts := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, op := range []*Operation{
+		{Event: "insert", Data: &OperationData{Timestamp: ts, Type: "video", ID: "42"}},
+		{Event: "insert", Data: &OperationData{Timestamp: ts, Type: "user", ID: "42"}},
+		{Event: "update", Data: &OperationData{Timestamp: ts.Add(time.Second), Type: "video", ID: "42"}},
+		{Event: "delete", Data: &OperationData{Timestamp: ts.Add(2 * time.Second), Type: "user", ID: "42"}},
+	} {
+		ol.upsertState(nil, newObjectState(op, op.Data.Timestamp), time.Now())
+	}
+	if len(states.states) != 2 || states.states["video/42"].Event != "insert" || states.states["user/42"].Event != "delete" {
+		t.Fatalf("states overwritten across types: %v", states.states)
+	}
+
+	// Only the video is replicated: the older operations of the video are skipped, not
+	// the ones of the user
+	ol.openStatesPage = func(query bson.M) stateIterator {
+		return &slowStateIterator{states: []objectState{states.states["video/42"]}}
+	}
+	out := make(chan GenericEvent, 10)
+	tl := ol.newTailer(Filter{}, TailOptions{}, out, false)
+	tl.replicated = map[string]time.Time{}
+	tl.handoff = time.Now().Add(time.Hour)
+	if _, err := tl.replicatePage(nil, bson.M{}, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []*OperationData{
+		{Timestamp: ts, Type: "video", ID: "42"},
+		{Timestamp: ts, Type: "user", ID: "42"},
+	} {
+		id := bson.NewObjectId()
+		tl.emitOperation(Operation{ID: &id, Event: "insert", Data: data})
+	}
+	close(out)
+	expected := []string{`"type":"video","id":"42"`, `"type":"user","id":"42"`}
+	i := 0
+	for ev := range out {
+		b := &bytes.Buffer{}
+		ev.WriteTo(b)
+		if i >= len(expected) || !strings.Contains(b.String(), expected[i]) {
+			t.Errorf("invalid event %d: %s", i, b)
+		}
+		i++
+	}
+	if i != len(expected) {
+		t.Errorf("expected %d events, got %d", len(expected), i)
+	}
+}
@@ -0,0 +1,134 @@
+package oplog
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// hashCacheTTL defines how long a password successfully verified against a hash is
+	// accepted without being verified again
+	hashCacheTTL = time.Minute
+	// hashCacheMaxEntries defines the maximum number of verified passwords cached
+	hashCacheMaxEntries = 1000
+)
+
+// verifiedHashes caches the passwords successfully verified against a hash. As hash
+// verification is slow by design, it prevents reconnection storms from burning CPU.
+var verifiedHashes = newHashCache(hashCacheTTL, hashCacheMaxEntries, time.Now)
+
+// passwordMatches checks a password against the expected one, which can be given in
+// plaintext or as a bcrypt ($2a$, $2b$ or $2y$) or argon2id ($argon2id$) hash.
+func passwordMatches(expected, password string) bool {
+	if !isPasswordHash(expected) {
+		return secureCompare(expected, password)
+	}
+	key := sha256.Sum256([]byte(expected + "\x00" + password))
+	if verifiedHashes.valid(key) {
+		return true
+	}
+	var ok bool
+	if strings.HasPrefix(expected, "$argon2id$") {
+		ok = argon2idMatches(expected, password)
+	} else {
+		ok = bcrypt.CompareHashAndPassword([]byte(expected), []byte(password)) == nil
+	}
+	if ok {
+		verifiedHashes.add(key)
+	}
+	return ok
+}
+
+// isPasswordHash tells if a configured password is given as a hash
+func isPasswordHash(password string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$", "$argon2id$"} {
+		if strings.HasPrefix(password, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// argon2idMatches checks a password against an argon2id hash in the PHC string format,
+// i.e.: $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>
+func argon2idMatches(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return false
+	}
+	given := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, given) == 1
+}
+
+// hashCache stores, for a limited time, the keys of successfully verified credentials.
+// Keys are hashes so the cache never holds the passwords.
+type hashCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	max     int
+	entries map[[sha256.Size]byte]time.Time
+	now     func() time.Time
+}
+
+func newHashCache(ttl time.Duration, max int, now func() time.Time) *hashCache {
+	return &hashCache{ttl: ttl, max: max, entries: map[[sha256.Size]byte]time.Time{}, now: now}
+}
+
+// valid tells if key has been verified less than ttl ago
+func (c *hashCache) valid(key [sha256.Size]byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires, found := c.entries[key]
+	if !found {
+		return false
+	}
+	if !c.now().Before(expires) {
+		delete(c.entries, key)
+		return false
+	}
+	return true
+}
+
+// add records key as verified
+func (c *hashCache) add(key [sha256.Size]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if len(c.entries) >= c.max {
+		for k, expires := range c.entries {
+			if !now.Before(expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= c.max {
+			// Still full of valid entries, start over rather than growing unbounded
+			c.entries = map[[sha256.Size]byte]time.Time{}
+		}
+	}
+	c.entries[key] = now.Add(c.ttl)
+}
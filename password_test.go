@@ -0,0 +1,110 @@
+package oplog
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTestArgon2idHash(password string) string {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte(password), salt, 1, 1024, 1, 32)
+	return fmt.Sprintf("$argon2id$v=%d$m=1024,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func TestPasswordMatches(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		expected string
+		password string
+		valid    bool
+	}{
+		{"secret", "secret", true},
+		{"secret", "secret2", false},
+		{string(bcryptHash), "secret", true},
+		{string(bcryptHash), "secret2", false},
+		// The hash itself is not accepted as a password
+		{string(bcryptHash), string(bcryptHash), false},
+		{newTestArgon2idHash("secret"), "secret", true},
+		{newTestArgon2idHash("secret"), "secret2", false},
+		{"$argon2id$v=19$m=1024,t=1,p=1$invalid", "secret", false},
+		{"$argon2id$v=16$m=1024,t=1,p=1$MDEyMzQ1Njc4OWFiY2RlZg$AAAA", "secret", false},
+	}
+	for _, test := range tests {
+		// Run twice to go thru the cache of verified hashes
+		for i := 0; i < 2; i++ {
+			if valid := passwordMatches(test.expected, test.password); valid != test.valid {
+				t.Errorf("%q/%q: expected %v, got %v", test.expected, test.password, test.valid, valid)
+			}
+		}
+	}
+}
+
+func TestHashedPasswordAuthenticate(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	daemon := newTestSSEDaemonHandler("")
+	daemon.Password = string(bcryptHash)
+	daemon.Authenticator = Credentials{"alice": {Password: newTestArgon2idHash("a")}, "bob": {Password: "b"}}
+	tests := []struct {
+		user, password string
+		status         int
+	}{
+		{"anyone", "secret", 200},
+		{"anyone", string(bcryptHash), 401},
+		{"alice", "a", 200},
+		{"alice", "b", 401},
+		{"bob", "b", 200},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/ops/poll?since_id=1423995187898", nil)
+		req.SetBasicAuth(test.user, test.password)
+		daemon.ServeHTTP(rec, req)
+		if rec.Code != test.status {
+			t.Errorf("%s/%s: expected status %d, got %d", test.user, test.password, test.status, rec.Code)
+		}
+	}
+}
+
+func TestHashCache(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := newHashCache(time.Minute, 2, func() time.Time { return now })
+	a := sha256.Sum256([]byte("a"))
+	b := sha256.Sum256([]byte("b"))
+	if c.valid(a) {
+		t.Fatal("unknown key reported valid")
+	}
+	c.add(a)
+	now = now.Add(59 * time.Second)
+	if !c.valid(a) {
+		t.Error("key expired before its ttl")
+	}
+	now = now.Add(time.Second)
+	if c.valid(a) {
+		t.Error("key not expired after its ttl")
+	}
+	if len(c.entries) != 0 {
+		t.Errorf("expired key not removed: %d entries", len(c.entries))
+	}
+
+	// The cache is bounded
+	c.add(a)
+	c.add(b)
+	c.add(sha256.Sum256([]byte("c")))
+	if len(c.entries) > 2 {
+		t.Errorf("expected at most 2 entries, got %d", len(c.entries))
+	}
+}
@@ -0,0 +1,135 @@
+package oplog
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// PolicyMode defines how the streams asking for operations outside of the policy of their
+// credentials are handled.
+type PolicyMode int
+
+const (
+	// PolicyReject refuses the stream with a 403 Forbidden error.
+	PolicyReject PolicyMode = iota
+	// PolicyConstrain silently removes the types and parents outside of the policy from
+	// the filter of the stream.
+	PolicyConstrain
+)
+
+// Policy restricts the operations a principal can consume. Empty lists allow everything.
+type Policy struct {
+	// Types are the allowed object types
+	Types []string `json:"types,omitempty"`
+	// Parents are the prefixes of the allowed parents, i.e.: "user/" or "user/xkjdi"
+	Parents []string `json:"parents,omitempty"`
+}
+
+// PolicyAuthenticator is an Authenticator restricting the operations each user can consume.
+// Users of other authenticators are not restricted.
+type PolicyAuthenticator interface {
+	Authenticator
+	Policy(user string) Policy
+}
+
+// restricted tells if the policy restricts the operations
+func (p Policy) restricted() bool {
+	return len(p.Types) > 0 || len(p.Parents) > 0
+}
+
+// enforce returns the filter restricted to the policy. A filter not giving types or
+// parents is restricted to exactly the policy. A filter asking for types or parents
+// outside of the policy is refused with an error, or, if constrain is true, stripped from
+// them. A filter left with none of the types or parents it asked for is always refused.
+// A filter requiring all its parents only needs one of them to be allowed.
+func (p Policy) enforce(filter Filter, constrain bool) (Filter, error) {
+	if len(p.Types) > 0 {
+		if len(filter.Types) == 0 {
+			filter.Types = append([]string{}, p.Types...)
+		} else {
+			allowed := []string{}
+			for _, t := range filter.Types {
+				if patternCovered(p.Types, t) {
+					allowed = append(allowed, t)
+				} else if !constrain {
+					return filter, fmt.Errorf("type %s not allowed", t)
+				}
+			}
+			if len(allowed) == 0 {
+				return filter, fmt.Errorf("types %s not allowed", strings.Join(filter.Types, ","))
+			}
+			filter.Types = allowed
+		}
+	}
+	if len(p.Parents) > 0 {
+		if len(filter.Parents) == 0 {
+			filter.ParentPrefixes = append([]string{}, p.Parents...)
+		} else if filter.ParentsMode != ParentsAll || !anyHasPrefix(filter.Parents, p.Parents) {
+			// When all the parents are required, the operations all have the allowed one
+			allowed := []string{}
+			for _, parent := range filter.Parents {
+				if hasAnyPrefix(parent, p.Parents) {
+					allowed = append(allowed, parent)
+				} else if !constrain {
+					return filter, fmt.Errorf("parent %s not allowed", parent)
+				}
+			}
+			if len(allowed) == 0 {
+				return filter, fmt.Errorf("parents %s not allowed", strings.Join(filter.Parents, ","))
+			}
+			filter.Parents = allowed
+		}
+	}
+	return filter, nil
+}
+
+// anyHasPrefix returns true if one of the values starts with one of the prefixes
+func anyHasPrefix(values, prefixes []string) bool {
+	for _, v := range values {
+		if hasAnyPrefix(v, prefixes) {
+			return true
+		}
+	}
+	return false
+}
+
+// enforcePolicy restricts the filter of a stream to the policy of the principal
+// authenticated by r. When the filter is refused, a 403 error is answered and false is
+// returned.
+func (daemon *SSEDaemon) enforcePolicy(w http.ResponseWriter, r *http.Request, prefix, ip string, filter Filter) (Filter, bool) {
+	principal, found := PrincipalFromContext(r.Context())
+	if !found || !principal.Policy.restricted() {
+		return filter, true
+	}
+	enforced, err := principal.Policy.enforce(filter, daemon.PolicyMode == PolicyConstrain)
+	if err != nil {
+		daemon.logger().Warnf("%s[%s] filter refused for %q: %s", prefix, ip, principal.Name, err)
+		daemon.ol.Stats.AuthzDeniedPolicy.Add(1)
+		writeError(w, 403, "forbidden", err.Error())
+		return filter, false
+	}
+	return enforced, true
+}
+
+// parseGrants parses the optional fields of a credentials or tokens file line: the comma
+// separated scopes, and the "types=" and "parents=" comma separated lists of the policy.
+func parseGrants(fields []string) (scopes []string, policy Policy, err error) {
+	for _, field := range fields {
+		switch {
+		case strings.HasPrefix(field, "types="):
+			policy.Types = strings.Split(strings.TrimPrefix(field, "types="), ",")
+		case strings.HasPrefix(field, "parents="):
+			policy.Parents = strings.Split(strings.TrimPrefix(field, "parents="), ",")
+		case scopes == nil && !strings.Contains(field, "="):
+			scopes = strings.Split(field, ",")
+		default:
+			return nil, Policy{}, fmt.Errorf("invalid field %q", field)
+		}
+	}
+	if contains(scopes, "") || contains(policy.Types, "") || contains(policy.Parents, "") {
+		return nil, Policy{}, errors.New("empty value")
+	}
+	return scopes, policy, nil
+}
@@ -0,0 +1,211 @@
+package oplog
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPolicyEnforce(t *testing.T) {
+	policy := Policy{Types: []string{"video", "user"}, Parents: []string{"user/"}}
+	tests := []struct {
+		filter    Filter
+		constrain bool
+		types     string
+		parents   string
+		prefixes  string
+		err       bool
+	}{
+		// Empty requests default to exactly the grant
+		{Filter{}, false, "video,user", "", "user/", false},
+		{Filter{Types: []string{"video"}}, false, "video", "", "user/", false},
+		{Filter{Parents: []string{"user/x1"}}, false, "video,user", "user/x1", "", false},
+		// Explicit requests outside of the policy
+		{Filter{Types: []string{"video", "playlist"}}, false, "", "", "", true},
+		{Filter{Parents: []string{"user/x1", "playlist/x2"}}, false, "", "", "", true},
+		{Filter{Types: []string{"video", "playlist"}}, true, "video", "", "user/", false},
+		{Filter{Parents: []string{"user/x1", "playlist/x2"}}, true, "video,user", "user/x1", "", false},
+		// Nothing left once constrained
+		{Filter{Types: []string{"playlist"}}, true, "", "", "", true},
+		{Filter{Parents: []string{"playlist/x2"}}, true, "", "", "", true},
+	}
+	for _, test := range tests {
+		f, err := policy.enforce(test.filter, test.constrain)
+		if test.err {
+			if err == nil {
+				t.Errorf("%#v: expected an error, got %#v", test.filter, f)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%#v: unexpected error: %s", test.filter, err)
+			continue
+		}
+		if strings.Join(f.Types, ",") != test.types || strings.Join(f.Parents, ",") != test.parents || strings.Join(f.ParentPrefixes, ",") != test.prefixes {
+			t.Errorf("%#v: invalid filter %#v", test.filter, f)
+		}
+	}
+}
+
+func TestPolicyEnforceTypePatterns(t *testing.T) {
+	policy := Policy{Types: []string{"video.*", "user"}}
+	for typ, allowed := range map[string]bool{
+		"video.caption": true,
+		"video.*":       true,
+		"video.thumb*":  true,
+		"video":         false,
+		"video*":        false,
+		"user":          true,
+		"user*":         false,
+	} {
+		_, err := policy.enforce(Filter{Types: []string{typ}}, false)
+		if (err == nil) != allowed {
+			t.Errorf("%s: expected allowed %v, got error %v", typ, allowed, err)
+		}
+	}
+}
+
+func TestPolicyEnforceParentsAll(t *testing.T) {
+	policy := Policy{Parents: []string{"user/"}}
+	f, err := policy.enforce(Filter{Parents: []string{"user/1", "playlist/2"}, ParentsMode: ParentsAll}, false)
+	if err != nil || strings.Join(f.Parents, ",") != "user/1,playlist/2" {
+		t.Errorf("a filter requiring an allowed parent must be kept, got %#v, %v", f, err)
+	}
+	if _, err := policy.enforce(Filter{Parents: []string{"video/1", "playlist/2"}, ParentsMode: ParentsAll}, true); err == nil {
+		t.Error("a filter without any allowed parent must be refused")
+	}
+}
+
+func TestParseGrants(t *testing.T) {
+	scopes, policy, err := parseGrants([]string{"types=video,user", "read,write", "parents=user/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(scopes, ",") != "read,write" || strings.Join(policy.Types, ",") != "video,user" || strings.Join(policy.Parents, ",") != "user/" {
+		t.Errorf("invalid grants: %v %#v", scopes, policy)
+	}
+	for _, invalid := range [][]string{{"read", "write"}, {"foo=bar"}, {"types="}, {"read,"}} {
+		if _, _, err := parseGrants(invalid); err == nil {
+			t.Errorf("%v: expected an error", invalid)
+		}
+	}
+}
+
+// newTestPolicyDaemon returns a daemon recording the filters its streams are tailed with
+func newTestPolicyDaemon(credentials Credentials) (*SSEDaemon, func() []Filter) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.Authenticator = credentials
+	daemon.lastID = func() (LastID, error) { return NewLastID("545b55c7f095528dd0f3863c") }
+	daemon.hasID = func(LastID) (bool, error) { return true, nil }
+	mu := sync.Mutex{}
+	filters := []Filter{}
+	daemon.tail = func(lastID LastID, filter Filter, opts TailOptions, out chan<- GenericEvent, stop <-chan bool) {
+		mu.Lock()
+		filters = append(filters, filter)
+		mu.Unlock()
+		<-stop
+	}
+	return daemon, func() []Filter {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]Filter{}, filters...)
+	}
+}
+
+func TestGetOpsPolicy(t *testing.T) {
+	credentials := Credentials{
+		"partner":  {Password: "p", Policy: Policy{Types: []string{"video"}, Parents: []string{"user/"}}},
+		"internal": {Password: "i"},
+	}
+	daemon, filters := newTestPolicyDaemon(credentials)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	get := func(url, user string) int {
+		req := httptest.NewRequest("GET", url, nil).WithContext(ctx)
+		req.Header.Set("Accept", "text/event-stream")
+		req.SetBasicAuth(user, map[string]string{"partner": "p", "internal": "i"}[user])
+		rec := httptest.NewRecorder()
+		daemon.ServeHTTP(flushResponseWriter{rec}, req)
+		return rec.Code
+	}
+
+	// Explicit requests outside of the policy are refused
+	for _, url := range []string{"/ops?types=video,playlist", "/ops?parents=playlist/x1", "/ops/poll?types=playlist"} {
+		if status := get(url, "partner"); status != 403 {
+			t.Errorf("%s: expected status 403, got %d", url, status)
+		}
+	}
+	if len(filters()) != 0 {
+		t.Fatalf("refused streams must not be tailed: %#v", filters())
+	}
+
+	// Empty requests default to exactly the grant, for live streams and replications
+	for _, url := range []string{"/ops", "/ops?since=1423995187000"} {
+		if status := get(url, "partner"); status != 200 {
+			t.Fatalf("%s: expected status 200, got %d", url, status)
+		}
+	}
+	for _, f := range filters() {
+		if strings.Join(f.Types, ",") != "video" || len(f.Parents) != 0 || strings.Join(f.ParentPrefixes, ",") != "user/" {
+			t.Errorf("filter not restricted to the grant: %#v", f)
+		}
+	}
+
+	// Unrestricted credentials are not affected
+	if status := get("/ops?types=playlist", "internal"); status != 200 {
+		t.Errorf("expected status 200, got %d", status)
+	}
+	if f := filters()[2]; strings.Join(f.Types, ",") != "playlist" || f.ParentPrefixes != nil {
+		t.Errorf("unrestricted filter changed: %#v", f)
+	}
+
+	// Constrained requests are narrowed to the grant
+	daemon.PolicyMode = PolicyConstrain
+	if status := get("/ops?types=video,playlist&parents=user/x1,playlist/x2", "partner"); status != 200 {
+		t.Fatalf("expected status 200, got %d", status)
+	}
+	if f := filters()[3]; strings.Join(f.Types, ",") != "video" || strings.Join(f.Parents, ",") != "user/x1" {
+		t.Errorf("filter not constrained: %#v", f)
+	}
+}
+
+func TestGetOpsPolicyChange(t *testing.T) {
+	credentials := Credentials{"partner": {Password: "p", Policy: Policy{Types: []string{"video"}}}}
+	daemon, filters := newTestPolicyDaemon(credentials)
+	daemon.FilterFingerprint = true
+	daemon.FilterChangePolicy = FilterChangeReject
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	get := func(lastEventID string) int {
+		req := httptest.NewRequest("GET", "/ops", nil).WithContext(ctx)
+		req.Header.Set("Accept", "text/event-stream")
+		req.Header.Set("Last-Event-ID", lastEventID)
+		req.SetBasicAuth("partner", "p")
+		rec := httptest.NewRecorder()
+		daemon.ServeHTTP(flushResponseWriter{rec}, req)
+		return rec.Code
+	}
+	granted := Filter{Types: []string{"video"}}
+	lastEventID := "545b55c7f095528dd0f3863c." + granted.Fingerprint()
+	if status := get(lastEventID); status != 200 {
+		t.Fatalf("expected status 200, got %d", status)
+	}
+
+	// The grant changes between reconnects: the new policy applies and the change of
+	// filter is detected
+	credentials["partner"] = Credential{Password: "p", Policy: Policy{Types: []string{"user"}}}
+	if status := get(lastEventID); status != 409 {
+		t.Errorf("expected the filter change to be refused, got %d", status)
+	}
+	daemon.FilterChangePolicy = FilterChangeIgnore
+	if status := get(lastEventID); status != 200 {
+		t.Fatalf("expected status 200, got %d", status)
+	}
+	if f := filters(); len(f) != 2 || strings.Join(f[1].Types, ",") != "user" {
+		t.Errorf("new policy not applied: %#v", f)
+	}
+}
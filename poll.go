@@ -0,0 +1,215 @@
+package oplog
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sebest/xff"
+)
+
+// pollLinger defines how long a poll keeps waiting for more events after receiving one,
+// so events streamed in a burst are returned together.
+const pollLinger = 100 * time.Millisecond
+
+// defaultPollMax defines the number of events returned by a poll when max is not given
+const defaultPollMax = 100
+
+// PollOps exposes a long-polling endpoint returning the events following since_id as a
+// JSON array, for clients which can't keep a stream open. The poll waits up to the wait
+// query-string parameter for at least one event before returning an empty array.
+func (daemon *SSEDaemon) PollOps(w http.ResponseWriter, r *http.Request) {
+	daemon.handlers.Add(1)
+	defer daemon.handlers.Done()
+
+	ip := xff.GetRemoteAddr(r)
+	daemon.logger().Infof("POLL[%s] poll started", ip)
+
+	leave, ok := daemon.admit(w, r)
+	if !ok {
+		return
+	}
+	defer leave()
+
+	r, ok = daemon.authenticate(w, r, ScopeRead)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query()
+	max := defaultPollMax
+	if max > daemon.MaxLimit {
+		max = daemon.MaxLimit
+	}
+	if m := q.Get("max"); m != "" {
+		var err error
+		if max, err = strconv.Atoi(m); err != nil || max < 1 || max > daemon.MaxLimit {
+			daemon.logger().Warnf("POLL[%s] invalid max: %s", ip, m)
+			writeError(w, 400, "invalid_parameter", fmt.Sprintf("invalid max: %s, must be between 1 and %d", m, daemon.MaxLimit))
+			return
+		}
+	}
+	var wait time.Duration
+	if wt := q.Get("wait"); wt != "" {
+		seconds, err := strconv.Atoi(wt)
+		wait = time.Duration(seconds) * time.Second
+		if err != nil || seconds < 0 || wait > daemon.MaxPollWait {
+			daemon.logger().Warnf("POLL[%s] invalid wait: %s", ip, wt)
+			writeError(w, 400, "invalid_parameter", fmt.Sprintf("invalid wait: %s, must be between 0 and %d seconds", wt, daemon.MaxPollWait/time.Second))
+			return
+		}
+	}
+
+	filter, err := daemon.parseFilter(r)
+	if err != nil {
+		daemon.logger().Warnf("POLL[%s] invalid filter: %s", ip, err)
+		writeError(w, 400, "invalid_filter", err.Error())
+		return
+	}
+	if filter, ok = daemon.enforcePolicy(w, r, "POLL", ip, filter); !ok {
+		return
+	}
+
+	lastID, startID, serr := daemon.resolveLastID(ip, q.Get("since_id"), filter, time.Time{})
+	if serr != nil {
+		writeError(w, serr.status, serr.code, serr.message)
+		return
+	}
+	if startID != lastID {
+		// A poll can't run a replication, the client must replicate from the suggested
+		// id on its own
+		daemon.logger().Warnf("POLL[%s] since id evicted from the capped collection", ip)
+		daemon.writeEvicted(w, "since_id_evicted", "since_id is no longer in the oplog, replicate from fallback_id", startID)
+		return
+	}
+
+	release, ok := daemon.ol.reserveTail(startID)
+	if !ok {
+		daemon.logger().Warnf("POLL[%s] too many concurrent tails", ip)
+		w.Header().Set("Retry-After", strconv.Itoa(int(daemon.RetryAfter/time.Second)))
+		writeError(w, 503, "too_many_clients", "too many clients, retry later")
+		return
+	}
+	defer release()
+
+	// The poll is registered so it is listed by Connections and can be revoked, see
+	// DisconnectClients
+	stream := newConnection(ip, r)
+	stream.update(func(info *ConnectionInfo) {
+		info.Filter = filter
+		info.LastEventID = q.Get("since_id")
+		info.Mode = "live"
+		if principal, found := PrincipalFromContext(r.Context()); found {
+			info.Auth = "ok"
+			info.User = principal.Name
+		}
+	})
+	daemon.register(stream)
+	defer daemon.unregister(stream)
+
+	ops := make(chan GenericEvent)
+	stop := make(chan bool)
+	go daemon.tail(lastID, filter, TailOptions{}, ops, stop)
+	defer func() {
+		// Stop the oplog tailer
+		stop <- true
+	}()
+
+	fingerprint := ""
+	if daemon.FilterFingerprint {
+		fingerprint = filter.Fingerprint()
+	}
+
+	nextID := ""
+	if lastID != nil {
+		nextID = lastID.String()
+	}
+	events := []json.RawMessage{}
+
+	// Even without wait, the tail is given some time to send the events already available
+	if wait < pollLinger {
+		wait = pollLinger
+	}
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+	linger := time.NewTimer(pollLinger)
+	linger.Stop()
+	defer linger.Stop()
+
+collect:
+	for len(events) < max {
+		select {
+		case <-r.Context().Done():
+			daemon.logger().Infof("POLL[%s] connection closed", ip)
+			return
+
+		case <-daemon.quit:
+			break collect
+
+		case <-stream.revoked:
+			daemon.logger().Warnf("POLL[%s] poll revoked", ip)
+			writeError(w, 401, "revoked", "credentials revoked")
+			return
+
+		case <-deadline.C:
+			break collect
+
+		case <-linger.C:
+			break collect
+
+		case op := <-ops:
+			e, _ := op.(*Event)
+			if e != nil && e.Event == "retry-later" {
+				if len(events) == 0 {
+					daemon.logger().Warnf("POLL[%s] replication timed out waiting for a slot", ip)
+					w.Header().Set("Retry-After", strconv.Itoa(int(daemon.RetryAfter/time.Second)))
+					writeError(w, 503, "too_many_clients", "too many clients, retry later")
+					return
+				}
+				break collect
+			}
+			if _, checkpoint := op.(*Checkpoint); checkpoint {
+				continue
+			}
+			msg, err := eventJSON(daemon.wrapEvent(op, fingerprint))
+			if err != nil {
+				daemon.logger().Warnf("POLL[%s] can't encode event: %s", ip, err)
+				continue
+			}
+			if msg == nil {
+				continue
+			}
+			events = append(events, msg)
+			daemon.countSent(op)
+			switch op.(type) {
+			case *Event, *Queued, *Fallback, *Warning:
+				stream.sent(op.GetEventID().String(), false)
+			default:
+				stream.sent(op.GetEventID().String(), true)
+			}
+			if id := op.GetEventID().String(); id != "" {
+				nextID = id
+			}
+			if e != nil && e.Event == "end" {
+				break collect
+			}
+			resetTimer(linger, pollLinger)
+		}
+	}
+
+	nextID = daemon.eventID(nextID, fingerprint)
+	body, _ := json.Marshal(struct {
+		Events []json.RawMessage `json:"events"`
+		NextID string            `json:"next_id"`
+	}{events, nextID})
+	h := w.Header()
+	h.Set("Server", fmt.Sprintf("oplog/%s", Version))
+	h.Set("Content-Type", "application/json")
+	h.Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	h.Set("X-Oplog-Next-ID", nextID)
+	w.Write(body)
+	daemon.ol.Stats.EventsSent.Add(int64(len(events)))
+	daemon.logger().Infof("POLL[%s] %d events returned", ip, len(events))
+}
@@ -0,0 +1,132 @@
+package oplog
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+type testPollResponse struct {
+	Events []struct {
+		ID    string `json:"id"`
+		Event string `json:"event"`
+	} `json:"events"`
+	NextID     string `json:"next_id"`
+	FallbackID string `json:"fallback_id"`
+}
+
+func testPoll(t *testing.T, daemon *SSEDaemon, query string) (*httptest.ResponseRecorder, testPollResponse) {
+	rec := httptest.NewRecorder()
+	daemon.ServeHTTP(rec, httptest.NewRequest("GET", "/ops/poll"+query, nil))
+	res := testPollResponse{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("invalid JSON body: %s: %s", err, rec.Body.String())
+	}
+	return rec, res
+}
+
+func TestPollOps(t *testing.T) {
+	ops := newTestOperations(5)
+	var filter Filter
+	daemon := newTestSSEOpsDaemon(ops)
+	tail := daemon.tail
+	daemon.tail = func(lastID LastID, f Filter, opts TailOptions, out chan<- GenericEvent, stop <-chan bool) {
+		filter = f
+		tail(lastID, f, opts, out, stop)
+	}
+
+	rec, res := testPoll(t, daemon, "?since_id=1423995187898&max=3&types=video")
+	if rec.Code != 200 {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	if strings.Join(filter.Types, ",") != "video" {
+		t.Errorf("filter not applied: %#v", filter)
+	}
+	// The reset event counts as an event
+	if len(res.Events) != 3 || res.Events[0].Event != "reset" || res.Events[1].ID != ops[0].ID.Hex() || res.Events[2].ID != ops[1].ID.Hex() {
+		t.Fatalf("unexpected events: %#v", res.Events)
+	}
+	if res.NextID != ops[1].ID.Hex() || rec.Header().Get("X-Oplog-Next-ID") != res.NextID {
+		t.Errorf("invalid next id: %s (header %s)", res.NextID, rec.Header().Get("X-Oplog-Next-ID"))
+	}
+}
+
+func TestPollOpsWait(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.tail = func(lastID LastID, filter Filter, opts TailOptions, out chan<- GenericEvent, stop <-chan bool) {
+		<-stop
+	}
+	started := time.Now()
+	rec, res := testPoll(t, daemon, "?since_id=1423995187898&wait=1")
+	if elapsed := time.Since(started); elapsed < time.Second || elapsed > 2*time.Second {
+		t.Errorf("poll didn't wait for the requested time: %s", elapsed)
+	}
+	if rec.Code != 200 || len(res.Events) != 0 {
+		t.Fatalf("expected an empty array, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), `"events":[]`) {
+		t.Errorf("events must be an empty array: %s", rec.Body.String())
+	}
+	if res.NextID != "1423995187898" {
+		t.Errorf("the next id must be the since id when no event is returned, got %s", res.NextID)
+	}
+}
+
+func TestPollOpsRevoked(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.tail = func(lastID LastID, filter Filter, opts TailOptions, out chan<- GenericEvent, stop <-chan bool) {
+		<-stop
+	}
+	go func() {
+		for deadline := time.Now().Add(time.Second); len(daemon.Connections()) == 0 && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+		}
+		daemon.DisconnectClients(func(info ConnectionInfo) bool { return info.Path == "/ops/poll" })
+	}()
+	started := time.Now()
+	rec := httptest.NewRecorder()
+	daemon.ServeHTTP(rec, httptest.NewRequest("GET", "/ops/poll?since_id=1423995187898&wait=5", nil))
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("revoked poll kept waiting: %s", elapsed)
+	}
+	if rec.Code != 401 || !strings.Contains(rec.Body.String(), `"revoked"`) {
+		t.Errorf("expected a revoked error, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if conns := daemon.Connections(); len(conns) != 0 {
+		t.Errorf("poll still registered: %#v", conns)
+	}
+}
+
+func TestPollOpsEvicted(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.hasID = func(id LastID) (bool, error) {
+		return false, nil
+	}
+	daemon.tail = func(lastID LastID, filter Filter, opts TailOptions, out chan<- GenericEvent, stop <-chan bool) {
+		t.Error("no tail should be started for an evicted since id")
+		<-stop
+	}
+	id := bson.ObjectIdHex("545b55c7f095528dd0f3863c")
+	rec, res := testPoll(t, daemon, "?since_id="+id.Hex())
+	if rec.Code != 410 {
+		t.Fatalf("expected status 410, got %d", rec.Code)
+	}
+	if expected := (&OperationLastID{&id}).Fallback().String(); res.FallbackID != expected {
+		t.Errorf("expected fallback id %s, got %s", expected, res.FallbackID)
+	}
+}
+
+func TestPollOpsInvalidParameters(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	for _, query := range []string{"max=0", "max=abc", "max=100001", "wait=-1", "wait=61", "types=,"} {
+		rec := httptest.NewRecorder()
+		daemon.ServeHTTP(rec, httptest.NewRequest("GET", "/ops/poll?since_id=1423995187898&"+query, nil))
+		if rec.Code != 400 {
+			t.Errorf("%s: expected status 400, got %d", query, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package oplog
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// ReadFilterPresets reads filter presets given as "<name> <query-string>" lines, the
+// query-string using the same parameters as the streams (i.e.:
+// "catalog-only types=video,playlist&parents_exclude=user/*"). Presets can use any
+// field.<name> parameter. Empty lines and lines starting with # are ignored.
+func ReadFilterPresets(r io.Reader) (map[string]Filter, error) {
+	presets := map[string]Filter{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid preset on line %d", n)
+		}
+		q, err := url.ParseQuery(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid preset on line %d: %s", n, err)
+		}
+		names := []string{}
+		for param := range q {
+			if strings.HasPrefix(param, "field.") {
+				names = append(names, strings.TrimPrefix(param, "field."))
+			}
+		}
+		filter, err := parseFilter(q, 0, 0, names)
+		if err != nil {
+			return nil, fmt.Errorf("invalid preset on line %d: %s", n, err)
+		}
+		presets[fields[0]] = filter
+	}
+	return presets, scanner.Err()
+}
+
+// narrows checks the filter only narrows the preset, i.e.: it doesn't ask for types,
+// parents, events or fields the preset doesn't match
+func (f Filter) narrows(preset Filter, name string) error {
+	for _, t := range f.Types {
+		if len(preset.Types) > 0 && !patternCovered(preset.Types, t) {
+			return &FilterError{"types", fmt.Sprintf("%s not part of preset %s", t, name)}
+		}
+	}
+	for _, parent := range f.Parents {
+		if len(preset.Parents) > 0 && !patternCovered(preset.Parents, parent) ||
+			len(preset.ParentPrefixes) > 0 && !hasAnyPrefix(parent, preset.ParentPrefixes) {
+			return &FilterError{"parents", fmt.Sprintf("%s not part of preset %s", parent, name)}
+		}
+	}
+	for _, event := range f.Events {
+		if len(preset.Events) > 0 && !contains(preset.Events, event) {
+			return &FilterError{"events", fmt.Sprintf("%s not part of preset %s", event, name)}
+		}
+	}
+	for field, value := range f.Fields {
+		if v, found := preset.Fields[field]; found && v != value {
+			return &FilterError{"field." + field, fmt.Sprintf("%s not part of preset %s", value, name)}
+		}
+	}
+	return nil
+}
+
+// applyPreset returns the preset named by the filter query-string parameter narrowed by
+// the explicit filter. Unknown presets are refused, listing the available presets to the
+// authenticated clients.
+func (daemon *SSEDaemon) applyPreset(r *http.Request, explicit Filter) (Filter, error) {
+	name := r.URL.Query().Get("filter")
+	if name == "" {
+		return explicit, nil
+	}
+	preset, found := daemon.FilterPresets[name]
+	if !found {
+		message := fmt.Sprintf("unknown preset %s", name)
+		if _, authenticated := PrincipalFromContext(r.Context()); authenticated || !daemon.authRequired(ScopeRead) {
+			names := make([]string, 0, len(daemon.FilterPresets))
+			for name := range daemon.FilterPresets {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			message += fmt.Sprintf(", available presets: %s", strings.Join(names, ", "))
+		}
+		return explicit, &FilterError{"filter", message}
+	}
+	if daemon.ol.NormalizeTypes {
+		preset = preset.normalized(daemon.ol.NormalizeParentTypes)
+	}
+	if err := explicit.narrows(preset, name); err != nil {
+		return explicit, err
+	}
+	return explicit.Intersect(preset), nil
+}
@@ -0,0 +1,103 @@
+package oplog
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadFilterPresets(t *testing.T) {
+	presets, err := ReadFilterPresets(strings.NewReader(`
+# Comment
+catalog-only types=video,playlist&parents_exclude=user/*
+by-country field.pl.country=fr&events=insert,update
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(presets) != 2 {
+		t.Fatalf("expected 2 presets, got %d", len(presets))
+	}
+	if f := presets["catalog-only"]; strings.Join(f.Types, ",") != "video,playlist" || strings.Join(f.ExcludeParents, ",") != "user/*" {
+		t.Errorf("invalid catalog-only preset: %#v", f)
+	}
+	if f := presets["by-country"]; f.Fields["pl.country"] != "fr" || strings.Join(f.Events, ",") != "insert,update" {
+		t.Errorf("invalid by-country preset: %#v", f)
+	}
+
+	for _, invalid := range []string{"catalog-only", "a types=a b", "a types=a**"} {
+		if _, err := ReadFilterPresets(strings.NewReader(invalid)); err == nil {
+			t.Errorf("%q: expected an error", invalid)
+		}
+	}
+}
+
+func TestGetOpsFilterPresets(t *testing.T) {
+	daemon, filters := newTestPolicyDaemon(Credentials{"search": {Password: "s"}})
+	daemon.FilterPresets = map[string]Filter{
+		"catalog-only": {Types: []string{"video", "playlist.*"}, ExcludeParents: []string{"user/*"}},
+		"deletes":      {Events: []string{"delete"}},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	get := func(url string, authenticated bool) (int, string) {
+		req := httptest.NewRequest("GET", url, nil).WithContext(ctx)
+		req.Header.Set("Accept", "text/event-stream")
+		if authenticated {
+			req.SetBasicAuth("search", "s")
+		}
+		rec := httptest.NewRecorder()
+		daemon.ServeHTTP(flushResponseWriter{rec}, req)
+		return rec.Code, rec.Body.String()
+	}
+
+	// Resolution
+	if status, _ := get("/ops?filter=catalog-only", true); status != 200 {
+		t.Fatalf("expected status 200, got %d", status)
+	}
+	f := filters()[0]
+	if strings.Join(f.Types, ",") != "video,playlist.*" || strings.Join(f.ExcludeParents, ",") != "user/*" {
+		t.Errorf("preset not resolved: %#v", f)
+	}
+
+	// Narrowing
+	if status, _ := get("/ops?filter=catalog-only&types=playlist.public&parents_exclude=x/1", true); status != 200 {
+		t.Fatalf("expected status 200, got %d", status)
+	}
+	f = filters()[1]
+	if strings.Join(f.Types, ",") != "playlist.public" || strings.Join(f.ExcludeParents, ",") != "x/1,user/*" {
+		t.Errorf("preset not narrowed: %#v", f)
+	}
+	if !f.match(&OperationData{Type: "playlist.public"}) || f.match(&OperationData{Type: "video"}) || f.match(&OperationData{Type: "playlist.public", Parents: []string{"user/1"}}) {
+		t.Errorf("narrowed preset matches outside of the preset: %#v", f)
+	}
+
+	// Widening is refused
+	for _, url := range []string{"/ops?filter=catalog-only&types=video,user", "/ops?filter=catalog-only&types=playlist*", "/ops?filter=deletes&events=insert"} {
+		if status, body := get(url, true); status != 400 || !strings.Contains(body, "invalid_filter") {
+			t.Errorf("%s: expected status 400, got %d: %s", url, status, body)
+		}
+	}
+
+	// Unknown presets are listed to the authenticated clients only
+	daemon.Authenticator = nil
+	daemon.Password = ""
+	if status, body := get("/ops?filter=unknown", false); status != 400 || !strings.Contains(body, "available presets: catalog-only, deletes") {
+		t.Errorf("expected the presets to be listed, got %d: %s", status, body)
+	}
+	daemon.Authenticator = Credentials{"search": {Password: "s"}}
+	if status, body := get("/ops?filter=unknown", true); status != 400 || !strings.Contains(body, "available presets") {
+		t.Errorf("expected the presets to be listed, got %d: %s", status, body)
+	}
+	if len(filters()) != 2 {
+		t.Errorf("refused streams must not be tailed")
+	}
+}
+
+func TestConnectionPreset(t *testing.T) {
+	conn := newConnection("10.0.0.1", httptest.NewRequest("GET", "/ops?filter=catalog-only", nil))
+	if conn.snapshot().Preset != "catalog-only" {
+		t.Errorf("preset not recorded: %#v", conn.snapshot())
+	}
+}
@@ -0,0 +1,89 @@
+package oplog
+
+import (
+	"sync"
+	"time"
+)
+
+// queuePeakBuckets and queuePeakBucket define the rolling window over which
+// Stats.QueueRecentPeak is computed: the current bucket and the previous ones, a minute
+// in total
+const (
+	queuePeakBuckets = 6
+	queuePeakBucket  = 10 * time.Second
+)
+
+// peakWindow keeps the highest value observed since its creation and over a rolling
+// window of queuePeakBuckets buckets. Its zero value is ready to use.
+type peakWindow struct {
+	mu  sync.Mutex
+	max int64
+	// slots holds the time slot of each bucket, the peak of a bucket being discarded once
+	// its slot leaves the window
+	slots []int64
+	peaks []int64
+}
+
+// observe records value at t and returns the highest value over the window and since
+// the creation, the caller holding mu
+func (w *peakWindow) observe(t time.Time, value int64) (recent, max int64) {
+	if w.slots == nil {
+		w.slots = make([]int64, queuePeakBuckets)
+		w.peaks = make([]int64, queuePeakBuckets)
+	}
+	slot := t.UnixNano() / int64(queuePeakBucket)
+	i := slot % queuePeakBuckets
+	if w.slots[i] != slot {
+		w.slots[i] = slot
+		w.peaks[i] = 0
+	}
+	if value > w.peaks[i] {
+		w.peaks[i] = value
+	}
+	if value > w.max {
+		w.max = value
+	}
+	for i, s := range w.slots {
+		if slot-s < queuePeakBuckets && w.peaks[i] > recent {
+			recent = w.peaks[i]
+		}
+	}
+	return recent, w.max
+}
+
+// observeQueue records the current size of the ingestion queue in QueueSize and the size
+// it reached in QueuePeak and QueueRecentPeak
+func (oplog *OpLog) observeQueue(size, reached int) {
+	oplog.Stats.QueueSize.Set(int64(size))
+	oplog.queuePeaks.mu.Lock()
+	defer oplog.queuePeaks.mu.Unlock()
+	recent, max := oplog.queuePeaks.observe(time.Now(), int64(reached))
+	oplog.Stats.QueueRecentPeak.Set(recent)
+	if max > oplog.Stats.QueuePeak.Value() {
+		oplog.Stats.QueuePeak.Set(max)
+	}
+}
+
+// enqueue sends op to the ingestion queue without blocking, stamping it to measure its
+// time in the queue. It returns false if the queue is full.
+func (oplog *OpLog) enqueue(ops chan<- *Operation, op *Operation) bool {
+	op.queued = time.Now()
+	select {
+	case ops <- op:
+		size := len(ops)
+		oplog.observeQueue(size, size)
+		return true
+	default:
+		return false
+	}
+}
+
+// dequeued records the time spent by op in the ingestion queue, if stamped by enqueue, and
+// the size of the queue once op left it. The queue only shrinks when operations leave it,
+// so its peaks are recorded even when filled by producers not using enqueue.
+func (oplog *OpLog) dequeued(op *Operation, size int) {
+	if !op.queued.IsZero() {
+		oplog.Stats.QueueLatency.Observe(time.Since(op.queued))
+	}
+	oplog.observeQueue(size, size+1)
+}
@@ -0,0 +1,80 @@
+package oplog
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPeakWindow(t *testing.T) {
+	w := &peakWindow{}
+	start := time.Unix(600, 0)
+	for _, test := range []struct {
+		after  time.Duration
+		value  int64
+		recent int64
+		max    int64
+	}{
+		{0, 5, 5, 5},
+		{30 * time.Second, 2, 5, 5},
+		// The first peak left the window
+		{70 * time.Second, 1, 2, 5},
+		// The bucket of the second peak is reused
+		{90 * time.Second, 0, 1, 5},
+	} {
+		recent, max := w.observe(start.Add(test.after), test.value)
+		if recent != test.recent || max != test.max {
+			t.Errorf("after %s: expected peaks of %d and %d, got %d and %d", test.after, test.recent, test.max, recent, max)
+		}
+	}
+}
+
+func TestIngestQueue(t *testing.T) {
+	ol := newTestOpLog()
+	stats := *ol.Stats
+	stats.QueueSize = new(Int)
+	stats.QueuePeak = new(Int)
+	stats.QueueRecentPeak = new(Int)
+	stats.QueueLatency = NewHistogram(mongoBuckets...)
+	ol.Stats = &stats
+	ops := make(chan *Operation, 10)
+	done := make(chan bool)
+	release := make(chan struct{})
+	appended := make(chan *Operation, 10)
+	go ol.ingest(ops, done, func(op *Operation) {
+		// MongoDB stalls until released
+		<-release
+		appended <- op
+	})
+	defer close(done)
+
+	// A burst of operations fills the queue while the consumer is stalled
+	for _, op := range newTestOperations(5) {
+		op := op
+		if !ol.enqueue(ops, &op) {
+			t.Fatal("queue full")
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	for i := 0; i < 5; i++ {
+		select {
+		case <-appended:
+		case <-time.After(time.Second):
+			t.Fatalf("only %d operations appended", i)
+		}
+	}
+
+	if peak := stats.QueuePeak.Value(); peak < 4 {
+		t.Errorf("expected a peak of at least 4 operations, got %d", peak)
+	}
+	if recent := stats.QueueRecentPeak.Value(); recent != stats.QueuePeak.Value() {
+		t.Errorf("expected a recent peak of %d, got %d", stats.QueuePeak.Value(), recent)
+	}
+	if size := stats.QueueSize.Value(); size != 0 {
+		t.Errorf("expected an empty queue, got %d", size)
+	}
+	latency := stats.QueueLatency.Snapshot()
+	if latency.Count != 5 || latency.Max < 20 {
+		t.Errorf("invalid queue latency: %#v", latency)
+	}
+}
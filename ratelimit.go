@@ -0,0 +1,143 @@
+package oplog
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ipLimiterSweepInterval defines how often the idle clients are removed from the limiter
+const ipLimiterSweepInterval = time.Minute
+
+// ipLimiter enforces the per client IP limits: a maximum number of concurrent connections
+// and a token bucket on connection attempts.
+type ipLimiter struct {
+	mu        sync.Mutex
+	clients   map[string]*ipClient
+	lastSweep time.Time
+}
+
+// ipClient stores the state of the limits of a client IP
+type ipClient struct {
+	connections int
+	tokens      float64
+	last        time.Time
+}
+
+func newIPLimiter() *ipLimiter {
+	return &ipLimiter{clients: map[string]*ipClient{}}
+}
+
+// acquire registers a connection attempt from ip. If the attempt is allowed, release must
+// be called once the connection ends. Otherwise, retryAfter tells when the client may
+// try again. A maxConns or rate of 0 disables the corresponding limit.
+func (l *ipLimiter) acquire(ip string, maxConns int, rate float64, burst int, now time.Time) (release func(), retryAfter time.Duration, rateLimited bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if burst < 1 {
+		burst = 1
+	}
+	l.sweep(rate, burst, now)
+	c, found := l.clients[ip]
+	if !found {
+		c = &ipClient{tokens: float64(burst), last: now}
+		l.clients[ip] = c
+	}
+	if rate > 0 {
+		c.tokens = math.Min(float64(burst), c.tokens+now.Sub(c.last).Seconds()*rate)
+		c.last = now
+		if c.tokens < 1 {
+			return nil, time.Duration((1 - c.tokens) / rate * float64(time.Second)), true
+		}
+		c.tokens--
+	}
+	if maxConns > 0 && c.connections >= maxConns {
+		return nil, 0, false
+	}
+	c.connections++
+	released := false
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if !released {
+			released = true
+			c.connections--
+		}
+	}, 0, false
+}
+
+// sweep removes the clients with no connection and a full bucket, as they are in the same
+// state as new clients
+func (l *ipLimiter) sweep(rate float64, burst int, now time.Time) {
+	if now.Sub(l.lastSweep) < ipLimiterSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for ip, c := range l.clients {
+		if c.connections == 0 && (rate == 0 || c.tokens+now.Sub(c.last).Seconds()*rate >= float64(burst)) {
+			delete(l.clients, ip)
+		}
+	}
+}
+
+// clientIP returns the IP of the client the per IP limits apply to. When TrustedProxyDepth
+// is set, the client IP is read from the X-Forwarded-For header, skipping the entries
+// added by the trusted proxies.
+func (daemon *SSEDaemon) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if daemon.TrustedProxyDepth <= 0 {
+		return ip
+	}
+	forwarded := []string{}
+	for _, value := range r.Header["X-Forwarded-For"] {
+		for _, f := range strings.Split(value, ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				forwarded = append(forwarded, f)
+			}
+		}
+	}
+	if len(forwarded) == 0 {
+		return ip
+	}
+	// Each trusted proxy appends the address it received the request from, the last
+	// entry being added by the proxy connected to the daemon
+	i := len(forwarded) - daemon.TrustedProxyDepth
+	if i < 0 {
+		i = 0
+	}
+	return forwarded[i]
+}
+
+// admit applies the per IP limits to a new connection. When the connection is refused, a
+// 429 error is answered and ok is false. Otherwise, release must be called once the
+// connection ends.
+func (daemon *SSEDaemon) admit(w http.ResponseWriter, r *http.Request) (release func(), ok bool) {
+	if daemon.MaxConnectionsPerIP <= 0 && daemon.ConnectionRate <= 0 {
+		return func() {}, true
+	}
+	ip := daemon.clientIP(r)
+	release, retryAfter, rateLimited := daemon.limiter.acquire(ip, daemon.MaxConnectionsPerIP, daemon.ConnectionRate, daemon.ConnectionBurst, time.Now())
+	if release != nil {
+		return release, true
+	}
+	if rateLimited {
+		daemon.logger().Warnf("SSE[%s] too many connection attempts", ip)
+		daemon.ol.Stats.ConnectionsRateLimited.Add(1)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		writeError(w, 429, "too_many_requests", "too many connection attempts, retry later")
+		return nil, false
+	}
+	daemon.logger().Warnf("SSE[%s] too many concurrent connections", ip)
+	daemon.ol.Stats.ConnectionsPerIPRejected.Add(1)
+	w.Header().Set("Retry-After", strconv.Itoa(int(daemon.RetryAfter/time.Second)))
+	writeError(w, 429, "too_many_connections", "too many concurrent connections, retry later")
+	return nil, false
+}
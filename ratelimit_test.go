@@ -0,0 +1,154 @@
+package oplog
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIPLimiterConnections(t *testing.T) {
+	l := newIPLimiter()
+	now := time.Now()
+	release1, _, _ := l.acquire("1.2.3.4", 2, 0, 0, now)
+	release2, _, _ := l.acquire("1.2.3.4", 2, 0, 0, now)
+	if release1 == nil || release2 == nil {
+		t.Fatal("connections under the limit refused")
+	}
+	if release, _, rateLimited := l.acquire("1.2.3.4", 2, 0, 0, now); release != nil || rateLimited {
+		t.Fatal("connection over the limit accepted")
+	}
+	if release, _, _ := l.acquire("5.6.7.8", 2, 0, 0, now); release == nil {
+		t.Fatal("connection from another IP refused")
+	}
+	release1()
+	release1()
+	if release, _, _ := l.acquire("1.2.3.4", 2, 0, 0, now); release == nil {
+		t.Fatal("connection refused after a release")
+	}
+	if release, _, _ := l.acquire("1.2.3.4", 2, 0, 0, now); release != nil {
+		t.Fatal("a double release must not free two slots")
+	}
+}
+
+func TestIPLimiterRate(t *testing.T) {
+	l := newIPLimiter()
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		release, _, _ := l.acquire("1.2.3.4", 0, 2, 3, now)
+		if release == nil {
+			t.Fatalf("attempt %d in the burst refused", i)
+		}
+		release()
+	}
+	release, retryAfter, rateLimited := l.acquire("1.2.3.4", 0, 2, 3, now)
+	if release != nil || !rateLimited {
+		t.Fatal("attempt over the burst accepted")
+	}
+	if retryAfter != 500*time.Millisecond {
+		t.Fatalf("invalid retry after: %s", retryAfter)
+	}
+	if release, _, _ := l.acquire("1.2.3.4", 0, 2, 3, now.Add(500*time.Millisecond)); release == nil {
+		t.Fatal("attempt refused once a token has been refilled")
+	}
+
+	// Idle clients are swept
+	l.acquire("1.2.3.4", 0, 2, 3, now.Add(time.Hour))
+	if len(l.clients) != 1 {
+		t.Fatalf("idle clients not swept: %d", len(l.clients))
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	req := httptest.NewRequest("GET", "/ops", nil)
+	req.RemoteAddr = "10.0.0.1:4242"
+	req.Header.Add("X-Forwarded-For", "6.6.6.6, 1.2.3.4")
+	req.Header.Add("X-Forwarded-For", "10.0.0.2")
+	tests := []struct {
+		depth int
+		ip    string
+	}{
+		{0, "10.0.0.1"},
+		{1, "10.0.0.2"},
+		{2, "1.2.3.4"},
+		{5, "6.6.6.6"},
+	}
+	for _, test := range tests {
+		daemon.TrustedProxyDepth = test.depth
+		if ip := daemon.clientIP(req); ip != test.ip {
+			t.Errorf("depth %d: expected %s, got %s", test.depth, test.ip, ip)
+		}
+	}
+}
+
+func TestGetOpsMaxConnectionsPerIP(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.MaxConnectionsPerIP = 1
+	daemon.RetryAfter = 7 * time.Second
+	rejected := testStats.ConnectionsPerIPRejected.Value()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		daemon.ServeHTTP(httptest.NewRecorder(), newTestSSERequest(ctx))
+		close(done)
+	}()
+	// Wait for the first stream to be connected
+	for connected := false; !connected; {
+		time.Sleep(time.Millisecond)
+		daemon.limiter.mu.Lock()
+		c := daemon.limiter.clients["192.0.2.1"]
+		connected = c != nil && c.connections == 1
+		daemon.limiter.mu.Unlock()
+	}
+
+	rec := httptest.NewRecorder()
+	daemon.ServeHTTP(rec, newTestSSERequest(context.Background()))
+	if rec.Code != 429 || rec.Header().Get("Retry-After") != "7" {
+		t.Fatalf("expected a 429 with a Retry-After, got %d", rec.Code)
+	}
+	if testStats.ConnectionsPerIPRejected.Value() != rejected+1 {
+		t.Error("rejection not counted")
+	}
+
+	cancel()
+	<-done
+	rec = httptest.NewRecorder()
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	daemon.ServeHTTP(rec, newTestSSERequest(ctx))
+	if rec.Code != 200 {
+		t.Fatalf("connection refused once the first one ended: %d", rec.Code)
+	}
+}
+
+func TestPollOpsConnectionRate(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.ConnectionRate = 0.5
+	daemon.ConnectionBurst = 2
+	daemon.TrustedProxyDepth = 1
+	limited := testStats.ConnectionsRateLimited.Value()
+	poll := func(ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/ops/poll?since_id=1423995187898", nil)
+		req.Header.Set("X-Forwarded-For", ip)
+		rec := httptest.NewRecorder()
+		daemon.ServeHTTP(rec, req)
+		return rec
+	}
+	for i := 0; i < 2; i++ {
+		if rec := poll("1.2.3.4"); rec.Code != 200 {
+			t.Fatalf("attempt %d in the burst refused: %d", i, rec.Code)
+		}
+	}
+	rec := poll("1.2.3.4")
+	if rec.Code != 429 || rec.Header().Get("Retry-After") != "2" {
+		t.Fatalf("expected a 429 with a Retry-After, got %d %s", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if testStats.ConnectionsRateLimited.Value() != limited+1 {
+		t.Error("rate limited attempt not counted")
+	}
+	if rec := poll("5.6.7.8"); rec.Code != 200 {
+		t.Fatalf("attempt from another client refused: %d", rec.Code)
+	}
+}
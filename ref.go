@@ -0,0 +1,147 @@
+package oplog
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// legacyRefVariables rewrites the {{type}} and {{id}} variables of the object URLs written
+// before they were templates
+var legacyRefVariables = strings.NewReplacer("{{type}}", "{{.Type}}", "{{id}}", "{{.ID}}")
+
+// sampleRefData is the data an object URL template is tried on once compiled, so the
+// errors like unknown fields are reported by SetObjectURL rather than for each event
+var sampleRefData = &OperationData{
+	Timestamp: time.Unix(0, 0).UTC(),
+	Parents:   []string{"type/id"},
+	Type:      "type",
+	ID:        "id",
+}
+
+// refTemplate is the compiled template of an object URL
+type refTemplate struct {
+	// url is the ObjectURL the template was compiled from
+	url string
+	// tmpl is nil if the template is invalid
+	tmpl *template.Template
+	// legacy is true if the template only has {{type}} and {{id}} variables, replaced
+	// without executing the template
+	legacy bool
+}
+
+// compileObjectURL compiles an object URL template with the given additional functions
+func compileObjectURL(objectURL string, funcs template.FuncMap) (*refTemplate, error) {
+	tmpl, err := template.New("ref").Option("missingkey=error").Funcs(funcs).Parse(legacyRefVariables.Replace(objectURL))
+	if err != nil {
+		return nil, err
+	}
+	if err := tmpl.Execute(ioutil.Discard, sampleRefData); err != nil {
+		return nil, err
+	}
+	legacy := strings.Count(objectURL, "{{") == strings.Count(objectURL, "{{type}}")+strings.Count(objectURL, "{{id}}")
+	return &refTemplate{url: objectURL, tmpl: tmpl, legacy: legacy}, nil
+}
+
+// SetObjectURL sets the ObjectURL template, compiling it once for all the events with the
+// given additional functions, i.e.: to derive a shard from the id. An error is returned if
+// the template doesn't compile or can't be executed.
+func (oplog *OpLog) SetObjectURL(objectURL string, funcs template.FuncMap) error {
+	rt, err := compileObjectURL(objectURL, funcs)
+	if err != nil {
+		return err
+	}
+	oplog.ObjectURL = objectURL
+	oplog.refTemplates.Store(objectURL, rt)
+	return nil
+}
+
+// SetObjectURLs sets the ObjectURLs templates by type like SetObjectURL, returning the
+// error of the first template of a type which doesn't compile
+func (oplog *OpLog) SetObjectURLs(objectURLs map[string]string, funcs template.FuncMap) error {
+	compiled := make([]*refTemplate, 0, len(objectURLs))
+	for typ, objectURL := range objectURLs {
+		rt, err := compileObjectURL(objectURL, funcs)
+		if err != nil {
+			return fmt.Errorf("%s: %s", typ, err)
+		}
+		compiled = append(compiled, rt)
+	}
+	oplog.ObjectURLs = objectURLs
+	for _, rt := range compiled {
+		oplog.refTemplates.Store(rt.url, rt)
+	}
+	return nil
+}
+
+// ReadObjectURLs reads object URL templates by type given as "<type> <template>" lines,
+// i.e.: "user http://users.mydomain.com/{{.ID}}". Empty lines and lines starting with #
+// are ignored.
+func ReadObjectURLs(r io.Reader) (map[string]string, error) {
+	objectURLs := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexAny(line, " \t")
+		if i == -1 {
+			return nil, fmt.Errorf("invalid object URL on line %d", n)
+		}
+		objectURLs[line[:i]] = strings.TrimSpace(line[i:])
+	}
+	return objectURLs, scanner.Err()
+}
+
+// objectURLTemplate returns the compiled template of an object URL, compiling it on first
+// use when ObjectURL or ObjectURLs were set directly
+func (oplog *OpLog) objectURLTemplate(objectURL string) *refTemplate {
+	if rt, found := oplog.refTemplates.Load(objectURL); found {
+		return rt.(*refTemplate)
+	}
+	rt, err := compileObjectURL(objectURL, nil)
+	if err != nil {
+		oplog.warnSampled(err, "OPLOG invalid object URL template, no ref generated: %s", err)
+		rt = &refTemplate{url: objectURL}
+	}
+	oplog.refTemplates.Store(objectURL, rt)
+	return rt
+}
+
+// hasRefs returns true if refs are generated for some types
+func (oplog *OpLog) hasRefs() bool {
+	return oplog.ObjectURL != "" || len(oplog.ObjectURLs) > 0
+}
+
+// genRef generates the reference URL (Ref field) of the data from the template of its type
+// in ObjectURLs, or ObjectURL if its type has none, given the Type, ID, Parents and
+// Timestamp fields. The ref is dropped if there is no template or if it fails to execute.
+func (oplog *OpLog) genRef(data *OperationData) {
+	data.Ref = ""
+	objectURL, found := oplog.ObjectURLs[data.Type]
+	if !found {
+		objectURL = oplog.ObjectURL
+	}
+	if objectURL == "" {
+		return
+	}
+	rt := oplog.objectURLTemplate(objectURL)
+	switch {
+	case rt.tmpl == nil:
+		return
+	case rt.legacy:
+		data.Ref = strings.Replace(strings.Replace(rt.url, "{{type}}", data.Type, -1), "{{id}}", data.ID, -1)
+		return
+	}
+	b := strings.Builder{}
+	if err := rt.tmpl.Execute(&b, data); err != nil {
+		oplog.warnSampled(err, "OPLOG can't generate the ref of %s: %s", data.GetID(), err)
+		return
+	}
+	data.Ref = b.String()
+}
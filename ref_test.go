@@ -0,0 +1,206 @@
+package oplog
+
+import (
+	"bytes"
+	"hash/crc32"
+	"strconv"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var testRefFuncs = template.FuncMap{
+	"shard": func(id string) string {
+		return strconv.Itoa(int(crc32.ChecksumIEEE([]byte(id)) % 16))
+	},
+}
+
+func TestGenRef(t *testing.T) {
+	data := &OperationData{
+		Timestamp: time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC),
+		Parents:   []string{"user/xl2d", "channel/x3"},
+		Type:      "video",
+		ID:        "x34cd",
+	}
+	for _, test := range []struct {
+		objectURL string
+		ref       string
+	}{
+		{"http://api.mydomain.com/{{type}}/{{id}}", "http://api.mydomain.com/video/x34cd"},
+		{"http://api.mydomain.com/{{.Type}}/{{.ID}}", "http://api.mydomain.com/video/x34cd"},
+		{"http://api.mydomain.com/{{index .Parents 0}}/{{.Type}}s/{{.ID}}", "http://api.mydomain.com/user/xl2d/videos/x34cd"},
+		{"http://api.mydomain.com/{{.Type}}/{{.ID}}?at={{.Timestamp.Unix}}", "http://api.mydomain.com/video/x34cd?at=1451703845"},
+		{"http://s{{shard .ID}}.mydomain.com/{{.Type}}/{{.ID}}", "http://s5.mydomain.com/video/x34cd"},
+		{"http://api.mydomain.com/{{.Type}}/{{.ID}}{{range .Parents}};{{.}}{{end}}", "http://api.mydomain.com/video/x34cd;user/xl2d;channel/x3"},
+	} {
+		ol := newTestOpLog()
+		if err := ol.SetObjectURL(test.objectURL, testRefFuncs); err != nil {
+			t.Fatalf("%s: %s", test.objectURL, err)
+		}
+		ol.genRef(data)
+		if data.Ref != test.ref {
+			t.Errorf("%s: expected %s, got %s", test.objectURL, test.ref, data.Ref)
+		}
+	}
+
+	// The template is compiled on first use when ObjectURL is set directly
+	ol := newTestOpLog()
+	ol.ObjectURL = "http://api.mydomain.com/{{type}}/{{id}}"
+	ol.genRef(data)
+	ol.ObjectURL = "http://api.mydomain.com/{{.ID}}"
+	ol.genRef(data)
+	if data.Ref != "http://api.mydomain.com/x34cd" {
+		t.Errorf("ObjectURL change not applied: %s", data.Ref)
+	}
+}
+
+func TestGenRefErrors(t *testing.T) {
+	ol := newTestOpLog()
+	logger := &capturingLogger{}
+	ol.Logger = logger
+	ol.LogSampleWindow = time.Minute
+	for _, objectURL := range []string{"http://{{.Type}", "http://{{shard .ID}}", "http://{{.Unknown}}"} {
+		if err := ol.SetObjectURL(objectURL, nil); err == nil {
+			t.Errorf("%s: expected a compile error", objectURL)
+		}
+	}
+
+	// A failed execution drops the ref with a sampled warning
+	if err := ol.SetObjectURL("http://api.mydomain.com/{{index .Parents 0}}/{{.ID}}", nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		data := &OperationData{Type: "video", ID: strconv.Itoa(i), Ref: "stale"}
+		ol.genRef(data)
+		if data.Ref != "" {
+			t.Errorf("expected no ref, got %s", data.Ref)
+		}
+	}
+	if len(logger.lines) != 1 || !strings.HasPrefix(logger.lines[0], "warn OPLOG can't generate the ref of video/0: ") {
+		t.Errorf("expected a single warning, got %q", logger.lines)
+	}
+
+	// An invalid template set directly generates no ref
+	ol.ObjectURL = "http://{{.Type}"
+	data := &OperationData{Type: "video", ID: "1", Parents: []string{"user/1"}}
+	ol.genRef(data)
+	if data.Ref != "" || len(logger.lines) != 2 || !strings.HasPrefix(logger.lines[1], "warn OPLOG invalid object URL template") {
+		t.Errorf("invalid template not reported: %s, %q", data.Ref, logger.lines)
+	}
+}
+
+func TestReadObjectURLs(t *testing.T) {
+	objectURLs, err := ReadObjectURLs(strings.NewReader(`
+# Comment
+video http://videos.mydomain.com/{{.ID}}
+user	http://users.mydomain.com/{{index .Parents 0}} /{{.ID}}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objectURLs) != 2 || objectURLs["video"] != "http://videos.mydomain.com/{{.ID}}" || objectURLs["user"] != "http://users.mydomain.com/{{index .Parents 0}} /{{.ID}}" {
+		t.Errorf("invalid object URLs: %q", objectURLs)
+	}
+	if _, err := ReadObjectURLs(strings.NewReader("video")); err == nil {
+		t.Error("expected an error")
+	}
+
+	ol := newTestOpLog()
+	err = ol.SetObjectURLs(map[string]string{"video": "http://{{.ID}}", "user": "http://{{.Name}}"}, nil)
+	if err == nil || !strings.HasPrefix(err.Error(), "user: ") {
+		t.Errorf("expected an error on the user template, got %v", err)
+	}
+	if ol.ObjectURLs != nil {
+		t.Errorf("invalid templates set: %q", ol.ObjectURLs)
+	}
+}
+
+func TestTailRefsByType(t *testing.T) {
+	ol := newTestOpLog()
+	stats := *ol.Stats
+	stats.MongoDurations = NewHistograms(mongoBuckets...)
+	ol.Stats = &stats
+	if err := ol.SetObjectURL("http://api.mydomain.com/{{.Type}}/{{.ID}}", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ol.SetObjectURLs(map[string]string{
+		"video": "http://videos.mydomain.com/{{.ID}}",
+		"user":  "http://s{{shard .ID}}.users.mydomain.com/{{.ID}}",
+		// Channels have no ref even though there is a global template
+		"channel": "",
+	}, testRefFuncs); err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	data := func(typ, id string) *OperationData {
+		return &OperationData{Timestamp: ts, Type: typ, ID: id}
+	}
+	ol.openStatesPage = func(query bson.M) stateIterator {
+		return &slowStateIterator{states: []objectState{
+			{ID: "video/1", Event: "insert", Timestamp: ts, Data: data("video", "1")},
+			{ID: "playlist/2", Event: "insert", Timestamp: ts, Data: data("playlist", "2")},
+			{ID: "channel/3", Event: "insert", Timestamp: ts, Data: data("channel", "3")},
+		}}
+	}
+	out := make(chan GenericEvent, 10)
+	tl := ol.newTailer(Filter{}, TailOptions{}, out, false)
+	tl.replicated = map[string]time.Time{}
+	if _, err := tl.replicatePage(nil, bson.M{}, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	for i, d := range []*OperationData{data("user", "x34cd"), data("playlist", "5"), data("video", "6")} {
+		id := bson.NewObjectId()
+		tl.emitOperation(Operation{ID: &id, Event: "insert", Data: d})
+		if i == 1 {
+			// Without global template, the types without one of their own have no ref
+			ol.ObjectURL = ""
+		}
+	}
+	close(out)
+
+	expected := []string{
+		`"type":"video","id":"1","ref":"http://videos.mydomain.com/1"}`,
+		`"type":"playlist","id":"2","ref":"http://api.mydomain.com/playlist/2"}`,
+		`"type":"channel","id":"3"}`,
+		`"type":"user","id":"x34cd","ref":"http://s5.users.mydomain.com/x34cd"}`,
+		`"type":"playlist","id":"5","ref":"http://api.mydomain.com/playlist/5"}`,
+		`"type":"video","id":"6","ref":"http://videos.mydomain.com/6"}`,
+	}
+	i := 0
+	for ev := range out {
+		b := &bytes.Buffer{}
+		ev.WriteTo(b)
+		if i >= len(expected) || !strings.Contains(b.String(), expected[i]) {
+			t.Errorf("invalid event %d: %s", i, b)
+		}
+		i++
+	}
+	if i != len(expected) {
+		t.Errorf("expected %d events, got %d", len(expected), i)
+	}
+}
+
+func BenchmarkGenRef(b *testing.B) {
+	ol := newTestOpLog()
+	if err := ol.SetObjectURL("http://s{{shard .ID}}.mydomain.com/{{index .Parents 0}}/{{.Type}}/{{.ID}}", testRefFuncs); err != nil {
+		b.Fatal(err)
+	}
+	data := &OperationData{Parents: []string{"user/xl2d"}, Type: "video", ID: "x34cd"}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ol.genRef(data)
+	}
+}
+
+func BenchmarkGenRefLegacy(b *testing.B) {
+	ol := newTestOpLog()
+	ol.ObjectURL = "http://api.mydomain.com/{{type}}/{{id}}"
+	data := &OperationData{Type: "video", ID: "x34cd"}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ol.genRef(data)
+	}
+}
@@ -0,0 +1,152 @@
+package oplog
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// TailMode defines what a tail is currently streaming
+type TailMode string
+
+const (
+	// TailModeLive is used while a tail streams live operations
+	TailModeLive TailMode = "live"
+	// TailModeReplication is used while a tail replicates object states
+	TailModeReplication TailMode = "replication"
+	// TailModeFallback is used while a tail replicates object states because its resume
+	// point was no longer in the capped collection
+	TailModeFallback TailMode = "fallback"
+)
+
+// TailInfo describes a running tail
+type TailInfo struct {
+	// ID identifies the tail for the lifetime of the process
+	ID     int64
+	Mode   TailMode
+	Filter Filter
+	// Started is the time the tail started at
+	Started time.Time
+	// EventsSent is the number of operations and object states sent by the tail
+	EventsSent int64
+	// LastEventTime is the time of the last operation or object state sent
+	LastEventTime time.Time
+	// Lag is the time between the last event sent and the most recent operation of
+	// the oplog. It is 0 when the tail sent nothing yet.
+	Lag time.Duration
+}
+
+// tailRegistry holds the running tails of an oplog
+type tailRegistry struct {
+	mu    sync.Mutex
+	tails map[*tailer]bool
+	seq   int64
+}
+
+// register adds a tail to the registry
+func (oplog *OpLog) register(t *tailer) {
+	oplog.registry.mu.Lock()
+	defer oplog.registry.mu.Unlock()
+	if oplog.registry.tails == nil {
+		oplog.registry.tails = make(map[*tailer]bool)
+	}
+	oplog.registry.seq++
+	t.infoMu.Lock()
+	t.info.ID = oplog.registry.seq
+	t.info.Filter = t.filter
+	t.info.Started = time.Now()
+	t.infoMu.Unlock()
+	oplog.registry.tails[t] = true
+}
+
+// unregister removes a tail from the registry
+func (oplog *OpLog) unregister(t *tailer) {
+	oplog.registry.mu.Lock()
+	delete(oplog.registry.tails, t)
+	oplog.registry.mu.Unlock()
+	t.setMode("")
+}
+
+// modeStat returns the stat counting the tails in the given mode
+func (oplog *OpLog) modeStat(mode TailMode) *Int {
+	switch mode {
+	case TailModeLive:
+		return oplog.Stats.TailsLive
+	case TailModeReplication:
+		return oplog.Stats.TailsReplicating
+	case TailModeFallback:
+		return oplog.Stats.TailsFallback
+	}
+	return nil
+}
+
+// setMode updates the mode of the tail and the count of tails by mode
+func (t *tailer) setMode(mode TailMode) {
+	t.infoMu.Lock()
+	previous := t.info.Mode
+	t.info.Mode = mode
+	t.infoMu.Unlock()
+	if previous == mode || t.ol == nil {
+		return
+	}
+	if s := t.ol.modeStat(previous); s != nil {
+		s.Add(-1)
+	}
+	if s := t.ol.modeStat(mode); s != nil {
+		s.Add(1)
+	}
+}
+
+// sent records an operation or object state sent by the tail
+func (t *tailer) sent(ev GenericEvent) {
+	t.infoMu.Lock()
+	t.info.EventsSent++
+	t.info.LastEventTime = ev.GetEventID().Time()
+	t.infoMu.Unlock()
+}
+
+// ActiveTails returns the description of all the running tails, oldest first. The lag
+// of the tails is computed against the most recent operation of the oplog, and the
+// highest lag is saved in the TailsMaxLag stat.
+func (oplog *OpLog) ActiveTails() []TailInfo {
+	var head time.Time
+	if lastID, err := oplog.LastID(); err == nil && lastID != nil {
+		head = lastID.Time()
+	}
+	return oplog.activeTails(head)
+}
+
+// activeTails returns the running tails with their lag computed against the given time
+func (oplog *OpLog) activeTails(head time.Time) []TailInfo {
+	oplog.registry.mu.Lock()
+	infos := make([]TailInfo, 0, len(oplog.registry.tails))
+	for t := range oplog.registry.tails {
+		t.infoMu.Lock()
+		infos = append(infos, t.info)
+		t.infoMu.Unlock()
+	}
+	oplog.registry.mu.Unlock()
+
+	var maxLag time.Duration
+	for i := range infos {
+		if infos[i].LastEventTime.IsZero() || head.IsZero() {
+			continue
+		}
+		if lag := head.Sub(infos[i].LastEventTime); lag > 0 {
+			infos[i].Lag = lag
+			if lag > maxLag {
+				maxLag = lag
+			}
+		}
+	}
+	oplog.Stats.TailsMaxLag.Set(int64(maxLag / time.Millisecond))
+	sort.Sort(byTailID(infos))
+	return infos
+}
+
+// byTailID sorts tail infos by id
+type byTailID []TailInfo
+
+func (s byTailID) Len() int           { return len(s) }
+func (s byTailID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byTailID) Less(i, j int) bool { return s[i].ID < s[j].ID }
@@ -0,0 +1,61 @@
+package oplog
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestRegistryModes(t *testing.T) {
+	ol := newTestOpLog()
+	live := ol.Stats.TailsLive.Value()
+	fallback := ol.Stats.TailsFallback.Value()
+	tl := &tailer{ol: ol}
+	ol.register(tl)
+	tl.setMode(TailModeLive)
+	if ol.Stats.TailsLive.Value() != live+1 {
+		t.Fatal("live tail not counted")
+	}
+	tl.setMode(TailModeFallback)
+	if ol.Stats.TailsLive.Value() != live || ol.Stats.TailsFallback.Value() != fallback+1 {
+		t.Fatal("mode change not counted")
+	}
+	infos := ol.activeTails(time.Time{})
+	if len(infos) != 1 || infos[0].Mode != TailModeFallback {
+		t.Fatalf("invalid active tails: %#v", infos)
+	}
+	ol.unregister(tl)
+	if ol.Stats.TailsFallback.Value() != fallback {
+		t.Fatal("mode count leaked")
+	}
+	if len(ol.activeTails(time.Time{})) != 0 {
+		t.Fatal("tail leaked")
+	}
+}
+
+func TestRegistryLag(t *testing.T) {
+	ol := newTestOpLog()
+	head := time.Unix(1423995187, 0)
+	tl1 := &tailer{ol: ol}
+	tl2 := &tailer{ol: ol}
+	ol.register(tl1)
+	ol.register(tl2)
+	defer ol.unregister(tl1)
+	defer ol.unregister(tl2)
+	id := bson.NewObjectIdWithTime(head.Add(-10 * time.Second))
+	tl2.sent(Operation{ID: &id})
+	infos := ol.activeTails(head)
+	if len(infos) != 2 || infos[0].ID >= infos[1].ID {
+		t.Fatal("tails not sorted by id")
+	}
+	if infos[0].Lag != 0 {
+		t.Fatal("tail with no event has a lag")
+	}
+	if infos[1].Lag != 10*time.Second || infos[1].EventsSent != 1 {
+		t.Fatalf("invalid tail info: %#v", infos[1])
+	}
+	if ol.Stats.TailsMaxLag.Value() != 10000 {
+		t.Fatal("invalid max lag")
+	}
+}
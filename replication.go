@@ -0,0 +1,86 @@
+package oplog
+
+import "sync"
+
+// replicationLimiter limits the number of concurrent replications. Replications beyond
+// the limit wait in a FIFO queue for a slot to be released.
+type replicationLimiter struct {
+	mu      sync.Mutex
+	running int
+	queue   []*replicationSlot
+	stats   *Stats
+}
+
+// replicationSlot represents a replication registered on the limiter
+type replicationSlot struct {
+	// ready is closed once the replication is allowed to run
+	ready   chan struct{}
+	running bool
+}
+
+// newReplicationLimiter creates a limiter reporting its activity in the given stats
+func newReplicationLimiter(stats *Stats) *replicationLimiter {
+	return &replicationLimiter{stats: stats}
+}
+
+// enter registers a new replication. If less than max replications are running, the
+// returned slot is ready right away, otherwise it is queued until a slot is released.
+func (l *replicationLimiter) enter(max int) *replicationSlot {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := &replicationSlot{ready: make(chan struct{})}
+	if l.running < max && len(l.queue) == 0 {
+		l.start(s)
+	} else {
+		l.queue = append(l.queue, s)
+		l.stats.ReplicationsQueued.Add(1)
+	}
+	return s
+}
+
+// start marks the slot as running. The lock must be held by the caller.
+func (l *replicationLimiter) start(s *replicationSlot) {
+	s.running = true
+	l.running++
+	l.stats.ReplicationsRunning.Add(1)
+	close(s.ready)
+}
+
+// position returns the 1-based position of the slot in the queue, or 0 if the slot
+// is not queued.
+func (l *replicationLimiter) position(s *replicationSlot) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, q := range l.queue {
+		if q == s {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// leave releases the slot if running, letting the first queued replication start, or
+// removes it from the queue otherwise.
+func (l *replicationLimiter) leave(s *replicationSlot) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !s.running {
+		for i, q := range l.queue {
+			if q == s {
+				l.queue = append(l.queue[:i], l.queue[i+1:]...)
+				l.stats.ReplicationsQueued.Add(-1)
+				break
+			}
+		}
+		return
+	}
+	s.running = false
+	l.running--
+	l.stats.ReplicationsRunning.Add(-1)
+	if len(l.queue) > 0 {
+		next := l.queue[0]
+		l.queue = l.queue[1:]
+		l.stats.ReplicationsQueued.Add(-1)
+		l.start(next)
+	}
+}
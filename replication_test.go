@@ -0,0 +1,57 @@
+package oplog
+
+import "testing"
+
+func isReady(s *replicationSlot) bool {
+	select {
+	case <-s.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestReplicationLimiterFIFO(t *testing.T) {
+	l := newReplicationLimiter(&testStats)
+	s1 := l.enter(1)
+	s2 := l.enter(1)
+	s3 := l.enter(1)
+	if !isReady(s1) || isReady(s2) || isReady(s3) {
+		t.Fatal("invalid initial state")
+	}
+	if l.position(s1) != 0 || l.position(s2) != 1 || l.position(s3) != 2 {
+		t.Fatal("invalid queue positions")
+	}
+	l.leave(s1)
+	if !isReady(s2) || isReady(s3) {
+		t.Fatal("queue not served in order")
+	}
+	if l.position(s3) != 1 {
+		t.Fatal("queue position not updated")
+	}
+	l.leave(s2)
+	if !isReady(s3) {
+		t.Fatal("last replication not started")
+	}
+	l.leave(s3)
+	if l.running != 0 {
+		t.Fatal("slots leaked")
+	}
+}
+
+func TestReplicationLimiterLeaveQueued(t *testing.T) {
+	l := newReplicationLimiter(&testStats)
+	s1 := l.enter(1)
+	s2 := l.enter(1)
+	s3 := l.enter(1)
+	// s2 times out
+	l.leave(s2)
+	l.leave(s1)
+	if isReady(s2) || !isReady(s3) {
+		t.Fatal("timed out replication started")
+	}
+	l.leave(s3)
+	if l.running != 0 || len(l.queue) != 0 {
+		t.Fatal("slots leaked")
+	}
+}
@@ -0,0 +1,89 @@
+package oplog
+
+import (
+	"time"
+)
+
+// retentionState is what the retention watchdog reads from the capped collection
+type retentionState struct {
+	// Found tells if the id recorded by the previous check is still in the capped
+	// collection
+	Found bool
+	// Head is the id of the newest operation, nil if the capped collection is empty
+	Head LastID
+	// OldestOperation and NewestOperation are the insertion times of the oldest and newest
+	// operations, zero if the capped collection is empty
+	OldestOperation time.Time
+	NewestOperation time.Time
+}
+
+// retentionState looks for id, if not nil, in the capped collection and reads its head
+func (oplog *OpLog) retentionState(id LastID) (retentionState, error) {
+	rs := retentionState{Found: true}
+	var err error
+	if id != nil {
+		if rs.Found, err = oplog.HasID(id); err != nil {
+			return rs, err
+		}
+	}
+	if rs.Head, err = oplog.LastID(); err != nil {
+		return rs, err
+	}
+	db := oplog.db()
+	defer db.Session.Close()
+	rs.NewestOperation, rs.OldestOperation, err = operationTimes(db.C("oplog_ops"))
+	return rs, err
+}
+
+// WatchRetention starts checking every interval that the head of the capped collection
+// recorded by the previous check is still there, until Close is called. When it was
+// evicted, the capped collection retains less than interval of operations and consumers
+// lagging that much miss operations: RetentionBreaches is incremented and an error is
+// logged. The time between the oldest and newest operations is kept in RetentionActual.
+// Each check costs a few single document queries.
+func (oplog *OpLog) WatchRetention(interval time.Duration) {
+	oplog.samplerMu.Lock()
+	defer oplog.samplerMu.Unlock()
+	if oplog.watchdogStop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	oplog.watchdogStop, oplog.watchdogDone = stop, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var head LastID
+		for {
+			head = oplog.checkRetention(time.Now(), head)
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// checkRetention checks that the head recorded by the previous check is still in the
+// capped collection, and returns the head to check next time
+func (oplog *OpLog) checkRetention(now time.Time, head LastID) LastID {
+	stateFunc := oplog.retention
+	if stateFunc == nil {
+		stateFunc = oplog.retentionState
+	}
+	rs, err := stateFunc(head)
+	if err != nil {
+		oplog.warnSampled(err, "OPLOG can't check the retention: %s", err)
+		return head
+	}
+	if !rs.Found {
+		oplog.Stats.RetentionBreaches.Add(1)
+		oplog.logger().Errorf("OPLOG retention breach: operation %s, newest %s ago, evicted from the capped collection, consumers lagging that much missed operations", head, now.Sub(head.Time()))
+	}
+	if !rs.OldestOperation.IsZero() {
+		oplog.Stats.RetentionActual.Set(int64(rs.NewestOperation.Sub(rs.OldestOperation) / time.Millisecond))
+	}
+	return rs.Head
+}
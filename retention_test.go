@@ -0,0 +1,117 @@
+package oplog
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// testCappedCollection is a capped collection holding the size newest operation ids
+type testCappedCollection struct {
+	mu   sync.Mutex
+	size int
+	ids  []bson.ObjectId
+}
+
+func (c *testCappedCollection) append(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ids = append(c.ids, bson.NewObjectIdWithTime(t))
+	if len(c.ids) > c.size {
+		c.ids = c.ids[len(c.ids)-c.size:]
+	}
+}
+
+func (c *testCappedCollection) state(id LastID) (retentionState, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rs := retentionState{Found: id == nil}
+	for i := range c.ids {
+		if id != nil && c.ids[i] == *id.(*OperationLastID).ObjectId {
+			rs.Found = true
+		}
+	}
+	if n := len(c.ids); n > 0 {
+		rs.Head = &OperationLastID{&c.ids[n-1]}
+		rs.OldestOperation = c.ids[0].Time()
+		rs.NewestOperation = c.ids[n-1].Time()
+	}
+	return rs, nil
+}
+
+func newTestRetentionOpLog(state func(id LastID) (retentionState, error)) *OpLog {
+	ol := newTestOpLog()
+	stats := *ol.Stats
+	stats.RetentionBreaches = new(Int)
+	stats.RetentionActual = new(Int)
+	ol.Stats = &stats
+	ol.retention = state
+	return ol
+}
+
+func TestCheckRetention(t *testing.T) {
+	capped := &testCappedCollection{size: 3}
+	ol := newTestRetentionOpLog(capped.state)
+	logger := &capturingLogger{}
+	ol.Logger = logger
+	now := time.Unix(1000, 0)
+	capped.append(now.Add(-20 * time.Second))
+	capped.append(now.Add(-10 * time.Second))
+
+	head := ol.checkRetention(now, nil)
+	if head == nil || !head.Time().Equal(now.Add(-10*time.Second)) {
+		t.Fatalf("invalid head: %v", head)
+	}
+	if actual := ol.Stats.RetentionActual.Value(); actual != 10000 {
+		t.Errorf("expected an actual retention of 10000, got %d", actual)
+	}
+
+	// The recorded head is still there
+	capped.append(now)
+	head = ol.checkRetention(now.Add(10*time.Second), head)
+	if breaches := ol.Stats.RetentionBreaches.Value(); breaches != 0 || len(logger.lines) != 0 {
+		t.Errorf("unexpected breach: %d, %q", breaches, logger.lines)
+	}
+
+	// The burst evicts the recorded head before the next check
+	for i := 1; i <= 3; i++ {
+		capped.append(now.Add(time.Duration(i) * time.Second))
+	}
+	ol.checkRetention(now.Add(20*time.Second), head)
+	if breaches := ol.Stats.RetentionBreaches.Value(); breaches != 1 {
+		t.Errorf("expected a breach, got %d", breaches)
+	}
+	if len(logger.lines) != 1 || !strings.HasPrefix(logger.lines[0], "error OPLOG retention breach: operation "+head.String()) {
+		t.Errorf("breach not logged: %q", logger.lines)
+	}
+	if actual := ol.Stats.RetentionActual.Value(); actual != 2000 {
+		t.Errorf("expected an actual retention of 2000, got %d", actual)
+	}
+}
+
+func TestWatchRetentionClose(t *testing.T) {
+	var checks int64
+	ol := newTestRetentionOpLog(func(id LastID) (retentionState, error) {
+		atomic.AddInt64(&checks, 1)
+		return retentionState{Found: true}, nil
+	})
+	ol.WatchRetention(time.Millisecond)
+	// Starting the watchdog twice has no effect
+	ol.WatchRetention(time.Millisecond)
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt64(&checks) < 2; {
+		if time.Now().After(deadline) {
+			t.Fatal("watchdog not running")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	ol.Close()
+	n := atomic.LoadInt64(&checks)
+	time.Sleep(10 * time.Millisecond)
+	if atomic.LoadInt64(&checks) != n {
+		t.Errorf("watchdog still running after Close")
+	}
+}
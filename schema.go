@@ -0,0 +1,105 @@
+package oplog
+
+import (
+	"fmt"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The operations and object states are stored with the version of their document schema
+// in a v field. As the capped collection and the states collection keep the documents
+// written by the previous versions of the agent for their whole retention, the documents
+// are read according to their version by decodeStoredOperation and decodeObjectState,
+// the places where the version-specific handling lives:
+//
+//   - 0: the documents written before the versioning, without v field, which have the
+//     schema of version 1
+//   - 1: the current schema, see Operation and objectState
+//
+// The documents of a greater version, written by a more recent agent, are refused with a
+// VersionError, counted in UnknownVersions, rather than misread.
+
+// schemaVersion is the schema version of the documents written by the agent
+const schemaVersion = 1
+
+// VersionError is returned when reading a document of a schema version the agent doesn't
+// know, written by a more recent agent
+type VersionError struct {
+	// Kind is "operation" or "object state"
+	Kind    string
+	ID      string
+	Version int
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("%s %s has schema version %d, newer than the supported version %d", e.Kind, e.ID, e.Version, schemaVersion)
+}
+
+// decodeStoredOperation reads an operation document of the capped collection according
+// to its schema version. The operations received by the ingest endpoints are decoded by
+// decodeOperation.
+func decodeStoredOperation(raw bson.Raw) (*Operation, error) {
+	header := struct {
+		ID            bson.ObjectId `bson:"_id"`
+		SchemaVersion int           `bson:"v"`
+	}{}
+	if err := raw.Unmarshal(&header); err != nil {
+		return nil, err
+	}
+	op := &Operation{}
+	switch header.SchemaVersion {
+	case 0, 1:
+		if err := raw.Unmarshal(op); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, &VersionError{"operation", header.ID.Hex(), header.SchemaVersion}
+	}
+	return op, nil
+}
+
+// decodeObjectState reads an object state document according to its schema version. The
+// replication pages are decoded by their iterator and only checked with checkObjectState,
+// see replicatePage.
+func decodeObjectState(raw bson.Raw) (*objectState, error) {
+	header := struct {
+		ID            string `bson:"_id"`
+		SchemaVersion int    `bson:"v"`
+	}{}
+	if err := raw.Unmarshal(&header); err != nil {
+		return nil, err
+	}
+	obj := &objectState{}
+	switch header.SchemaVersion {
+	case 0, 1:
+		if err := raw.Unmarshal(obj); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, &VersionError{"object state", header.ID, header.SchemaVersion}
+	}
+	return obj, nil
+}
+
+// checkObjectState returns a VersionError if an object state decoded as the current
+// schema has an unknown schema version
+func checkObjectState(obj objectState) error {
+	if obj.SchemaVersion > schemaVersion {
+		return &VersionError{"object state", obj.ID, obj.SchemaVersion}
+	}
+	return nil
+}
+
+// countUnknownVersion counts the VersionError errors in UnknownVersions
+func (oplog *OpLog) countUnknownVersion(err error) {
+	if _, ok := err.(*VersionError); ok {
+		oplog.Stats.UnknownVersions.Add(1)
+	}
+}
+
+// undecodable logs a document which can't be decoded, skipped by the caller, see
+// countUnknownVersion
+func (oplog *OpLog) undecodable(err error) {
+	oplog.countUnknownVersion(err)
+	oplog.warnSampled(err, "OPLOG skipping undecodable document: %s", err)
+}
@@ -0,0 +1,148 @@
+package oplog
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// rawDocument returns the raw BSON of a stored document
+func rawDocument(t *testing.T, doc bson.M) bson.Raw {
+	b, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bson.Raw{Kind: 3, Data: b}
+}
+
+func TestDecodeStoredOperation(t *testing.T) {
+	id := bson.ObjectIdHex("545b55c7f095528dd0f3863c")
+	ts := time.Date(2014, 11, 6, 11, 4, 39, 41000000, time.UTC)
+	at := time.Date(2014, 11, 6, 11, 4, 40, 0, time.UTC)
+	for _, test := range []struct {
+		name string
+		doc  bson.M
+		op   Operation
+	}{
+		{
+			"version 0",
+			bson.M{"_id": id, "event": "insert", "data": bson.M{"ts": ts, "p": []string{"user/xl2d"}, "t": "video", "id": "x34cd"}},
+			Operation{ID: &id, Event: "insert", Data: &OperationData{Timestamp: ts, Parents: []string{"user/xl2d"}, Type: "video", ID: "x34cd"}},
+		},
+		{
+			"version 1",
+			bson.M{"_id": id, "event": "update", "v": 1, "at": at, "data": bson.M{"ts": ts, "p": []string{}, "t": "video", "id": "x34cd", "r": int64(3), "m": bson.M{"origin": "api"}, "pl": bson.M{"title": "cat"}}},
+			Operation{ID: &id, Event: "update", Appended: at, SchemaVersion: 1, Data: &OperationData{Timestamp: ts, Parents: []string{}, Type: "video", ID: "x34cd", Revision: 3, Meta: map[string]string{"origin": "api"}, Payload: map[string]interface{}{"title": "cat"}}},
+		},
+	} {
+		op, err := decodeStoredOperation(rawDocument(t, test.doc))
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if !op.Data.Timestamp.Equal(ts) || !op.Appended.Equal(test.op.Appended) {
+			t.Errorf("%s: invalid times %s, %s", test.name, op.Data.Timestamp, op.Appended)
+		}
+		op.Data.Timestamp, op.Appended = test.op.Data.Timestamp, test.op.Appended
+		if !reflect.DeepEqual(*op, test.op) {
+			t.Errorf("%s: invalid operation %#v", test.name, op)
+		}
+	}
+
+	// A future version is refused instead of being misread
+	_, err := decodeStoredOperation(rawDocument(t, bson.M{"_id": id, "event": "insert", "v": 2, "data": "video/x34cd"}))
+	if verr, ok := err.(*VersionError); !ok || verr.Version != 2 || verr.ID != id.Hex() {
+		t.Fatalf("expected a version error, got %v", err)
+	}
+	if err.Error() != "operation 545b55c7f095528dd0f3863c has schema version 2, newer than the supported version 1" {
+		t.Errorf("invalid message: %s", err)
+	}
+}
+
+func TestDecodeObjectState(t *testing.T) {
+	ts := time.Date(2014, 11, 6, 11, 4, 39, 41000000, time.UTC)
+	for _, test := range []struct {
+		name string
+		doc  bson.M
+		obj  objectState
+	}{
+		{
+			"version 0",
+			bson.M{"_id": "video/x34cd", "event": "insert", "ts": ts, "data": bson.M{"ts": ts, "p": []string{}, "t": "video", "id": "x34cd"}},
+			objectState{ID: "video/x34cd", Event: "insert", Data: &OperationData{Parents: []string{}, Type: "video", ID: "x34cd"}},
+		},
+		{
+			"version 1",
+			bson.M{"_id": "video/x34cd", "event": "delete", "v": 1, "ts": ts, "data": bson.M{"ts": ts, "p": []string{}, "t": "video", "id": "x34cd", "r": int64(4)}},
+			objectState{ID: "video/x34cd", Event: "delete", SchemaVersion: 1, Data: &OperationData{Parents: []string{}, Type: "video", ID: "x34cd", Revision: 4}},
+		},
+	} {
+		obj, err := decodeObjectState(rawDocument(t, test.doc))
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if !obj.Timestamp.Equal(ts) || !obj.Data.Timestamp.Equal(ts) {
+			t.Errorf("%s: invalid timestamps %s, %s", test.name, obj.Timestamp, obj.Data.Timestamp)
+		}
+		obj.Timestamp, obj.Data.Timestamp = time.Time{}, time.Time{}
+		if !reflect.DeepEqual(*obj, test.obj) {
+			t.Errorf("%s: invalid object state %#v", test.name, obj)
+		}
+		if err := checkObjectState(*obj); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+	}
+
+	_, err := decodeObjectState(rawDocument(t, bson.M{"_id": "video/x34cd", "event": "insert", "v": 2, "ts": ts}))
+	if verr, ok := err.(*VersionError); !ok || verr.Kind != "object state" || verr.ID != "video/x34cd" {
+		t.Errorf("expected a version error, got %v", err)
+	}
+	if err := checkObjectState(objectState{ID: "video/x34cd", SchemaVersion: 2}); err == nil {
+		t.Error("expected a version error")
+	}
+
+	// The states are written with the current version
+	op := &Operation{Event: "insert", Data: &OperationData{Type: "video", ID: "x34cd"}}
+	if obj := newObjectState(op, ts); obj.SchemaVersion != schemaVersion {
+		t.Errorf("invalid schema version %d", obj.SchemaVersion)
+	}
+}
+
+func TestReplicationUnknownVersion(t *testing.T) {
+	ol := newTestOpLog()
+	stats := *ol.Stats
+	stats.MongoDurations = NewHistograms(mongoBuckets...)
+	stats.UnknownVersions = new(Int)
+	ol.Stats = &stats
+	logger := &capturingLogger{}
+	ol.Logger = logger
+	ts := time.Unix(1423995187, 0)
+	ol.openStatesPage = func(query bson.M) stateIterator {
+		return &slowStateIterator{states: []objectState{
+			{ID: "video/1", Event: "insert", Timestamp: ts, Data: &OperationData{Type: "video", ID: "1"}},
+			{ID: "video/2", Event: "insert", Timestamp: ts, Data: &OperationData{Type: "video", ID: "2"}, SchemaVersion: 2},
+			{ID: "video/3", Event: "insert", Timestamp: ts, Data: &OperationData{Type: "video", ID: "3"}, SchemaVersion: 1},
+		}}
+	}
+	out := make(chan GenericEvent, 10)
+	tl := ol.newTailer(Filter{}, TailOptions{}, out, false)
+	tl.replicated = map[string]time.Time{}
+	if _, err := tl.replicatePage(nil, bson.M{}, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	close(out)
+	ids := []string{}
+	for ev := range out {
+		ids = append(ids, ev.(objectState).ID)
+	}
+	if !reflect.DeepEqual(ids, []string{"video/1", "video/3"}) {
+		t.Errorf("invalid replicated states: %v", ids)
+	}
+	if stats.UnknownVersions.Value() != 1 {
+		t.Errorf("expected an unknown version, got %d", stats.UnknownVersions.Value())
+	}
+	if len(logger.lines) != 1 || logger.lines[0] != "warn OPLOG skipping undecodable document: object state video/2 has schema version 2, newer than the supported version 1" {
+		t.Errorf("invalid warning: %q", logger.lines)
+	}
+}
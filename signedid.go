@@ -0,0 +1,87 @@
+package oplog
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+)
+
+// UnsignedIDPolicy defines how the last event ids without a valid signature are handled
+// when the event ids are signed.
+type UnsignedIDPolicy int
+
+const (
+	// UnsignedIDReject refuses the stream with a 400 Bad Request error.
+	UnsignedIDReject UnsignedIDPolicy = iota
+	// UnsignedIDIgnore resumes the stream as if no last event id was given, i.e.: from
+	// the most recent operation.
+	UnsignedIDIgnore
+)
+
+// signatureSize defines the number of bytes of the HMAC-SHA256 kept in signed ids
+const signatureSize = 16
+
+// idSignature returns the signature of id with key
+func idSignature(key []byte, id string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:signatureSize])
+}
+
+// signID returns id with its signature appended as "<id>.<signature>"
+func signID(key []byte, id string) string {
+	return id + "." + idSignature(key, id)
+}
+
+// verifyID returns the id signed by one of the keys, without its signature
+func verifyID(keys [][]byte, signedID string) (string, bool) {
+	i := strings.LastIndex(signedID, ".")
+	if i == -1 {
+		return "", false
+	}
+	id, signature := signedID[:i], signedID[i+1:]
+	for _, key := range keys {
+		if len(key) > 0 && hmac.Equal([]byte(signature), []byte(idSignature(key, id))) {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// wrapEvent returns the event as sent to the clients, its id carrying the fingerprint of
+// the stream filter, if any, and signed when a SigningKey is set
+func (daemon *SSEDaemon) wrapEvent(ev GenericEvent, fingerprint string) GenericEvent {
+	if fingerprint != "" {
+		ev = fingerprinted{ev, fingerprint}
+	}
+	if len(daemon.SigningKey) > 0 {
+		ev = signed{ev, daemon.SigningKey}
+	}
+	return ev
+}
+
+// eventID returns the id as sent to the clients, see wrapEvent
+func (daemon *SSEDaemon) eventID(id, fingerprint string) string {
+	if id == "" {
+		return ""
+	}
+	if fingerprint != "" {
+		id += "." + fingerprint
+	}
+	if len(daemon.SigningKey) > 0 {
+		id = signID(daemon.SigningKey, id)
+	}
+	return id
+}
+
+// verifyLastID returns the last event id given by a client without its signature. When
+// event ids are signed, ids not signed by the SigningKey or one of the VerificationKeys
+// are refused.
+func (daemon *SSEDaemon) verifyLastID(lastEventID string) (string, bool) {
+	if len(daemon.SigningKey) == 0 || lastEventID == "" {
+		return lastEventID, true
+	}
+	keys := append([][]byte{daemon.SigningKey}, daemon.VerificationKeys...)
+	return verifyID(keys, lastEventID)
+}
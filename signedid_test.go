@@ -0,0 +1,126 @@
+package oplog
+
+import (
+	"context"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestSignID(t *testing.T) {
+	oldKey, newKey := []byte("old"), []byte("new")
+	oid := bson.NewObjectId()
+	for _, lastID := range []LastID{&OperationLastID{&oid}, &ReplicationLastID{1423995187000, false, ""}} {
+		signedID := signID(oldKey, lastID.String())
+		id, ok := verifyID([][]byte{oldKey}, signedID)
+		if !ok || id != lastID.String() {
+			t.Fatalf("%s not verified: %s %v", signedID, id, ok)
+		}
+		parsed, err := NewLastID(id)
+		if err != nil || parsed.String() != lastID.String() || parsed.Time() != lastID.Time() {
+			t.Errorf("%s does not round-trip: %v %v", signedID, parsed, err)
+		}
+		// Rotated keys are still verified as secondary keys
+		if _, ok := verifyID([][]byte{newKey, oldKey}, signedID); !ok {
+			t.Errorf("%s not verified by the secondary key", signedID)
+		}
+		if _, ok := verifyID([][]byte{newKey}, signedID); ok {
+			t.Errorf("%s verified by another key", signedID)
+		}
+	}
+
+	signedID := signID(oldKey, "1423995187000")
+	for _, tampered := range []string{"0", "1423995187000", "0" + signedID[strings.Index(signedID, "."):], signedID + "x", ""} {
+		if _, ok := verifyID([][]byte{oldKey}, tampered); ok {
+			t.Errorf("%q verified", tampered)
+		}
+	}
+
+	// The fingerprint of the filter is covered by the signature
+	id, ok := verifyID([][]byte{oldKey}, signID(oldKey, "1423995187000.abcd1234"))
+	if !ok || id != "1423995187000.abcd1234" {
+		t.Errorf("fingerprinted id not verified: %s %v", id, ok)
+	}
+}
+
+var testEventIDLine = regexp.MustCompile(`(?m)^id: (.+)$`)
+
+func TestGetOpsSignedIDs(t *testing.T) {
+	ops := newTestOperations(1)
+	daemon := newTestSSEOpsDaemon(ops)
+	daemon.SigningKey = []byte("old")
+	daemon.MaxConnectionDuration = 10 * time.Millisecond
+	rec := httptest.NewRecorder()
+	daemon.ServeHTTP(rec, newTestSSERequest(context.Background()))
+	ids := []string{}
+	for _, m := range testEventIDLine.FindAllStringSubmatch(rec.Body.String(), -1) {
+		ids = append(ids, m[1])
+	}
+	if len(ids) < 2 || ids[1] != signID([]byte("old"), ops[0].ID.Hex()) {
+		t.Fatalf("event ids not signed: %v", ids)
+	}
+
+	head := bson.NewObjectId()
+	resume := func(daemon *SSEDaemon, lastEventID string) (int, LastID) {
+		lastIDs := make(chan LastID, 1)
+		d := newTestSSELastIDDaemon(lastIDs)
+		d.SigningKey, d.VerificationKeys, d.UnsignedIDPolicy = daemon.SigningKey, daemon.VerificationKeys, daemon.UnsignedIDPolicy
+		d.hasID = func(id LastID) (bool, error) {
+			return true, nil
+		}
+		d.lastID = func() (LastID, error) {
+			return &OperationLastID{&head}, nil
+		}
+		req := httptest.NewRequest("GET", "/ops", nil)
+		req.Header.Set("Accept", "text/event-stream")
+		req.Header.Set("Last-Event-ID", lastEventID)
+		rec := httptest.NewRecorder()
+		d.ServeHTTP(rec, req)
+		select {
+		case lastID := <-lastIDs:
+			return rec.Code, lastID
+		default:
+			return rec.Code, nil
+		}
+	}
+
+	// Resuming from a signed id, for an operation or a replication
+	for _, id := range []string{ops[0].ID.Hex(), "1423995187000"} {
+		status, lastID := resume(daemon, signID(daemon.SigningKey, id))
+		if status != 200 || lastID == nil || lastID.String() != id {
+			t.Errorf("%s: expected to resume from it, got %d %v", id, status, lastID)
+		}
+	}
+
+	// Unsigned ids can't force a full replication
+	unsigned := testStats.UnsignedIDs.Value()
+	for _, id := range []string{"0", ops[0].ID.Hex(), signID([]byte("other"), "0")} {
+		if status, lastID := resume(daemon, id); status != 400 || lastID != nil {
+			t.Errorf("%s: expected 400, got %d %v", id, status, lastID)
+		}
+	}
+	if testStats.UnsignedIDs.Value()-unsigned != 3 {
+		t.Errorf("unsigned ids not counted")
+	}
+
+	// Or are ignored, resuming from the most recent operation
+	daemon.UnsignedIDPolicy = UnsignedIDIgnore
+	if status, lastID := resume(daemon, "0"); status != 200 || lastID == nil || lastID.String() != head.Hex() {
+		t.Errorf("expected the unsigned id to be ignored, got %d %v", status, lastID)
+	}
+
+	// Ids signed with the previous key are accepted once the key is rotated
+	daemon.UnsignedIDPolicy = UnsignedIDReject
+	daemon.SigningKey, daemon.VerificationKeys = []byte("new"), [][]byte{[]byte("old")}
+	if status, lastID := resume(daemon, ids[1]); status != 200 || lastID == nil || lastID.String() != ops[0].ID.Hex() {
+		t.Errorf("expected the id signed by the old key to be accepted, got %d %v", status, lastID)
+	}
+	daemon.VerificationKeys = nil
+	if status, _ := resume(daemon, ids[1]); status != 400 {
+		t.Errorf("expected the id signed by a retired key to be refused, got %d", status)
+	}
+}
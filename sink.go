@@ -0,0 +1,107 @@
+package oplog
+
+import (
+	"expvar"
+	"time"
+)
+
+// Tag qualifies a metric, i.e.: the object type of the sent events
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// MetricsSink receives the statistics of the oplog, named after their /status field
+// (i.e.: events_sent), the per key statistics being tagged with their key (i.e.:
+// events_sent_by_type tagged with the type). The statistics are always kept as expvars,
+// served by the /status and /metrics endpoints, the sink getting them as they change.
+type MetricsSink interface {
+	// Counter returns the counter of the given name and tags
+	Counter(name string, tags ...Tag) Counter
+	// Gauge returns the gauge of the given name and tags
+	Gauge(name string, tags ...Tag) Gauge
+	// Histogram returns the distribution of durations of the given name and tags
+	Histogram(name string, tags ...Tag) Observer
+}
+
+// Counter is a metric which only goes up
+type Counter interface {
+	Add(delta int64)
+}
+
+// Gauge is a metric which goes up and down
+type Gauge interface {
+	Add(delta int64)
+	Set(value int64)
+}
+
+// Observer is a distribution of durations
+type Observer interface {
+	Observe(d time.Duration)
+}
+
+// Int is a statistic kept as an expvar.Int and reported to the MetricsSink, if any, as a
+// counter or a gauge
+type Int struct {
+	expvar.Int
+	counter Counter
+	gauge   Gauge
+	// isGauge tells if the statistic goes up and down, gauges are not zeroed by Stats.Reset
+	isGauge bool
+}
+
+// Add adds delta to the statistic
+func (v *Int) Add(delta int64) {
+	v.Int.Add(delta)
+	if v.gauge != nil {
+		v.gauge.Add(delta)
+	} else if v.counter != nil {
+		v.counter.Add(delta)
+	}
+}
+
+// Set sets the statistic to value, only reported to the sink for gauges
+func (v *Int) Set(value int64) {
+	v.Int.Set(value)
+	if v.gauge != nil {
+		v.gauge.Set(value)
+	}
+}
+
+// Map is a statistic counted by key kept as an expvar.Map and reported to the MetricsSink,
+// if any, as a counter tagged with the key
+type Map struct {
+	expvar.Map
+	name  string
+	label string
+	sink  MetricsSink
+}
+
+// Add adds delta to the counter of key
+func (v *Map) Add(key string, delta int64) {
+	v.Map.Add(key, delta)
+	if v.sink != nil {
+		v.sink.Counter(v.name, Tag{v.label, key}).Add(delta)
+	}
+}
+
+// Snapshot returns the current counter of each key
+func (v *Map) Snapshot() map[string]int64 {
+	snapshot := map[string]int64{}
+	v.Do(func(kv expvar.KeyValue) {
+		if i, ok := kv.Value.(*expvar.Int); ok {
+			snapshot[kv.Key] = i.Value()
+		}
+	})
+	return snapshot
+}
+
+// Reset zeroes the counter of each key. The keys are kept, so the number of keys stays
+// bounded for the per type counters.
+func (v *Map) Reset() {
+	v.Do(func(kv expvar.KeyValue) {
+		if i, ok := kv.Value.(*expvar.Int); ok {
+			i.Set(0)
+		}
+	})
+}
@@ -0,0 +1,155 @@
+package oplog
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingMetricsSink is a MetricsSink recording the metric changes
+type recordingMetricsSink struct {
+	mu      sync.Mutex
+	changes []string
+}
+
+// recordingMetric records the changes of a metric in its sink
+type recordingMetric struct {
+	s   *recordingMetricsSink
+	key string
+}
+
+func (s *recordingMetricsSink) metric(name string, tags []Tag) recordingMetric {
+	key := name
+	for _, tag := range tags {
+		key += fmt.Sprintf(",%s=%s", tag.Key, tag.Value)
+	}
+	return recordingMetric{s, key}
+}
+
+func (s *recordingMetricsSink) Counter(name string, tags ...Tag) Counter {
+	return s.metric(name, tags)
+}
+
+func (s *recordingMetricsSink) Gauge(name string, tags ...Tag) Gauge {
+	return s.metric(name, tags)
+}
+
+func (s *recordingMetricsSink) Histogram(name string, tags ...Tag) Observer {
+	return s.metric(name, tags)
+}
+
+func (m recordingMetric) record(change string) {
+	m.s.mu.Lock()
+	m.s.changes = append(m.s.changes, m.key+" "+change)
+	m.s.mu.Unlock()
+}
+
+func (m recordingMetric) Add(delta int64) {
+	m.record(fmt.Sprintf("%+d", delta))
+}
+
+func (m recordingMetric) Set(value int64) {
+	m.record(fmt.Sprintf("=%d", value))
+}
+
+func (m recordingMetric) Observe(d time.Duration) {
+	m.record("observed")
+}
+
+// sorted returns the recorded changes in order
+func (s *recordingMetricsSink) sorted() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changes := append([]string{}, s.changes...)
+	sort.Strings(changes)
+	return changes
+}
+
+func TestMetricsSink(t *testing.T) {
+	sink := &recordingMetricsSink{}
+	stats := makeStats(sink, false)
+	ops := newTestOperations(1)
+	daemon := newTestSSEOpsDaemon(ops)
+	daemon.ol.Stats = &stats
+
+	ops[0].Appended = time.Now()
+	daemon.ol.appended(&ops[0], time.Now())
+	req := httptest.NewRequest("GET", "/ops?since=1423995187000&limit=1", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	rec := httptest.NewRecorder()
+	daemon.ServeHTTP(flushResponseWriter{rec}, req)
+
+	// The bytes are counted write by write
+	changes := []string{}
+	bytesSent := int64(0)
+	for _, change := range sink.sorted() {
+		var n int64
+		if _, err := fmt.Sscanf(change, "bytes_sent %d", &n); err == nil {
+			bytesSent += n
+			continue
+		}
+		changes = append(changes, change)
+	}
+	if bytesSent != int64(rec.Body.Len()) {
+		t.Errorf("expected %d bytes sent, got %d", rec.Body.Len(), bytesSent)
+	}
+	expected := []string{
+		"clients +1",
+		"clients -1",
+		"connections +1",
+		"delivery_latency observed",
+		"events_ingested +1",
+		"events_ingested_by_event,event=insert +1",
+		"events_ingested_by_type,type=video +1",
+		// The reset event and the operation
+		"events_sent +1",
+		"events_sent +1",
+		"events_sent_by_event,event=insert +1",
+		"events_sent_by_type,type=video +1",
+		"streams_ended,reason=limit_reached +1",
+		"tails +1",
+		"tails -1",
+		"tails_peak =1",
+	}
+	if strings.Join(changes, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected metric changes:\n%s", strings.Join(changes, "\n"))
+	}
+}
+
+func TestMetricsSinkMongo(t *testing.T) {
+	sink := &recordingMetricsSink{}
+	stats := makeStats(sink, false)
+	ol := newTestOpLog()
+	ol.Stats = &stats
+
+	// Calls made by a tail reopening its cursor then an append
+	ol.observeMongo("tail", time.Millisecond)
+	ol.cursorOpened(false)
+	ol.observeMongo("tail", time.Millisecond)
+	ol.cursorOpened(true)
+	ol.observeMongo("insert", time.Millisecond)
+	ol.observeMongo("upsert", time.Millisecond)
+	appended := time.Now().Add(-time.Minute)
+	ol.appended(&newTestOperations(1)[0], appended)
+
+	expected := []string{
+		"events_ingested +1",
+		"events_ingested_by_event,event=insert +1",
+		"events_ingested_by_type,type=video +1",
+		"mongo_cursor_reopens +1",
+		"mongo_durations,operation=insert observed",
+		"mongo_durations,operation=tail observed",
+		"mongo_durations,operation=tail observed",
+		"mongo_durations,operation=upsert observed",
+	}
+	if changes := sink.sorted(); strings.Join(changes, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected metric changes:\n%s", strings.Join(changes, "\n"))
+	}
+	if !ol.lastAppend.Equal(appended) {
+		t.Errorf("expected the last append at %s, got %s", appended, ol.lastAppend)
+	}
+}
@@ -0,0 +1,176 @@
+package oplog
+
+import "reflect"
+
+// StatsSnapshot holds the values of the statistics at a point in time, named after their
+// /status field, see Stats.Snapshot
+type StatsSnapshot struct {
+	EventsReceived           int64                        `json:"events_received"`
+	EventsSent               int64                        `json:"events_sent"`
+	BytesSent                int64                        `json:"bytes_sent"`
+	CheckpointsSent          int64                        `json:"checkpoints_sent"`
+	EventsIngested           int64                        `json:"events_ingested"`
+	EventsIngestedByEvent    map[string]int64             `json:"events_ingested_by_event"`
+	EventsIngestedByType     map[string]int64             `json:"events_ingested_by_type"`
+	EventsSentByEvent        map[string]int64             `json:"events_sent_by_event"`
+	EventsSentByType         map[string]int64             `json:"events_sent_by_type"`
+	EventsError              int64                        `json:"events_error"`
+	EventsDiscarded          int64                        `json:"events_discarded"`
+	StaleRevisions           int64                        `json:"stale_revisions"`
+	UnknownVersions          int64                        `json:"unknown_versions"`
+	QueueSize                int64                        `json:"queue_size"`
+	QueueMaxSize             int64                        `json:"queue_max_size"`
+	QueuePeak                int64                        `json:"queue_peak"`
+	QueueRecentPeak          int64                        `json:"queue_recent_peak"`
+	QueueLatency             HistogramSnapshot            `json:"queue_latency"`
+	Clients                  int64                        `json:"clients"`
+	Connections              int64                        `json:"connections"`
+	ConnectionsRateLimited   int64                        `json:"connections_rate_limited"`
+	ConnectionsPerIPRejected int64                        `json:"connections_per_ip_rejected"`
+	Tails                    int64                        `json:"tails"`
+	TailsPeak                int64                        `json:"tails_peak"`
+	TailsRejected            int64                        `json:"tails_rejected"`
+	TailsLive                int64                        `json:"tails_live"`
+	TailsReplicating         int64                        `json:"tails_replicating"`
+	TailsFallback            int64                        `json:"tails_fallback"`
+	TailsMaxLag              int64                        `json:"tails_max_lag"`
+	ClientsMaxLag            int64                        `json:"clients_max_lag"`
+	ClientsMeanLag           int64                        `json:"clients_mean_lag"`
+	SharedTailSubscribers    int64                        `json:"shared_tail_subscribers"`
+	SharedTailEvictions      int64                        `json:"shared_tail_evictions"`
+	ReplicationsRunning      int64                        `json:"replications_running"`
+	ReplicationsQueued       int64                        `json:"replications_queued"`
+	ReplicationQueueWait     int64                        `json:"replication_queue_wait"`
+	ReplicationQueueTimeouts int64                        `json:"replication_queue_timeouts"`
+	ResyncFallbacks          int64                        `json:"resync_fallbacks"`
+	FilterMismatches         int64                        `json:"filter_mismatches"`
+	UnsignedIDs              int64                        `json:"unsigned_ids"`
+	ClientBuffered           int64                        `json:"client_buffered"`
+	SlowConsumerEvictions    int64                        `json:"slow_consumer_evictions"`
+	EventsDropped            int64                        `json:"events_dropped"`
+	StreamsEnded             map[string]int64             `json:"streams_ended"`
+	AuthSuccesses            int64                        `json:"auth_successes"`
+	AuthFailures             int64                        `json:"auth_failures"`
+	AuthFailuresMissing      int64                        `json:"auth_failures_missing"`
+	AuthFailuresMalformed    int64                        `json:"auth_failures_malformed"`
+	AuthFailuresInvalid      int64                        `json:"auth_failures_invalid"`
+	AuthFailuresExpired      int64                        `json:"auth_failures_expired"`
+	AuthzDeniedScope         int64                        `json:"authz_denied_scope"`
+	AuthzDeniedPolicy        int64                        `json:"authz_denied_policy"`
+	AuthBans                 int64                        `json:"auth_bans"`
+	AuthBanned               int64                        `json:"auth_banned"`
+	BlockedRequests          int64                        `json:"blocked_requests"`
+	AuditDropped             int64                        `json:"audit_dropped"`
+	CappedBytes              int64                        `json:"capped_bytes"`
+	CappedMaxBytes           int64                        `json:"capped_max_bytes"`
+	CappedCount              int64                        `json:"capped_count"`
+	CappedOldestAge          int64                        `json:"capped_oldest_age"`
+	CappedNewestAge          int64                        `json:"capped_newest_age"`
+	CappedRetention          int64                        `json:"capped_retention"`
+	RetentionBreaches        int64                        `json:"retention_breaches"`
+	RetentionActual          int64                        `json:"retention_actual"`
+	DeliveryLatency          HistogramSnapshot            `json:"delivery_latency"`
+	MongoDurations           map[string]HistogramSnapshot `json:"mongo_durations"`
+	MongoCursorReopens       int64                        `json:"mongo_cursor_reopens"`
+	MongoSessionRefreshes    int64                        `json:"mongo_session_refreshes"`
+	ThrottledBytes           int64                        `json:"throttled_bytes"`
+	ThrottleWait             int64                        `json:"throttle_wait"`
+}
+
+// Snapshot returns the current values of the statistics. Each value is read atomically,
+// the statistics updated concurrently may be taken before or after their update.
+func (s *Stats) Snapshot() StatsSnapshot {
+	return StatsSnapshot{
+		EventsReceived:           s.EventsReceived.Value(),
+		EventsSent:               s.EventsSent.Value(),
+		BytesSent:                s.BytesSent.Value(),
+		CheckpointsSent:          s.CheckpointsSent.Value(),
+		EventsIngested:           s.EventsIngested.Value(),
+		EventsIngestedByEvent:    s.EventsIngestedByEvent.Snapshot(),
+		EventsIngestedByType:     s.EventsIngestedByType.Snapshot(),
+		EventsSentByEvent:        s.EventsSentByEvent.Snapshot(),
+		EventsSentByType:         s.EventsSentByType.Snapshot(),
+		EventsError:              s.EventsError.Value(),
+		EventsDiscarded:          s.EventsDiscarded.Value(),
+		StaleRevisions:           s.StaleRevisions.Value(),
+		UnknownVersions:          s.UnknownVersions.Value(),
+		QueueSize:                s.QueueSize.Value(),
+		QueueMaxSize:             s.QueueMaxSize.Value(),
+		QueuePeak:                s.QueuePeak.Value(),
+		QueueRecentPeak:          s.QueueRecentPeak.Value(),
+		QueueLatency:             s.QueueLatency.Snapshot(),
+		Clients:                  s.Clients.Value(),
+		Connections:              s.Connections.Value(),
+		ConnectionsRateLimited:   s.ConnectionsRateLimited.Value(),
+		ConnectionsPerIPRejected: s.ConnectionsPerIPRejected.Value(),
+		Tails:                    s.Tails.Value(),
+		TailsPeak:                s.TailsPeak.Value(),
+		TailsRejected:            s.TailsRejected.Value(),
+		TailsLive:                s.TailsLive.Value(),
+		TailsReplicating:         s.TailsReplicating.Value(),
+		TailsFallback:            s.TailsFallback.Value(),
+		TailsMaxLag:              s.TailsMaxLag.Value(),
+		ClientsMaxLag:            s.ClientsMaxLag.Value(),
+		ClientsMeanLag:           s.ClientsMeanLag.Value(),
+		SharedTailSubscribers:    s.SharedTailSubscribers.Value(),
+		SharedTailEvictions:      s.SharedTailEvictions.Value(),
+		ReplicationsRunning:      s.ReplicationsRunning.Value(),
+		ReplicationsQueued:       s.ReplicationsQueued.Value(),
+		ReplicationQueueWait:     s.ReplicationQueueWait.Value(),
+		ReplicationQueueTimeouts: s.ReplicationQueueTimeouts.Value(),
+		ResyncFallbacks:          s.ResyncFallbacks.Value(),
+		FilterMismatches:         s.FilterMismatches.Value(),
+		UnsignedIDs:              s.UnsignedIDs.Value(),
+		ClientBuffered:           s.ClientBuffered.Value(),
+		SlowConsumerEvictions:    s.SlowConsumerEvictions.Value(),
+		EventsDropped:            s.EventsDropped.Value(),
+		StreamsEnded:             s.StreamsEnded.Snapshot(),
+		AuthSuccesses:            s.AuthSuccesses.Value(),
+		AuthFailures:             s.AuthFailures.Value(),
+		AuthFailuresMissing:      s.AuthFailuresMissing.Value(),
+		AuthFailuresMalformed:    s.AuthFailuresMalformed.Value(),
+		AuthFailuresInvalid:      s.AuthFailuresInvalid.Value(),
+		AuthFailuresExpired:      s.AuthFailuresExpired.Value(),
+		AuthzDeniedScope:         s.AuthzDeniedScope.Value(),
+		AuthzDeniedPolicy:        s.AuthzDeniedPolicy.Value(),
+		AuthBans:                 s.AuthBans.Value(),
+		AuthBanned:               s.AuthBanned.Value(),
+		BlockedRequests:          s.BlockedRequests.Value(),
+		AuditDropped:             s.AuditDropped.Value(),
+		CappedBytes:              s.CappedBytes.Value(),
+		CappedMaxBytes:           s.CappedMaxBytes.Value(),
+		CappedCount:              s.CappedCount.Value(),
+		CappedOldestAge:          s.CappedOldestAge.Value(),
+		CappedNewestAge:          s.CappedNewestAge.Value(),
+		CappedRetention:          s.CappedRetention.Value(),
+		RetentionBreaches:        s.RetentionBreaches.Value(),
+		RetentionActual:          s.RetentionActual.Value(),
+		DeliveryLatency:          s.DeliveryLatency.Snapshot(),
+		MongoDurations:           s.MongoDurations.Snapshot(),
+		MongoCursorReopens:       s.MongoCursorReopens.Value(),
+		MongoSessionRefreshes:    s.MongoSessionRefreshes.Value(),
+		ThrottledBytes:           s.ThrottledBytes.Value(),
+		ThrottleWait:             s.ThrottleWait.Value(),
+	}
+}
+
+// Reset zeroes the counters, the per key counters and the histograms, leaving the gauges
+// as they are, so benchmarks and integration tests can assert on deltas. The MetricsSink,
+// if any, is not notified. It is safe to call while the statistics are updated.
+func (s *Stats) Reset() {
+	v := reflect.ValueOf(s).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		switch stat := v.Field(i).Interface().(type) {
+		case *Int:
+			if !stat.isGauge {
+				stat.Int.Set(0)
+			}
+		case *Map:
+			stat.Reset()
+		case *Histogram:
+			stat.Reset()
+		case *Histograms:
+			stat.Reset()
+		}
+	}
+}
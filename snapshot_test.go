@@ -0,0 +1,113 @@
+package oplog
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStatsSnapshot(t *testing.T) {
+	stats := makeStats(nil, false)
+	stats.EventsSent.Add(3)
+	stats.Clients.Add(2)
+	stats.EventsSentByType.Add("video", 2)
+	stats.DeliveryLatency.Observe(20 * time.Millisecond)
+	stats.MongoDurations.Observe("insert", 3*time.Millisecond)
+
+	snapshot := stats.Snapshot()
+	if snapshot.EventsSent != 3 || snapshot.Clients != 2 || snapshot.EventsReceived != 0 {
+		t.Errorf("invalid values: %d events sent, %d clients, %d events received", snapshot.EventsSent, snapshot.Clients, snapshot.EventsReceived)
+	}
+	if !reflect.DeepEqual(snapshot.EventsSentByType, map[string]int64{"video": 2}) {
+		t.Errorf("invalid events sent by type: %v", snapshot.EventsSentByType)
+	}
+	if l := snapshot.DeliveryLatency; l.Count != 1 || l.P50 != 20 || l.Max != 20 || l.Buckets["25"] != 1 {
+		t.Errorf("invalid delivery latency: %#v", l)
+	}
+	if d := snapshot.MongoDurations["insert"]; d.Count != 1 || d.Max != 3 {
+		t.Errorf("invalid mongo durations: %#v", snapshot.MongoDurations)
+	}
+
+	// Every statistic is part of the snapshot
+	st := reflect.TypeOf(stats)
+	for i := 0; i < st.NumField(); i++ {
+		if f := st.Field(i); f.Type.Kind() == reflect.Ptr {
+			if _, found := reflect.TypeOf(snapshot).FieldByName(f.Name); !found {
+				t.Errorf("%s missing from the snapshot", f.Name)
+			}
+		}
+	}
+}
+
+func TestStatsReset(t *testing.T) {
+	stats := makeStats(nil, false)
+	stats.EventsSent.Add(3)
+	stats.Clients.Add(2)
+	stats.EventsSentByType.Add("video", 2)
+	stats.DeliveryLatency.Observe(20 * time.Millisecond)
+	stats.MongoDurations.Observe("insert", 3*time.Millisecond)
+
+	stats.Reset()
+	snapshot := stats.Snapshot()
+	if snapshot.EventsSent != 0 {
+		t.Errorf("counter not reset: %d", snapshot.EventsSent)
+	}
+	if snapshot.Clients != 2 {
+		t.Errorf("gauge reset: %d", snapshot.Clients)
+	}
+	if !reflect.DeepEqual(snapshot.EventsSentByType, map[string]int64{"video": 0}) {
+		t.Errorf("per type counter not reset: %v", snapshot.EventsSentByType)
+	}
+	if l := snapshot.DeliveryLatency; l.Count != 0 || l.Max != 0 || l.Buckets["25"] != 0 {
+		t.Errorf("histogram not reset: %#v", l)
+	}
+	if d := snapshot.MongoDurations["insert"]; d.Count != 0 {
+		t.Errorf("histograms not reset: %#v", snapshot.MongoDurations)
+	}
+
+	// The deltas are counted from the reset
+	stats.EventsSent.Add(1)
+	if sent := stats.Snapshot().EventsSent; sent != 1 {
+		t.Errorf("expected 1 event sent since the reset, got %d", sent)
+	}
+}
+
+func TestStatsSnapshotConcurrent(t *testing.T) {
+	stats := makeStats(nil, false)
+	stop := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				stats.EventsSent.Add(1)
+				stats.Clients.Add(1)
+				stats.Clients.Add(-1)
+				stats.EventsSentByType.Add("video", 1)
+				stats.DeliveryLatency.Observe(time.Millisecond)
+				stats.MongoDurations.Observe("tail", time.Millisecond)
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		snapshot := stats.Snapshot()
+		if snapshot.Clients < 0 || snapshot.Clients > 4 {
+			t.Errorf("invalid number of clients: %d", snapshot.Clients)
+		}
+		if i%10 == 0 {
+			stats.Reset()
+		}
+	}
+	close(stop)
+	wg.Wait()
+	if clients := stats.Clients.Value(); clients != 0 {
+		t.Errorf("gauge altered by the resets: %d", clients)
+	}
+}
@@ -1,42 +1,314 @@
 package oplog
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/base64"
+	"encoding/json"
 	"expvar"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	log "github.com/Sirupsen/logrus"
 	"github.com/sebest/xff"
+	"gopkg.in/mgo.v2/bson"
 )
 
 // SSEDaemon listens for events and send them to the oplog MongoDB capped collection
 type SSEDaemon struct {
 	s  *http.Server
 	ol *OpLog
-	// Password is the shared secret to connect to a password protected oplog.
+	// Password is the shared secret to connect to a password protected oplog, with any
+	// username, granting the read scope. All the passwords of the daemon can be given in plaintext or as a bcrypt
+	// ($2a$, $2b$, $2y$) or argon2id ($argon2id$) hash.
 	Password string
-	// IngestPassword is the shared secret to connect to the HTTP ingest endpoint.
+	// Authenticator optionally checks the credentials of the clients, i.e.: to give each
+	// consumer its own credentials. A ScopedAuthenticator grants each user the scopes
+	// required by the endpoints: read for the streams, write to post operations and admin
+	// for the metrics and the clients detailed by /status. The shared passwords are still
+	// accepted when set.
+	Authenticator Authenticator
+	// TokenValidator optionally validates the bearer tokens of the clients, given with an
+	// "Authorization: Bearer" header instead of basic authentication credentials. The
+	// principal of the token is attached to the request context.
+	TokenValidator TokenValidator
+	// AllowQueryToken accepts the bearer token of the SSE clients in the access_token
+	// query-string parameter, for browsers' EventSource which can't set headers. Tokens in
+	// URLs may leak thru proxies logs or browser history: only enable it if required.
+	AllowQueryToken bool
+	// IngestPassword is the shared secret to connect to the HTTP ingest endpoint, granting
+	// the write scope.
 	IngestPassword string
+	// EnableMetrics exposes the stats in the Prometheus text format on /metrics.
+	EnableMetrics bool
+	// MetricsPassword is the shared secret to access the metrics endpoint, granting the
+	// admin scope.
+	MetricsPassword string
 	// FlushInterval defines the interval between flushes of the HTTP socket.
 	FlushInterval time.Duration
+	// KeepaliveInterval defines the time without any event after which an heartbeat is
+	// sent to keep the connection open. A value of 0 disables the heartbeats.
+	KeepaliveInterval time.Duration
 	// HeartbeatTickerCount defines the number of FlushInterval with nothing to flush
-	// is required before we send an heartbeat.
+	// required before an heartbeat is sent. When set, it overrides KeepaliveInterval.
+	//
+	// Deprecated: use KeepaliveInterval.
 	HeartbeatTickerCount int8
+	// MaxConnectionDuration defines the time after which a stream is ended, so the client
+	// reconnects, possibly to another server, and resumes from its last event id. A value
+	// of 0 means no limit.
+	MaxConnectionDuration time.Duration
+	// ClientBufferSize defines the number of events buffered between the tail and each
+	// client. When a client falls behind by more than this number of events, it is
+	// handled according to SlowConsumerPolicy. A value of 0 disables the buffering.
+	ClientBufferSize int
+	// SlowConsumerPolicy defines how clients overflowing their buffer are handled.
+	SlowConsumerPolicy SlowConsumerPolicy
+	// MaxHistory defines the maximum number of past operations a client can request
+	// thru the history query-string parameter.
+	MaxHistory int
+	// FilterFingerprint makes the event ids include a fingerprint of the stream filter,
+	// so a client resuming with a different filter can be detected.
+	FilterFingerprint bool
+	// FilterChangePolicy defines how clients resuming with a different filter are handled.
+	FilterChangePolicy FilterChangePolicy
+	// SigningKey optionally signs the event ids sent to the clients with an HMAC, as
+	// "<id>.<signature>", so they can only resume from the ids they were given. The ids
+	// signed by one of the VerificationKeys are accepted as well, so the key can be rotated.
+	SigningKey       []byte
+	VerificationKeys [][]byte
+	// UnsignedIDPolicy defines how clients resuming from an id without a valid signature
+	// are handled.
+	UnsignedIDPolicy UnsignedIDPolicy
+	// PolicyMode defines how clients asking for operations outside of the policy of their
+	// credentials are handled.
+	PolicyMode PolicyMode
+	// RetryAfter defines the delay advertised to clients thru the Retry-After header
+	// when the server is overloaded.
+	RetryAfter time.Duration
+	// MaxLimit defines the maximum number of events a client can request thru the limit
+	// query-string parameter.
+	MaxLimit int
+	// MaxIdleTimeout defines the maximum delay a client can request thru the idle_timeout
+	// query-string parameter.
+	MaxIdleTimeout time.Duration
+	// MaxFilterValues and MaxFilterValueLength limit the number of values of each filter
+	// query-string parameter and their length. A value of 0 means no limit.
+	MaxFilterValues      int
+	MaxFilterValueLength int
+	// FilterableFields lists the data fields clients can filter on thru the field.<name>
+	// query-string parameters, checked with ValidateField. Each field should be indexed
+	// so the filter doesn't scan the collections, see the README.
+	FilterableFields []string
+	// FilterPresets defines named filters clients can select with the filter
+	// query-string parameter, see ReadFilterPresets. The other filter parameters can only
+	// narrow a preset.
+	FilterPresets map[string]Filter
+	// MaxPollWait defines the maximum time a client can ask the poll endpoint to wait for
+	// events thru the wait query-string parameter.
+	MaxPollWait time.Duration
+	// MaxBandwidth defines the number of bytes per second each stream is limited to, so
+	// full replications don't starve the other clients. Clients can ask for a lower rate
+	// thru the max_rate query-string parameter. A value of 0 means no limit.
+	MaxBandwidth int64
+	// MinBandwidth defines the lowest rate in bytes per second a stream can be throttled
+	// to, whatever the client asks for.
+	MinBandwidth int64
+	// UnthrottledPassword is the shared secret of privileged clients whose streams are
+	// not throttled. It grants the same access as Password.
+	UnthrottledPassword string
+	// MaxAuthFailures defines the number of authentication failures within
+	// AuthFailureWindow after which a client IP is banned for AuthBanDuration. A value of
+	// 0 disables the ban.
+	MaxAuthFailures   int
+	AuthFailureWindow time.Duration
+	AuthBanDuration   time.Duration
+	// ProtectStatus makes the status and metrics endpoints require credentials granted the
+	// read or admin scope as soon as the streams or the metrics require credentials. The
+	// liveness and readiness probes are never protected.
+	ProtectStatus bool
+	// RedactedVars lists the expvars masked on the status endpoint, given as names or
+	// path.Match patterns, i.e.: to hide the vars embedding connection strings.
+	RedactedVars []string
+	// MaxStatusClients defines the maximum number of connected clients detailed by the
+	// status endpoint. A value of 0 hides the connected clients.
+	MaxStatusClients int
+	// MaxConnectionsPerIP defines the maximum number of concurrent connections to the
+	// stream endpoints per client IP. A value of 0 means no limit.
+	MaxConnectionsPerIP int
+	// ConnectionRate defines the number of connection attempts per second allowed per
+	// client IP, with bursts of up to ConnectionBurst attempts. A value of 0 means no limit.
+	ConnectionRate  float64
+	ConnectionBurst int
+	// TrustedProxyDepth defines the number of trusted proxies in front of the daemon. When
+	// set, the client IP the per IP limits apply to is read from the X-Forwarded-For
+	// header instead of the connection.
+	TrustedProxyDepth int
+	// AllowedCIDRs optionally restricts the client IPs allowed to connect, see ParseCIDRs.
+	// The health probes are not restricted.
+	AllowedCIDRs []*net.IPNet
+	// DeniedCIDRs lists the networks of the client IPs refused, even if they are part of
+	// the AllowedCIDRs.
+	DeniedCIDRs []*net.IPNet
+	// CORS defines the Cross-Origin Resource Sharing policy of the endpoints. By default,
+	// any origin is allowed.
+	CORS CORS
+	// MaxIngestSize defines the maximum size in bytes of a body posted to the ingest
+	// endpoint.
+	MaxIngestSize int64
+	// ReconnectDelay defines the reconnection delay sent to clients thru the SSE retry
+	// directive at the start of each stream. When the server is overloaded, RetryAfter is
+	// sent instead. A value of 0 lets clients use their default delay.
+	ReconnectDelay time.Duration
+	// ReadHeaderTimeout defines the time allowed to read the request headers. A value of 0
+	// means no timeout.
+	ReadHeaderTimeout time.Duration
+	// IdleTimeout defines the time to wait for the next request on a keep-alive
+	// connection. A value of 0 means no timeout. There is no write timeout as streams
+	// are long lived.
+	IdleTimeout time.Duration
+	// TLSConfig optionally defines the TLS configuration used by RunTLS, i.e.: to require
+	// client certificates.
+	TLSConfig *tls.Config
+	// CertAuthorizer optionally authenticates the clients by their certificate, verified
+	// during the TLS handshake (see TLSConfig), instead of basic auth or bearer tokens.
+	// Requests without a verified certificate get a 401 error.
+	CertAuthorizer CertAuthorizer
+	// AuditSink optionally records the authentications and the streams started and ended,
+	// see NewMongoAuditSink. Events are recorded in the background, and dropped when the
+	// sink can't keep up, so the streams are never slowed down.
+	AuditSink AuditSink
+	// Hello makes the streams start with a "hello" event giving the server time, the most
+	// recent operation of the oplog and how the stream starts.
+	Hello bool
+	// HelloFilter makes the hello event give the effective filter of the stream, once the
+	// presets, the policy and the normalization of the types applied.
+	HelloFilter bool
+	// HelloFilteredHead makes the hello event give the newest operation matching the
+	// filter of the stream, see OpLog.LastIDForFilter. The capped collection is scanned
+	// on each stream start until a matching operation is found.
+	HelloFilteredHead bool
+	// ShutdownGoodbye makes the streams end with a "goodbye" event on Shutdown so clients
+	// can reconnect to another server right away.
+	ShutdownGoodbye bool
+	// DrainDelay defines how long Shutdown waits between making the readiness probe fail
+	// and closing the listener, so load balancers have time to stop routing traffic to
+	// this server before connections are cut.
+	DrainDelay time.Duration
+	// LagRefreshInterval defines the interval at which the lag of the live streams behind
+	// the most recent operation of the oplog is refreshed, see ConnectionInfo.Lag. The lag
+	// is also updated on each operation sent. A value of 0 disables the refresh.
+	LagRefreshInterval time.Duration
+	// Logger logs the messages of the daemon, the Logger of the oplog when nil. Setting it
+	// lets the daemon log at its own level.
+	Logger Logger
+	// LogSampleWindow defines the window in which the repeated warnings of the daemon, like
+	// the failures to check the last ids during a MongoDB outage, are collapsed into a
+	// single line. A value of 0 logs every warning.
+	LogSampleWindow time.Duration
+
+	// handlers tracks the running streams
+	handlers sync.WaitGroup
+	// draining is closed as soon as Shutdown begins, quit once the drain delay is elapsed
+	draining chan struct{}
+	quit     chan struct{}
+	quitOnce sync.Once
+	// handler is the daemon routes wrapped by the middlewares
+	handler     http.Handler
+	middlewares []func(http.Handler) http.Handler
+	// conns lists the running streams with their registration sequence
+	connsMu  sync.Mutex
+	conns    map[*connection]uint64
+	connsSeq uint64
+	// lagStop stops the refresh of the lags once the last stream ended
+	lagStop chan struct{}
+	// head is the time of the most recent operation known by the daemon
+	headMu sync.Mutex
+	head   time.Time
+	// logSampler collapses the repeated warnings
+	logSampler logSampler
+	// authGuard bans the client IPs failing to authenticate
+	authGuard *authGuard
+	// removals is the Authenticator notifying the daemon of its removed users
+	removalsMu sync.Mutex
+	removals   removalNotifier
+	// auditQueue holds the audit events waiting to be recorded by the AuditSink
+	auditQueue chan AuditEvent
+	auditOnce  sync.Once
+	// limiter enforces the per client IP limits
+	limiter *ipLimiter
+	// append appends the operations posted to the ingest endpoint
+	append func(ctx context.Context, ops []*Operation)
+	// health checks the health of the oplog for the status endpoint
+	health func() (Health, error)
+	// hasID checks if a last id is still present in the capped collection
+	hasID func(id LastID) (bool, error)
+	// lastID returns the id of the most recent operation of the oplog
+	lastID func() (LastID, error)
+	// lastIDForFilter returns the id of the most recent operation matching a filter
+	lastIDForFilter func(filter Filter) (LastID, error)
+	// now returns the current time, used to measure the delivery latency
+	now func() time.Time
+	// encoders are the framings of the streams by name, see RegisterEncoder
+	encoders map[string]Encoder
+	// tail starts the oplog tail feeding a stream
+	tail func(lastID LastID, filter Filter, opts TailOptions, out chan<- GenericEvent, stop <-chan bool)
 }
 
 // NewSSEDaemon creates a new HTTP server configured to serve oplog stream over HTTP
 // using Server Sent Event protocol.
+// The daemon statistics are kept in the Stats of ol, reported to its MetricsSink if any.
 func NewSSEDaemon(addr string, ol *OpLog) *SSEDaemon {
 	daemon := &SSEDaemon{
-		ol:                   ol,
-		Password:             "",
-		FlushInterval:        500 * time.Millisecond,
-		HeartbeatTickerCount: 50, // 25 seconds
+		ol:                ol,
+		Password:          "",
+		FlushInterval:     500 * time.Millisecond,
+		KeepaliveInterval: 25 * time.Second,
+		MaxHistory:        1000,
+		RetryAfter:        5 * time.Second,
+		MaxIngestSize:     1 << 20,
+		CORS: CORS{
+			AllowedOrigins: []string{"*"},
+			AllowedHeaders: []string{"Authorization", "Content-Type", "Last-Event-ID"},
+		},
+		MaxLimit:             100000,
+		MaxIdleTimeout:       time.Hour,
+		MaxPollWait:          time.Minute,
+		MaxFilterValues:      DefaultMaxFilterValues,
+		MaxFilterValueLength: DefaultMaxFilterValueLength,
+		ProtectStatus:        true,
+		RedactedVars:         []string{"cmdline"},
+		MaxStatusClients:     100,
+		MaxAuthFailures:      10,
+		AuthFailureWindow:    time.Minute,
+		AuthBanDuration:      5 * time.Minute,
+		ShutdownGoodbye:      true,
+		LagRefreshInterval:   5 * time.Second,
+		LogSampleWindow:      DefaultLogSampleWindow,
+		draining:             make(chan struct{}),
+		quit:                 make(chan struct{}),
+		conns:                map[*connection]uint64{},
+		limiter:              newIPLimiter(),
+		authGuard:            newAuthGuard(authGuardMaxClients),
+		encoders:             map[string]Encoder{"sse": sseEncoder{}, "ndjson": ndjsonEncoder{}},
+		tail:                 ol.tail,
+		append:               ol.AppendBulkContext,
+		health:               ol.Health,
+		hasID:                ol.HasID,
+		lastID:               ol.LastID,
+		lastIDForFilter:      ol.LastIDForFilter,
+		now:                  time.Now,
 	}
+	daemon.handler = http.HandlerFunc(daemon.route)
 	daemon.s = &http.Server{
 		Addr:           addr,
 		Handler:        daemon,
@@ -46,7 +318,7 @@ func NewSSEDaemon(addr string, ol *OpLog) *SSEDaemon {
 	return daemon
 }
 
-// checkPassword checks HTTP basic authentication's password.
+// checkPassword checks HTTP basic authentication's password, given in plaintext or hashed.
 func checkPassword(r *http.Request, password string) bool {
 	if password == "" {
 		return true
@@ -66,210 +338,1157 @@ func checkPassword(r *http.Request, password string) bool {
 		return false
 	}
 
-	return password == pair[1]
+	return passwordMatches(password, pair[1])
 }
 
-func (daemon *SSEDaemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	switch r.URL.Path {
+// routes returns the handlers of the endpoint at path by method, or nil if there is no
+// such endpoint
+func (daemon *SSEDaemon) routes(path string) map[string]http.HandlerFunc {
+	switch path {
 	case "/status":
-		if r.Method == "GET" {
-			daemon.Status(w, r)
-		} else {
-			w.WriteHeader(405)
-			return
+		return map[string]http.HandlerFunc{"GET": daemon.Status, "HEAD": daemon.Status}
+	case "/healthz":
+		return map[string]http.HandlerFunc{"GET": daemon.Healthz}
+	case "/readyz":
+		return map[string]http.HandlerFunc{"GET": daemon.Readyz}
+	case "/metrics":
+		if daemon.EnableMetrics {
+			return map[string]http.HandlerFunc{"GET": daemon.Metrics}
 		}
+	case "/admin/disconnect":
+		return map[string]http.HandlerFunc{"POST": daemon.Disconnect}
+	case "/ops/poll":
+		return map[string]http.HandlerFunc{"GET": daemon.PollOps}
+	case "/ws":
+		return map[string]http.HandlerFunc{"GET": daemon.GetWS}
 	case "/ops", "/":
-		if r.Method == "GET" {
-			daemon.GetOps(w, r)
-		} else if r.Method == "POST" {
-			daemon.PostOps(w, r)
-		} else {
-			w.WriteHeader(405)
-			return
+		return map[string]http.HandlerFunc{"GET": daemon.GetOps, "HEAD": daemon.GetOps, "POST": daemon.PostOps}
+	}
+	return nil
+}
+
+// endpoints lists the paths of the endpoints, the most specific first
+var endpoints = []string{"/ops/poll", "/ops", "/status", "/healthz", "/readyz", "/metrics", "/ws", "/admin/disconnect"}
+
+func (daemon *SSEDaemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	daemon.handler.ServeHTTP(w, r)
+}
+
+// Handler returns the daemon as an http.Handler which can be mounted under any path
+// prefix of another server, with or without http.StripPrefix: requests are routed on the
+// end of their path (i.e.: /internal/oplog/ops is routed to /ops).
+func (daemon *SSEDaemon) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := endpointPath(r.URL.Path)
+		if path != r.URL.Path {
+			u := *r.URL
+			u.Path = path
+			u.RawPath = ""
+			r = r.WithContext(r.Context())
+			r.URL = &u
 		}
-	default:
-		w.WriteHeader(404)
+		daemon.ServeHTTP(w, r)
+	})
+}
+
+// endpointPath returns the path of the endpoint a prefixed path ends with
+func endpointPath(path string) string {
+	for _, endpoint := range endpoints {
+		if strings.HasSuffix(path, endpoint) {
+			return endpoint
+		}
+	}
+	if path == "" || strings.HasSuffix(path, "/") {
+		// The root of the mount point serves the stream
+		return "/"
 	}
+	return path
 }
 
-// Status exposes expvar data
+// route dispatches the request to the handler of the requested endpoint
+func (daemon *SSEDaemon) route(w http.ResponseWriter, r *http.Request) {
+	routes := daemon.routes(r.URL.Path)
+	if routes == nil {
+		writeError(w, 404, "not_found", fmt.Sprintf("%s not found", r.URL.Path))
+		return
+	}
+	if r.URL.Path != "/healthz" && r.URL.Path != "/readyz" && !daemon.checkIP(w, r) {
+		// Health probes are left open to the orchestrator
+		return
+	}
+	methods := []string{"OPTIONS"}
+	for method := range routes {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	if isPreflight(r) {
+		daemon.CORS.preflight(w, r, methods)
+		return
+	}
+	daemon.CORS.writeHeaders(w, r)
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		w.WriteHeader(204)
+		return
+	}
+	handler, found := routes[r.Method]
+	if !found {
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		writeError(w, 405, "method_not_allowed", fmt.Sprintf("method %s not allowed", r.Method))
+		return
+	}
+	if r.Method == "HEAD" {
+		// HEAD requests are handled as GET ones, without body
+		w = headResponseWriter{w}
+	}
+	handler(w, r)
+}
+
+// headResponseWriter discards the body of the response to a HEAD request
+type headResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w headResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w headResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Status exposes the health of the oplog along with expvar data. A 503 is returned when
+// the oplog is not healthy so load balancers stop routing traffic to this instance.
 func (daemon *SSEDaemon) Status(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, "{\"status\":\"OK\"")
+	if daemon.ProtectStatus {
+		if _, ok := daemon.authenticate(w, r, ScopeRead, ScopeAdmin); !ok {
+			return
+		}
+	}
+
+	// The statistics are taken from their snapshot, the other expvars (i.e.: memstats)
+	// from their JSON representation
+	stats := map[string]json.RawMessage{}
+	snapshot, _ := json.Marshal(daemon.ol.Stats.Snapshot())
+	json.Unmarshal(snapshot, &stats)
+	status := map[string]interface{}{}
+	for key, value := range stats {
+		if daemon.redacted(key) {
+			status[key] = "REDACTED"
+		} else {
+			status[key] = value
+		}
+	}
 	expvar.Do(func(kv expvar.KeyValue) {
-		fmt.Fprintf(w, ",%q:%s", kv.Key, kv.Value)
+		if _, found := stats[kv.Key]; found {
+			return
+		}
+		if daemon.redacted(kv.Key) {
+			status[kv.Key] = "REDACTED"
+			return
+		}
+		value := kv.Value.String()
+		if json.Valid([]byte(value)) {
+			status[kv.Key] = json.RawMessage(value)
+		} else {
+			status[kv.Key] = value
+		}
 	})
-	fmt.Fprintf(w, "}")
+
+	health, err := daemon.health()
+	if err != nil {
+		daemon.warnSampled(err, "SSE health check failed: %s", err)
+		status["status"] = "DOWN"
+		status["error"] = err.Error()
+	} else {
+		status["status"] = "OK"
+	}
+	for key, t := range map[string]time.Time{
+		"last_append":      health.LastAppend,
+		"newest_operation": health.NewestOperation,
+		"oldest_operation": health.OldestOperation,
+	} {
+		if !t.IsZero() {
+			status[key] = t
+		}
+	}
+	status["clients"] = daemon.ol.Stats.Clients.Value()
+	// The details of the clients are only shown to admins, or to the readers of the stream
+	// when no admin credential is set
+	statusScope := ScopeAdmin
+	if !daemon.authRequired(ScopeAdmin) {
+		statusScope = ScopeRead
+	}
+	if daemon.MaxStatusClients > 0 && daemon.authorized(r, statusScope) {
+		clients := daemon.Connections()
+		if len(clients) > daemon.MaxStatusClients {
+			clients = clients[:daemon.MaxStatusClients]
+		}
+		status["connected_clients"] = clients
+	}
+	status["replications"] = daemon.ol.Stats.ReplicationsRunning.Value()
+
+	body, _ := json.Marshal(status)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(503)
+	}
+	w.Write(body)
+}
+
+// redacted tells if the expvar key must be masked on the status endpoint
+func (daemon *SSEDaemon) redacted(key string) bool {
+	for _, pattern := range daemon.RedactedVars {
+		if matched, _ := path.Match(pattern, key); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Healthz exposes the liveness probe. It succeeds as long as the daemon is serving
+// requests, whatever the state of MongoDB.
+func (daemon *SSEDaemon) Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"OK"}`))
+}
+
+// Readyz exposes the readiness probe. It fails when the oplog is not healthy or as soon as
+// the daemon is shutting down, so it is removed from the load balancer before its streams
+// are ended.
+func (daemon *SSEDaemon) Readyz(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-daemon.draining:
+		writeError(w, 503, "shutting_down", "the server is shutting down")
+		return
+	default:
+	}
+	if _, err := daemon.health(); err != nil {
+		writeError(w, 503, "backend_unavailable", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"OK"}`))
 }
 
-// PostOps exposes an endpoint to POST operations
+// Metrics exposes the stats in the Prometheus text format
+func (daemon *SSEDaemon) Metrics(w http.ResponseWriter, r *http.Request) {
+	scopes := []string{ScopeAdmin}
+	if daemon.ProtectStatus && !daemon.authRequired(ScopeAdmin) {
+		// Without admin credentials, the metrics are protected like the status
+		scopes = append(scopes, ScopeRead)
+	}
+	if _, ok := daemon.authenticate(w, r, scopes...); !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w, daemon.ol.Stats)
+}
+
+// PostOps exposes an endpoint to POST operations. The body contains either a single
+// operation or an array of operations. If any operation is invalid, none is appended.
 func (daemon *SSEDaemon) PostOps(w http.ResponseWriter, r *http.Request) {
-	if !checkPassword(r, daemon.IngestPassword) {
-		w.WriteHeader(401)
+	ctx, span := daemon.ol.startSpan(daemon.ol.requestContext(r), "oplog.post_ops")
+	defer span.End()
+	if _, ok := daemon.authenticate(w, r, ScopeWrite); !ok {
 		return
 	}
 
-	if r.Header.Get("Content-Type") != "application/json" {
-		w.WriteHeader(415)
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		writeError(w, 415, "unsupported_media_type", "operations must be sent as application/json")
 		return
 	}
 
 	h := w.Header()
 	h.Set("Server", fmt.Sprintf("oplog/%s", Version))
 	h.Set("Cache-Control", "no-cache, no-store, must-revalidate")
-	h.Set("Access-Control-Allow-Origin", "*")
 
-	body, err := ioutil.ReadAll(r.Body)
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, daemon.MaxIngestSize+1))
 	if err != nil {
-		log.Warnf("HTTP ingest error reading Body: %s", err)
+		daemon.logger().Warnf("HTTP ingest error reading Body: %s", err)
 		daemon.ol.Stats.EventsError.Add(1)
-		w.WriteHeader(503)
+		writeError(w, 503, "backend_unavailable", "can't read the request body")
+		return
+	}
+	if int64(len(body)) > daemon.MaxIngestSize {
+		daemon.logger().Warnf("HTTP ingest body too large")
+		daemon.ol.Stats.EventsError.Add(1)
+		writeError(w, 413, "body_too_large", fmt.Sprintf("body must not exceed %d bytes", daemon.MaxIngestSize))
 		return
 	}
 
-	op, err := decodeOperation(body)
+	ops, errs, err := decodeOperations(body)
 	if err != nil {
-		log.Warnf("HTTP ingest invalid operation received: %s", err)
+		daemon.logger().Warnf("HTTP ingest invalid body received: %s", err)
 		daemon.ol.Stats.EventsError.Add(1)
-		w.WriteHeader(503)
+		writeError(w, 400, "invalid_body", fmt.Sprintf("invalid body: %s", err))
+		return
+	}
+	if len(errs) == 0 {
+		// The operations are in the order of the batch when all decoded
+		for i, op := range ops {
+			if err := daemon.ol.validate(op); err != nil {
+				errs[i] = err
+			}
+		}
+	}
+	if len(errs) > 0 {
+		daemon.logger().Warnf("HTTP ingest %d invalid operations received", len(errs))
+		daemon.ol.Stats.EventsError.Add(int64(len(errs)))
+		writeItemErrors(w, errs)
 		return
 	}
 
-	daemon.ol.Append(op)
-	daemon.ol.Stats.EventsReceived.Add(1)
-	w.WriteHeader(204)
+	ids := make([]string, 0, len(ops))
+	for _, op := range ops {
+		// Assign the ids here so they can be returned to the producer
+		id := bson.NewObjectId()
+		op.ID = &id
+		ids = append(ids, id.Hex())
+	}
+	span.SetAttribute("oplog.operations", len(ops))
+	daemon.append(ctx, ops)
+	daemon.ol.Stats.EventsReceived.Add(int64(len(ops)))
+
+	res, _ := json.Marshal(map[string][]string{"ids": ids})
+	h.Set("Content-Type", "application/json")
+	w.WriteHeader(201)
+	w.Write(res)
 }
 
 // GetOps exposes an SSE endpoint to stream operations
 func (daemon *SSEDaemon) GetOps(w http.ResponseWriter, r *http.Request) {
+	daemon.handlers.Add(1)
+	defer daemon.handlers.Done()
+
 	ip := xff.GetRemoteAddr(r)
-	log.Infof("SSE[%s] connection started", ip)
+	daemon.logger().Infof("SSE[%s] connection started", ip)
 
-	if r.Header.Get("Accept") != "text/event-stream" {
-		// Not an event stream request, return a 406 Not Acceptable HTTP error
-		w.WriteHeader(406)
+	// The connection is summarized in the access log once ended
+	conn := newConnection(ip, r)
+	_, span := daemon.ol.startSpan(daemon.ol.requestContext(r), "oplog.stream")
+	reason := ""
+	// mode is set once the stream started tailing the oplog
+	mode := ""
+	defer func() {
+		conn.update(func(info *ConnectionInfo) {
+			if reason == "" && info.Status >= 400 {
+				reason = "rejected"
+			}
+			if reason == "" {
+				reason = "other"
+			}
+			info.EndReason = reason
+		})
+		daemon.ol.Stats.StreamsEnded.Add(reason, 1)
+		conn.logEnd("SSE")
+		if mode != "" {
+			daemon.auditStream(AuditStreamEnd, conn.snapshot(), mode, reason)
+		}
+		traceConnection(span, conn.snapshot(), mode)
+		span.End()
+	}()
+	rw := w
+	w = &countingResponseWriter{w, conn, daemon.ol.Stats}
+
+	leave, ok := daemon.admit(w, r)
+	if !ok {
+		return
+	}
+	defer leave()
+
+	enc, serr := daemon.encoder(r)
+	if serr != nil {
+		// No encoder for the Accept header or the format, return a 406 Not Acceptable
+		// or a 400 Bad Request HTTP error
+		writeError(w, serr.status, serr.code, serr.message)
+		return
+	}
+
+	r = daemon.queryToken(w, r)
+	r, ok = daemon.authenticate(w, r, ScopeRead)
+	if !ok {
+		conn.update(func(info *ConnectionInfo) { info.Auth = "failed" })
 		return
 	}
+	if principal, found := PrincipalFromContext(r.Context()); found {
+		conn.update(func(info *ConnectionInfo) {
+			info.Auth = "ok"
+			info.User = principal.Name
+		})
+	}
 
-	if !checkPassword(r, daemon.Password) {
-		w.WriteHeader(401)
+	if _, ok := rw.(http.Flusher); !ok {
+		// Most likely a middleware wrapping the response writer without forwarding flushes
+		daemon.logger().Errorf("SSE[%s] response writer %T doesn't implement http.Flusher, check the middlewares", ip, rw)
+		writeError(w, 500, "streaming_not_supported", "streaming not supported")
 		return
 	}
+	flusher := w.(http.Flusher)
 
 	h := w.Header()
 	h.Set("Server", fmt.Sprintf("oplog/%s", Version))
-	h.Set("Content-Type", "text/event-stream; charset=utf-8")
+	h.Set("Content-Type", enc.ContentType())
 	h.Set("Cache-Control", "no-cache, no-store, must-revalidate")
 	h.Set("Connection", "close")
-	h.Set("Access-Control-Allow-Origin", "*")
 
-	var lastID LastID
+	// The last event id can also be given in the query-string for clients which can't
+	// set the header, the header takes precedence
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("since_id")
+	}
+
+	opts := TailOptions{}
 	var err error
-	if r.Header.Get("Last-Event-ID") == "" {
-		// No last id provided, use the very last id of the events collection
-		lastID, err = daemon.ol.LastID()
-		if err != nil {
-			log.Warnf("SSE[%s] can't get last id: %s", ip, err)
-			w.WriteHeader(503)
+	if opts.Since, err = parseTime(r.URL.Query().Get("since"), daemon.now()); err != nil {
+		daemon.logger().Warnf("SSE[%s] invalid since: %s", ip, err)
+		writeError(w, 400, "invalid_parameter", fmt.Sprintf("invalid since: %s", err))
+		return
+	}
+	if opts.Until, err = parseTime(r.URL.Query().Get("until"), daemon.now()); err != nil {
+		daemon.logger().Warnf("SSE[%s] invalid until: %s", ip, err)
+		writeError(w, 400, "invalid_parameter", fmt.Sprintf("invalid until: %s", err))
+		return
+	}
+	if !opts.Since.IsZero() && opts.reached(opts.Since) {
+		daemon.logger().Warnf("SSE[%s] until is before since", ip)
+		writeError(w, 400, "invalid_parameter", "until must be after since")
+		return
+	}
+
+	if checkpoint := r.URL.Query().Get("checkpoint"); checkpoint != "" {
+		seconds, err := strconv.Atoi(checkpoint)
+		if err != nil || seconds < 1 {
+			daemon.logger().Warnf("SSE[%s] invalid checkpoint interval: %s", ip, checkpoint)
+			writeError(w, 400, "invalid_parameter", fmt.Sprintf("invalid checkpoint interval: %s", checkpoint))
 			return
 		}
-	} else {
-		if lastID, err = NewLastID(r.Header.Get("Last-Event-ID")); err != nil {
-			log.Warnf("SSE[%s] invalid last id: %s", ip, err)
-			w.WriteHeader(400)
+		opts.CheckpointInterval = time.Duration(seconds) * time.Second
+	}
+
+	if history := r.URL.Query().Get("history"); history != "" {
+		if opts.History, err = strconv.Atoi(history); err != nil || opts.History < 0 {
+			daemon.logger().Warnf("SSE[%s] invalid history: %s", ip, history)
+			writeError(w, 400, "invalid_parameter", fmt.Sprintf("invalid history: %s", history))
 			return
 		}
-		found, err := daemon.ol.HasID(lastID)
-		if err != nil {
-			log.Warnf("SSE[%s] can't check last id: %s", ip, err)
-			w.WriteHeader(503)
+		if lastEventID != "" || !opts.Since.IsZero() {
+			daemon.logger().Warnf("SSE[%s] history can't be used with a last id or since", ip)
+			writeError(w, 400, "invalid_parameter", "history can't be used with a last event id or since")
 			return
 		}
-		if !found {
-			log.Debugf("SSE[%s] last id not found, falling back to replication id: %s", ip, lastID.String())
-			// If the requested event id is not found, fallback to a replication id
-			olid := lastID.(*OperationLastID)
-			lastID = olid.Fallback()
+		if opts.History > daemon.MaxHistory {
+			opts.History = daemon.MaxHistory
+		}
+	}
+
+	switch r.URL.Query().Get("resume") {
+	case "", "exclusive":
+	case "inclusive":
+		opts.InclusiveResume = true
+	default:
+		daemon.logger().Warnf("SSE[%s] invalid resume mode: %s", ip, r.URL.Query().Get("resume"))
+		writeError(w, 400, "invalid_parameter", fmt.Sprintf("invalid resume mode: %s", r.URL.Query().Get("resume")))
+		return
+	}
+
+	// The stream can be ended after a number of events or after some time without events
+	limit := 0
+	if l := r.URL.Query().Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > daemon.MaxLimit {
+			daemon.logger().Warnf("SSE[%s] invalid limit: %s", ip, l)
+			writeError(w, 400, "invalid_parameter", fmt.Sprintf("invalid limit: %s, must be between 1 and %d", l, daemon.MaxLimit))
+			return
+		}
+	}
+	var idleTimeout time.Duration
+	if it := r.URL.Query().Get("idle_timeout"); it != "" {
+		seconds, err := strconv.Atoi(it)
+		idleTimeout = time.Duration(seconds) * time.Second
+		if err != nil || seconds < 1 || idleTimeout > daemon.MaxIdleTimeout {
+			daemon.logger().Warnf("SSE[%s] invalid idle timeout: %s", ip, it)
+			writeError(w, 400, "invalid_parameter", fmt.Sprintf("invalid idle timeout: %s, must be between 1 and %d seconds", it, daemon.MaxIdleTimeout/time.Second))
+			return
+		}
+	}
+
+	// Clients can ask for an error instead of an automatic fallback replication when their
+	// last id is no longer in the oplog
+	explicitFallback := r.Header.Get("X-Oplog-No-Fallback") == "1"
+	switch fallback := r.URL.Query().Get("fallback"); fallback {
+	case "", "auto":
+	case "explicit":
+		explicitFallback = true
+	default:
+		daemon.logger().Warnf("SSE[%s] invalid fallback mode: %s", ip, fallback)
+		writeError(w, 400, "invalid_parameter", fmt.Sprintf("invalid fallback mode: %s", fallback))
+		return
+	}
+
+	// The payloads of the objects are only sent on demand, not to break the parsers of
+	// the existing clients
+	includePayload := false
+	switch include := r.URL.Query().Get("include"); include {
+	case "":
+	case "payload":
+		includePayload = true
+	default:
+		daemon.logger().Warnf("SSE[%s] invalid include: %s", ip, include)
+		writeError(w, 400, "invalid_parameter", fmt.Sprintf("invalid include: %s", include))
+		return
+	}
+
+	var maxRate int64
+	if mr := r.URL.Query().Get("max_rate"); mr != "" {
+		if maxRate, err = strconv.ParseInt(mr, 10, 64); err != nil || maxRate < 1 {
+			daemon.logger().Warnf("SSE[%s] invalid max rate: %s", ip, mr)
+			writeError(w, 400, "invalid_parameter", fmt.Sprintf("invalid max rate: %s", mr))
+			return
+		}
+	}
+
+	filter, err := daemon.parseFilter(r)
+	if err != nil {
+		daemon.logger().Warnf("SSE[%s] invalid filter: %s", ip, err)
+		writeError(w, 400, "invalid_filter", err.Error())
+		return
+	}
+	if filter, ok = daemon.enforcePolicy(w, r, "SSE", ip, filter); !ok {
+		return
+	}
+
+	conn.update(func(info *ConnectionInfo) {
+		info.LastEventID = lastEventID
+		info.Filter = filter
+	})
+
+	lastID, startID, serr := daemon.resolveLastID(ip, lastEventID, filter, opts.Since)
+	if serr != nil {
+		if serr.status == 503 {
+			reason = "backend_error"
 		}
+		writeError(w, serr.status, serr.code, serr.message)
+		return
+	}
+	if lastEventID != "" {
 		// Backward compat, remove when all oplogc will be updated
-		h.Set("Last-Event-ID", r.Header.Get("Last-Event-ID"))
+		h.Set("Last-Event-ID", lastEventID)
+	}
+	if startID != lastID && explicitFallback {
+		daemon.logger().Warnf("SSE[%s] last id evicted from the capped collection", ip)
+		reason = "evicted"
+		daemon.writeEvicted(w, "last_id_evicted", "last event id is no longer in the oplog, replicate from fallback_id", startID)
+		return
+	}
+	h.Set("X-Oplog-Mode", streamMode(lastID, startID))
+	if r.Method == "HEAD" {
+		// Probes only check the stream can be started, no tail is started
+		reason = "head"
+		w.WriteHeader(200)
+		return
 	}
 
 	if lastID != nil {
-		log.Debugf("SSE[%s] using last id: %s", ip, lastID.String())
+		daemon.logger().Debugf("SSE[%s] using last id: %s", ip, lastID.String())
 	}
 
-	types := []string{}
-	if r.URL.Query().Get("types") != "" {
-		types = strings.Split(r.URL.Query().Get("types"), ",")
+	release, ok := daemon.ol.reserveTail(startID)
+	if !ok {
+		daemon.logger().Warnf("SSE[%s] too many concurrent tails", ip)
+		reason = "overloaded"
+		daemon.overloaded(w)
+		return
 	}
-	parents := []string{}
-	if r.URL.Query().Get("parents") != "" {
-		parents = strings.Split(r.URL.Query().Get("parents"), ",")
+	defer release()
+	mode = streamMode(lastID, startID)
+	conn.update(func(info *ConnectionInfo) { info.Mode = mode })
+	daemon.auditStream(AuditStreamStart, conn.snapshot(), mode, "")
+
+	// The throttling applies to the bytes sent on the wire, after compression
+	var bucket *tokenBucket
+	if rate := daemon.bandwidth(r, maxRate); rate > 0 {
+		daemon.logger().Debugf("SSE[%s] throttled to %d bytes/s", ip, rate)
+		conn.update(func(info *ConnectionInfo) { info.Bandwidth = rate })
+		bucket = newTokenBucket(rate, time.Now)
+		tw := &throttledResponseWriter{w, bucket, daemon.ol.Stats}
+		w = tw
+		flusher = tw
 	}
-	filter := Filter{
-		Types:   types,
-		Parents: parents,
+
+	if r.URL.Query().Get("compress") != "off" && acceptsGzip(r) {
+		// Compressed streams are flushed along with the response so events are still
+		// delivered right away
+		h.Set("Content-Encoding", "gzip")
+		h.Add("Vary", "Accept-Encoding")
+		gw := newGzipResponseWriter(w, flusher)
+		defer gw.Close()
+		w = &uncompressedCounter{gw, conn}
+		flusher = gw
+	}
+
+	var hello *Hello
+	if daemon.Hello {
+		hello = &Hello{Mode: streamMode(lastID, startID)}
+		if daemon.HelloFilter {
+			hello.Filter = &filter
+		}
+		if newest, err := daemon.lastID(); err != nil {
+			daemon.warnSampled(err, "SSE[%s] can't get the newest operation: %s", ip, err)
+		} else if newest != nil {
+			hello.NewestID = newest.String()
+			hello.NewestTime = newest.Time()
+		}
+		if daemon.HelloFilteredHead {
+			if head, err := daemon.lastIDForFilter(filter); err != nil {
+				daemon.warnSampled(err, "SSE[%s] can't get the newest operation matching the filter: %s", ip, err)
+			} else if head != nil {
+				hello.FilteredNewestID = head.String()
+				hello.FilteredNewestTime = head.Time()
+			}
+		}
 	}
 
-	flusher := w.(http.Flusher)
-	notifier := w.(http.CloseNotifier)
 	ops := make(chan GenericEvent)
 	stop := make(chan bool)
-	flusher.Flush()
+	written := false
+	start := func() {
+		if written {
+			return
+		}
+		written = true
+		if _, sse := enc.(sseEncoder); sse && daemon.ReconnectDelay > 0 {
+			writeRetry(w, daemon.ReconnectDelay)
+		}
+		if hello != nil {
+			hello.Time = time.Now()
+			enc.Encode(hello, w)
+		}
+	}
+	// When the replication may be queued, the response is held until the first event so
+	// a timeout can still be answered with a 503
+	_, queued := startID.(*ReplicationLastID)
+	queued = queued && daemon.ol.MaxConcurrentReplications > 0
+	if !queued {
+		start()
+		flusher.Flush()
+	}
 
-	go daemon.ol.Tail(lastID, filter, ops, stop)
+	go daemon.tail(lastID, filter, opts, ops, stop)
 	defer func() {
 		// Stop the oplog tailer
 		stop <- true
 	}()
 
+	events := (<-chan GenericEvent)(ops)
+	var buf *clientBuffer
+	var overflow <-chan struct{}
+	if daemon.ClientBufferSize > 0 {
+		buf = newClientBuffer(daemon.ClientBufferSize, daemon.ol.Stats)
+		done := make(chan struct{})
+		go buf.relay(ops, done)
+		defer buf.close(done)
+		events = buf.events
+		overflow = buf.overflow
+	}
+
+	fingerprint := ""
+	if daemon.FilterFingerprint {
+		fingerprint = filter.Fingerprint()
+	}
+
 	daemon.ol.Stats.Clients.Add(1)
 	daemon.ol.Stats.Connections.Add(1)
 	defer daemon.ol.Stats.Clients.Add(-1)
+	daemon.register(conn)
+	defer daemon.unregister(conn)
 
 	// Messages are buffered and flushed every daemon.FlushInterval to save I/Os
 	ticker := time.NewTicker(daemon.FlushInterval)
 	defer ticker.Stop()
-	var empty int8
+	pending := false
+
+	var keepaliveC <-chan time.Time
+	var keepalive *time.Timer
+	keepaliveInterval := daemon.keepaliveInterval()
+	if keepaliveInterval > 0 {
+		keepalive = time.NewTimer(keepaliveInterval)
+		defer keepalive.Stop()
+		keepaliveC = keepalive.C
+	}
+	var maxDurationC <-chan time.Time
+	if daemon.MaxConnectionDuration > 0 {
+		maxDuration := time.NewTimer(daemon.MaxConnectionDuration)
+		defer maxDuration.Stop()
+		maxDurationC = maxDuration.C
+	}
+	var idleC <-chan time.Time
+	var idle *time.Timer
+	if idleTimeout > 0 {
+		idle = time.NewTimer(idleTimeout)
+		defer idle.Stop()
+		idleC = idle.C
+	}
+
+	// end ends the stream with an "end" event carrying the id of the last sent event, so
+	// the client can tell a deliberate close from a network drop
+	sentID := ""
+	if lastID != nil {
+		sentID = lastID.String()
+	}
+	sentEvents := 0
+	end := func() {
+		start()
+		enc.Encode(daemon.wrapEvent(&Event{ID: sentID, Event: "end"}, fingerprint), w)
+		flusher.Flush()
+	}
+
+	// While the throttled stream is in debt, no event is read so the other cases are
+	// still handled on time
+	var throttledSince time.Time
+	defer func() {
+		if !throttledSince.IsZero() {
+			daemon.throttled(conn, time.Since(throttledSince))
+		}
+	}()
 
 	for {
+		in := events
+		var throttleC <-chan time.Time
+		if bucket != nil {
+			if d := bucket.delay(); d > 0 {
+				if throttledSince.IsZero() {
+					throttledSince = time.Now()
+				}
+				in = nil
+				throttleC = time.After(d)
+			} else if !throttledSince.IsZero() {
+				daemon.throttled(conn, time.Since(throttledSince))
+				throttledSince = time.Time{}
+			}
+		}
+
 		select {
-		case <-notifier.CloseNotify():
-			log.Infof("SSE[%s] connection closed", ip)
+		case <-throttleC:
+			continue
+
+		case <-r.Context().Done():
+			daemon.logger().Infof("SSE[%s] connection closed", ip)
+			reason = "client_closed"
+			return
+
+		case <-daemon.quit:
+			daemon.logger().Infof("SSE[%s] server shutting down, closing connection", ip)
+			reason = "shutdown"
+			if daemon.ShutdownGoodbye {
+				enc.Encode(notice{"goodbye", "shutdown"}, w)
+			}
+			flusher.Flush()
+			return
+
+		case <-conn.revoked:
+			daemon.logger().Warnf("SSE[%s] connection revoked", ip)
+			reason = "revoked"
+			enc.Encode(notice{"error", "revoked"}, w)
+			flusher.Flush()
+			return
+
+		case <-overflow:
+			reason = "slow_consumer"
+			if daemon.SlowConsumerPolicy == SlowConsumerDisconnect {
+				daemon.logger().Warnf("SSE[%s] client too slow, disconnecting", ip)
+				enc.Encode(notice{"error", "too slow"}, w)
+			} else {
+				// Dropping the buffered events, the client will resume from its last received id
+				daemon.logger().Warnf("SSE[%s] client too slow, closing for resume", ip)
+			}
+			flusher.Flush()
 			return
 
-		case op := <-ops:
-			log.Debugf("SSE[%s] sending event", ip)
-			daemon.ol.Stats.EventsSent.Add(1)
-			if _, err := op.WriteTo(w); err != nil {
-				log.Warnf("SSE[%s] write error: %s", ip, err)
+		case op := <-in:
+			if buf != nil {
+				buf.taken()
+			}
+			e, _ := op.(*Event)
+			if e != nil && e.Event == "retry-later" && !written {
+				daemon.logger().Warnf("SSE[%s] replication timed out waiting for a slot", ip)
+				reason = "overloaded"
+				daemon.overloaded(w)
+				return
+			}
+			start()
+			daemon.logger().Debugf("SSE[%s] sending event", ip)
+			switch op.(type) {
+			case *Checkpoint:
+				daemon.ol.Stats.CheckpointsSent.Add(1)
+			case *Queued:
+				// Replication queue feedback only
+			default:
+				daemon.ol.Stats.EventsSent.Add(1)
+				daemon.countSent(op)
+			}
+			ev := op
+			if includePayload {
+				ev = withPayload{op}
+			}
+			if err := enc.Encode(daemon.wrapEvent(ev, fingerprint), w); err != nil {
+				daemon.logger().Warnf("SSE[%s] write error: %s", ip, err)
+				reason = "write_error"
 				return
 			}
-			empty = -1
+			daemon.observeDelivery(op)
+			if _, sse := enc.(sseEncoder); sse && e != nil && e.Event == "retry-later" && daemon.ReconnectDelay > 0 {
+				// Ask the client to wait longer before reconnecting
+				writeRetry(w, daemon.RetryAfter)
+			}
+			if e != nil && (e.Event == "end" || e.Event == "retry-later") {
+				// The until bound has been reached or the replication timed out, end the stream
+				daemon.logger().Infof("SSE[%s] end of stream reached", ip)
+				reason = "end_of_stream"
+				flusher.Flush()
+				return
+			}
+			pending = true
+			if keepalive != nil {
+				resetTimer(keepalive, keepaliveInterval)
+			}
+			if id := op.GetEventID().String(); id != "" {
+				sentID = id
+			}
+			switch op.(type) {
+			case *Event, *Checkpoint, *Queued, *Fallback, *Warning:
+				// Technical events don't count as streamed events
+				conn.sent(sentID, false)
+			default:
+				sentEvents++
+				conn.sent(sentID, true)
+				conn.delivered(op, daemon.observeHead(time.Time{}))
+				if limit > 0 && sentEvents >= limit {
+					daemon.logger().Infof("SSE[%s] limit of %d events reached", ip, limit)
+					reason = "limit_reached"
+					end()
+					return
+				}
+				if idle != nil {
+					resetTimer(idle, idleTimeout)
+				}
+			}
 
 		case <-ticker.C:
-			// Flush the buffer at regular interval
-			if empty >= 0 {
-				// Skip if buffer has no data, if empty for too long, send a heartbeat
-				if empty >= daemon.HeartbeatTickerCount {
-					if _, err := w.Write([]byte{':', '\n'}); err != nil {
-						log.Warnf("SSE[%s] write error: %s", ip, err)
-						return
-					}
-				} else {
-					empty++
-					continue
-				}
+			// Flush the buffer at regular interval, skip if buffer has no data
+			if !pending {
+				continue
 			}
-			empty = 0
-			log.Debugf("SSE[%s] flushing buffer", ip)
+			pending = false
+			daemon.logger().Debugf("SSE[%s] flushing buffer", ip)
 			flusher.Flush()
+
+		case <-keepaliveC:
+			// Nothing sent for too long, send an heartbeat
+			if err := enc.Encode(heartbeat{}, w); err != nil {
+				daemon.logger().Warnf("SSE[%s] write error: %s", ip, err)
+				reason = "write_error"
+				return
+			}
+			flusher.Flush()
+			pending = false
+			keepalive.Reset(keepaliveInterval)
+
+		case <-idleC:
+			daemon.logger().Infof("SSE[%s] idle timeout reached, closing connection", ip)
+			reason = "idle_timeout"
+			end()
+			return
+
+		case <-maxDurationC:
+			daemon.logger().Infof("SSE[%s] max connection duration reached, closing connection", ip)
+			reason = "max_duration"
+			flusher.Flush()
+			return
+		}
+	}
+}
+
+// streamError describes an error refusing a stream
+type streamError struct {
+	status  int
+	code    string
+	message string
+}
+
+// parseFilter parses the filter query-string parameters of r with the limits of the
+// daemon, normalizing the types as the oplog does, and applies the requested preset
+func (daemon *SSEDaemon) parseFilter(r *http.Request) (Filter, error) {
+	filter, err := parseFilter(r.URL.Query(), daemon.MaxFilterValues, daemon.MaxFilterValueLength, daemon.FilterableFields)
+	if err != nil {
+		return filter, err
+	}
+	if daemon.ol.NormalizeTypes {
+		filter = filter.normalized(daemon.ol.NormalizeParentTypes)
+	}
+	return daemon.applyPreset(r, filter)
+}
+
+// streamMode tells how a stream starts: "live" when following the oplog from an operation
+// or from its start, "replication" when replicating from a timestamp, or "fallback" when
+// the requested operation is no longer in the oplog and a replication is started instead
+func streamMode(lastID, startID LastID) string {
+	if startID != lastID {
+		return "fallback"
+	}
+	if _, replication := lastID.(*ReplicationLastID); replication {
+		return "replication"
+	}
+	return "live"
+}
+
+// resolveLastID parses the last event id sent by a client and returns the id the stream
+// must be resumed from. The startID is the id the stream actually starts from, which
+// differs from lastID when a fallback replication is required.
+func (daemon *SSEDaemon) resolveLastID(ip, lastEventID string, filter Filter, since time.Time) (lastID, startID LastID, serr *streamError) {
+	id, ok := daemon.verifyLastID(lastEventID)
+	if !ok {
+		daemon.ol.Stats.UnsignedIDs.Add(1)
+		if daemon.UnsignedIDPolicy != UnsignedIDIgnore {
+			daemon.logger().Warnf("SSE[%s] last id without a valid signature: %s", ip, lastEventID)
+			return nil, nil, &streamError{400, "invalid_last_id", fmt.Sprintf("last event id not signed by this server: %s", lastEventID)}
 		}
+		daemon.logger().Warnf("SSE[%s] last id without a valid signature, ignored: %s", ip, lastEventID)
 	}
+	lastEventID = id
+
+	var err error
+	if lastEventID == "" {
+		if since.IsZero() {
+			// No last id nor since provided, use the very last id of the events collection
+			lastID, err = daemon.lastID()
+			if err != nil {
+				daemon.warnSampled(err, "SSE[%s] can't get last id: %s", ip, err)
+				return nil, nil, &streamError{503, "backend_unavailable", "can't get the last event id"}
+			}
+		}
+	} else {
+		id, fingerprint := splitFingerprint(lastEventID)
+		if lastID, err = newLastID(id, daemon.now()); err != nil {
+			daemon.logger().Warnf("SSE[%s] invalid last id: %s", ip, err)
+			message := fmt.Sprintf("invalid last event id: %s", lastEventID)
+			if err != errInvalidLastID {
+				message = fmt.Sprintf("invalid last event id: %s", err)
+			}
+			return nil, nil, &streamError{400, "invalid_last_id", message}
+		}
+		if fingerprint != "" && fingerprint != filter.Fingerprint() {
+			daemon.ol.Stats.FilterMismatches.Add(1)
+			switch daemon.FilterChangePolicy {
+			case FilterChangeReject:
+				daemon.logger().Warnf("SSE[%s] filter changed since last id, refusing", ip)
+				return nil, nil, &streamError{409, "filter_changed", "filter changed since last event id"}
+			case FilterChangeResync:
+				daemon.logger().Warnf("SSE[%s] filter changed since last id, starting a full replication", ip)
+				lastID = &ReplicationLastID{0, false, ""}
+			default:
+				daemon.logger().Warnf("SSE[%s] filter changed since last id, resuming with the new filter", ip)
+			}
+		}
+		found, err := daemon.hasID(lastID)
+		if err != nil {
+			daemon.warnSampled(err, "SSE[%s] can't check last id: %s", ip, err)
+			return nil, nil, &streamError{503, "backend_unavailable", "can't check the last event id"}
+		}
+		if !found {
+			daemon.logger().Debugf("SSE[%s] last id not found, falling back to replication id: %s", ip, lastID.String())
+			// If the requested event id is not found, the tail falls back to a replication
+			// id and notifies the client with a "fallback" event
+			startID = daemon.ol.fallbackID(lastID.(*OperationLastID))
+		}
+	}
+	if startID == nil {
+		startID = lastID
+	}
+	return lastID, startID, nil
+}
+
+// errorBody returns the JSON body describing an error
+func errorBody(code, message string) []byte {
+	body, _ := json.Marshal(map[string]interface{}{
+		"error": map[string]string{
+			"code":    code,
+			"message": message,
+		},
+	})
+	return body
+}
+
+// itemError describes why an operation of an ingested batch is invalid
+type itemError struct {
+	Index   int    `json:"index"`
+	Message string `json:"message"`
+}
+
+// writeItemErrors answers an invalid_operation error listing the invalid operations of an
+// ingested batch, ordered by index.
+func writeItemErrors(w http.ResponseWriter, errs map[int]error) {
+	indexes := make([]int, 0, len(errs))
+	for i := range errs {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	items := make([]itemError, 0, len(errs))
+	for _, i := range indexes {
+		items = append(items, itemError{i, errs[i].Error()})
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"error": map[string]string{
+			"code":    "invalid_operation",
+			"message": "some operations are invalid, none has been appended",
+		},
+		"items": items,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(422)
+	w.Write(body)
+}
+
+// writeError answers an error with a JSON body describing it. All the non stream errors
+// must be answered thru this function so clients get consistent errors.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(errorBody(code, message))
+}
+
+// overloaded answers a 503 error asking the client to retry later. When a reconnect
+// delay is configured, the error is sent as an SSE "error" event preceded by a retry
+// directive with the overload delay.
+func (daemon *SSEDaemon) overloaded(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(daemon.RetryAfter/time.Second)))
+	const message = "too many clients, retry later"
+	if daemon.ReconnectDelay <= 0 {
+		writeError(w, 503, "too_many_clients", message)
+		return
+	}
+	w.WriteHeader(503)
+	writeRetry(w, daemon.RetryAfter)
+	fmt.Fprintf(w, "event: error\ndata: %s\n\n", errorBody("too_many_clients", message))
+}
+
+// writeEvicted answers a 410 error to a client whose last id is no longer in the oplog,
+// suggesting the id to replicate from along with the time of the oldest operation
+func (daemon *SSEDaemon) writeEvicted(w http.ResponseWriter, code, message string, fallbackID LastID) {
+	body := map[string]interface{}{
+		"error": map[string]string{
+			"code":    code,
+			"message": message,
+		},
+		"fallback_id": daemon.eventID(fallbackID.String(), ""),
+	}
+	if health, err := daemon.health(); err == nil && !health.OldestOperation.IsZero() {
+		body["oldest_operation"] = health.OldestOperation
+	}
+	b, _ := json.Marshal(body)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(410)
+	w.Write(b)
+}
+
+// writeRetry writes a SSE retry directive with the given reconnection delay
+func writeRetry(w io.Writer, delay time.Duration) error {
+	_, err := fmt.Fprintf(w, "retry: %d\n\n", delay/time.Millisecond)
+	return err
+}
+
+// resetTimer resets a running or expired timer to fire after d
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+// keepaliveInterval returns KeepaliveInterval, or the interval given by the deprecated
+// HeartbeatTickerCount when set
+func (daemon *SSEDaemon) keepaliveInterval() time.Duration {
+	if daemon.HeartbeatTickerCount > 0 {
+		return time.Duration(daemon.HeartbeatTickerCount) * daemon.FlushInterval
+	}
+	return daemon.KeepaliveInterval
 }
 
 // Run starts the SSE server
 func (daemon *SSEDaemon) Run() error {
-	return daemon.s.ListenAndServe()
+	return serverClosed(daemon.server().ListenAndServe())
+}
+
+// RunTLS runs the daemon serving HTTPS with the given certificate and key files.
+func (daemon *SSEDaemon) RunTLS(certFile, keyFile string) error {
+	return serverClosed(daemon.server().ListenAndServeTLS(certFile, keyFile))
+}
+
+// Serve runs the daemon on the given listener, i.e.: a unix socket, a listener inherited
+// from the process manager or a TLS listener.
+func (daemon *SSEDaemon) Serve(l net.Listener) error {
+	return serverClosed(daemon.server().Serve(l))
+}
+
+// server returns the HTTP server configured with the daemon settings
+func (daemon *SSEDaemon) server() *http.Server {
+	daemon.s.ReadHeaderTimeout = daemon.ReadHeaderTimeout
+	daemon.s.IdleTimeout = daemon.IdleTimeout
+	daemon.s.TLSConfig = daemon.TLSConfig
+	// Streams are long lived, the write timeout must stay disabled
+	daemon.s.WriteTimeout = 0
+	return daemon.s
+}
+
+// serverClosed ignores the error returned by the HTTP server once shutdown
+func serverClosed(err error) error {
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Shutdown gracefully stops the daemon. The readiness probe fails right away and, once
+// DrainDelay is elapsed, the listener is closed and the running streams are ended after
+// their current event, with a final "goodbye" event if ShutdownGoodbye is set. Shutdown
+// waits for the streams to end until ctx is done, in which case the remaining connections
+// are closed and the ctx error is returned.
+func (daemon *SSEDaemon) Shutdown(ctx context.Context) error {
+	daemon.quitOnce.Do(func() {
+		close(daemon.draining)
+		if daemon.DrainDelay > 0 {
+			daemon.logger().Infof("SSE draining for %s", daemon.DrainDelay)
+			select {
+			case <-time.After(daemon.DrainDelay):
+			case <-ctx.Done():
+			}
+		}
+		close(daemon.quit)
+	})
+	err := daemon.s.Shutdown(ctx)
+	if err == nil {
+		done := make(chan struct{})
+		go func() {
+			daemon.handlers.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	if err != nil {
+		daemon.logger().Warnf("SSE forcing shutdown: %s", err)
+		daemon.s.Close()
+	}
+	return err
 }
@@ -0,0 +1,1249 @@
+package oplog
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// newTestSSEDaemon starts a daemon on a free local port, with tails sending a single
+// operation.
+func newTestSSEDaemon(t *testing.T) (*SSEDaemon, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	daemon := newTestSSEDaemonHandler(l.Addr().String())
+	go daemon.Serve(l)
+	return daemon, l.Addr().String()
+}
+
+// newTestSSEDaemonHandler creates a daemon with tails sending a single operation
+func newTestSSEDaemonHandler(addr string) *SSEDaemon {
+	daemon := NewSSEDaemon(addr, newTestOpLog())
+	// The lags are refreshed against the last id of MongoDB, see TestLagRefresh
+	daemon.LagRefreshInterval = 0
+	daemon.tail = func(lastID LastID, filter Filter, opts TailOptions, out chan<- GenericEvent, stop <-chan bool) {
+		id := bson.NewObjectId()
+		select {
+		case out <- Operation{ID: &id, Event: "insert", Data: &OperationData{ID: "1", Type: "video"}}:
+		case <-stop:
+			return
+		}
+		<-stop
+	}
+	daemon.health = func() (Health, error) {
+		return Health{}, nil
+	}
+	return daemon
+}
+
+func TestSSEDaemonShutdown(t *testing.T) {
+	daemon, addr := newTestSSEDaemon(t)
+
+	req, _ := http.NewRequest("GET", "http://"+addr+"/ops?since=1423995187000", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body := bufio.NewReader(res.Body)
+	if line, _ := body.ReadString('\n'); !strings.HasPrefix(line, "id: ") {
+		t.Fatalf("invalid first line: %s", line)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := daemon.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown failed: %s", err)
+	}
+
+	goodbye := false
+	for {
+		line, err := body.ReadString('\n')
+		if line == "event: goodbye\n" {
+			goodbye = true
+		}
+		if err != nil {
+			break
+		}
+	}
+	if !goodbye {
+		t.Fatal("goodbye event not received")
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Fatal("listener not closed")
+	}
+}
+
+func TestSSEDaemonServeTLS(t *testing.T) {
+	// Borrow the test certificate of an httptest server
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	client := ts.Client()
+	config := ts.TLS
+	ts.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	daemon := newTestSSEDaemonHandler(l.Addr().String())
+	daemon.ReadHeaderTimeout = time.Second
+	daemon.IdleTimeout = time.Second
+	done := make(chan error)
+	go func() {
+		done <- daemon.Serve(tls.NewListener(l, config))
+	}()
+
+	req, _ := http.NewRequest("GET", "https://"+l.Addr().String()+"/ops?since=1423995187000", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, _ := bufio.NewReader(res.Body).ReadString('\n')
+	res.Body.Close()
+	if !strings.HasPrefix(line, "id: ") {
+		t.Fatalf("invalid first line: %s", line)
+	}
+	if daemon.s.WriteTimeout != 0 || daemon.s.ReadHeaderTimeout != time.Second || daemon.s.IdleTimeout != time.Second {
+		t.Fatal("invalid server timeouts")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	daemon.Shutdown(ctx)
+	if err := <-done; err != nil {
+		t.Fatalf("serve returned an error after shutdown: %s", err)
+	}
+}
+
+// plainResponseWriter only implements http.ResponseWriter
+type plainResponseWriter struct {
+	http.ResponseWriter
+}
+
+// flushResponseWriter implements http.Flusher but not http.CloseNotifier
+type flushResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w flushResponseWriter) Flush() {
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+func newTestSSERequest(ctx context.Context) *http.Request {
+	req := httptest.NewRequest("GET", "/ops?since=1423995187000", nil).WithContext(ctx)
+	req.Header.Set("Accept", "text/event-stream")
+	return req
+}
+
+func TestGetOpsNoFlusher(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	rec := httptest.NewRecorder()
+	daemon.ServeHTTP(plainResponseWriter{rec}, newTestSSERequest(context.Background()))
+	if rec.Code != 500 {
+		t.Fatalf("expected 500, got %d", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "streaming not supported") {
+		t.Fatalf("invalid error message: %s", rec.Body.String())
+	}
+}
+
+func TestGetOpsContextDisconnect(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	rec := httptest.NewRecorder()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		daemon.ServeHTTP(flushResponseWriter{rec}, newTestSSERequest(ctx))
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("handler not stopped on client disconnect")
+	}
+	if !strings.HasPrefix(rec.Body.String(), "id: ") {
+		t.Fatalf("operation not streamed: %s", rec.Body.String())
+	}
+}
+
+func TestGetOpsKeepalive(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.FlushInterval = 10 * time.Millisecond
+	daemon.KeepaliveInterval = 30 * time.Millisecond
+	daemon.MaxConnectionDuration = 100 * time.Millisecond
+	rec := httptest.NewRecorder()
+	daemon.ServeHTTP(rec, newTestSSERequest(context.Background()))
+	// The stream is ended once the max duration is reached
+	body := rec.Body.String()
+	if !strings.HasPrefix(body, "id: ") {
+		t.Fatalf("operation not streamed: %s", body)
+	}
+	if n := strings.Count(body, "\n:\n"); n < 1 || n > 4 {
+		t.Fatalf("invalid number of heartbeats: %d", n)
+	}
+}
+
+func TestGetOpsKeepaliveDisabled(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.FlushInterval = 10 * time.Millisecond
+	daemon.KeepaliveInterval = 0
+	daemon.MaxConnectionDuration = 50 * time.Millisecond
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		daemon.ServeHTTP(rec, newTestSSERequest(context.Background()))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("stream not ended after max duration")
+	}
+	if strings.Contains(rec.Body.String(), "\n:\n") {
+		t.Fatal("heartbeat sent while disabled")
+	}
+}
+
+func TestGetOpsHeartbeatTickerCount(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.FlushInterval = 10 * time.Millisecond
+	daemon.KeepaliveInterval = 0
+	// The deprecated setting still enables the heartbeats, every 3 flush intervals
+	daemon.HeartbeatTickerCount = 3
+	daemon.MaxConnectionDuration = 100 * time.Millisecond
+	if interval := daemon.keepaliveInterval(); interval != 30*time.Millisecond {
+		t.Fatalf("invalid keepalive interval: %s", interval)
+	}
+	rec := httptest.NewRecorder()
+	daemon.ServeHTTP(rec, newTestSSERequest(context.Background()))
+	if n := strings.Count(rec.Body.String(), "\n:\n"); n < 1 || n > 4 {
+		t.Fatalf("invalid number of heartbeats: %d", n)
+	}
+}
+
+func TestGetOpsReconnectDelay(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.ReconnectDelay = 1500 * time.Millisecond
+	daemon.MaxConnectionDuration = 20 * time.Millisecond
+	rec := httptest.NewRecorder()
+	daemon.ServeHTTP(rec, newTestSSERequest(context.Background()))
+	if !strings.HasPrefix(rec.Body.String(), "retry: 1500\n\nid: ") {
+		t.Fatalf("invalid stream start: %q", rec.Body.String())
+	}
+}
+
+func TestGetOpsNoReconnectDelay(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.MaxConnectionDuration = 20 * time.Millisecond
+	rec := httptest.NewRecorder()
+	daemon.ServeHTTP(rec, newTestSSERequest(context.Background()))
+	if strings.Contains(rec.Body.String(), "retry:") {
+		t.Fatalf("retry directive sent while disabled: %q", rec.Body.String())
+	}
+}
+
+func TestGetOpsOverloadedReconnectDelay(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.ReconnectDelay = time.Second
+	daemon.RetryAfter = 10 * time.Second
+	daemon.ol.MaxConcurrentTails = 1
+	release, _ := daemon.ol.reserveTail(nil)
+	defer release()
+	rec := httptest.NewRecorder()
+	daemon.ServeHTTP(rec, newTestSSERequest(context.Background()))
+	if rec.Code != 503 || rec.Header().Get("Retry-After") != "10" {
+		t.Fatalf("invalid overload response: %d", rec.Code)
+	}
+	if !strings.HasPrefix(rec.Body.String(), "retry: 10000\n\nevent: error\ndata: {\"error\":{\"code\":\"too_many_clients\"") {
+		t.Fatalf("invalid overload body: %q", rec.Body.String())
+	}
+}
+
+// newTestSSELastIDDaemon creates a daemon saving the last id its tails are started with
+func newTestSSELastIDDaemon(lastIDs chan<- LastID) *SSEDaemon {
+	daemon := NewSSEDaemon("", newTestOpLog())
+	daemon.MaxConnectionDuration = 10 * time.Millisecond
+	daemon.tail = func(lastID LastID, filter Filter, opts TailOptions, out chan<- GenericEvent, stop <-chan bool) {
+		lastIDs <- lastID
+		<-stop
+	}
+	return daemon
+}
+
+func testGetOpsLastID(t *testing.T, header, query string) (*httptest.ResponseRecorder, LastID) {
+	lastIDs := make(chan LastID, 1)
+	daemon := newTestSSELastIDDaemon(lastIDs)
+	req := httptest.NewRequest("GET", "/ops"+query, nil)
+	req.Header.Set("Accept", "text/event-stream")
+	if header != "" {
+		req.Header.Set("Last-Event-ID", header)
+	}
+	rec := httptest.NewRecorder()
+	daemon.ServeHTTP(rec, req)
+	select {
+	case lastID := <-lastIDs:
+		return rec, lastID
+	default:
+		return rec, nil
+	}
+}
+
+func TestGetOpsLastIDHeader(t *testing.T) {
+	_, lastID := testGetOpsLastID(t, "1423995187898", "")
+	if lastID == nil || lastID.String() != "1423995187898" {
+		t.Fatalf("invalid last id: %v", lastID)
+	}
+}
+
+func TestGetOpsLastIDQuery(t *testing.T) {
+	for _, param := range []string{"last_event_id", "since_id"} {
+		_, lastID := testGetOpsLastID(t, "", "?"+param+"=1423995187898")
+		if lastID == nil || lastID.String() != "1423995187898" {
+			t.Fatalf("invalid last id with %s: %v", param, lastID)
+		}
+	}
+}
+
+func TestGetOpsLastIDHeaderPrecedence(t *testing.T) {
+	_, lastID := testGetOpsLastID(t, "1423995187898", "?last_event_id=1423995180000")
+	if lastID == nil || lastID.String() != "1423995187898" {
+		t.Fatalf("header doesn't take precedence: %v", lastID)
+	}
+}
+
+func TestGetOpsLastIDMalformed(t *testing.T) {
+	for _, header := range []string{"invalid", ""} {
+		query := ""
+		if header == "" {
+			query = "?last_event_id=invalid"
+		}
+		rec, lastID := testGetOpsLastID(t, header, query)
+		if rec.Code != 400 || lastID != nil {
+			t.Fatalf("malformed last id accepted: %d", rec.Code)
+		}
+		if rec.Header().Get("Content-Type") != "application/json" {
+			t.Fatal("error is not JSON")
+		}
+		if !strings.Contains(rec.Body.String(), `"code":"invalid_last_id"`) {
+			t.Fatalf("invalid error body: %s", rec.Body.String())
+		}
+	}
+}
+
+// errReader is a request body failing to be read
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) {
+	return 0, errors.New("read error")
+}
+
+func TestErrorResponses(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.Password = "secret"
+	daemon.IngestPassword = "secret"
+	full := newTestSSEDaemonHandler("")
+	full.ol.MaxConcurrentTails = 1
+	release, _ := full.ol.reserveTail(nil)
+	defer release()
+
+	sse := func(method, url string, auth bool) *http.Request {
+		req := httptest.NewRequest(method, url, nil)
+		req.Header.Set("Accept", "text/event-stream")
+		if auth {
+			req.SetBasicAuth("", "secret")
+		}
+		return req
+	}
+	post := func(body io.Reader, contentType string) *http.Request {
+		req := httptest.NewRequest("POST", "/ops", body)
+		req.Header.Set("Content-Type", contentType)
+		req.SetBasicAuth("", "secret")
+		return req
+	}
+	notAcceptable := sse("GET", "/ops", true)
+	notAcceptable.Header.Set("Accept", "text/html")
+
+	tests := []struct {
+		daemon *SSEDaemon
+		req    *http.Request
+		status int
+		code   string
+	}{
+		{daemon, sse("PUT", "/ops", true), 405, "method_not_allowed"},
+		{daemon, sse("POST", "/status", true), 405, "method_not_allowed"},
+		{daemon, sse("GET", "/unknown", true), 404, "not_found"},
+		{daemon, notAcceptable, 406, "not_acceptable"},
+		{daemon, sse("GET", "/ops", false), 401, "unauthorized"},
+		{daemon, sse("GET", "/ops?last_event_id=invalid", true), 400, "invalid_last_id"},
+		{daemon, sse("GET", "/ops?types=,,,", true), 400, "invalid_filter"},
+		{daemon, sse("GET", "/ops?types_exclude=%20,", true), 400, "invalid_filter"},
+		{daemon, sse("GET", "/ops?parents="+strings.Repeat("a", DefaultMaxFilterValueLength+1), true), 400, "invalid_filter"},
+		{daemon, sse("GET", "/ops?types="+strings.Repeat("a,", DefaultMaxFilterValues+1), true), 400, "invalid_filter"},
+		{daemon, sse("GET", "/ops?types=a*b", true), 400, "invalid_filter"},
+		{daemon, sse("GET", "/ops?types=a.**", true), 400, "invalid_filter"},
+		{daemon, sse("GET", "/ops?types=*", true), 400, "invalid_filter"},
+		{daemon, sse("GET", "/ops?parents=user/*/x", true), 400, "invalid_filter"},
+		{daemon, sse("GET", "/ops?field.country=fr", true), 400, "invalid_filter"},
+		{daemon, sse("GET", "/ops?types=a&types_exclude=b", true), 400, "invalid_filter"},
+		{daemon, sse("GET", "/ops?parents=a/1&parents_exclude=b/1", true), 400, "invalid_filter"},
+		{daemon, sse("GET", "/ops?since=invalid", true), 400, "invalid_parameter"},
+		{daemon, sse("GET", "/ops?limit=0", true), 400, "invalid_parameter"},
+		{daemon, sse("GET", "/ops?limit=abc", true), 400, "invalid_parameter"},
+		{daemon, sse("GET", "/ops?limit=100001", true), 400, "invalid_parameter"},
+		{daemon, sse("GET", "/ops?idle_timeout=0", true), 400, "invalid_parameter"},
+		{daemon, sse("GET", "/ops?idle_timeout=3601", true), 400, "invalid_parameter"},
+		{daemon, sse("GET", "/ops?include=body", true), 400, "invalid_parameter"},
+		{daemon, post(errReader{}, "application/json"), 503, "backend_unavailable"},
+		{daemon, post(strings.NewReader("{}"), "text/plain"), 415, "unsupported_media_type"},
+		{daemon, post(strings.NewReader("{"), "application/json"), 400, "invalid_body"},
+		{daemon, post(strings.NewReader("[]"), "application/json"), 400, "invalid_body"},
+		{daemon, post(strings.NewReader(`{"event":"insert"}`), "application/json"), 422, "invalid_operation"},
+		{daemon, post(strings.NewReader(strings.Repeat(" ", 1<<20+1)), "application/json"), 413, "body_too_large"},
+		{full, sse("GET", "/ops?since=1423995187000", false), 503, "too_many_clients"},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		test.daemon.ServeHTTP(rec, test.req)
+		if rec.Code != test.status {
+			t.Errorf("%s %s: expected status %d, got %d", test.req.Method, test.req.URL, test.status, rec.Code)
+		}
+		if rec.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s %s: error is not JSON", test.req.Method, test.req.URL)
+		}
+		body := struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Errorf("%s %s: invalid JSON body: %s", test.req.Method, test.req.URL, err)
+		}
+		if body.Error.Code != test.code || body.Error.Message == "" {
+			t.Errorf("%s %s: expected code %s, got %s", test.req.Method, test.req.URL, test.code, rec.Body.String())
+		}
+	}
+}
+
+func newTestPostOpsRequest(body, password string) *http.Request {
+	req := httptest.NewRequest("POST", "/ops", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.SetBasicAuth("", password)
+	return req
+}
+
+func TestPostOps(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	var appended []*Operation
+	daemon.append = func(ctx context.Context, ops []*Operation) {
+		appended = append(appended, ops...)
+	}
+
+	tests := []struct {
+		body  string
+		types []string
+	}{
+		{`{"event":"insert","type":"video","id":"1"}`, []string{"video"}},
+		{`{"event":"update","data":{"type":"User","id":"2","parents":["user/2"]}}`, []string{"user"}},
+		{`[{"event":"insert","type":"video","id":"3"},{"event":"delete","data":{"type":"user","id":"4"}}]`, []string{"video", "user"}},
+	}
+	for _, test := range tests {
+		appended = nil
+		rec := httptest.NewRecorder()
+		daemon.ServeHTTP(rec, newTestPostOpsRequest(test.body, ""))
+		if rec.Code != 201 {
+			t.Fatalf("%s: expected status 201, got %d: %s", test.body, rec.Code, rec.Body.String())
+		}
+		res := struct {
+			IDs []string `json:"ids"`
+		}{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%s: invalid JSON body: %s", test.body, err)
+		}
+		if len(appended) != len(test.types) || len(res.IDs) != len(test.types) {
+			t.Fatalf("%s: expected %d operations, got %d appended and %d ids", test.body, len(test.types), len(appended), len(res.IDs))
+		}
+		for i, op := range appended {
+			if op.Data.Type != test.types[i] {
+				t.Errorf("%s: expected type %s at %d, got %s", test.body, test.types[i], i, op.Data.Type)
+			}
+			if op.ID == nil || op.ID.Hex() != res.IDs[i] {
+				t.Errorf("%s: returned id %s doesn't match the appended operation", test.body, res.IDs[i])
+			}
+		}
+	}
+}
+
+func TestPostOpsPartialFailure(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.append = func(ctx context.Context, ops []*Operation) {
+		t.Fatal("no operation should be appended when the batch contains invalid operations")
+	}
+
+	body := `[{"event":"insert","type":"video","id":"1"},{"event":"unknown","type":"video","id":"2"},{"event":"insert"}]`
+	rec := httptest.NewRecorder()
+	daemon.ServeHTTP(rec, newTestPostOpsRequest(body, ""))
+	if rec.Code != 422 {
+		t.Fatalf("expected status 422, got %d", rec.Code)
+	}
+	res := struct {
+		Items []struct {
+			Index   int    `json:"index"`
+			Message string `json:"message"`
+		} `json:"items"`
+	}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("invalid JSON body: %s", err)
+	}
+	if len(res.Items) != 2 || res.Items[0].Index != 1 || res.Items[1].Index != 2 || res.Items[0].Message == "" {
+		t.Fatalf("expected items 1 and 2 to be reported, got %s", rec.Body.String())
+	}
+}
+
+func TestPostOpsMetaLimits(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.ol.MaxMetaKeys = 2
+	daemon.ol.MaxMetaSize = 16
+	var appended []*Operation
+	daemon.append = func(ctx context.Context, ops []*Operation) {
+		appended = append(appended, ops...)
+	}
+
+	body := `[{"event":"insert","type":"video","id":"1","meta":{"origin":"api"}},{"event":"insert","data":{"type":"video","id":"2","meta":{"a":"1","b":"2","c":"3"}}},{"event":"insert","type":"video","id":"3","meta":{"tenant":"a-very-long-tenant"}}]`
+	rec := httptest.NewRecorder()
+	daemon.ServeHTTP(rec, newTestPostOpsRequest(body, ""))
+	if rec.Code != 422 || len(appended) != 0 {
+		t.Fatalf("expected status 422 without append, got %d and %d operations", rec.Code, len(appended))
+	}
+	if expected := `"items":[{"index":1,"message":"too many meta keys: 3, 2 maximum"},{"index":2,"message":"meta too large: 24 bytes, 16 maximum"}]`; !strings.Contains(rec.Body.String(), expected) {
+		t.Errorf("invalid items: %s", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	daemon.ServeHTTP(rec, newTestPostOpsRequest(`{"event":"insert","type":"video","id":"1","meta":{"origin":"api"}}`, ""))
+	if rec.Code != 201 || len(appended) != 1 || appended[0].Data.Meta["origin"] != "api" {
+		t.Fatalf("expected the metadata to be appended, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestPostOpsPayloadSize(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.ol.MaxPayloadSize = 64
+	var appended []*Operation
+	daemon.append = func(ctx context.Context, ops []*Operation) {
+		appended = append(appended, ops...)
+	}
+
+	body := `[{"event":"insert","type":"video","id":"1","payload":{"title":"cat"}},{"event":"insert","type":"video","id":"2","payload":{"title":"` + strings.Repeat("a", 64) + `"}}]`
+	rec := httptest.NewRecorder()
+	daemon.ServeHTTP(rec, newTestPostOpsRequest(body, ""))
+	if rec.Code != 422 || len(appended) != 0 {
+		t.Fatalf("expected status 422 without append, got %d and %d operations", rec.Code, len(appended))
+	}
+	if expected := `"items":[{"index":1,"message":"payload too large: 81 bytes, 64 maximum"}]`; !strings.Contains(rec.Body.String(), expected) {
+		t.Errorf("invalid items: %s", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	daemon.ServeHTTP(rec, newTestPostOpsRequest(`{"event":"insert","data":{"type":"video","id":"1","payload":{"title":"cat"}}}`, ""))
+	if rec.Code != 201 || len(appended) != 1 || appended[0].Data.Payload["title"] != "cat" {
+		t.Fatalf("expected the payload to be appended, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestPostOpsPasswords(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.Password = "read"
+	daemon.IngestPassword = "write"
+	daemon.append = func(ctx context.Context, ops []*Operation) {}
+
+	rec := httptest.NewRecorder()
+	daemon.ServeHTTP(rec, newTestPostOpsRequest(`{"event":"insert","type":"video","id":"1"}`, "read"))
+	if rec.Code != 403 {
+		t.Errorf("expected the read password to be refused on ingest, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	daemon.ServeHTTP(rec, newTestPostOpsRequest(`{"event":"insert","type":"video","id":"1"}`, "write"))
+	if rec.Code != 201 {
+		t.Errorf("expected the ingest password to be accepted on ingest, got %d", rec.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/ops", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	req.SetBasicAuth("", "write")
+	rec = httptest.NewRecorder()
+	daemon.ServeHTTP(rec, req)
+	if rec.Code != 403 {
+		t.Errorf("expected the ingest password to be refused on stream, got %d", rec.Code)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	expvar.NewString("test_status\x01key").Set("\"quoted\"\n")
+	newest := time.Unix(1423995187, 0).UTC()
+	tests := []struct {
+		err    error
+		status int
+		value  string
+	}{
+		{nil, 200, "OK"},
+		{errors.New("can't reach MongoDB: no reachable servers"), 503, "DOWN"},
+	}
+	for _, test := range tests {
+		daemon := newTestSSEDaemonHandler("")
+		daemon.health = func() (Health, error) {
+			return Health{NewestOperation: newest}, test.err
+		}
+		rec := httptest.NewRecorder()
+		daemon.ServeHTTP(rec, httptest.NewRequest("GET", "/status", nil))
+		if rec.Code != test.status {
+			t.Errorf("expected status %d, got %d", test.status, rec.Code)
+		}
+		body := map[string]interface{}{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("invalid JSON body: %s: %s", err, rec.Body.String())
+		}
+		if body["status"] != test.value {
+			t.Errorf("expected status %s, got %v", test.value, body["status"])
+		}
+		if test.err != nil && body["error"] != test.err.Error() {
+			t.Errorf("expected error %q, got %v", test.err, body["error"])
+		}
+		if test.err == nil && body["error"] != nil {
+			t.Errorf("unexpected error %v", body["error"])
+		}
+		if body["newest_operation"] != "2015-02-15T10:13:07Z" {
+			t.Errorf("unexpected newest_operation: %v", body["newest_operation"])
+		}
+		if _, found := body["last_append"]; found {
+			t.Error("last_append should be omitted when nothing has been appended")
+		}
+		if _, found := body["clients"]; !found {
+			t.Error("clients is missing")
+		}
+		if _, found := body["replications"]; !found {
+			t.Error("replications is missing")
+		}
+		if body["test_status\x01key"] != "\"quoted\"\n" {
+			t.Errorf("unexpected expvar value: %v", body["test_status\x01key"])
+		}
+	}
+}
+
+func TestStatusProtection(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.EnableMetrics = true
+	get := func(path, password string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		if password != "" {
+			req.SetBasicAuth("", password)
+		}
+		rec := httptest.NewRecorder()
+		daemon.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Nothing to protect without credentials
+	if status := get("/status", ""); status != 200 {
+		t.Errorf("expected 200 without password, got %d", status)
+	}
+
+	daemon.Password = "secret"
+	tests := []struct {
+		path     string
+		password string
+		status   int
+	}{
+		{"/status", "", 401},
+		{"/status", "wrong", 401},
+		{"/status", "secret", 200},
+		{"/metrics", "", 401},
+		{"/metrics", "secret", 200},
+		{"/healthz", "", 200},
+	}
+	for _, test := range tests {
+		if status := get(test.path, test.password); status != test.status {
+			t.Errorf("%s with %q: expected %d, got %d", test.path, test.password, test.status, status)
+		}
+	}
+
+	// Admins can read the status, readers can't read the metrics once admins are set
+	daemon.MetricsPassword = "admin"
+	if status := get("/status", "admin"); status != 200 {
+		t.Errorf("expected 200 for an admin, got %d", status)
+	}
+	if status := get("/metrics", "secret"); status != 403 {
+		t.Errorf("expected 403 for a reader on the metrics, got %d", status)
+	}
+
+	daemon.ProtectStatus = false
+	if status := get("/status", ""); status != 200 {
+		t.Errorf("expected 200 when unprotected, got %d", status)
+	}
+}
+
+func TestStatusRedaction(t *testing.T) {
+	expvar.NewString("test_redacted_mongo_url").Set("mongodb://user:secret@db/oplog")
+	daemon := newTestSSEDaemonHandler("")
+	daemon.RedactedVars = append(daemon.RedactedVars, "test_redacted_*")
+	rec := httptest.NewRecorder()
+	daemon.ServeHTTP(rec, httptest.NewRequest("GET", "/status", nil))
+	if strings.Contains(rec.Body.String(), "secret") {
+		t.Errorf("redacted var leaked: %s", rec.Body.String())
+	}
+	body := map[string]interface{}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid JSON body: %s: %s", err, rec.Body.String())
+	}
+	for _, key := range []string{"test_redacted_mongo_url", "cmdline"} {
+		if body[key] != "REDACTED" {
+			t.Errorf("expected %s to be redacted, got %v", key, body[key])
+		}
+	}
+	if _, found := body["events_sent"]; !found {
+		t.Error("events_sent is missing")
+	}
+}
+
+func TestHealthProbes(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.Password = "secret"
+	daemon.DrainDelay = time.Second
+	var healthErr error
+	daemon.health = func() (Health, error) {
+		return Health{}, healthErr
+	}
+	probe := func(path string) int {
+		rec := httptest.NewRecorder()
+		daemon.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Code
+	}
+
+	if code := probe("/healthz"); code != 200 {
+		t.Errorf("expected liveness to succeed without authentication, got %d", code)
+	}
+	if code := probe("/readyz"); code != 200 {
+		t.Errorf("expected readiness to succeed without authentication, got %d", code)
+	}
+
+	healthErr = errors.New("can't reach MongoDB")
+	if code := probe("/readyz"); code != 503 {
+		t.Errorf("expected readiness to fail when the oplog is not healthy, got %d", code)
+	}
+	if code := probe("/healthz"); code != 200 {
+		t.Errorf("expected liveness to succeed when the oplog is not healthy, got %d", code)
+	}
+	healthErr = nil
+
+	done := make(chan struct{})
+	go func() {
+		daemon.Shutdown(context.Background())
+		close(done)
+	}()
+	<-daemon.draining
+	if code := probe("/readyz"); code != 503 {
+		t.Errorf("expected readiness to fail once shutdown began, got %d", code)
+	}
+	if code := probe("/healthz"); code != 200 {
+		t.Errorf("expected liveness to succeed while draining, got %d", code)
+	}
+	select {
+	case <-daemon.quit:
+		t.Error("streams should not be ended before the drain delay")
+	default:
+	}
+	<-done
+}
+
+// newTestSSEOpsDaemon creates a daemon whose tails stream the given operations then wait
+func newTestSSEOpsDaemon(ops []Operation) *SSEDaemon {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.tail = func(lastID LastID, filter Filter, opts TailOptions, out chan<- GenericEvent, stop <-chan bool) {
+		events := []GenericEvent{&Event{ID: "1", Event: "reset"}}
+		checkpointID := "1"
+		for _, op := range ops {
+			events = append(events, op)
+			checkpointID = op.ID.Hex()
+		}
+		events = append(events, &Checkpoint{ID: checkpointID, Time: time.Now()})
+		for _, ev := range events {
+			select {
+			case out <- ev:
+			case <-stop:
+				return
+			}
+		}
+		<-stop
+	}
+	return daemon
+}
+
+func newTestOperations(n int) []Operation {
+	ops := []Operation{}
+	for i := 0; i < n; i++ {
+		id := bson.NewObjectId()
+		ops = append(ops, Operation{ID: &id, Event: "insert", Data: &OperationData{ID: strconv.Itoa(i), Type: "video"}})
+	}
+	return ops
+}
+
+func TestGetOpsIncludePayload(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	id := bson.ObjectIdHex("545b55c7f095528dd0f3863c")
+	ts := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	payload := map[string]interface{}{"title": "cat", "views": 3}
+	daemon.tail = func(lastID LastID, filter Filter, opts TailOptions, out chan<- GenericEvent, stop <-chan bool) {
+		for _, ev := range []GenericEvent{
+			// A replicated object state, then a live operation with and without payload
+			objectState{ID: "video/1", Event: "insert", Timestamp: ts, Data: &OperationData{Timestamp: ts, Type: "video", ID: "1", Payload: payload}},
+			Operation{ID: &id, Event: "update", Data: &OperationData{Timestamp: ts, Type: "video", ID: "1", Payload: payload}},
+			Operation{ID: &id, Event: "delete", Data: &OperationData{Timestamp: ts, Type: "video", ID: "2"}},
+		} {
+			select {
+			case out <- ev:
+			case <-stop:
+				return
+			}
+		}
+		<-stop
+	}
+
+	for _, test := range []struct {
+		query string
+		data  []string
+	}{
+		{"", []string{
+			`{"timestamp":"2016-01-02T03:04:05.000Z","parents":[],"type":"video","id":"1"}`,
+			`{"timestamp":"2016-01-02T03:04:05.000Z","parents":[],"type":"video","id":"1"}`,
+			`{"timestamp":"2016-01-02T03:04:05.000Z","parents":[],"type":"video","id":"2"}`,
+		}},
+		{"&include=payload", []string{
+			`{"timestamp":"2016-01-02T03:04:05.000Z","parents":[],"type":"video","id":"1","payload":{"title":"cat","views":3}}`,
+			`{"timestamp":"2016-01-02T03:04:05.000Z","parents":[],"type":"video","id":"1","payload":{"title":"cat","views":3}}`,
+			`{"timestamp":"2016-01-02T03:04:05.000Z","parents":[],"type":"video","id":"2"}`,
+		}},
+	} {
+		req := httptest.NewRequest("GET", "/ops?since=1423995187000&limit=3"+test.query, nil)
+		req.Header.Set("Accept", "text/event-stream")
+		rec := httptest.NewRecorder()
+		daemon.ServeHTTP(rec, req)
+		data := []string{}
+		for _, line := range strings.Split(rec.Body.String(), "\n") {
+			if strings.HasPrefix(line, "data: {\"timestamp\"") {
+				data = append(data, strings.TrimPrefix(line, "data: "))
+			}
+		}
+		if strings.Join(data, "\n") != strings.Join(test.data, "\n") {
+			t.Errorf("%q: invalid events:\n%s\nexpected:\n%s", test.query, strings.Join(data, "\n"), strings.Join(test.data, "\n"))
+		}
+	}
+}
+
+func TestGetOpsLimit(t *testing.T) {
+	ops := newTestOperations(5)
+	daemon := newTestSSEOpsDaemon(ops)
+	req := httptest.NewRequest("GET", "/ops?since=1423995187000&limit=3", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		daemon.ServeHTTP(rec, req)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("stream not ended once the limit is reached")
+	}
+	body := rec.Body.String()
+	if n := strings.Count(body, "event: insert"); n != 3 {
+		t.Fatalf("expected 3 operations, got %d: %q", n, body)
+	}
+	if !strings.HasSuffix(body, "id: "+ops[2].ID.Hex()+"\nevent: end\n\n") {
+		t.Fatalf("expected the stream to end with an end event at the last operation: %q", body)
+	}
+}
+
+func TestGetOpsIdleTimeout(t *testing.T) {
+	ops := newTestOperations(1)
+	daemon := newTestSSEOpsDaemon(ops)
+	req := httptest.NewRequest("GET", "/ops?since=1423995187000&idle_timeout=1", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	started := time.Now()
+	go func() {
+		daemon.ServeHTTP(rec, req)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("stream not ended once idle")
+	}
+	if elapsed := time.Since(started); elapsed < time.Second {
+		t.Fatalf("stream ended before the idle timeout: %s", elapsed)
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, "event: insert") {
+		t.Fatalf("operation not sent: %q", body)
+	}
+	if !strings.HasSuffix(body, "id: "+ops[0].ID.Hex()+"\nevent: end\n\n") {
+		t.Fatalf("expected the stream to end with an end event at the last operation: %q", body)
+	}
+}
+
+func TestServeHTTPMethods(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.EnableMetrics = true
+	allowed := map[string]string{
+		"/status":   "GET, HEAD, OPTIONS",
+		"/healthz":  "GET, OPTIONS",
+		"/readyz":   "GET, OPTIONS",
+		"/metrics":  "GET, OPTIONS",
+		"/ops/poll": "GET, OPTIONS",
+		"/ws":       "GET, OPTIONS",
+		"/ops":      "GET, HEAD, OPTIONS, POST",
+		"/":         "GET, HEAD, OPTIONS, POST",
+	}
+	for path, allow := range allowed {
+		for _, method := range []string{"GET", "HEAD", "POST", "PUT", "DELETE", "PATCH", "OPTIONS"} {
+			if method == "GET" || (method == "HEAD" && strings.Contains(allow, "HEAD")) || (method == "POST" && strings.Contains(allow, "POST")) {
+				// Served by the endpoint handlers, covered by their own tests
+				continue
+			}
+			rec := httptest.NewRecorder()
+			daemon.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+			expected := 405
+			if method == "OPTIONS" {
+				expected = 204
+			}
+			if rec.Code != expected {
+				t.Errorf("%s %s: expected status %d, got %d", method, path, expected, rec.Code)
+			}
+			if a := rec.Header().Get("Allow"); a != allow {
+				t.Errorf("%s %s: expected Allow: %s, got %q", method, path, allow, a)
+			}
+		}
+	}
+}
+
+func TestHeadStatus(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	rec := httptest.NewRecorder()
+	daemon.ServeHTTP(rec, httptest.NewRequest("HEAD", "/status", nil))
+	if rec.Code != 200 {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected the GET content type, got %q", ct)
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("expected no body, got %q", rec.Body.String())
+	}
+}
+
+func TestHeadOps(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.Password = "secret"
+	daemon.tail = func(lastID LastID, filter Filter, opts TailOptions, out chan<- GenericEvent, stop <-chan bool) {
+		t.Error("no tail should be started for a HEAD request")
+		<-stop
+	}
+	evicted := bson.ObjectIdHex("545b55c7f095528dd0f3863c")
+	daemon.hasID = func(id LastID) (bool, error) {
+		return id.String() != evicted.Hex(), nil
+	}
+	// Empty oplog
+	daemon.lastID = func() (LastID, error) { return nil, nil }
+	head := func(lastEventID, query string, auth bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("HEAD", "/ops"+query, nil)
+		req.Header.Set("Accept", "text/event-stream")
+		req.Header.Set("Last-Event-ID", lastEventID)
+		if auth {
+			req.SetBasicAuth("", "secret")
+		}
+		rec := httptest.NewRecorder()
+		daemon.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		lastEventID string
+		query       string
+		auth        bool
+		status      int
+		mode        string
+	}{
+		{bson.NewObjectId().Hex(), "", false, 401, ""},
+		{"invalid", "", true, 400, ""},
+		{bson.NewObjectId().Hex(), "", true, 200, "live"},
+		{"", "", true, 200, "live"},
+		{"", "?since=1423995187000", true, 200, "live"},
+		{"1423995187898", "", true, 200, "replication"},
+		{evicted.Hex(), "", true, 200, "fallback"},
+	}
+	for _, test := range tests {
+		rec := head(test.lastEventID, test.query, test.auth)
+		if rec.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.lastEventID, test.status, rec.Code)
+			continue
+		}
+		if rec.Body.Len() != 0 {
+			t.Errorf("%s: expected no body, got %q", test.lastEventID, rec.Body.String())
+		}
+		if m := rec.Header().Get("X-Oplog-Mode"); m != test.mode {
+			t.Errorf("%s: expected mode %q, got %q", test.lastEventID, test.mode, m)
+		}
+		if test.status == 200 && rec.Header().Get("Content-Type") != "text/event-stream; charset=utf-8" {
+			t.Errorf("%s: expected the GET content type, got %q", test.lastEventID, rec.Header().Get("Content-Type"))
+		}
+	}
+}
+
+func TestGetOpsHello(t *testing.T) {
+	ops := newTestOperations(1)
+	for _, enabled := range []bool{true, false} {
+		daemon := newTestSSEOpsDaemon(ops)
+		daemon.Hello = enabled
+		daemon.ReconnectDelay = 3 * time.Second
+		newest := bson.ObjectIdHex("545b55c7f095528dd0f3863c")
+		daemon.lastID = func() (LastID, error) {
+			return &OperationLastID{&newest}, nil
+		}
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/ops?since=1423995187000&limit=1", nil)
+		req.Header.Set("Accept", "text/event-stream")
+		daemon.ServeHTTP(rec, req)
+
+		hello := "event: hello\ndata: {\"server_time\":\"SERVER_TIME\",\"newest_id\":\"545b55c7f095528dd0f3863c\",\"newest_time\":\"2014-11-06T11:04:39Z\",\"mode\":\"live\"}\n\n"
+		if !enabled {
+			hello = ""
+		}
+		expected := "retry: 3000\n\n" + hello + "id: 1\nevent: reset\n\n"
+		output := regexp.MustCompile(`"server_time":"[^"]+"`).ReplaceAllString(rec.Body.String(), `"server_time":"SERVER_TIME"`)
+		if !strings.HasPrefix(output, expected) {
+			t.Errorf("invalid stream start:\n%q\nexpected:\n%q", output, expected)
+		}
+	}
+}
+
+func TestHandlerPrefix(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	mux := http.NewServeMux()
+	mux.Handle("/internal/oplog/", http.StripPrefix("/internal/oplog", daemon.Handler()))
+	mux.Handle("/mounted/", daemon.Handler())
+
+	for _, prefix := range []string{"/internal/oplog", "/mounted"} {
+		tests := []struct {
+			method string
+			path   string
+			status int
+		}{
+			{"GET", "/status", 200},
+			{"GET", "/healthz", 200},
+			{"GET", "/readyz", 200},
+			{"PUT", "/ops", 405},
+			{"PUT", "/", 405},
+			{"PUT", "/ops/poll", 405},
+			{"GET", "/unknown", 404},
+		}
+		for _, test := range tests {
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(test.method, prefix+test.path, nil))
+			if rec.Code != test.status {
+				t.Errorf("%s %s%s: expected status %d, got %d", test.method, prefix, test.path, test.status, rec.Code)
+			}
+		}
+
+		// The query-string is preserved
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("HEAD", prefix+"/ops?last_event_id=invalid", nil)
+		req.Header.Set("Accept", "text/event-stream")
+		mux.ServeHTTP(rec, req)
+		if rec.Code != 400 {
+			t.Errorf("%s/ops: expected status 400, got %d", prefix, rec.Code)
+		}
+	}
+}
+
+func TestGetOpsExplicitFallback(t *testing.T) {
+	evicted := bson.ObjectIdHex("545b55c7f095528dd0f3863c")
+	oldest := time.Date(2015, 2, 15, 10, 13, 7, 0, time.UTC)
+	fallbackID := (&OperationLastID{&evicted}).Fallback().String()
+	tests := []struct {
+		query    string
+		header   string
+		status   int
+		tailFrom string
+	}{
+		{"", "", 200, evicted.Hex()},
+		{"&fallback=auto", "", 200, evicted.Hex()},
+		{"", "1", 410, ""},
+		{"&fallback=explicit", "", 410, ""},
+		{"&fallback=invalid", "", 400, ""},
+	}
+	for _, test := range tests {
+		daemon := newTestSSEDaemonHandler("")
+		daemon.hasID = func(id LastID) (bool, error) {
+			return false, nil
+		}
+		daemon.health = func() (Health, error) {
+			return Health{OldestOperation: oldest}, nil
+		}
+		tailFrom := ""
+		tail := daemon.tail
+		daemon.tail = func(lastID LastID, filter Filter, opts TailOptions, out chan<- GenericEvent, stop <-chan bool) {
+			tailFrom = lastID.String()
+			tail(lastID, filter, opts, out, stop)
+		}
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/ops?limit=1"+test.query, nil)
+		req.Header.Set("Accept", "text/event-stream")
+		req.Header.Set("Last-Event-ID", evicted.Hex())
+		if test.header != "" {
+			req.Header.Set("X-Oplog-No-Fallback", test.header)
+		}
+		daemon.ServeHTTP(rec, req)
+		if rec.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.query, test.status, rec.Code)
+			continue
+		}
+		if tailFrom != test.tailFrom {
+			t.Errorf("%s: expected the tail to start from %q, got %q", test.query, test.tailFrom, tailFrom)
+		}
+		if test.status != 410 {
+			continue
+		}
+		body := struct {
+			Error struct {
+				Code string `json:"code"`
+			} `json:"error"`
+			FallbackID      string    `json:"fallback_id"`
+			OldestOperation time.Time `json:"oldest_operation"`
+		}{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("invalid JSON body: %s: %s", err, rec.Body.String())
+		}
+		if body.Error.Code != "last_id_evicted" || body.FallbackID != fallbackID || !body.OldestOperation.Equal(oldest) {
+			t.Errorf("%s: invalid body: %s", test.query, rec.Body.String())
+		}
+	}
+}
+
+func TestGetOpsFilterableFields(t *testing.T) {
+	daemon, filters := newTestPolicyDaemon(Credentials{"search": {Password: "s"}})
+	daemon.FilterableFields = []string{"id"}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	get := func(url string) int {
+		req := httptest.NewRequest("GET", url, nil).WithContext(ctx)
+		req.Header.Set("Accept", "text/event-stream")
+		req.SetBasicAuth("search", "s")
+		rec := httptest.NewRecorder()
+		daemon.ServeHTTP(flushResponseWriter{rec}, req)
+		return rec.Code
+	}
+
+	if status := get("/ops?field.country=fr"); status != 400 {
+		t.Errorf("expected status 400 for a field not allowed, got %d", status)
+	}
+	if status := get("/ops?field.id=x1"); status != 200 {
+		t.Fatalf("expected status 200, got %d", status)
+	}
+	if f := filters(); len(f) != 1 || f[0].Fields["id"] != "x1" {
+		t.Errorf("field not passed to the tail: %#v", f)
+	}
+}
+
+func TestGetOpsHelloFilter(t *testing.T) {
+	daemon := newTestSSEOpsDaemon(newTestOperations(1))
+	daemon.Hello = true
+	daemon.HelloFilter = true
+	daemon.Authenticator = Credentials{"partner": {Password: "p", Policy: Policy{Types: []string{"video", "playlist"}, Parents: []string{"user/"}}}}
+	daemon.FilterPresets = map[string]Filter{"no-updates": {Events: []string{"insert", "delete"}}}
+	daemon.lastID = func() (LastID, error) { return nil, nil }
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/ops?since=1423995187000&limit=1&filter=no-updates", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	req.SetBasicAuth("partner", "p")
+	daemon.ServeHTTP(rec, req)
+
+	expected := `"filter":{"types":["playlist","video"],"parent_prefixes":["user/"],"events":["delete","insert"]}}`
+	if !strings.Contains(rec.Body.String(), "event: hello\ndata: ") || !strings.Contains(rec.Body.String(), expected+"\n\n") {
+		t.Errorf("effective filter not given by the hello event:\n%s", rec.Body.String())
+	}
+}
+
+func TestGetOpsHelloFilteredHead(t *testing.T) {
+	// Interleaved types and events, from the oldest to the newest
+	ops := newTestOperations(6)
+	for i, s := range []string{"insert video", "insert user", "update video", "insert playlist", "delete user", "update playlist"} {
+		f := strings.Fields(s)
+		ops[i].Event, ops[i].Data.Type = f[0], f[1]
+	}
+	daemon := newTestSSEOpsDaemon(ops[:1])
+	daemon.Hello = true
+	daemon.HelloFilteredHead = true
+	daemon.lastID = func() (LastID, error) { return nil, nil }
+	// Mimics OpLog.LastIDForFilter: the newest operation matching the query of the filter
+	daemon.lastIDForFilter = func(filter Filter) (LastID, error) {
+		query := bson.M{}
+		filter.apply(&query)
+		for i := len(ops) - 1; i >= 0; i-- {
+			if queryMatches(t, query["data.t"], ops[i].Data.Type) && queryMatches(t, query["event"], ops[i].Event) {
+				return &OperationLastID{ops[i].ID}, nil
+			}
+		}
+		return nil, nil
+	}
+	tests := []struct {
+		query string
+		head  int
+	}{
+		{"", 5},
+		{"types=video", 2},
+		{"types=user", 4},
+		{"types=video,user", 4},
+		{"types=video&events=insert", 0},
+		{"types_exclude=playlist,user", 2},
+		{"events=insert", 3},
+		{"types=channel", -1},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/ops?since=1423995187000&limit=1&"+test.query, nil)
+		req.Header.Set("Accept", "text/event-stream")
+		daemon.ServeHTTP(rec, req)
+		body := rec.Body.String()
+		if test.head == -1 {
+			if strings.Contains(body, "filtered_newest_id") {
+				t.Errorf("%s: unexpected filtered head:\n%s", test.query, body)
+			}
+			continue
+		}
+		if expected := `"filtered_newest_id":"` + ops[test.head].ID.Hex() + `"`; !strings.Contains(body, expected) {
+			t.Errorf("%s: expected %s in the hello event:\n%s", test.query, expected, body)
+		}
+	}
+}
@@ -1,8 +1,6 @@
 package oplog
 
 import (
-	"encoding/json"
-	"fmt"
 	"io"
 	"time"
 )
@@ -13,19 +11,51 @@ type objectState struct {
 	Event     string         `bson:"event"`
 	Timestamp time.Time      `bson:"ts"`
 	Data      *OperationData `bson:"data"`
+	// SchemaVersion is the version of the schema of the stored state, see
+	// decodeObjectState
+	SchemaVersion int `bson:"v,omitempty"`
+}
+
+// stateID returns the _id of the state of an object, "<type>/<id>". As the types can't
+// contain a /, objects of different types sharing an id have distinct states.
+func stateID(data *OperationData) string {
+	return data.Type + "/" + data.ID
+}
+
+// newObjectState returns the state of the object modified by op at ts. The updates and
+// touches are stored as inserts as only the final state of the object is kept. The ts is
+// truncated to the millisecond, the precision of MongoDB dates and of the replication ids,
+// so the states are resumed from their id at the exact ts they are stored with.
+func newObjectState(op *Operation, ts time.Time) objectState {
+	event := op.Event
+	if event == "update" || event == "touch" {
+		event = "insert"
+	}
+	return objectState{
+		ID:            stateID(op.Data),
+		Event:         event,
+		Timestamp:     ts.Truncate(time.Millisecond),
+		Data:          op.Data,
+		SchemaVersion: schemaVersion,
+	}
 }
 
 // GetEventID returns an SSE last event id for the object state
 func (obj objectState) GetEventID() LastID {
-	return &ReplicationLastID{obj.Timestamp.UnixNano() / 1000000, false}
+	return &ReplicationLastID{timestampID(obj.Timestamp), false, obj.ID}
+}
+
+// EventName returns the event of the operation the state results from
+func (obj objectState) EventName() string {
+	return obj.Event
+}
+
+// EventData returns the data of the object, without its payload
+func (obj objectState) EventData() ([]byte, error) {
+	return obj.Data.marshal(false)
 }
 
 // WriteTo serializes an objectState as a SSE compatible message
 func (obj objectState) WriteTo(w io.Writer) (int64, error) {
-	data, err := json.Marshal(obj.Data)
-	if err != nil {
-		return 0, err
-	}
-	n, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", obj.Timestamp.UnixNano()/1000000, obj.Event, data)
-	return int64(n), err
+	return writeSSE(w, obj)
 }
@@ -1,42 +1,343 @@
 package oplog
 
-import "expvar"
+import (
+	"expvar"
+	"sync"
+	"time"
+)
 
 // Stats stores all the statistics about the oplog
 type Stats struct {
 	Status string
 	// Total number of events recieved on the UDP interface
-	EventsReceived *expvar.Int
+	EventsReceived *Int
 	// Total number of events sent thru the SSE interface
-	EventsSent *expvar.Int
+	EventsSent *Int
+	// Total number of bytes sent on the SSE streams, after compression
+	BytesSent *Int
+	// Total number of checkpoint events sent thru the SSE interface
+	CheckpointsSent *Int
 	// Total number of events ingested into MongoDB with success
-	EventsIngested *expvar.Int
+	EventsIngested *Int
+	// Number of operations ingested and sent by event (insert, update or delete) and by
+	// object type, see OpLog.MaxStatsTypes
+	EventsIngestedByEvent *Map
+	EventsIngestedByType  *Map
+	EventsSentByEvent     *Map
+	EventsSentByType      *Map
 	// Total number of events received on the UDP interface with an invalid format
-	EventsError *expvar.Int
+	EventsError *Int
 	// Total number of events discarded because the queue was full
-	EventsDiscarded *expvar.Int
+	EventsDiscarded *Int
+	// Total number of operations whose revision was not greater than the one of the
+	// object state, which was left as is
+	StaleRevisions *Int
+	// Total number of operations and object states skipped because they have a schema
+	// version more recent than the one of the agent, see VersionError
+	UnknownVersions *Int
 	// Current number of events in the ingestion queue
-	QueueSize *expvar.Int
+	QueueSize *Int
 	// Maximum number of events allowed in the ingestion queue before discarding events
-	QueueMaxSize *expvar.Int
+	QueueMaxSize *Int
+	// Highest number of events in the ingestion queue since the start and over the last
+	// minute
+	QueuePeak       *Int
+	QueueRecentPeak *Int
+	// Time spent by the events received on the UDP interface in the ingestion queue
+	QueueLatency *Histogram
 	// Number of clients connected to the SSE API
-	Clients *expvar.Int
+	Clients *Int
 	// Total number of SSE connections
-	Connections *expvar.Int
+	Connections *Int
+	// Total number of connections refused because their client IP made too many
+	// connection attempts
+	ConnectionsRateLimited *Int
+	// Total number of connections refused because their client IP had too many
+	// concurrent connections
+	ConnectionsPerIPRejected *Int
+	// Current number of running tails
+	Tails *Int
+	// Highest number of tails run concurrently
+	TailsPeak *Int
+	// Total number of tails refused because of the concurrent tails limit
+	TailsRejected *Int
+	// Current number of tails streaming live operations
+	TailsLive *Int
+	// Current number of tails replicating object states
+	TailsReplicating *Int
+	// Current number of tails replicating object states because their resume point was
+	// no longer in the capped collection
+	TailsFallback *Int
+	// Highest lag of the running tails in milliseconds, as of the last ActiveTails call
+	TailsMaxLag *Int
+	// Highest and mean lag of the live SSE streams in milliseconds, see ConnectionInfo.Lag
+	ClientsMaxLag  *Int
+	ClientsMeanLag *Int
+	// Current number of live tails subscribed to the shared tail
+	SharedTailSubscribers *Int
+	// Total number of live tails evicted from the shared tail for being too slow
+	SharedTailEvictions *Int
+	// Current number of running replications
+	ReplicationsRunning *Int
+	// Current number of replications waiting for a slot
+	ReplicationsQueued *Int
+	// Total time spent by replications waiting for a slot in milliseconds
+	ReplicationQueueWait *Int
+	// Total number of replications which timed out waiting for a slot
+	ReplicationQueueTimeouts *Int
+	// Total number of live tails which fell back to replication because their resume
+	// point was evicted from the capped collection
+	ResyncFallbacks *Int
+	// Total number of SSE clients which resumed with a filter different from the one of
+	// their last event id
+	FilterMismatches *Int
+	// Total number of last event ids refused or ignored because of an invalid signature
+	UnsignedIDs *Int
+	// Current number of events buffered for SSE clients
+	ClientBuffered *Int
+	// Total number of SSE clients disconnected because their buffer was full
+	SlowConsumerEvictions *Int
+	// Total number of events not sent to the SSE clients disconnected because their
+	// buffer was full
+	EventsDropped *Int
+	// Number of ended streams by reason, see ConnectionInfo.EndReason
+	StreamsEnded *Map
+	// Total number of successful authentications
+	AuthSuccesses *Int
+	// Total number of failed authentications, and by reason: no credentials given,
+	// credentials which can't be decoded, wrong credentials and expired tokens
+	AuthFailures          *Int
+	AuthFailuresMissing   *Int
+	AuthFailuresMalformed *Int
+	AuthFailuresInvalid   *Int
+	AuthFailuresExpired   *Int
+	// Total number of requests of authenticated clients refused because their credentials
+	// are not granted the scope of the endpoint, or the filter is outside of their policy
+	AuthzDeniedScope  *Int
+	AuthzDeniedPolicy *Int
+	// Total number of client IPs banned for failing to authenticate too many times
+	AuthBans *Int
+	// Total number of requests refused because their client IP was banned
+	AuthBanned *Int
+	// Total number of requests refused because of their client IP
+	BlockedRequests *Int
+	// Total number of audit events dropped because the audit sink was lagging
+	AuditDropped *Int
+	// Bytes used by the operations of the capped collection, its maximum size and its
+	// number of operations, as of the last capacity sample
+	CappedBytes    *Int
+	CappedMaxBytes *Int
+	CappedCount    *Int
+	// Age of the oldest and newest operations of the capped collection in milliseconds,
+	// as of the last capacity sample
+	CappedOldestAge *Int
+	CappedNewestAge *Int
+	// Estimated time in milliseconds an operation stays in the capped collection at the
+	// rate operations have been ingested since the previous capacity sample, 0 if nothing
+	// has been ingested
+	CappedRetention *Int
+	// Total number of times the retention watchdog found the head of the capped collection
+	// recorded by its previous check evicted, and the time in milliseconds between the
+	// oldest and newest operations of the capped collection as of its last check, see
+	// OpLog.WatchRetention
+	RetentionBreaches *Int
+	RetentionActual   *Int
+	// Time taken by the live operations from their append to their sending on the SSE
+	// streams
+	DeliveryLatency *Histogram
+	// Duration of the MongoDB calls by kind of operation: insert and upsert of the
+	// appends, tail for the opening of the tailable cursors, replication_page for the
+	// query and the reading of each replication page, last_id, has_id and diff
+	MongoDurations *Histograms
+	// Total number of tailable cursors opened again after the previous one expired or
+	// failed, and of MongoDB sessions refreshed after a failure
+	MongoCursorReopens    *Int
+	MongoSessionRefreshes *Int
+	// Total number of bytes sent on throttled streams
+	ThrottledBytes *Int
+	// Total time spent by streams waiting for their throttling in milliseconds
+	ThrottleWait *Int
 }
 
-// newStats create a new empty stats object
-func newStats() Stats {
+// newStats create a new empty stats object, published as expvars and reported to sink if
+// not nil
+func newStats(sink MetricsSink) Stats {
+	return makeStats(sink, true)
+}
+
+// makeStats creates the statistics reported to sink if not nil, published as expvars if
+// publish is true
+func makeStats(sink MetricsSink, publish bool) Stats {
+	counter := func(name string) *Int {
+		v := &Int{}
+		if sink != nil {
+			v.counter = sink.Counter(name)
+		}
+		if publish {
+			expvar.Publish(name, v)
+		}
+		return v
+	}
+	gauge := func(name string) *Int {
+		v := &Int{isGauge: true}
+		if sink != nil {
+			v.gauge = sink.Gauge(name)
+		}
+		if publish {
+			expvar.Publish(name, v)
+		}
+		return v
+	}
+	counterMap := func(name, label string) *Map {
+		v := &Map{name: name, label: label, sink: sink}
+		if publish {
+			expvar.Publish(name, v)
+		}
+		return v
+	}
+	histogram := func(name string, bounds []time.Duration) *Histogram {
+		h := NewHistogram(bounds...)
+		if sink != nil {
+			h.sink = sink.Histogram(name)
+		}
+		if publish {
+			expvar.Publish(name, h)
+		}
+		return h
+	}
+	histograms := func(name, label string, bounds []time.Duration) *Histograms {
+		hs := NewHistograms(bounds...)
+		hs.name, hs.label, hs.sink = name, label, sink
+		if publish {
+			expvar.Publish(name, hs)
+		}
+		return hs
+	}
 	return Stats{
-		Status:          "OK",
-		EventsReceived:  expvar.NewInt("events_received"),
-		EventsSent:      expvar.NewInt("events_sent"),
-		EventsIngested:  expvar.NewInt("events_ingested"),
-		EventsError:     expvar.NewInt("events_error"),
-		EventsDiscarded: expvar.NewInt("events_discarded"),
-		QueueSize:       expvar.NewInt("queue_size"),
-		QueueMaxSize:    expvar.NewInt("queue_max_size"),
-		Clients:         expvar.NewInt("clients"),
-		Connections:     expvar.NewInt("connections"),
+		Status:                   "OK",
+		EventsReceived:           counter("events_received"),
+		EventsSent:               counter("events_sent"),
+		BytesSent:                counter("bytes_sent"),
+		CheckpointsSent:          counter("checkpoints_sent"),
+		EventsIngested:           counter("events_ingested"),
+		EventsIngestedByEvent:    counterMap("events_ingested_by_event", "event"),
+		EventsIngestedByType:     counterMap("events_ingested_by_type", "type"),
+		EventsSentByEvent:        counterMap("events_sent_by_event", "event"),
+		EventsSentByType:         counterMap("events_sent_by_type", "type"),
+		EventsError:              counter("events_error"),
+		EventsDiscarded:          counter("events_discarded"),
+		StaleRevisions:           counter("stale_revisions"),
+		UnknownVersions:          counter("unknown_versions"),
+		QueueSize:                gauge("queue_size"),
+		QueueMaxSize:             gauge("queue_max_size"),
+		QueuePeak:                gauge("queue_peak"),
+		QueueRecentPeak:          gauge("queue_recent_peak"),
+		QueueLatency:             histogram("queue_latency", mongoBuckets),
+		Clients:                  gauge("clients"),
+		Connections:              counter("connections"),
+		ConnectionsRateLimited:   counter("connections_rate_limited"),
+		ConnectionsPerIPRejected: counter("connections_per_ip_rejected"),
+		Tails:                    gauge("tails"),
+		TailsPeak:                gauge("tails_peak"),
+		TailsRejected:            counter("tails_rejected"),
+		TailsLive:                gauge("tails_live"),
+		TailsReplicating:         gauge("tails_replicating"),
+		TailsFallback:            gauge("tails_fallback"),
+		TailsMaxLag:              gauge("tails_max_lag"),
+		ClientsMaxLag:            gauge("clients_max_lag"),
+		ClientsMeanLag:           gauge("clients_mean_lag"),
+		SharedTailSubscribers:    gauge("shared_tail_subscribers"),
+		SharedTailEvictions:      counter("shared_tail_evictions"),
+		ReplicationsRunning:      gauge("replications_running"),
+		ReplicationsQueued:       gauge("replications_queued"),
+		ReplicationQueueWait:     counter("replication_queue_wait"),
+		ReplicationQueueTimeouts: counter("replication_queue_timeouts"),
+		ResyncFallbacks:          counter("resync_fallbacks"),
+		FilterMismatches:         counter("filter_mismatches"),
+		UnsignedIDs:              counter("unsigned_ids"),
+		ClientBuffered:           gauge("client_buffered"),
+		SlowConsumerEvictions:    counter("slow_consumer_evictions"),
+		EventsDropped:            counter("events_dropped"),
+		StreamsEnded:             counterMap("streams_ended", "reason"),
+		AuthSuccesses:            counter("auth_successes"),
+		AuthFailures:             counter("auth_failures"),
+		AuthFailuresMissing:      counter("auth_failures_missing"),
+		AuthFailuresMalformed:    counter("auth_failures_malformed"),
+		AuthFailuresInvalid:      counter("auth_failures_invalid"),
+		AuthFailuresExpired:      counter("auth_failures_expired"),
+		AuthzDeniedScope:         counter("authz_denied_scope"),
+		AuthzDeniedPolicy:        counter("authz_denied_policy"),
+		AuthBans:                 counter("auth_bans"),
+		AuthBanned:               counter("auth_banned"),
+		BlockedRequests:          counter("blocked_requests"),
+		AuditDropped:             counter("audit_dropped"),
+		CappedBytes:              gauge("capped_bytes"),
+		CappedMaxBytes:           gauge("capped_max_bytes"),
+		CappedCount:              gauge("capped_count"),
+		CappedOldestAge:          gauge("capped_oldest_age"),
+		CappedNewestAge:          gauge("capped_newest_age"),
+		CappedRetention:          gauge("capped_retention"),
+		RetentionBreaches:        counter("retention_breaches"),
+		RetentionActual:          gauge("retention_actual"),
+		DeliveryLatency:          histogram("delivery_latency", latencyBuckets),
+		MongoDurations:           histograms("mongo_durations", "operation", mongoBuckets),
+		MongoCursorReopens:       counter("mongo_cursor_reopens"),
+		MongoSessionRefreshes:    counter("mongo_session_refreshes"),
+		ThrottledBytes:           counter("throttled_bytes"),
+		ThrottleWait:             counter("throttle_wait"),
+	}
+}
+
+// otherTypes is the key counting the object types beyond OpLog.MaxStatsTypes
+const otherTypes = "other"
+
+// statsTypesMu serializes the creation of the per type counters so their number never
+// exceeds the limit
+var statsTypesMu sync.Mutex
+
+// countEvent counts an operation or an object state in byEvent by event and in byType by
+// object type. Once limit object types are counted, the new ones are counted as "other" so
+// the number of counters stays bounded. Other events are not counted.
+func countEvent(byEvent, byType *Map, ev GenericEvent, limit int) {
+	var event string
+	var data *OperationData
+	switch ev := ev.(type) {
+	case Operation:
+		event, data = ev.Event, ev.Data
+	case *Operation:
+		event, data = ev.Event, ev.Data
+	case objectState:
+		event, data = ev.Event, ev.Data
+	case *objectState:
+		event, data = ev.Event, ev.Data
+	default:
+		return
 	}
+	byEvent.Add(event, 1)
+	if data == nil {
+		return
+	}
+	typ := data.Type
+	if byType.Get(typ) == nil && limit > 0 {
+		statsTypesMu.Lock()
+		defer statsTypesMu.Unlock()
+		if byType.Get(typ) == nil {
+			n := 0
+			byType.Do(func(kv expvar.KeyValue) {
+				if kv.Key != otherTypes {
+					n++
+				}
+			})
+			if n >= limit {
+				typ = otherTypes
+			}
+		}
+	}
+	byType.Add(typ, 1)
+}
+
+// countSent counts an event sent to a client by event and object type
+func (daemon *SSEDaemon) countSent(ev GenericEvent) {
+	s := daemon.ol.Stats
+	countEvent(s.EventsSentByEvent, s.EventsSentByType, ev, daemon.ol.MaxStatsTypes)
 }
@@ -0,0 +1,84 @@
+package oplog
+
+import (
+	"expvar"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// counter returns the value of a key of m, 0 if absent
+func counter(m *Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestCountEvent(t *testing.T) {
+	byEvent := new(Map)
+	byType := new(Map)
+	batch := []GenericEvent{
+		Operation{Event: "insert", Data: &OperationData{ID: "1", Type: "video"}},
+		&Operation{Event: "update", Data: &OperationData{ID: "1", Type: "video"}},
+		Operation{Event: "delete", Data: &OperationData{ID: "2", Type: "user"}},
+		Operation{Event: "insert", Data: &OperationData{ID: "3", Type: "playlist"}},
+		objectState{ID: "video/4", Event: "delete", Data: &OperationData{ID: "4", Type: "video"}},
+		Operation{Event: "update", Data: &OperationData{ID: "5", Type: "channel"}},
+		// Technical events are not counted
+		&Event{ID: "1", Event: "reset"},
+		&Checkpoint{ID: "1", Time: time.Now()},
+	}
+	for _, ev := range batch {
+		countEvent(byEvent, byType, ev, 2)
+	}
+	for event, expected := range map[string]int64{"insert": 2, "update": 2, "delete": 2, "reset": 0} {
+		if n := counter(byEvent, event); n != expected {
+			t.Errorf("expected %d %s events, got %d", expected, event, n)
+		}
+	}
+	for typ, expected := range map[string]int64{"video": 3, "user": 1, "other": 2, "playlist": 0, "channel": 0} {
+		if n := counter(byType, typ); n != expected {
+			t.Errorf("expected %d %s events, got %d", expected, typ, n)
+		}
+	}
+}
+
+func TestCountEventNoLimit(t *testing.T) {
+	byEvent := new(Map)
+	byType := new(Map)
+	for _, typ := range []string{"a", "b", "c"} {
+		countEvent(byEvent, byType, Operation{Event: "insert", Data: &OperationData{ID: "1", Type: typ}}, 0)
+	}
+	if counter(byType, "c") != 1 || counter(byType, "other") != 0 {
+		t.Errorf("types limited without limit: %s", byType)
+	}
+}
+
+func TestGetOpsCountsSent(t *testing.T) {
+	ops := []Operation{}
+	for _, s := range []struct{ event, typ string }{{"insert", "countedvideo"}, {"delete", "countedvideo"}, {"update", "counteduser"}} {
+		id := bson.NewObjectId()
+		ops = append(ops, Operation{ID: &id, Event: s.event, Data: &OperationData{ID: "1", Type: s.typ}})
+	}
+	stats := &testStats
+	videos, users := counter(stats.EventsSentByType, "countedvideo"), counter(stats.EventsSentByType, "counteduser")
+	deletes := counter(stats.EventsSentByEvent, "delete")
+
+	daemon := newTestSSEOpsDaemon(ops)
+	req := httptest.NewRequest("GET", "/ops?since=1423995187000&limit=3", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	daemon.ServeHTTP(httptest.NewRecorder(), req)
+
+	if n := counter(stats.EventsSentByType, "countedvideo") - videos; n != 2 {
+		t.Errorf("expected 2 video events sent, got %d", n)
+	}
+	if n := counter(stats.EventsSentByType, "counteduser") - users; n != 1 {
+		t.Errorf("expected 1 user event sent, got %d", n)
+	}
+	if n := counter(stats.EventsSentByEvent, "delete") - deletes; n < 1 {
+		t.Errorf("expected the delete event to be counted, got %d", n)
+	}
+}
@@ -0,0 +1,105 @@
+// Package statsd provides an oplog.MetricsSink sending the statistics of the oplog to a
+// statsd server, with the tags in the DogStatsD format (i.e.: name:1|c|#type:video).
+package statsd
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dailymotion/oplog"
+)
+
+// Sink is an oplog.MetricsSink sending each metric change to a statsd server over UDP
+type Sink struct {
+	conn   net.Conn
+	prefix string
+}
+
+// New creates a sink sending the metrics to the statsd server at addr, their name
+// prefixed by prefix (i.e.: "oplog.")
+func New(addr, prefix string) (*Sink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Sink{conn: conn, prefix: prefix}, nil
+}
+
+// Close closes the connection to the statsd server
+func (s *Sink) Close() error {
+	return s.conn.Close()
+}
+
+// Counter returns a counter sent as a statsd count
+func (s *Sink) Counter(name string, tags ...oplog.Tag) oplog.Counter {
+	return s.metric(name, tags)
+}
+
+// Gauge returns a gauge sent as a statsd gauge
+func (s *Sink) Gauge(name string, tags ...oplog.Tag) oplog.Gauge {
+	return gauge{s.metric(name, tags)}
+}
+
+// Histogram returns a distribution sent as statsd timings in milliseconds
+func (s *Sink) Histogram(name string, tags ...oplog.Tag) oplog.Observer {
+	return s.metric(name, tags)
+}
+
+// metric is a statsd metric with its tags formatted
+type metric struct {
+	s    *Sink
+	name string
+	tags string
+}
+
+func (s *Sink) metric(name string, tags []oplog.Tag) metric {
+	m := metric{s: s, name: s.prefix + name}
+	if len(tags) > 0 {
+		t := make([]string, len(tags))
+		for i, tag := range tags {
+			t[i] = tag.Key + ":" + tag.Value
+		}
+		m.tags = "|#" + strings.Join(t, ",")
+	}
+	return m
+}
+
+// send sends a value of the metric with the given statsd type. Errors are ignored as
+// statsd is best effort.
+func (m metric) send(value, typ string) {
+	m.s.conn.Write([]byte(m.name + ":" + value + "|" + typ + m.tags))
+}
+
+// Add sends a count
+func (m metric) Add(delta int64) {
+	m.send(strconv.FormatInt(delta, 10), "c")
+}
+
+// Observe sends a timing
+func (m metric) Observe(d time.Duration) {
+	m.send(strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', -1, 64), "ms")
+}
+
+// gauge sends statsd gauges, which are relative when signed
+type gauge struct {
+	metric
+}
+
+// Add sends a relative gauge
+func (g gauge) Add(delta int64) {
+	value := strconv.FormatInt(delta, 10)
+	if delta >= 0 {
+		value = "+" + value
+	}
+	g.send(value, "g")
+}
+
+// Set sends an absolute gauge, reset to 0 first when negative as it would be relative
+func (g gauge) Set(value int64) {
+	if value < 0 {
+		g.send("0", "g")
+	}
+	g.send(strconv.FormatInt(value, 10), "g")
+}
@@ -0,0 +1,53 @@
+package statsd
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dailymotion/oplog"
+)
+
+func TestSink(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	s, err := New(l.LocalAddr().String(), "oplog.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Counter("events_sent").Add(2)
+	s.Counter("events_sent_by_type", oplog.Tag{Key: "type", Value: "video"}).Add(1)
+	g := s.Gauge("clients")
+	g.Add(1)
+	g.Add(-1)
+	g.Set(3)
+	g.Set(-2)
+	s.Histogram("delivery_latency").Observe(1500 * time.Microsecond)
+
+	expected := []string{
+		"oplog.events_sent:2|c",
+		"oplog.events_sent_by_type:1|c|#type:video",
+		"oplog.clients:+1|g",
+		"oplog.clients:-1|g",
+		"oplog.clients:3|g",
+		"oplog.clients:0|g",
+		"oplog.clients:-2|g",
+		"oplog.delivery_latency:1.5|ms",
+	}
+	l.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, 512)
+	for _, e := range expected {
+		n, _, err := l.ReadFrom(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b[:n]) != e {
+			t.Errorf("expected %q, got %q", e, b[:n])
+		}
+	}
+}
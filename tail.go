@@ -0,0 +1,922 @@
+package oplog
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// errTailStopped is returned by the tail steps when the tail must not go any further,
+// either because it has been stopped or because its end has been reached.
+var errTailStopped = errors.New("tail stopped")
+
+// TailOptions defines optional settings for a tail.
+type TailOptions struct {
+	// Since defines the time at which the tail starts when no lastID is given: the live
+	// tail starts with the first operation created at or after this time. In replication
+	// mode, object states modified before this time are skipped.
+	Since time.Time
+	// Until defines the time after which the tail stops. Once an event created at or
+	// after this time is reached, an "end" event is sent and no more events are streamed.
+	Until time.Time
+	// InclusiveResume makes a replication resumed from a ReplicationLastID include the
+	// object states modified at the exact time of the id. By default, the resume is
+	// exclusive: it starts right after the object state the id was taken from, or after
+	// the whole millisecond of a timestamp id. Fallback replications are always inclusive.
+	InclusiveResume bool
+	// CheckpointInterval defines the interval at which a Checkpoint event is sent during
+	// live tailing. A value of 0 disables checkpoints.
+	CheckpointInterval time.Duration
+	// History defines a number of past operations to send, oldest first, before starting
+	// the live updates. Only the operations matching the filter and created before the
+	// live updates starting point are sent. History is ignored in replication mode.
+	History int
+}
+
+// reached returns true if the given time is past the Until bound
+func (opts TailOptions) reached(t time.Time) bool {
+	return !opts.Until.IsZero() && !t.Before(opts.Until)
+}
+
+// reserveTail reserves a tail slot for the given last id. If the MaxConcurrentTails
+// limit would be exceeded, false is returned. On success, the returned function must be
+// called once the tail is finished in order to release the slot.
+func (oplog *OpLog) reserveTail(lastID LastID) (release func(), ok bool) {
+	weight := 1
+	if _, ok := lastID.(*ReplicationLastID); ok && oplog.ReplicationTailWeight > 1 {
+		weight = oplog.ReplicationTailWeight
+	}
+
+	oplog.tailsMu.Lock()
+	defer oplog.tailsMu.Unlock()
+	if oplog.MaxConcurrentTails > 0 && oplog.tailsLoad+weight > oplog.MaxConcurrentTails {
+		oplog.Stats.TailsRejected.Add(1)
+		return nil, false
+	}
+	oplog.tailsLoad += weight
+	oplog.Stats.Tails.Add(1)
+	if tails := oplog.Stats.Tails.Value(); tails > oplog.Stats.TailsPeak.Value() {
+		oplog.Stats.TailsPeak.Set(tails)
+	}
+
+	return func() {
+		oplog.tailsMu.Lock()
+		defer oplog.tailsMu.Unlock()
+		oplog.tailsLoad -= weight
+		oplog.Stats.Tails.Add(-1)
+	}, true
+}
+
+// Tail tails all the new operations in the oplog and send the operation in
+// the given channel. If the lastID parameter is given, all operation posted after
+// this event will be returned.
+//
+// If the lastID is a ReplicationLastID (unix timestamp in milliseconds), the tailing will
+// start by replicating all the objects last updated after the timestamp.
+//
+// Giving a lastID of 0 mean replicating all the stored objects before tailing the live updates.
+//
+// The filter argument can be used to filter on some type of objects or objects with given parrents.
+//
+// The create, update, delete events are streamed back to the sender thru the out channel.
+// The receiver owns the events it receives: they are neither reused nor modified by the
+// tail once sent, so they can be retained or modified while the stream continues.
+func (oplog *OpLog) Tail(lastID LastID, filter Filter, out chan<- GenericEvent, stop <-chan bool) {
+	oplog.TailWithOptions(lastID, filter, TailOptions{}, out, stop)
+}
+
+// TailWithOptions works like Tail with the given options applied.
+//
+// When opts.Until is set, an "end" event is sent once the bound is reached and the
+// tail stops streaming. When the MaxConcurrentTails limit is reached, a "retry-later"
+// event is sent and nothing is streamed. In both cases, the stop channel must still be
+// signaled to release the tail.
+func (oplog *OpLog) TailWithOptions(lastID LastID, filter Filter, opts TailOptions, out chan<- GenericEvent, stop <-chan bool) {
+	release, ok := oplog.reserveTail(lastID)
+	if !ok {
+		oplog.logger().Warnf("OPLOG too many concurrent tails, refusing tail")
+		select {
+		case out <- &Event{Event: "retry-later"}:
+			<-stop
+		case <-stop:
+		}
+		return
+	}
+	defer release()
+	oplog.tail(lastID, filter, opts, out, stop)
+}
+
+// tailer holds the state of a running tail
+type tailer struct {
+	ol     *OpLog
+	filter Filter
+	opts   TailOptions
+	out    chan<- GenericEvent
+	// quit is closed once the tail is stopped
+	quit chan struct{}
+	// lastEv is the last sent event, used to resume after a failure
+	lastEv  GenericEvent
+	backoff *backoff.ExponentialBackOff
+	// retry makes the tail retry with backoff on failures instead of returning the error
+	retry bool
+	// info describes the tail for ActiveTails
+	infoMu sync.Mutex
+	info   TailInfo
+	// lastCheckpoint is the time of the last checkpoint sent
+	lastCheckpoint time.Time
+	// liveQuery is the live updates query, built once per tail. Only its _id bound
+	// (liveIDClause) changes when the live updates are restarted.
+	liveQuery    bson.M
+	liveIDClause bson.M
+	// handoff is the time at which the last replication captured its fallback id
+	handoff time.Time
+	// replicated holds the data timestamp of the object states sent by the last
+	// replication which have been modified after the fallback id, and may thus be
+	// streamed again by the live updates.
+	replicated map[string]time.Time
+	// eventsOverridden is set once the client has been warned that a fallback replication
+	// sends the deletes its event filter excludes
+	eventsOverridden bool
+	// cursors counts the tailable cursors opened by the live updates
+	cursors int
+	// pages counts the pages read by the last replication
+	pages int
+}
+
+// newTailer creates a tailer sending its events to the given out channel
+func (oplog *OpLog) newTailer(filter Filter, opts TailOptions, out chan<- GenericEvent, retry bool) *tailer {
+	t := &tailer{
+		ol:      oplog,
+		filter:  filter,
+		opts:    opts,
+		out:     out,
+		quit:    make(chan struct{}),
+		backoff: backoff.NewExponentialBackOff(),
+		retry:   retry,
+	}
+	t.backoff.MaxElapsedTime = 0 // Retry forever
+	return t
+}
+
+// tail implements TailWithOptions once a tail slot has been reserved
+func (oplog *OpLog) tail(lastID LastID, filter Filter, opts TailOptions, out chan<- GenericEvent, stop <-chan bool) {
+	t := oplog.newTailer(filter, opts, out, true)
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t.run(lastID)
+	}()
+
+	<-stop
+	close(t.quit)
+	wg.Wait()
+	oplog.logger().Infof("OPLOG tail closed")
+}
+
+// stopped returns true once the tail has been stopped
+func (t *tailer) stopped() bool {
+	select {
+	case <-t.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// send sends the event to the out channel, returns false if the tail has been stopped
+// in the meantime.
+func (t *tailer) send(ev GenericEvent) bool {
+	select {
+	case t.out <- ev:
+		return true
+	case <-t.quit:
+		return false
+	}
+}
+
+// emit sends an operation or object state event and saves it for resume
+func (t *tailer) emit(ev GenericEvent) bool {
+	if !t.send(ev) {
+		return false
+	}
+	t.lastEv = ev
+	t.sent(ev)
+	return true
+}
+
+// end sends the terminal "end" event once the Until bound is reached
+func (t *tailer) end() {
+	endID := ""
+	if t.lastEv != nil {
+		endID = t.lastEv.GetEventID().String()
+	}
+	t.send(&Event{
+		ID:    endID,
+		Event: "end",
+	})
+}
+
+// checkpoint sends a Checkpoint event if the checkpoint interval elapsed since the last
+// one. The checkpoint id is the id of the last sent event or the id the live updates
+// started from. It returns false if the tail has been stopped.
+func (t *tailer) checkpoint(from *OperationLastID) bool {
+	if t.opts.CheckpointInterval <= 0 || time.Since(t.lastCheckpoint) < t.opts.CheckpointInterval {
+		return true
+	}
+	t.lastCheckpoint = time.Now()
+	id := ""
+	if t.lastEv != nil {
+		id = t.lastEv.GetEventID().String()
+	} else if from != nil {
+		id = from.String()
+	}
+	if id == "" {
+		// Sending an empty id would reset the consumer's resume point
+		return true
+	}
+	return t.send(&Checkpoint{ID: id, Time: t.lastCheckpoint})
+}
+
+// run streams events starting at lastID until the tail is stopped or ended. On failure,
+// the tail is retried with backoff, or the error is returned if retry is disabled.
+func (t *tailer) run(lastID LastID) error {
+	if lastID == nil {
+		// No last id, start the live updates at the Since time if any
+		lastID = (*OperationLastID)(nil)
+	}
+
+	t.ol.register(t)
+	defer t.ol.unregister(t)
+
+	if !t.opts.Since.IsZero() && t.opts.reached(t.opts.Since) {
+		// Until is before Since, there is nothing to stream
+		t.end()
+		return nil
+	}
+
+	db := t.ol.db()
+	defer db.Session.Close()
+
+	t.backoff.Reset()
+
+	if i, ok := lastID.(*OperationLastID); ok && t.opts.History > 0 {
+		if err := t.history(db, i); err == errTailStopped {
+			return nil
+		}
+		if t.lastEv != nil {
+			// Start the live updates after the most recent operation of the history
+			lastID = t.lastEv.GetEventID()
+		}
+	}
+
+	for first := true; ; first = false {
+		var err error
+
+		switch i := lastID.(type) {
+		case *OperationLastID:
+			var evicted bool
+			if evicted, err = t.evicted(i); evicted {
+				// Resume point lost, fallback to replication from the corresponding time
+				if !first && !t.send(&Event{ID: i.String(), Event: "resync-required"}) {
+					return nil
+				}
+				fallbackID := t.ol.fallbackID(i)
+				if !t.send(&Fallback{ID: i.String(), Time: fallbackID.Time()}) {
+					return nil
+				}
+				lastID = fallbackID
+				continue
+			}
+			if err == nil {
+				t.setMode(TailModeLive)
+				err = t.live(db, i)
+			}
+		case *ReplicationLastID:
+			if i.fallbackMode {
+				t.setMode(TailModeFallback)
+				if w := t.fallbackEventsWarning(); w != nil && !t.send(w) {
+					return nil
+				}
+			} else {
+				t.setMode(TailModeReplication)
+			}
+			var fallbackID LastID
+			if fallbackID, err = t.replicate(db, i); err == nil {
+				// Switch to live update at the last operation id inserted before the replication
+				// was started
+				lastID = fallbackID
+				if lastID == nil {
+					lastID = (*OperationLastID)(nil)
+				}
+			}
+		default:
+			fmt.Printf("%#v", lastID)
+			panic("Invalid last id type")
+		}
+
+		if err == errTailStopped {
+			return nil
+		}
+		if err != nil && !t.retry {
+			return err
+		}
+
+		// Prepare for retry with backoff
+		time.Sleep(t.backoff.NextBackOff())
+		t.ol.refresh(db)
+		lastID = t.retryID(lastID)
+	}
+}
+
+// retryID returns the id to retry the tail from after a failure: the id of the last sent
+// event, if any. A failed fallback replication is retried in fallback mode so the deletes
+// are still sent.
+func (t *tailer) retryID(lastID LastID) LastID {
+	if t.lastEv == nil {
+		return lastID
+	}
+	id := t.lastEv.GetEventID()
+	if from, ok := lastID.(*ReplicationLastID); ok && from.fallbackMode {
+		if r, ok := id.(*ReplicationLastID); ok {
+			r.fallbackMode = true
+		}
+	}
+	return id
+}
+
+// fallbackEventsWarning returns the warning to send before a fallback replication when the
+// event filter excludes the deletes, nil if there is none or the client has already been
+// warned. A fallback replication always sends the deleted objects, otherwise the consumer
+// would keep the objects deleted while its resume point was evicted.
+func (t *tailer) fallbackEventsWarning() *Warning {
+	if len(t.filter.Events) == 0 || contains(t.filter.Events, "delete") || t.eventsOverridden {
+		return nil
+	}
+	t.eventsOverridden = true
+	return &Warning{
+		Code:    "events_filter_overridden",
+		Message: "the fallback replication sends the deletes despite the events filter",
+	}
+}
+
+// evicted checks if the operation the live updates must resume from is still in the
+// capped collection. If it has been evicted, the operations created right after it may
+// have been evicted too and can't be streamed anymore.
+func (t *tailer) evicted(from *OperationLastID) (bool, error) {
+	if from == nil {
+		return false, nil
+	}
+	found, err := t.ol.HasID(from)
+	if err != nil {
+		t.ol.warnSampled(err, "OPLOG can't check resume id, retrying: %s", err)
+		return false, err
+	}
+	if !found {
+		t.ol.logger().Warnf("OPLOG resume id %s evicted from the capped collection, falling back to replication", from)
+		t.ol.Stats.ResyncFallbacks.Add(1)
+	}
+	return !found, nil
+}
+
+// stale returns true if the live operation is older than the object state sent by the
+// previous replication. Such an operation is not sent so the consumer never sees an
+// object going back to a previous state after the handoff from replication to live.
+func (t *tailer) stale(operation Operation) bool {
+	if t.replicated == nil {
+		return false
+	}
+	if operation.ID != nil && operation.ID.Time().After(t.handoff) {
+		// Operations created after the handoff are more recent than any replicated state
+		t.replicated = nil
+		return false
+	}
+	id := stateID(operation.Data)
+	ts, found := t.replicated[id]
+	if !found {
+		return false
+	}
+	if operation.Data.Timestamp.Before(ts) {
+		t.ol.logger().Debugf("OPLOG skipping operation older than its replicated state: %s", id)
+		return true
+	}
+	delete(t.replicated, id)
+	return false
+}
+
+// emitOperation sends a live operation
+func (t *tailer) emitOperation(operation Operation) bool {
+	if t.stale(operation) {
+		return true
+	}
+	if t.ol.hasRefs() {
+		// If object URL template is provided, generate it from operation's data
+		t.ol.genRef(operation.Data)
+	}
+	return t.emit(operation)
+}
+
+// history sends the most recent operations created up to the given id, oldest first.
+// On failure, the history is skipped.
+func (t *tailer) history(db *mgo.Database, from *OperationLastID) error {
+	t.ol.logger().Debugf("OPLOG sending %d operations of history", t.opts.History)
+
+	query := bson.M{}
+	t.filter.apply(&query)
+	if from != nil {
+		query["_id"] = bson.M{"$lte": from.ObjectId}
+	}
+	ops := []Operation{}
+	err := db.C("oplog_ops").Find(query).Sort("-$natural").Limit(t.opts.History).All(&ops)
+	if err != nil {
+		t.ol.logger().Warnf("OPLOG can't fetch history, skipping it: %s", err)
+		return err
+	}
+	for i := len(ops) - 1; i >= 0; i-- {
+		if !t.emitOperation(ops[i]) {
+			return errTailStopped
+		}
+	}
+	return nil
+}
+
+// live streams the operations created after the given id until the tail is stopped
+// or the cursor fails.
+func (t *tailer) live(db *mgo.Database, from *OperationLastID) error {
+	if t.ol.SharedTail {
+		return t.liveShared(db, from)
+	}
+
+	t.ol.logger().Debugf("OPLOG start live updates")
+
+	query := t.prepareLiveQuery(from)
+	tailTimeout := 5 * time.Second
+	if t.opts.CheckpointInterval > 0 && t.opts.CheckpointInterval < tailTimeout {
+		tailTimeout = t.opts.CheckpointInterval
+	}
+	start := time.Now()
+	iter := db.C("oplog_ops").Find(query).Sort("$natural").Tail(tailTimeout)
+	defer iter.Close()
+
+	t.lastCheckpoint = time.Now()
+	t.ol.observeMongo("tail", t.lastCheckpoint.Sub(start))
+	t.ol.cursorOpened(t.cursors > 0)
+	t.cursors++
+	empty := true
+	for {
+		for {
+			raw := bson.Raw{}
+			if !iter.Next(&raw) {
+				break
+			}
+			empty = false
+			// Decoded into a fresh value as the consumer owns the sent operations
+			operation, err := decodeStoredOperation(raw)
+			if err != nil {
+				t.ol.undecodable(err)
+				continue
+			}
+			if t.opts.reached(operation.ID.Time()) {
+				t.end()
+				return errTailStopped
+			}
+			if !t.emitOperation(*operation) || !t.checkpoint(from) {
+				return errTailStopped
+			}
+		}
+
+		if iter.Timeout() {
+			if t.stopped() || !t.checkpoint(from) {
+				return errTailStopped
+			}
+			if t.opts.reached(time.Now()) {
+				// No more operation can be created before the until bound
+				t.end()
+				return errTailStopped
+			}
+			// On tail timeout, just wait again
+			continue
+		}
+		break
+	}
+
+	if t.stopped() {
+		return errTailStopped
+	}
+
+	if err := iter.Err(); err != nil {
+		t.ol.warnSampled(err, "OPLOG tail failed with error, try to reconnect: %s", err)
+		return err
+	}
+	if empty {
+		// This mostly happen when the tail cursor is on an empty collection
+		if t.opts.reached(time.Now()) {
+			t.end()
+			return errTailStopped
+		}
+		t.ol.logger().Debugf("OPLOG ops collection is empty, retrying")
+		return nil
+	}
+	// Reset the backoff counter
+	t.backoff.Reset()
+	return nil
+}
+
+// prepareLiveQuery returns the live updates query starting after the given id. The
+// filter part of the query is built on the first call only, following calls only update
+// the _id bound.
+func (t *tailer) prepareLiveQuery(from *OperationLastID) bson.M {
+	if t.liveQuery == nil {
+		t.liveQuery = bson.M{}
+		t.filter.apply(&t.liveQuery)
+		t.liveIDClause = bson.M{}
+	}
+	delete(t.liveIDClause, "$gt")
+	delete(t.liveIDClause, "$gte")
+	if from != nil {
+		// Resuming at given last id
+		t.liveIDClause["$gt"] = *from.ObjectId
+	} else if !t.opts.Since.IsZero() {
+		// Starting at the first operation created after the since time
+		t.liveIDClause["$gte"] = bson.NewObjectIdWithTime(t.opts.Since)
+	}
+	if len(t.liveIDClause) > 0 {
+		t.liveQuery["_id"] = t.liveIDClause
+	} else {
+		delete(t.liveQuery, "_id")
+	}
+	return t.liveQuery
+}
+
+// liveShared streams the operations created after the given id thru the shared tail.
+// Operations created before the subscription to the shared tail are fetched first.
+func (t *tailer) liveShared(db *mgo.Database, from *OperationLastID) error {
+	t.ol.logger().Debugf("OPLOG start shared live updates")
+
+	sub, err := t.ol.hub.subscribe()
+	if err != nil {
+		t.ol.warnSampled(err, "OPLOG can't subscribe to the shared tail: %s", err)
+		return err
+	}
+	defer t.ol.hub.unsubscribe(sub)
+
+	if sub.from != nil && (from != nil || !t.opts.Since.IsZero()) {
+		// Catch up with the operations created before the subscription
+		query := bson.M{}
+		t.filter.apply(&query)
+		idClause := bson.M{"$lte": *sub.from}
+		if from != nil {
+			idClause["$gt"] = from.ObjectId
+		} else {
+			idClause["$gte"] = bson.NewObjectIdWithTime(t.opts.Since)
+		}
+		query["_id"] = idClause
+		iter := db.C("oplog_ops").Find(query).Sort("$natural").Iter()
+		for {
+			raw := bson.Raw{}
+			if !iter.Next(&raw) {
+				break
+			}
+			// Decoded into a fresh value as the consumer owns the sent operations
+			operation, err := decodeStoredOperation(raw)
+			if err != nil {
+				t.ol.undecodable(err)
+				continue
+			}
+			if t.opts.reached(operation.ID.Time()) {
+				iter.Close()
+				t.end()
+				return errTailStopped
+			}
+			if !t.emitOperation(*operation) {
+				iter.Close()
+				return errTailStopped
+			}
+		}
+		if err := iter.Close(); err != nil {
+			t.ol.warnSampled(err, "OPLOG catch up failed with error, retrying: %s", err)
+			return err
+		}
+	}
+
+	var untilC <-chan time.Time
+	if !t.opts.Until.IsZero() {
+		timer := time.NewTimer(t.opts.Until.Sub(time.Now()))
+		defer timer.Stop()
+		untilC = timer.C
+	}
+
+	t.lastCheckpoint = time.Now()
+	var checkpointC <-chan time.Time
+	if t.opts.CheckpointInterval > 0 {
+		ticker := time.NewTicker(t.opts.CheckpointInterval)
+		defer ticker.Stop()
+		checkpointC = ticker.C
+	}
+
+	t.backoff.Reset()
+	for {
+		select {
+		case <-checkpointC:
+			if !t.checkpoint(from) {
+				return errTailStopped
+			}
+		case op, ok := <-sub.ops:
+			if !ok {
+				t.ol.logger().Warnf("OPLOG tail evicted from the shared tail, catching up")
+				return errSubscriberEvicted
+			}
+			if from != nil && *op.ID <= *from.ObjectId {
+				// The hub may be behind the resume id, the consumer already has this one
+				continue
+			}
+			if !t.filter.matchOperation(op) {
+				continue
+			}
+			if t.opts.reached(op.ID.Time()) {
+				t.end()
+				return errTailStopped
+			}
+			// Operations are shared between subscribers, the consumer owns a copy
+			if !t.emitOperation(op.Clone()) {
+				return errTailStopped
+			}
+		case <-untilC:
+			t.end()
+			return errTailStopped
+		case <-t.quit:
+			return errTailStopped
+		}
+	}
+}
+
+// replicate streams the object states modified after the given id, and returns the id of
+// the last operation at the time the replication started so the live updates can resume
+// from there.
+func (t *tailer) replicate(db *mgo.Database, i *ReplicationLastID) (LastID, error) {
+	if max := t.ol.MaxConcurrentReplications; max > 0 {
+		slot := t.ol.replications.enter(max)
+		defer t.ol.replications.leave(slot)
+		if err := t.waitReplicationSlot(slot); err != nil {
+			return nil, err
+		}
+	}
+
+	t.ol.logger().Debugf("OPLOG start replication")
+
+	if i.int64 == 0 && t.lastEv == nil {
+		// When full replication is requested, start by sending a "reset" event to instruct
+		// the consumer to reset its database before processing further operations.
+		// The id is 1 so if connection is lost after this event and consumer processed the event,
+		// the connection recover won't trigger a second "reset" event.
+		if !t.send(&Event{ID: "1", Event: "reset"}) {
+			return nil, errTailStopped
+		}
+	}
+
+	// Capture the current oplog position in order to resume at this position
+	// once replication or fallback is done. This also serves a upper limit for
+	// the fetching of the data.
+	fallbackID, err := t.ol.LastID()
+	if err != nil {
+		t.ol.warnSampled(err, "OPLOG error retriving replication fallback id: %s", err)
+		return nil, err
+	}
+	// Object states modified up to the handoff time are sent by the replication. As an
+	// object state is written after its operation, all the operations up to the fallback
+	// id are covered. Operations created after the fallback id may also be streamed again
+	// by the live updates, those older than the replicated state are then skipped. The
+	// handoff has the millisecond precision of the stored ts, see newObjectState.
+	t.handoff = time.Now().Truncate(time.Millisecond)
+	t.replicated = make(map[string]time.Time)
+	var fallbackTime time.Time
+	if fallbackID != nil {
+		fallbackTime = fallbackID.Time()
+	}
+
+	query, tsClause := t.replicationQuery(i, t.handoff)
+
+	t.pages = 0
+	for {
+		c, err := t.replicatePage(db, query, fallbackTime)
+		if err != nil {
+			return nil, err
+		}
+
+		if t.lastEv != nil && c == t.ol.PageSize {
+			// We consumed on page of event, go to the next page
+			resumeAfter(query, tsClause, t.lastEv.GetEventID().(*ReplicationLastID))
+			continue
+		}
+
+		// When the number of returned item is lower than page size, we can assume we where
+		// on the last "page".
+		break
+	}
+
+	if t.opts.reached(t.handoff) {
+		// All the operations after the replication are past the until bound
+		t.end()
+		return nil, errTailStopped
+	}
+
+	// Replication is done, notify and swtich to live event stream
+	//
+	// Send a "live" operation to inform the consumer it is no live event stream.
+	// We use the last event id here in order to ensure the consumer will resume
+	// the replication starting at this point in time in case of a failure after
+	// the "live" event.
+	liveID := "" // default value
+	if t.lastEv != nil {
+		liveID = t.lastEv.GetEventID().String()
+	}
+	if !t.send(&Event{ID: liveID, Event: "live", Data: map[string]interface{}{"pages": t.pages}}) {
+		return nil, errTailStopped
+	}
+	t.lastEv = nil
+
+	// Reset the backoff counter
+	t.backoff.Reset()
+	return fallbackID, nil
+}
+
+// stateIterator iterates over a page of object states, implemented by *mgo.Iter
+type stateIterator interface {
+	Next(result interface{}) bool
+	Close() error
+}
+
+// statesPage queries a page of the object states matching query
+func (oplog *OpLog) statesPage(db *mgo.Database, query bson.M) stateIterator {
+	if oplog.openStatesPage != nil {
+		return oplog.openStatesPage(query)
+	}
+	return db.C("oplog_states").Find(query).Sort("ts", "_id").Limit(oplog.PageSize).Iter()
+}
+
+// replicatePage streams a page of the object states matching query and returns the number
+// of object states sent. The time spent by MongoDB on the page, the client consuming the
+// object states excluded, is observed as replication_page and logged when above
+// SlowReplicationPage.
+func (t *tailer) replicatePage(db *mgo.Database, query bson.M, fallbackTime time.Time) (int, error) {
+	// Iterate over the collection using "page" of 1000 items so we don't hold a read lock
+	// on the db for too long when the states collection is large or the reader is slow
+	start := time.Now()
+	iter := t.ol.statesPage(db, query)
+	elapsed := time.Since(start)
+
+	c := 0
+	var first, last time.Time
+	for {
+		// Decoded into a fresh value as the consumer owns the sent object states
+		object := objectState{}
+		next := time.Now()
+		ok := iter.Next(&object)
+		elapsed += time.Since(next)
+		if !ok {
+			break
+		}
+		if err := checkObjectState(object); err != nil {
+			t.ol.undecodable(err)
+			continue
+		}
+		if c == 0 {
+			first = object.Timestamp
+		}
+		last = object.Timestamp
+		if t.ol.hasRefs() {
+			t.ol.genRef(object.Data)
+		}
+		if !object.Timestamp.Before(fallbackTime) && object.Data != nil {
+			t.replicated[object.ID] = object.Data.Timestamp
+		}
+		if !t.emit(object) {
+			iter.Close()
+			return c, errTailStopped
+		}
+		c++
+	}
+
+	if err := iter.Close(); err != nil {
+		t.ol.warnSampled(err, "OPLOG replication failed with error, retrying: %s", err)
+		return c, err
+	}
+	t.pages++
+	t.ol.observeMongo("replication_page", elapsed)
+	if slow := t.ol.SlowReplicationPage; slow > 0 && elapsed > slow {
+		if c == 0 {
+			t.ol.logger().Warnf("OPLOG slow replication page %d: no object state in %s", t.pages, elapsed)
+		} else {
+			t.ol.logger().Warnf("OPLOG slow replication page %d: %d object states from ts %s to %s in %s", t.pages, c, first.Format(time.RFC3339Nano), last.Format(time.RFC3339Nano), elapsed)
+		}
+	}
+	return c, nil
+}
+
+// waitReplicationSlot waits for the replication slot to be ready, sending Queued events
+// in the meantime. If the wait times out, a "retry-later" event is sent and the tail ends.
+func (t *tailer) waitReplicationSlot(slot *replicationSlot) error {
+	start := time.Now()
+	defer func() {
+		t.ol.Stats.ReplicationQueueWait.Add(int64(time.Since(start) / time.Millisecond))
+	}()
+
+	var timeout <-chan time.Time
+	if t.ol.ReplicationQueueTimeout > 0 {
+		timer := time.NewTimer(t.ol.ReplicationQueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var feedback <-chan time.Time
+	if t.ol.ReplicationQueueFeedback > 0 {
+		ticker := time.NewTicker(t.ol.ReplicationQueueFeedback)
+		defer ticker.Stop()
+		feedback = ticker.C
+	}
+
+	for {
+		select {
+		case <-slot.ready:
+			return nil
+		case <-feedback:
+			if pos := t.ol.replications.position(slot); pos > 0 {
+				if !t.send(&Queued{Position: pos}) {
+					return errTailStopped
+				}
+			}
+		case <-timeout:
+			t.ol.logger().Warnf("OPLOG replication timed out waiting for a slot")
+			t.ol.Stats.ReplicationQueueTimeouts.Add(1)
+			t.send(&Event{Event: "retry-later"})
+			return errTailStopped
+		case <-t.quit:
+			return errTailStopped
+		}
+	}
+}
+
+// replicationQuery builds the query on the states collection for a replication starting
+// at the given id, up to the given handoff time.
+func (t *tailer) replicationQuery(i *ReplicationLastID, handoff time.Time) (query, tsClause bson.M) {
+	query = bson.M{}
+	t.filter.apply(&query)
+	tsClause = bson.M{}
+	query["ts"] = tsClause
+	if i.object != "" && !t.opts.InclusiveResume {
+		// Resuming precisely after the last sent object state
+		resumeAfter(query, tsClause, i)
+	} else if i.int64 > 0 {
+		// Id is a timestamp, timestamp are always valid
+		if i.fallbackMode || t.opts.InclusiveResume {
+			tsClause["$gte"] = i.Time()
+		} else {
+			tsClause["$gt"] = i.Time()
+		}
+	}
+	if !t.opts.Since.IsZero() && t.opts.Since.After(i.Time()) {
+		delete(tsClause, "$gt")
+		tsClause["$gte"] = t.opts.Since
+	}
+	if !handoff.IsZero() {
+		// Do not fetch any new object modified after the switch to live updates
+		tsClause["$lte"] = handoff
+	}
+	if !t.opts.Until.IsZero() {
+		tsClause["$lt"] = t.opts.Until
+	}
+	if !i.fallbackMode {
+		// In replication mode, do only notify about inserts
+		query["event"] = "insert"
+		if len(t.filter.Events) > 0 && !contains(t.filter.Events, "insert") {
+			// Nothing can match an empty $in
+			query["event"] = bson.M{"$in": []string{}}
+		}
+	} else if len(t.filter.Events) > 0 {
+		// In fallback mode (when operation id is no longer in the capped collection),
+		// we must not filter deletes otherwise the consumer will get out of sync, whatever
+		// the events filter, see fallbackEventsWarning
+		query["event"] = "delete"
+		if contains(t.filter.Events, "insert") {
+			query["event"] = bson.M{"$in": []string{"insert", "delete"}}
+		}
+	}
+	return
+}
+
+// resumeAfter updates a replication query so it starts right after the object state
+// the given id has been generated from, using the (ts, _id) sort order.
+func resumeAfter(query, tsClause bson.M, i *ReplicationLastID) {
+	ts := i.Time()
+	delete(tsClause, "$gt")
+	tsClause["$gte"] = ts
+	query["$or"] = []bson.M{
+		{"ts": bson.M{"$gt": ts}},
+		{"ts": ts, "_id": bson.M{"$gt": i.object}},
+	}
+}
@@ -0,0 +1,1043 @@
+package oplog
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// TailOptions.reached()
+
+func TestTailOptionsReachedNoUntil(t *testing.T) {
+	opts := TailOptions{}
+	if opts.reached(time.Now()) {
+		t.Fail()
+	}
+}
+
+func TestTailOptionsReached(t *testing.T) {
+	until := time.Unix(1423995187, 0)
+	opts := TailOptions{Until: until}
+	if opts.reached(until.Add(-time.Millisecond)) {
+		t.Fail()
+	}
+	if !opts.reached(until) {
+		t.Fail()
+	}
+	if !opts.reached(until.Add(time.Second)) {
+		t.Fail()
+	}
+}
+
+// reserveTail()
+
+func TestReserveTailUnlimited(t *testing.T) {
+	ol := newTestOpLog()
+	for i := 0; i < 10; i++ {
+		if _, ok := ol.reserveTail(nil); !ok {
+			t.Fatal("tail refused with no limit")
+		}
+	}
+}
+
+func TestReserveTailLimit(t *testing.T) {
+	ol := newTestOpLog()
+	ol.MaxConcurrentTails = 2
+	r1, ok := ol.reserveTail(nil)
+	if !ok {
+		t.Fatal("first tail refused")
+	}
+	if _, ok := ol.reserveTail(nil); !ok {
+		t.Fatal("second tail refused")
+	}
+	if _, ok := ol.reserveTail(nil); ok {
+		t.Fatal("third tail accepted")
+	}
+	r1()
+	if _, ok := ol.reserveTail(nil); !ok {
+		t.Fatal("tail refused after release")
+	}
+}
+
+func TestTailRefusedStopped(t *testing.T) {
+	ol := newTestOpLog()
+	ol.MaxConcurrentTails = 1
+	if _, ok := ol.reserveTail(nil); !ok {
+		t.Fatal("first tail refused")
+	}
+	// The consumer is gone and never reads the retry-later event
+	out := make(chan GenericEvent)
+	stop := make(chan bool)
+	done := make(chan struct{})
+	go func() {
+		ol.TailWithOptions(nil, Filter{}, TailOptions{}, out, stop)
+		close(done)
+	}()
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("refused tail not released on stop")
+	}
+}
+
+func TestReserveTailReplicationWeight(t *testing.T) {
+	ol := newTestOpLog()
+	ol.MaxConcurrentTails = 3
+	ol.ReplicationTailWeight = 2
+	if _, ok := ol.reserveTail(&ReplicationLastID{0, false, ""}); !ok {
+		t.Fatal("replication refused")
+	}
+	if _, ok := ol.reserveTail(&ReplicationLastID{0, false, ""}); ok {
+		t.Fatal("second replication accepted")
+	}
+	if _, ok := ol.reserveTail(&OperationLastID{}); !ok {
+		t.Fatal("live tail refused")
+	}
+}
+
+// tailer.replicationQuery()
+
+func TestReplicationQueryExclusive(t *testing.T) {
+	tl := &tailer{}
+	i := &ReplicationLastID{1423995187898, false, ""}
+	_, tsClause := tl.replicationQuery(i, time.Time{})
+	if tsClause["$gt"] != i.Time() {
+		t.Fatal("resume is not exclusive")
+	}
+	if _, ok := tsClause["$gte"]; ok {
+		t.Fatal("resume is inclusive")
+	}
+}
+
+func TestReplicationQueryInclusive(t *testing.T) {
+	tl := &tailer{opts: TailOptions{InclusiveResume: true}}
+	i := &ReplicationLastID{1423995187898, false, ""}
+	_, tsClause := tl.replicationQuery(i, time.Time{})
+	if tsClause["$gte"] != i.Time() {
+		t.Fatal("resume is not inclusive")
+	}
+}
+
+func TestReplicationQueryFallbackInclusive(t *testing.T) {
+	tl := &tailer{}
+	i := &ReplicationLastID{1423995187898, true, ""}
+	query, tsClause := tl.replicationQuery(i, time.Time{})
+	if tsClause["$gte"] != i.Time() {
+		t.Fatal("fallback resume is not inclusive")
+	}
+	if _, ok := query["event"]; ok {
+		t.Fatal("fallback replication must not filter on events")
+	}
+}
+
+func TestReplicationQueryFull(t *testing.T) {
+	tl := &tailer{}
+	query, tsClause := tl.replicationQuery(&ReplicationLastID{0, false, ""}, time.Time{})
+	if len(tsClause) != 0 {
+		t.Fatal("full replication has a lower bound")
+	}
+	if query["event"] != "insert" {
+		t.Fatal("replication doesn't filter on inserts")
+	}
+}
+
+func TestReplicationQueryResumeAfterObject(t *testing.T) {
+	tl := &tailer{}
+	obj := objectState{ID: "video/1", Timestamp: time.Unix(1423995187, 898000000)}
+	// Reconnecting repeatedly at the same id must always build the same bounds
+	for n := 0; n < 3; n++ {
+		query, tsClause := tl.replicationQuery(obj.GetEventID().(*ReplicationLastID), time.Time{})
+		if tsClause["$gte"] != obj.Timestamp {
+			t.Fatal("invalid lower bound")
+		}
+		or, ok := query["$or"].([]bson.M)
+		if !ok || len(or) != 2 {
+			t.Fatal("missing (ts, _id) cursor")
+		}
+		if or[1]["_id"].(bson.M)["$gt"] != "video/1" {
+			t.Fatal("resume doesn't exclude the last object")
+		}
+	}
+}
+
+func TestReplicationQueryBounds(t *testing.T) {
+	since := time.Unix(1423995187, 0)
+	until := time.Unix(1423995287, 0)
+	tl := &tailer{opts: TailOptions{Since: since, Until: until}}
+	_, tsClause := tl.replicationQuery(&ReplicationLastID{1, false, ""}, until)
+	if tsClause["$gte"] != since || tsClause["$lt"] != until || tsClause["$lte"] != until {
+		t.Fatalf("invalid bounds: %#v", tsClause)
+	}
+	if _, ok := tsClause["$gt"]; ok {
+		t.Fatal("since doesn't override the resume bound")
+	}
+}
+
+func TestReplicationQueryEventsFilter(t *testing.T) {
+	// Object states sent by a replication, tombstones included
+	states := []string{"insert", "delete", "insert", "delete"}
+	tests := []struct {
+		events   []string
+		fallback bool
+		sent     string
+	}{
+		{nil, false, "insert,insert"},
+		{nil, true, "insert,delete,insert,delete"},
+		{[]string{"insert"}, false, "insert,insert"},
+		// The tombstones are sent in fallback mode whatever the events filter
+		{[]string{"insert"}, true, "insert,delete,insert,delete"},
+		{[]string{"update"}, false, ""},
+		{[]string{"update"}, true, "delete,delete"},
+		{[]string{"delete"}, false, ""},
+		{[]string{"delete"}, true, "delete,delete"},
+	}
+	for _, test := range tests {
+		tl := &tailer{filter: Filter{Events: test.events}}
+		query, _ := tl.replicationQuery(&ReplicationLastID{1423995187898, test.fallback, ""}, time.Time{})
+		sent := []string{}
+		for _, event := range states {
+			if queryMatches(t, query["event"], event) {
+				sent = append(sent, event)
+			}
+		}
+		if strings.Join(sent, ",") != test.sent {
+			t.Errorf("events %v, fallback %v: expected %q to be sent, got %q", test.events, test.fallback, test.sent, strings.Join(sent, ","))
+		}
+	}
+}
+
+// tailer.fallbackEventsWarning()
+
+func TestFallbackEventsWarning(t *testing.T) {
+	for _, events := range [][]string{nil, {"delete"}, {"insert", "delete"}} {
+		tl := &tailer{filter: Filter{Events: events}}
+		if w := tl.fallbackEventsWarning(); w != nil {
+			t.Errorf("events %v: unexpected warning %#v", events, w)
+		}
+	}
+	tl := &tailer{filter: Filter{Events: []string{"insert"}}}
+	w := tl.fallbackEventsWarning()
+	if w == nil || w.Code != "events_filter_overridden" {
+		t.Fatalf("expected the client to be warned, got %#v", w)
+	}
+	if w := tl.fallbackEventsWarning(); w != nil {
+		t.Errorf("client warned twice: %#v", w)
+	}
+}
+
+// tailer.retryID()
+
+func TestRetryIDFallback(t *testing.T) {
+	obj := objectState{ID: "video/1", Event: "delete", Timestamp: time.Unix(1423995187, 898000000)}
+	tl := &tailer{lastEv: obj}
+	id, ok := tl.retryID(&ReplicationLastID{1423995187000, true, ""}).(*ReplicationLastID)
+	if !ok || !id.fallbackMode || id.object != "video/1" {
+		t.Errorf("fallback replication not retried in fallback mode: %#v", id)
+	}
+	id, ok = tl.retryID(&ReplicationLastID{1423995187000, false, ""}).(*ReplicationLastID)
+	if !ok || id.fallbackMode {
+		t.Errorf("replication retried in fallback mode: %#v", id)
+	}
+	from := &ReplicationLastID{1423995187000, true, ""}
+	if id := (&tailer{}).retryID(from); id != from {
+		t.Errorf("expected the tail to be retried from its start id, got %#v", id)
+	}
+}
+
+// tailer.checkpoint()
+
+func TestCheckpointDisabled(t *testing.T) {
+	out := make(chan GenericEvent, 1)
+	tl := &tailer{out: out, lastEv: objectState{ID: "a"}}
+	tl.checkpoint(nil)
+	if len(out) != 0 {
+		t.Fatal("checkpoint sent while disabled")
+	}
+}
+
+func TestCheckpointInterval(t *testing.T) {
+	out := make(chan GenericEvent, 1)
+	oid := bson.NewObjectId()
+	from := &OperationLastID{&oid}
+	tl := &tailer{out: out, opts: TailOptions{CheckpointInterval: time.Hour}, lastCheckpoint: time.Now()}
+	tl.checkpoint(from)
+	if len(out) != 0 {
+		t.Fatal("checkpoint sent before the interval")
+	}
+	tl.lastCheckpoint = time.Now().Add(-2 * time.Hour)
+	tl.checkpoint(from)
+	c, ok := (<-out).(*Checkpoint)
+	if !ok {
+		t.Fatal("checkpoint not sent")
+	}
+	if c.ID != oid.Hex() {
+		t.Fatal("checkpoint id isn't the resume id")
+	}
+}
+
+func TestCheckpointNoID(t *testing.T) {
+	out := make(chan GenericEvent, 1)
+	tl := &tailer{out: out, opts: TailOptions{CheckpointInterval: time.Second}}
+	tl.checkpoint(nil)
+	if len(out) != 0 {
+		t.Fatal("checkpoint sent with an empty id")
+	}
+}
+
+func TestPrepareLiveQueryReconnect(t *testing.T) {
+	tl := &tailer{filter: Filter{Types: []string{"video", "user"}, Parents: []string{"x/1"}}}
+	id1 := bson.NewObjectIdWithTime(time.Unix(1423995187, 0))
+	id2 := bson.NewObjectIdWithTime(time.Unix(1423995188, 0))
+	query := tl.prepareLiveQuery(&OperationLastID{&id1})
+	if query["_id"].(bson.M)["$gt"] != id1 {
+		t.Fatal("invalid initial bound")
+	}
+	// A reconnect only moves the _id bound, the filter is left unchanged
+	query = tl.prepareLiveQuery(&OperationLastID{&id2})
+	idClause := query["_id"].(bson.M)
+	if idClause["$gt"] != id2 || len(idClause) != 1 {
+		t.Fatal("bound not swapped on reconnect")
+	}
+	expected := bson.M{}
+	tl.filter.apply(&expected)
+	expected["_id"] = bson.M{"$gt": id2}
+	if !reflect.DeepEqual(query, expected) {
+		t.Fatalf("prepared query differs from a fresh one: %#v", query)
+	}
+	// Without a resume id, the bound is removed
+	if _, ok := tl.prepareLiveQuery(nil)["_id"]; ok {
+		t.Fatal("bound not removed")
+	}
+}
+
+func TestPrepareLiveQuerySince(t *testing.T) {
+	since := time.Unix(1423995187, 0)
+	tl := &tailer{opts: TailOptions{Since: since}}
+	query := tl.prepareLiveQuery(nil)
+	if query["_id"].(bson.M)["$gte"] != bson.NewObjectIdWithTime(since) {
+		t.Fatal("invalid since bound")
+	}
+	id := bson.NewObjectIdWithTime(since.Add(time.Second))
+	idClause := tl.prepareLiveQuery(&OperationLastID{&id})["_id"].(bson.M)
+	if _, ok := idClause["$gte"]; ok || idClause["$gt"] != id {
+		t.Fatal("since bound kept after resume")
+	}
+}
+
+func BenchmarkPrepareLiveQuery(b *testing.B) {
+	tl := &tailer{filter: Filter{Types: []string{"video", "user"}, Parents: []string{"x/1"}}}
+	id := bson.NewObjectId()
+	from := &OperationLastID{&id}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		tl.prepareLiveQuery(from)
+	}
+}
+
+func BenchmarkDecodeStoredOperation(b *testing.B) {
+	id := bson.NewObjectId()
+	doc, _ := bson.Marshal(Operation{
+		ID:            &id,
+		Event:         "insert",
+		Data:          &OperationData{ID: "1", Type: "video", Parents: []string{"x/1"}, Timestamp: time.Now()},
+		SchemaVersion: schemaVersion,
+	})
+	raw := bson.Raw{Kind: 3, Data: doc}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := decodeStoredOperation(raw); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// tailer.stale()
+
+func TestHandoffNoStateRegression(t *testing.T) {
+	base := time.Unix(1423995187, 0)
+	out := make(chan GenericEvent, 10)
+	tl := &tailer{ol: newTestOpLog(), out: out, quit: make(chan struct{})}
+	tl.handoff = base.Add(500 * time.Millisecond)
+	// Object states sent by the replication, which started while video/1 and video/2
+	// were being updated
+	consumer := map[string]time.Time{
+		"video/1": base.Add(300 * time.Millisecond),
+		"video/2": base.Add(100 * time.Millisecond),
+	}
+	tl.replicated = map[string]time.Time{}
+	for id, ts := range consumer {
+		tl.replicated[id] = ts
+	}
+	op := func(id string, ts, created time.Time) Operation {
+		oid := bson.NewObjectIdWithTime(created)
+		return Operation{
+			ID:    &oid,
+			Event: "update",
+			Data:  &OperationData{ID: id[6:], Type: id[:5], Timestamp: ts},
+		}
+	}
+	// Operations streamed again by the live updates, then a new one
+	ops := []Operation{
+		op("video/1", base.Add(100*time.Millisecond), base),
+		op("video/2", base.Add(100*time.Millisecond), base),
+		op("video/1", base.Add(300*time.Millisecond), base),
+		op("video/3", base.Add(400*time.Millisecond), base),
+		op("video/1", base.Add(2*time.Second), base.Add(2*time.Second)),
+	}
+	for _, o := range ops {
+		if !tl.emitOperation(o) {
+			t.Fatal("tail stopped")
+		}
+	}
+	sent := []string{}
+	for len(out) > 0 {
+		o := (<-out).(Operation)
+		id := o.Data.GetID()
+		if ts, found := consumer[id]; found && o.Data.Timestamp.Before(ts) {
+			t.Fatalf("state regression for %s", id)
+		}
+		consumer[id] = o.Data.Timestamp
+		sent = append(sent, id)
+	}
+	expected := []string{"video/2", "video/1", "video/3", "video/1"}
+	if !reflect.DeepEqual(sent, expected) {
+		t.Fatalf("invalid operations sent: %v", sent)
+	}
+	if tl.replicated != nil {
+		t.Fatal("replicated states kept after the handoff")
+	}
+}
+
+func TestStaleWithoutReplication(t *testing.T) {
+	tl := &tailer{}
+	if tl.stale(Operation{Data: &OperationData{ID: "1", Type: "video"}}) {
+		t.Fatal("operation skipped without replication")
+	}
+}
+
+// slowStateIterator is a page of object states taking delay to read each of them
+type slowStateIterator struct {
+	states []objectState
+	delay  time.Duration
+}
+
+func (it *slowStateIterator) Next(result interface{}) bool {
+	time.Sleep(it.delay)
+	if len(it.states) == 0 {
+		return false
+	}
+	*result.(*objectState) = it.states[0]
+	it.states = it.states[1:]
+	return true
+}
+
+func (it *slowStateIterator) Close() error {
+	return nil
+}
+
+func TestReplicatePageSlow(t *testing.T) {
+	ol := newTestOpLog()
+	stats := *ol.Stats
+	stats.MongoDurations = NewHistograms(mongoBuckets...)
+	ol.Stats = &stats
+	logger := &capturingLogger{}
+	ol.Logger = logger
+	ol.SlowReplicationPage = 20 * time.Millisecond
+	ts := time.Date(2015, 2, 15, 10, 13, 7, 0, time.UTC)
+	states := []objectState{
+		{ID: "video/1", Event: "insert", Timestamp: ts, Data: &OperationData{Type: "video", ID: "1"}},
+		{ID: "video/2", Event: "insert", Timestamp: ts.Add(time.Second), Data: &OperationData{Type: "video", ID: "2"}},
+	}
+	var delay time.Duration
+	ol.openStatesPage = func(query bson.M) stateIterator {
+		return &slowStateIterator{append([]objectState{}, states...), delay}
+	}
+	out := make(chan GenericEvent, 10)
+	tl := ol.newTailer(Filter{}, TailOptions{}, out, false)
+	tl.replicated = map[string]time.Time{}
+
+	// A cold states collection
+	delay = 10 * time.Millisecond
+	if c, err := tl.replicatePage(nil, bson.M{}, time.Time{}); c != 2 || err != nil {
+		t.Fatalf("expected 2 object states, got %d, %v", c, err)
+	}
+	expected := "warn OPLOG slow replication page 1: 2 object states from ts 2015-02-15T10:13:07Z to 2015-02-15T10:13:08Z in "
+	if len(logger.lines) != 1 || !strings.HasPrefix(logger.lines[0], expected) {
+		t.Errorf("slow page not logged: %q", logger.lines)
+	}
+	if h := stats.MongoDurations.Get("replication_page").Snapshot(); h.Count != 1 || h.Max < 30 {
+		t.Errorf("page not timed: %#v", h)
+	}
+
+	// A slow client doesn't make the page slow
+	delay = 0
+	out = make(chan GenericEvent)
+	tl.out = out
+	go func() {
+		for range out {
+			time.Sleep(30 * time.Millisecond)
+		}
+	}()
+	defer close(out)
+	if c, err := tl.replicatePage(nil, bson.M{}, time.Time{}); c != 2 || err != nil {
+		t.Fatalf("expected 2 object states, got %d, %v", c, err)
+	}
+	if len(logger.lines) != 1 {
+		t.Errorf("page slowed by the client logged: %q", logger.lines)
+	}
+	if tl.pages != 2 {
+		t.Errorf("expected 2 pages counted, got %d", tl.pages)
+	}
+}
+
+// matchCondition tells if a value compared by cmp matches a MongoDB condition, either a
+// value or a document of $gt, $gte, $lt, $lte and $in operators
+func matchCondition(cond interface{}, cmp func(v interface{}) int) bool {
+	ops, ok := cond.(bson.M)
+	if !ok {
+		return cmp(cond) == 0
+	}
+	for op, v := range ops {
+		switch op {
+		case "$gt":
+			ok = cmp(v) > 0
+		case "$gte":
+			ok = cmp(v) >= 0
+		case "$lt":
+			ok = cmp(v) < 0
+		case "$lte":
+			ok = cmp(v) <= 0
+		case "$in":
+			ok = false
+			for _, e := range v.([]string) {
+				ok = ok || cmp(e) == 0
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// matchState tells if an object state matches a replication query
+func matchState(obj objectState, query bson.M) bool {
+	for key, cond := range query {
+		var ok bool
+		switch key {
+		case "ts":
+			ok = matchCondition(cond, func(v interface{}) int {
+				ts := v.(time.Time)
+				switch {
+				case obj.Timestamp.Before(ts):
+					return -1
+				case obj.Timestamp.After(ts):
+					return 1
+				}
+				return 0
+			})
+		case "_id", "event":
+			value := obj.ID
+			if key == "event" {
+				value = obj.Event
+			}
+			ok = matchCondition(cond, func(v interface{}) int {
+				return strings.Compare(value, v.(string))
+			})
+		case "$or":
+			for _, sub := range cond.([]bson.M) {
+				ok = ok || matchState(obj, sub)
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// queryStates emulates a page query on the states collection, states being sorted by
+// (ts, _id)
+func queryStates(states []objectState, query bson.M, limit int) stateIterator {
+	page := []objectState{}
+	for _, obj := range states {
+		if len(page) < limit && matchState(obj, query) {
+			page = append(page, obj)
+		}
+	}
+	return &slowStateIterator{states: page}
+}
+
+func TestReplicationSubMillisecondStates(t *testing.T) {
+	ol := newTestOpLog()
+	stats := *ol.Stats
+	stats.MongoDurations = NewHistograms(mongoBuckets...)
+	ol.Stats = &stats
+	ol.PageSize = 3
+	// Objects modified every 200µs across a millisecond boundary, the pages ending in the
+	// middle of a millisecond
+	base := time.Unix(1423995187, 999300000)
+	states := []objectState{}
+	for n := 0; n < 8; n++ {
+		op := &Operation{Event: "update", Data: &OperationData{Type: "video", ID: strconv.Itoa(n)}}
+		states = append(states, newObjectState(op, base.Add(time.Duration(n)*200*time.Microsecond)))
+	}
+	for _, obj := range states {
+		if obj.Timestamp.Nanosecond()%int(time.Millisecond) != 0 {
+			t.Fatalf("%s stored with a sub-millisecond ts: %s", obj.ID, obj.Timestamp.Format(time.RFC3339Nano))
+		}
+		if id := obj.GetEventID(); !id.Time().Equal(obj.Timestamp) {
+			t.Fatalf("%s ts changed by its id %s", obj.ID, id)
+		}
+	}
+	ol.openStatesPage = func(query bson.M) stateIterator {
+		return queryStates(states, query, ol.PageSize)
+	}
+	replicate := func(opts TailOptions, i *ReplicationLastID) []string {
+		// Room for the states sent again by each page
+		out := make(chan GenericEvent, len(states)*ol.PageSize)
+		tl := ol.newTailer(Filter{}, opts, out, false)
+		tl.replicated = map[string]time.Time{}
+		tl.handoff = base.Add(time.Second).Truncate(time.Millisecond)
+		query, tsClause := tl.replicationQuery(i, tl.handoff)
+		for pages := 0; pages < len(states); pages++ {
+			c, err := tl.replicatePage(nil, query, time.Time{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c < ol.PageSize {
+				break
+			}
+			resumeAfter(query, tsClause, tl.lastEv.GetEventID().(*ReplicationLastID))
+		}
+		close(out)
+		ids := []string{}
+		for ev := range out {
+			ids = append(ids, ev.(objectState).ID)
+		}
+		return ids
+	}
+	ids := func(from, to int) []string {
+		ids := []string{}
+		for n := from; n < to; n++ {
+			ids = append(ids, states[n].ID)
+		}
+		return ids
+	}
+
+	// Paging through the states sends each of them once
+	if got := replicate(TailOptions{}, &ReplicationLastID{}); !reflect.DeepEqual(got, ids(0, 8)) {
+		t.Errorf("invalid full replication: %v", got)
+	}
+
+	// Clients resume right after the last state they received, even in the middle of the
+	// states of its millisecond, or from the whole millisecond when the resume is inclusive
+	for n := 0; n < 4; n++ {
+		last, err := NewLastID(states[n].GetEventID().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := "1423995187999:" + base64.RawURLEncoding.EncodeToString([]byte(states[n].ID)); last.String() != expected {
+			t.Fatalf("invalid id %s, expected %s", last, expected)
+		}
+		if got := replicate(TailOptions{}, last.(*ReplicationLastID)); !reflect.DeepEqual(got, ids(n+1, 8)) {
+			t.Errorf("invalid exclusive resume after %s: %v", states[n].ID, got)
+		}
+		if got := replicate(TailOptions{InclusiveResume: true}, last.(*ReplicationLastID)); !reflect.DeepEqual(got, ids(0, 8)) {
+			t.Errorf("invalid inclusive resume after %s: %v", states[n].ID, got)
+		}
+	}
+
+	// The ids of the previous versions, without object state, exclude the whole millisecond
+	last, err := NewLastID("1423995187999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := replicate(TailOptions{}, last.(*ReplicationLastID)); !reflect.DeepEqual(got, ids(4, 8)) {
+		t.Errorf("invalid exclusive resume from a timestamp: %v", got)
+	}
+}
+
+// jsonStateIterator decodes each object state into the given result like a decoder
+// reusing the pointers of its target, as encoding/json does
+type jsonStateIterator struct {
+	states [][]byte
+}
+
+func (it *jsonStateIterator) Next(result interface{}) bool {
+	if len(it.states) == 0 {
+		return false
+	}
+	if err := json.Unmarshal(it.states[0], result); err != nil {
+		panic(err)
+	}
+	it.states = it.states[1:]
+	return true
+}
+
+func (it *jsonStateIterator) Close() error {
+	return nil
+}
+
+func TestReplicationRetainedStates(t *testing.T) {
+	ol := newTestOpLog()
+	stats := *ol.Stats
+	stats.MongoDurations = NewHistograms(mongoBuckets...)
+	ol.Stats = &stats
+	ts := time.Date(2015, 2, 15, 10, 13, 7, 0, time.UTC)
+	states := [][]byte{}
+	for n := 0; n < 50; n++ {
+		b, _ := json.Marshal(objectState{ID: "video/" + strconv.Itoa(n), Event: "insert", Timestamp: ts, Data: &OperationData{Timestamp: ts, Type: "video", ID: strconv.Itoa(n)}})
+		states = append(states, b)
+	}
+	ol.openStatesPage = func(query bson.M) stateIterator {
+		return &jsonStateIterator{states}
+	}
+	out := make(chan GenericEvent)
+	tl := ol.newTailer(Filter{}, TailOptions{}, out, false)
+	tl.replicated = map[string]time.Time{}
+
+	// The consumer retains the object states and reads them while the page is decoded
+	retained := make(chan []objectState)
+	go func() {
+		objects := []objectState{}
+		for ev := range out {
+			objects = append(objects, ev.(objectState))
+			for _, obj := range objects {
+				_ = obj.Data.ID
+			}
+		}
+		retained <- objects
+	}()
+	if c, err := tl.replicatePage(nil, bson.M{}, time.Time{}); c != len(states) || err != nil {
+		t.Fatalf("expected %d object states, got %d, %v", len(states), c, err)
+	}
+	close(out)
+	for n, obj := range <-retained {
+		if obj.ID != "video/"+strconv.Itoa(n) || obj.Data.ID != strconv.Itoa(n) {
+			t.Fatalf("retained object state %d changed: %s %#v", n, obj.ID, obj.Data)
+		}
+	}
+}
+
+func TestLiveSharedRetainedOperations(t *testing.T) {
+	ol := newTestOpLog()
+	ol.SharedTailQueueSize = 100
+	stop := make(chan struct{})
+	ol.hub.stop = stop
+	ops := []*Operation{}
+	for n := 0; n < 50; n++ {
+		op := newTestOperation("video")
+		op.Data.ID = strconv.Itoa(n)
+		op.Data.Parents = []string{"user/1"}
+		op.Data.Meta = map[string]string{"origin": "api"}
+		op.Data.Payload = map[string]interface{}{"tags": []interface{}{"cat"}}
+		ops = append(ops, op)
+	}
+
+	// Two live tails sharing the operations, their consumers retaining and modifying the
+	// received operations while the stream continues
+	consumers := []string{"a", "b"}
+	retained := make(chan []Operation)
+	done := make(chan error)
+	tailers := []*tailer{}
+	for _, name := range consumers {
+		out := make(chan GenericEvent)
+		tl := ol.newTailer(Filter{}, TailOptions{}, out, false)
+		tailers = append(tailers, tl)
+		go func() {
+			done <- tl.liveShared(nil, nil)
+		}()
+		go func(name string) {
+			received := []Operation{}
+			for len(received) < len(ops) {
+				op := (<-out).(Operation)
+				op.Data.Meta["consumer"] = name
+				op.Data.Parents[0] = name + "/1"
+				op.Data.Payload["tags"].([]interface{})[0] = name
+				received = append(received, op)
+				for _, op := range received {
+					_ = op.Data.Meta["consumer"]
+				}
+			}
+			retained <- received
+		}(name)
+	}
+	for {
+		ol.hub.mu.Lock()
+		subscribed := len(ol.hub.subs)
+		ol.hub.mu.Unlock()
+		if subscribed == len(consumers) {
+			break
+		}
+		runtime.Gosched()
+	}
+	for _, op := range ops {
+		if !ol.hub.dispatch(op, stop) {
+			t.Fatal("dispatch refused")
+		}
+	}
+	for range consumers {
+		for n, op := range <-retained {
+			name := op.Data.Parents[0][:1]
+			if op.Data.ID != strconv.Itoa(n) || op.Data.Meta["consumer"] != name || op.Data.Payload["tags"].([]interface{})[0] != name {
+				t.Errorf("operation %d retained by %s changed: %#v", n, name, op.Data)
+			}
+		}
+	}
+	for _, tl := range tailers {
+		close(tl.quit)
+		if err := <-done; err != errTailStopped {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	for _, op := range ops {
+		if len(op.Data.Meta) != 1 || op.Data.Parents[0] != "user/1" || op.Data.Payload["tags"].([]interface{})[0] != "cat" {
+			t.Fatalf("shared operation changed: %#v", op.Data)
+		}
+	}
+}
+
+func TestFallbackRewind(t *testing.T) {
+	ol := newTestOpLog()
+	stats := *ol.Stats
+	stats.MongoDurations = NewHistograms(mongoBuckets...)
+	ol.Stats = &stats
+	// States straddling the creation time of an evicted operation, the ones before it
+	// being possibly created after it by agents with a late clock
+	evicted := time.Unix(1423995187, 0)
+	states := []objectState{}
+	for n, offset := range []time.Duration{-40 * time.Second, -20 * time.Second, -time.Millisecond, 0, time.Second} {
+		op := &Operation{Event: "update", Data: &OperationData{Type: "video", ID: strconv.Itoa(n)}}
+		states = append(states, newObjectState(op, evicted.Add(offset)))
+	}
+	ol.openStatesPage = func(query bson.M) stateIterator {
+		return queryStates(states, query, ol.PageSize)
+	}
+	oid := bson.NewObjectIdWithTime(evicted)
+	id := &OperationLastID{&oid}
+	for _, test := range []struct {
+		rewind time.Duration
+		ids    []string
+	}{
+		{0, []string{"video/3", "video/4"}},
+		{30 * time.Second, []string{"video/1", "video/2", "video/3", "video/4"}},
+		// A rewound state sent again is applied again by the consumer
+		{time.Minute, []string{"video/0", "video/1", "video/2", "video/3", "video/4"}},
+	} {
+		ol.FallbackRewind = test.rewind
+		fallbackID := ol.fallbackID(id).(*ReplicationLastID)
+		if expected := evicted.Add(-test.rewind); !fallbackID.Time().Equal(expected) || !fallbackID.fallbackMode {
+			t.Errorf("%s: invalid fallback id %s", test.rewind, fallbackID)
+		}
+		out := make(chan GenericEvent, len(states))
+		tl := ol.newTailer(Filter{}, TailOptions{}, out, false)
+		tl.replicated = map[string]time.Time{}
+		query, _ := tl.replicationQuery(fallbackID, evicted.Add(time.Minute))
+		if _, err := tl.replicatePage(nil, query, fallbackID.Time()); err != nil {
+			t.Fatal(err)
+		}
+		close(out)
+		ids := []string{}
+		for ev := range out {
+			ids = append(ids, ev.(objectState).ID)
+		}
+		if !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("%s: expected %v, got %v", test.rewind, test.ids, ids)
+		}
+	}
+}
+
+// closingStateIterator records when its page is closed
+type closingStateIterator struct {
+	slowStateIterator
+	closed bool
+}
+
+func (it *closingStateIterator) Close() error {
+	it.closed = true
+	return nil
+}
+
+func TestTailUntilBeforeSince(t *testing.T) {
+	ol := newTestOpLog()
+	since := time.Unix(1423995187, 0)
+	opts := TailOptions{Since: since, Until: since.Add(-time.Hour)}
+	out := make(chan GenericEvent, 10)
+	stop := make(chan bool)
+	done := make(chan struct{})
+	go func() {
+		ol.tail(nil, Filter{}, opts, out, stop)
+		close(done)
+	}()
+	// Only the end event is sent, without any id
+	select {
+	case ev := <-out:
+		if e, ok := ev.(*Event); !ok || e.Event != "end" || e.ID != "" {
+			t.Fatalf("expected an end event, got %#v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("end event not sent")
+	}
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("tail not closed")
+	}
+	if len(out) != 0 {
+		t.Errorf("unexpected events after the end: %d", len(out))
+	}
+	if tails := ol.activeTails(time.Time{}); len(tails) != 0 {
+		t.Errorf("tail still registered: %#v", tails)
+	}
+}
+
+func TestTailUntilPast(t *testing.T) {
+	ol := newTestOpLog()
+	ol.SharedTailQueueSize = 10
+	stop := make(chan struct{})
+	ol.hub.stop = stop
+	out := make(chan GenericEvent, 10)
+	tl := ol.newTailer(Filter{}, TailOptions{Until: time.Now().Add(-time.Hour)}, out, false)
+	done := make(chan error)
+	go func() {
+		done <- tl.liveShared(nil, nil)
+	}()
+	// The operations created after the bound are never sent, the tail ends right away
+	ol.hub.dispatch(newTestOperation("video"), stop)
+	select {
+	case err := <-done:
+		if err != errTailStopped {
+			t.Errorf("expected the tail to stop, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("tail not ended")
+	}
+	close(out)
+	events := []string{}
+	for ev := range out {
+		events = append(events, ev.(*Event).Event)
+	}
+	if !reflect.DeepEqual(events, []string{"end"}) {
+		t.Errorf("expected a single end event, got %v", events)
+	}
+	ol.hub.mu.Lock()
+	defer ol.hub.mu.Unlock()
+	if len(ol.hub.subs) != 0 {
+		t.Error("tail still subscribed to the shared tail")
+	}
+}
+
+func TestLiveSharedSkipsResumed(t *testing.T) {
+	ol := newTestOpLog()
+	ol.SharedTailQueueSize = 10
+	stop := make(chan struct{})
+	ol.hub.stop = stop
+	ops := []*Operation{}
+	for n := 0; n < 5; n++ {
+		op := newTestOperation("video")
+		op.Data.ID = strconv.Itoa(n)
+		ops = append(ops, op)
+	}
+	out := make(chan GenericEvent, 10)
+	tl := ol.newTailer(Filter{}, TailOptions{}, out, false)
+	done := make(chan error)
+	go func() {
+		// The hub is behind the resume id
+		done <- tl.liveShared(nil, &OperationLastID{ops[2].ID})
+	}()
+	for {
+		ol.hub.mu.Lock()
+		subscribed := len(ol.hub.subs)
+		ol.hub.mu.Unlock()
+		if subscribed == 1 {
+			break
+		}
+		runtime.Gosched()
+	}
+	for _, op := range ops {
+		ol.hub.dispatch(op, stop)
+	}
+	ids := []string{}
+	for len(ids) < 2 {
+		select {
+		case ev := <-out:
+			ids = append(ids, ev.(Operation).Data.ID)
+		case <-time.After(time.Second):
+			t.Fatalf("operations not sent, got %v", ids)
+		}
+	}
+	if !reflect.DeepEqual(ids, []string{"3", "4"}) {
+		t.Errorf("expected the operations after the resume id, got %v", ids)
+	}
+	close(tl.quit)
+	if err := <-done; err != errTailStopped {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(out) != 0 {
+		t.Errorf("unexpected events: %d", len(out))
+	}
+}
+
+func TestReplicatePageStopped(t *testing.T) {
+	ol := newTestOpLog()
+	stats := *ol.Stats
+	stats.MongoDurations = NewHistograms(mongoBuckets...)
+	ol.Stats = &stats
+	ts := time.Unix(1423995187, 0)
+	states := []objectState{}
+	for n := 0; n < 5; n++ {
+		op := &Operation{Event: "insert", Data: &OperationData{Type: "video", ID: strconv.Itoa(n)}}
+		states = append(states, newObjectState(op, ts.Add(time.Duration(n)*time.Second)))
+	}
+	iter := &closingStateIterator{slowStateIterator: slowStateIterator{states: states}}
+	ol.openStatesPage = func(query bson.M) stateIterator {
+		return iter
+	}
+	out := make(chan GenericEvent)
+	tl := ol.newTailer(Filter{}, TailOptions{}, out, false)
+	tl.replicated = map[string]time.Time{}
+	type result struct {
+		c   int
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		c, err := tl.replicatePage(nil, bson.M{}, time.Time{})
+		done <- result{c, err}
+	}()
+	// The consumer stops after 2 object states of the page
+	ids := []string{(<-out).(objectState).ID, (<-out).(objectState).ID}
+	close(tl.quit)
+	var res result
+	select {
+	case res = <-done:
+	case <-time.After(time.Second):
+		t.Fatal("replication page not stopped")
+	}
+	if res.err != errTailStopped || res.c != 2 {
+		t.Errorf("expected 2 object states and errTailStopped, got %d, %v", res.c, res.err)
+	}
+	if !reflect.DeepEqual(ids, []string{"video/0", "video/1"}) {
+		t.Errorf("invalid object states sent: %v", ids)
+	}
+	if !iter.closed {
+		t.Error("page left open")
+	}
+	// The tail resumes after the last object state sent, the pending one is not lost
+	if id := tl.lastEv.GetEventID().String(); id != states[1].GetEventID().String() {
+		t.Errorf("invalid resume point %s", id)
+	}
+	if tl.pages != 0 {
+		t.Errorf("interrupted page counted: %d", tl.pages)
+	}
+}
@@ -0,0 +1,91 @@
+package oplog
+
+import (
+	"math"
+	"net/http"
+	"time"
+)
+
+// tokenBucket paces a connection to a number of bytes per second. Writes are never
+// blocked: they take tokens from the bucket, possibly going into debt, and the stream
+// stops reading events until the debt is paid back, so heartbeats and disconnections are
+// still handled on time.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+// newTokenBucket creates a bucket for rate bytes per second, allowing bursts of up to one
+// second worth of bytes
+func newTokenBucket(rate int64, now func() time.Time) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: now(), now: now}
+}
+
+// refill adds the tokens earned since the last call
+func (b *tokenBucket) refill() {
+	now := b.now()
+	b.tokens = math.Min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// take takes n bytes worth of tokens
+func (b *tokenBucket) take(n int) {
+	b.refill()
+	b.tokens -= float64(n)
+}
+
+// delay returns the time to wait before the bucket is out of debt
+func (b *tokenBucket) delay() time.Duration {
+	b.refill()
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(math.Ceil(-b.tokens / b.rate * float64(time.Second)))
+}
+
+// throttledResponseWriter takes the bytes written to a response from a token bucket
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	bucket *tokenBucket
+	stats  *Stats
+}
+
+func (tw *throttledResponseWriter) Write(b []byte) (int, error) {
+	n, err := tw.ResponseWriter.Write(b)
+	tw.bucket.take(n)
+	tw.stats.ThrottledBytes.Add(int64(n))
+	return n, err
+}
+
+// Flush flushes the underlying response if it supports it
+func (tw *throttledResponseWriter) Flush() {
+	if f, ok := tw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// throttled records the time a stream waited for its throttling
+func (daemon *SSEDaemon) throttled(conn *connection, wait time.Duration) {
+	ms := int64(wait / time.Millisecond)
+	daemon.ol.Stats.ThrottleWait.Add(ms)
+	conn.update(func(info *ConnectionInfo) { info.ThrottleWait += ms })
+}
+
+// bandwidth returns the rate in bytes per second a stream is limited to, or 0 if it is
+// not throttled. Clients can ask for a lower rate than MaxBandwidth thru the max_rate
+// parameter, but never lower than MinBandwidth.
+func (daemon *SSEDaemon) bandwidth(r *http.Request, maxRate int64) int64 {
+	if daemon.UnthrottledPassword != "" && checkPassword(r, daemon.UnthrottledPassword) {
+		return 0
+	}
+	rate := daemon.MaxBandwidth
+	if maxRate > 0 && (rate == 0 || maxRate < rate) {
+		rate = maxRate
+	}
+	if rate > 0 && rate < daemon.MinBandwidth {
+		rate = daemon.MinBandwidth
+	}
+	return rate
+}
@@ -0,0 +1,103 @@
+package oplog
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newTokenBucket(100, func() time.Time { return now })
+
+	// The first second worth of bytes is sent right away
+	b.take(100)
+	if d := b.delay(); d != 0 {
+		t.Errorf("expected no delay, got %s", d)
+	}
+	b.take(50)
+	if d := b.delay(); d != 500*time.Millisecond {
+		t.Errorf("expected a 500ms delay, got %s", d)
+	}
+	now = now.Add(250 * time.Millisecond)
+	if d := b.delay(); d != 250*time.Millisecond {
+		t.Errorf("expected a 250ms delay, got %s", d)
+	}
+	now = now.Add(250 * time.Millisecond)
+	if d := b.delay(); d != 0 {
+		t.Errorf("expected no delay, got %s", d)
+	}
+
+	// Idle time doesn't allow bursts larger than a second worth of bytes
+	now = now.Add(10 * time.Second)
+	b.take(150)
+	if d := b.delay(); d != 500*time.Millisecond {
+		t.Errorf("expected a 500ms delay, got %s", d)
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.UnthrottledPassword = "privileged"
+	tests := []struct {
+		max, min, maxRate int64
+		password          string
+		rate              int64
+	}{
+		{0, 0, 0, "", 0},
+		{1000, 0, 0, "", 1000},
+		{1000, 0, 500, "", 500},
+		// Clients can't ask for more than the default
+		{1000, 0, 5000, "", 1000},
+		{0, 0, 500, "", 500},
+		// Nor less than the lower bound
+		{1000, 200, 100, "", 200},
+		{1000, 200, 100, "privileged", 0},
+		{1000, 200, 100, "other", 200},
+	}
+	for _, test := range tests {
+		daemon.MaxBandwidth = test.max
+		daemon.MinBandwidth = test.min
+		r := httptest.NewRequest("GET", "/ops", nil)
+		if test.password != "" {
+			r.SetBasicAuth("", test.password)
+		}
+		if rate := daemon.bandwidth(r, test.maxRate); rate != test.rate {
+			t.Errorf("%#v: expected rate %d, got %d", test, test.rate, rate)
+		}
+	}
+}
+
+func TestGetOpsThrottled(t *testing.T) {
+	ops := newTestOperations(4)
+	daemon := newTestSSEOpsDaemon(ops)
+	daemon.MaxBandwidth = 300
+	daemon.KeepaliveInterval = 50 * time.Millisecond
+	bytes := testStats.ThrottledBytes.Value()
+	wait := testStats.ThrottleWait.Value()
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/ops?since=1423995187000&limit=4", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	started := time.Now()
+	daemon.ServeHTTP(rec, req)
+
+	// About 650 bytes are sent, the first 300 right away
+	if elapsed := time.Since(started); elapsed < 250*time.Millisecond {
+		t.Errorf("stream not paced, sent in %s", elapsed)
+	}
+	if !strings.Contains(rec.Body.String(), "event: end\n") {
+		t.Errorf("stream not ended: %q", rec.Body.String())
+	}
+	// Heartbeats are still sent while the stream waits for its throttling
+	if !strings.Contains(rec.Body.String(), "\n\n:\n") {
+		t.Errorf("no heartbeat sent while throttled: %q", rec.Body.String())
+	}
+	if sent := testStats.ThrottledBytes.Value() - bytes; sent != int64(rec.Body.Len()) {
+		t.Errorf("expected %d throttled bytes, got %d", rec.Body.Len(), sent)
+	}
+	if testStats.ThrottleWait.Value() == wait {
+		t.Error("throttle wait not recorded")
+	}
+}
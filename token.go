@@ -0,0 +1,125 @@
+package oplog
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ErrInvalidToken is returned by Tokens for unknown bearer tokens
+var ErrInvalidToken = errors.New("invalid token")
+
+// ErrExpiredToken should be returned, possibly wrapped, by the TokenValidators for expired
+// tokens so they are counted apart from the invalid ones
+var ErrExpiredToken = errors.New("expired token")
+
+// Principal is the identity of an authenticated client
+type Principal struct {
+	// Name is the username or the name of the token owner
+	Name string `json:"name"`
+	// Scopes are the scopes granted to a bearer token
+	Scopes []string `json:"scopes,omitempty"`
+	// Policy restricts the operations the principal can consume
+	Policy Policy `json:"policy"`
+}
+
+// TokenValidator validates the tokens given by the clients thru an "Authorization: Bearer"
+// header, i.e.: to plug a JWT validation. An error is returned for invalid or expired
+// tokens.
+type TokenValidator interface {
+	Validate(token string) (Principal, error)
+}
+
+// Tokens is a TokenValidator checking the tokens against a static list
+type Tokens map[string]Principal
+
+// Validate returns the principal of token
+func (t Tokens) Validate(token string) (Principal, error) {
+	// Every token is compared so the valid ones can't be guessed from the response time
+	var principal Principal
+	found := false
+	for expected, p := range t {
+		if secureCompare(expected, token) {
+			principal, found = p, true
+		}
+	}
+	if !found {
+		return Principal{}, ErrInvalidToken
+	}
+	return principal, nil
+}
+
+// ReadTokens reads tokens given as
+// "<token> <name> [<scope>,<scope>…] [types=type,type…] [parents=prefix,prefix…]" lines.
+// Empty lines and lines starting with # are ignored.
+func ReadTokens(r io.Reader) (Tokens, error) {
+	t := Tokens{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("invalid token on line %d", n)
+		}
+		scopes, policy, err := parseGrants(fields[2:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid token on line %d: %s", n, err)
+		}
+		t[fields[0]] = Principal{Name: fields[1], Scopes: scopes, Policy: policy}
+	}
+	return t, scanner.Err()
+}
+
+type principalKey struct{}
+
+// withPrincipal returns a copy of ctx carrying p
+func withPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFromContext returns the principal of the authenticated client of a request,
+// given the request context, if any
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// queryToken returns r authenticated by the token of its access_token query-string
+// parameter when AllowQueryToken is set and no Authorization header is given. The
+// parameter is removed from the URL of the returned request so it can't leak any further,
+// and the response is marked as not to be stored.
+func (daemon *SSEDaemon) queryToken(w http.ResponseWriter, r *http.Request) *http.Request {
+	if !daemon.AllowQueryToken || r.Header.Get("Authorization") != "" {
+		return r
+	}
+	q := r.URL.Query()
+	token := q.Get("access_token")
+	if token == "" {
+		return r
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+token)
+	q.Del("access_token")
+	r.URL.RawQuery = q.Encode()
+	r.RequestURI = r.URL.RequestURI()
+	return r
+}
+
+// redactQuery returns the query-string of u with the access token redacted
+func redactQuery(u *url.URL) string {
+	q := u.Query()
+	if _, found := q["access_token"]; !found {
+		return u.RawQuery
+	}
+	q.Set("access_token", "REDACTED")
+	return q.Encode()
+}
@@ -0,0 +1,188 @@
+package oplog
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// tokenValidatorFunc is a TokenValidator calling a function
+type tokenValidatorFunc func(token string) (Principal, error)
+
+func (f tokenValidatorFunc) Validate(token string) (Principal, error) {
+	return f(token)
+}
+
+func TestTokensValidate(t *testing.T) {
+	tokens := Tokens{"t0k3n": {Name: "search", Scopes: []string{"read"}}}
+	if p, err := tokens.Validate("t0k3n"); err != nil || p.Name != "search" || strings.Join(p.Scopes, ",") != "read" {
+		t.Errorf("invalid principal: %#v, %v", p, err)
+	}
+	if _, err := tokens.Validate("t0k3n2"); err != ErrInvalidToken {
+		t.Errorf("expected ErrInvalidToken, got %v", err)
+	}
+}
+
+func TestReadTokens(t *testing.T) {
+	tokens, err := ReadTokens(strings.NewReader("# teams\nt0k3n search read,admin\n\nabc  feed\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 || tokens["t0k3n"].Name != "search" || strings.Join(tokens["t0k3n"].Scopes, ",") != "read,admin" || tokens["abc"].Name != "feed" {
+		t.Errorf("invalid tokens: %#v", tokens)
+	}
+	for _, invalid := range []string{"t0k3n", "t0k3n search read extra"} {
+		if _, err := ReadTokens(strings.NewReader(invalid)); err == nil {
+			t.Errorf("%q: expected an error", invalid)
+		}
+	}
+}
+
+func TestBearerAuthentication(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.Password = "secret"
+	daemon.MaxAuthFailures = 0
+	daemon.TokenValidator = tokenValidatorFunc(func(token string) (Principal, error) {
+		switch token {
+		case "valid":
+			return Principal{Name: "search", Scopes: []string{"read"}}, nil
+		case "expired":
+			return Principal{}, errors.New("token expired")
+		}
+		return Principal{}, ErrInvalidToken
+	})
+	tests := []struct {
+		authorization string
+		status        int
+		message       string
+	}{
+		{"Bearer valid", 200, ""},
+		{"bearer valid", 200, ""},
+		{"Bearer expired", 401, "invalid credentials"},
+		{"Bearer unknown", 401, "invalid credentials"},
+		{"Bearer", 401, "malformed authorization header"},
+		{"Bearer  ", 401, "malformed authorization header"},
+		{"Token valid", 401, "malformed authorization header"},
+		{"Basic !!!", 401, "malformed authorization header"},
+		{"", 401, "invalid credentials"},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/ops/poll?since_id=1423995187898", nil)
+		if test.authorization != "" {
+			req.Header.Set("Authorization", test.authorization)
+		}
+		daemon.ServeHTTP(rec, req)
+		if rec.Code != test.status {
+			t.Errorf("%q: expected status %d, got %d", test.authorization, test.status, rec.Code)
+		}
+		if test.message != "" && !strings.Contains(rec.Body.String(), test.message) {
+			t.Errorf("%q: expected %q error, got %s", test.authorization, test.message, rec.Body.String())
+		}
+	}
+
+	// Basic auth keeps working when no token is presented
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/ops/poll?since_id=1423995187898", nil)
+	req.SetBasicAuth("", "secret")
+	daemon.ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Errorf("basic auth: expected status 200, got %d", rec.Code)
+	}
+
+	// The principal is attached to the request context
+	req = httptest.NewRequest("GET", "/ops", nil)
+	req.Header.Set("Authorization", "Bearer valid")
+	req, ok := daemon.authenticate(httptest.NewRecorder(), req, ScopeRead)
+	if !ok {
+		t.Fatal("valid token refused")
+	}
+	if p, found := PrincipalFromContext(req.Context()); !found || p.Name != "search" || strings.Join(p.Scopes, ",") != "read" {
+		t.Errorf("invalid principal: %#v", p)
+	}
+}
+
+func TestBearerOnly(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.TokenValidator = Tokens{"t0k3n": {Name: "search"}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Without password, a token is still required
+	rec := httptest.NewRecorder()
+	daemon.ServeHTTP(rec, newTestSSERequest(ctx))
+	if rec.Code != 401 {
+		t.Fatalf("expected status 401, got %d", rec.Code)
+	}
+
+	req := newTestSSERequest(ctx)
+	req.Header.Set("Authorization", "Bearer t0k3n")
+	done := make(chan struct{})
+	go func() {
+		daemon.ServeHTTP(flushResponseWriter{httptest.NewRecorder()}, req)
+		close(done)
+	}()
+	defer func() { cancel(); <-done }()
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		if conns := daemon.Connections(); len(conns) == 1 {
+			if conns[0].User != "search" || conns[0].Auth != "ok" {
+				t.Errorf("invalid connection info: %#v", conns[0])
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("connection not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestQueryToken(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	daemon.TokenValidator = Tokens{"s3cr3t-token": {Name: "dashboard"}}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	logs := &bytes.Buffer{}
+	out := log.StandardLogger().Out
+	log.SetOutput(logs)
+	defer log.SetOutput(out)
+
+	get := func() *httptest.ResponseRecorder {
+		logs.Reset()
+		req := httptest.NewRequest("GET", "/ops?since=1423995187000&types=video&access_token=s3cr3t-token", nil).WithContext(ctx)
+		req.Header.Set("Accept", "text/event-stream")
+		rec := httptest.NewRecorder()
+		daemon.ServeHTTP(flushResponseWriter{rec}, req)
+		return rec
+	}
+
+	// The parameter is ignored unless the option is on
+	if rec := get(); rec.Code != 401 {
+		t.Errorf("expected status 401, got %d", rec.Code)
+	}
+	if strings.Contains(logs.String(), "s3cr3t-token") {
+		t.Errorf("token not redacted: %s", logs.String())
+	}
+
+	daemon.AllowQueryToken = true
+	rec := get()
+	if rec.Code != 200 {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	if !strings.Contains(rec.Header().Get("Cache-Control"), "no-store") {
+		t.Errorf("response may be stored: %q", rec.Header().Get("Cache-Control"))
+	}
+	line := logs.String()
+	if !strings.Contains(line, "connection ended") || !strings.Contains(line, "user=dashboard") {
+		t.Fatalf("connection not logged: %s", line)
+	}
+	if strings.Contains(line, "s3cr3t-token") || !strings.Contains(line, "access_token=REDACTED") {
+		t.Errorf("token not redacted: %s", line)
+	}
+}
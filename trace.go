@@ -0,0 +1,88 @@
+package oplog
+
+import (
+	"context"
+	"net/http"
+)
+
+// Tracer creates the spans tracing the appends and the streams, see OpLog.Tracer. It is
+// meant to be implemented on top of a tracing library like OpenTelemetry.
+type Tracer interface {
+	// Start starts a span of the given name, child of the span of ctx if any, and returns
+	// a context holding the new span
+	Start(ctx context.Context, name string) (context.Context, Span)
+	// Extract returns ctx holding the span context propagated by the headers of an
+	// incoming request, if any
+	Extract(ctx context.Context, header http.Header) context.Context
+}
+
+// Span is a traced operation
+type Span interface {
+	// SetAttribute sets an attribute of the span, value being a string, an int, an int64
+	// or a bool
+	SetAttribute(key string, value interface{})
+	// End ends the span
+	End()
+}
+
+// noopSpan is the span used when no tracer is set
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+func (noopSpan) End()                                       {}
+
+// startSpan starts a span with the Tracer, if any
+func (oplog *OpLog) startSpan(ctx context.Context, name string) (context.Context, Span) {
+	if oplog.Tracer == nil {
+		return ctx, noopSpan{}
+	}
+	return oplog.Tracer.Start(ctx, name)
+}
+
+// requestContext returns the context of the request holding the span context it
+// propagates, if a Tracer is set
+func (oplog *OpLog) requestContext(r *http.Request) context.Context {
+	if oplog.Tracer == nil {
+		return r.Context()
+	}
+	return oplog.Tracer.Extract(r.Context(), r.Header)
+}
+
+// traceOperation sets the attributes describing op on span
+func traceOperation(span Span, op *Operation) {
+	if _, ok := span.(noopSpan); ok {
+		return
+	}
+	if op.ID != nil {
+		span.SetAttribute("oplog.id", op.ID.Hex())
+	}
+	span.SetAttribute("oplog.event", op.Event)
+	if op.Data != nil {
+		span.SetAttribute("oplog.type", op.Data.Type)
+		span.SetAttribute("oplog.object_id", op.Data.ID)
+	}
+}
+
+// traceConnection sets the attributes describing an ended stream on span
+func traceConnection(span Span, info ConnectionInfo, mode string) {
+	if _, ok := span.(noopSpan); ok {
+		return
+	}
+	span.SetAttribute("net.peer.ip", info.RemoteAddr)
+	if info.User != "" {
+		span.SetAttribute("oplog.user", info.User)
+	}
+	if filter, err := info.Filter.MarshalJSON(); err == nil {
+		span.SetAttribute("oplog.filter", string(filter))
+	}
+	if info.LastEventID != "" {
+		span.SetAttribute("oplog.last_event_id", info.LastEventID)
+	}
+	if mode != "" {
+		span.SetAttribute("oplog.mode", mode)
+	}
+	span.SetAttribute("oplog.events_sent", info.EventsSent)
+	span.SetAttribute("oplog.bytes_sent", info.BytesSent)
+	span.SetAttribute("http.status_code", info.Status)
+	span.SetAttribute("oplog.end_reason", info.EndReason)
+}
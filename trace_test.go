@@ -0,0 +1,131 @@
+package oplog
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// recordingSpan is a Span recorded by a recordingTracer
+type recordingSpan struct {
+	name   string
+	parent string
+	attrs  map[string]interface{}
+	ended  bool
+}
+
+func (s *recordingSpan) SetAttribute(key string, value interface{}) {
+	s.attrs[key] = value
+}
+
+func (s *recordingSpan) End() {
+	s.ended = true
+}
+
+type spanKey struct{}
+
+// recordingTracer is a Tracer recording the spans, the span context being propagated
+// in a Trace-Parent header
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordingSpan
+}
+
+func (tr *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	span := &recordingSpan{name: name, attrs: map[string]interface{}{}}
+	if parent, ok := ctx.Value(spanKey{}).(string); ok {
+		span.parent = parent
+	}
+	tr.mu.Lock()
+	tr.spans = append(tr.spans, span)
+	tr.mu.Unlock()
+	return context.WithValue(ctx, spanKey{}, name), span
+}
+
+func (tr *recordingTracer) Extract(ctx context.Context, header http.Header) context.Context {
+	if parent := header.Get("Trace-Parent"); parent != "" {
+		return context.WithValue(ctx, spanKey{}, parent)
+	}
+	return ctx
+}
+
+func (tr *recordingTracer) span(t *testing.T, name string) *recordingSpan {
+	t.Helper()
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	for _, span := range tr.spans {
+		if span.name == name {
+			return span
+		}
+	}
+	t.Fatalf("no %s span recorded", name)
+	return nil
+}
+
+func TestTracePostOps(t *testing.T) {
+	daemon := newTestSSEDaemonHandler("")
+	tracer := &recordingTracer{}
+	daemon.ol.Tracer = tracer
+	var parent interface{}
+	daemon.append = func(ctx context.Context, ops []*Operation) {
+		parent = ctx.Value(spanKey{})
+	}
+	req := newTestPostOpsRequest(`[{"event":"insert","type":"video","id":"1"},{"event":"delete","type":"video","id":"2"}]`, "")
+	req.Header.Set("Trace-Parent", "producer")
+	rec := httptest.NewRecorder()
+	daemon.ServeHTTP(rec, req)
+	if rec.Code != 201 {
+		t.Fatalf("expected 201, got %d", rec.Code)
+	}
+	span := tracer.span(t, "oplog.post_ops")
+	if span.parent != "producer" || !span.ended || span.attrs["oplog.operations"] != 2 {
+		t.Errorf("invalid span: %#v", span)
+	}
+	if parent != "oplog.post_ops" {
+		t.Errorf("operations not appended in the context of the span: %v", parent)
+	}
+}
+
+func TestTraceStream(t *testing.T) {
+	ops := newTestOperations(2)
+	daemon := newTestSSEOpsDaemon(ops)
+	tracer := &recordingTracer{}
+	daemon.ol.Tracer = tracer
+	req := httptest.NewRequest("GET", "/ops?since=1423995187000&limit=1&types=video", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Last-Event-ID", ops[0].ID.Hex())
+	req.Header.Set("Trace-Parent", "consumer")
+	daemon.hasID = func(id LastID) (bool, error) {
+		return true, nil
+	}
+	daemon.ServeHTTP(flushResponseWriter{httptest.NewRecorder()}, req)
+
+	span := tracer.span(t, "oplog.stream")
+	if span.parent != "consumer" || !span.ended {
+		t.Errorf("invalid span: %#v", span)
+	}
+	expected := map[string]interface{}{
+		"oplog.filter":        `{"types":["video"]}`,
+		"oplog.last_event_id": ops[0].ID.Hex(),
+		"oplog.mode":          "live",
+		"oplog.events_sent":   int64(1),
+		"oplog.end_reason":    "limit_reached",
+		"http.status_code":    200,
+	}
+	for key, value := range expected {
+		if span.attrs[key] != value {
+			t.Errorf("expected %s to be %#v, got %#v", key, value, span.attrs[key])
+		}
+	}
+}
+
+func TestTraceOperation(t *testing.T) {
+	op := newTestOperations(1)[0]
+	span := &recordingSpan{attrs: map[string]interface{}{}}
+	traceOperation(span, &op)
+	if span.attrs["oplog.id"] != op.ID.Hex() || span.attrs["oplog.event"] != "insert" || span.attrs["oplog.type"] != op.Data.Type || span.attrs["oplog.object_id"] != op.Data.ID {
+		t.Errorf("invalid attributes: %#v", span.attrs)
+	}
+}
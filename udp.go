@@ -2,8 +2,6 @@ package oplog
 
 import (
 	"net"
-
-	log "github.com/Sirupsen/logrus"
 )
 
 // UDPDaemon listens for events and send them to the oplog MongoDB capped collection
@@ -42,36 +40,38 @@ func (daemon *UDPDaemon) Run(queueMaxSize int) error {
 
 		n, _, err := c.ReadFromUDP(buffer)
 		if err != nil {
-			log.Warnf("UDP read error: %s", err)
+			daemon.ol.logger().Warnf("UDP read error: %s", err)
 			continue
 		}
 
-		log.Debugf("UDP received operation from UDP: %s", buffer[:n])
+		daemon.ol.logger().Debugf("UDP received operation from UDP: %s", buffer[:n])
 
 		queueSize := len(ops)
-		daemon.ol.Stats.QueueSize.Set(int64(queueSize))
+		daemon.ol.observeQueue(queueSize, queueSize)
 		if queueSize >= queueMaxSize {
 			// This check is preventive but racy, see select below for a non racy buffer
 			// overflow check
-			log.Warnf("UDP input queue is full, thowing message: %s", buffer[:n])
+			daemon.ol.logger().Warnf("UDP input queue is full, thowing message: %s", buffer[:n])
 			daemon.ol.Stats.EventsDiscarded.Add(1)
 			continue
 		}
 
 		op, err := decodeOperation(buffer[:n])
+		if err == nil {
+			err = daemon.ol.validate(op)
+		}
 		if err != nil {
-			log.Warnf("UDP invalid operation received: %s", err)
+			daemon.ol.logger().Warnf("UDP invalid operation received: %s", err)
 			daemon.ol.Stats.EventsError.Add(1)
 			continue
 		}
 
 		// Append to buffered channel in a non-blocking way so we can discard operations
 		// if buffer is full.
-		select {
-		case ops <- op:
+		if daemon.ol.enqueue(ops, op) {
 			daemon.ol.Stats.EventsReceived.Add(1)
-		default:
-			log.Warnf("UDP input queue is full, thowing message: %s", buffer[:n])
+		} else {
+			daemon.ol.logger().Warnf("UDP input queue is full, thowing message: %s", buffer[:n])
 			daemon.ol.Stats.EventsDiscarded.Add(1)
 		}
 	}
@@ -0,0 +1,462 @@
+package oplog
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sebest/xff"
+)
+
+// websocketGUID is used to compute the accept key of the handshake as defined by RFC 6455
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket frame opcodes
+const (
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xA
+)
+
+// WebSocket close codes
+const (
+	wsCloseNormal        = 1000
+	wsCloseGoingAway     = 1001
+	wsClosePolicy        = 1008
+	wsCloseTooLarge      = 1009
+	wsCloseTryAgainLater = 1013
+)
+
+// wsMaxMessageSize defines the maximum size of a message sent by a WebSocket client. Clients
+// are only expected to send their last event id.
+const wsMaxMessageSize = 4096
+
+// wsFirstMessageTimeout defines how long to wait for the client to send its last event id
+// as first message when it is not given in the query-string.
+const wsFirstMessageTimeout = 2 * time.Second
+
+var errWSMessageTooLarge = errors.New("message too large")
+
+// wsConn is a minimal server side WebSocket connection, only supporting what is needed to
+// stream events to clients.
+type wsConn struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+	// mu serializes the writes as control frames are answered by the reading goroutine
+	mu sync.Mutex
+}
+
+// websocketAccept computes the Sec-WebSocket-Accept header value for the given key
+func websocketAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerContains checks if a comma separated header contains the given token
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h[name] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgradeWebSocket validates the WebSocket handshake and takes over the connection
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, *streamError) {
+	if !headerContains(r.Header, "Connection", "upgrade") || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return nil, &streamError{400, "invalid_upgrade", "not a WebSocket handshake"}
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return nil, &streamError{426, "unsupported_version", "only WebSocket version 13 is supported"}
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, &streamError{400, "invalid_upgrade", "missing Sec-WebSocket-Key header"}
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, &streamError{500, "streaming_not_supported", "streaming not supported, the response writer doesn't implement http.Hijacker"}
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, &streamError{500, "streaming_not_supported", err.Error()}
+	}
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", websocketAccept(key))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, &streamError{500, "streaming_not_supported", err.Error()}
+	}
+	return &wsConn{conn: conn, rw: rw}, nil
+}
+
+// writeFrame writes a single unmasked frame with the FIN bit set
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	header := []byte{0x80 | op}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xffff:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+	if _, err := c.rw.Write(header); err != nil {
+		return err
+	}
+	if _, err := c.rw.Write(payload); err != nil {
+		return err
+	}
+	return c.rw.Flush()
+}
+
+// close sends a close frame with the given code and reason and closes the connection
+func (c *wsConn) close(code uint16, reason string) {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, code)
+	// Control frames payload is limited to 125 bytes
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	payload = append(payload, reason...)
+	c.writeFrame(wsOpClose, payload)
+	c.conn.Close()
+}
+
+// readFrame reads a single frame sent by the client
+func (c *wsConn) readFrame() (fin bool, op byte, payload []byte, err error) {
+	var h [2]byte
+	if _, err = io.ReadFull(c.rw, h[:]); err != nil {
+		return
+	}
+	fin = h[0]&0x80 != 0
+	op = h[0] & 0x0f
+	n := uint64(h[1] & 0x7f)
+	switch n {
+	case 126:
+		var b [2]byte
+		if _, err = io.ReadFull(c.rw, b[:]); err != nil {
+			return
+		}
+		n = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err = io.ReadFull(c.rw, b[:]); err != nil {
+			return
+		}
+		n = binary.BigEndian.Uint64(b[:])
+	}
+	if h[1]&0x80 == 0 {
+		err = errors.New("client frames must be masked")
+		return
+	}
+	if n > wsMaxMessageSize {
+		err = errWSMessageTooLarge
+		return
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(c.rw, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(c.rw, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+// readMessage returns the next data message sent by the client, answering the control
+// frames received in between. io.EOF is returned when the client closes the connection.
+func (c *wsConn) readMessage() ([]byte, error) {
+	msg := []byte{}
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			// Echo the close code as required by the closing handshake
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			c.writeFrame(wsOpClose, payload)
+			return nil, io.EOF
+		}
+		msg = append(msg, payload...)
+		if len(msg) > wsMaxMessageSize {
+			return nil, errWSMessageTooLarge
+		}
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+// eventJSON converts an event into a JSON object with its id, event and data fields. The
+// data is embedded as is when it is valid JSON. A nil message is returned for the events
+// only sent as SSE comments.
+func eventJSON(ev GenericEvent) ([]byte, error) {
+	msg := struct {
+		ID    string          `json:"id,omitempty"`
+		Event string          `json:"event,omitempty"`
+		Data  json.RawMessage `json:"data,omitempty"`
+	}{ID: ev.GetEventID().String(), Event: ev.EventName()}
+	if msg.Event == "" {
+		return nil, nil
+	}
+	data, err := ev.EventData()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if json.Valid(data) {
+			msg.Data = json.RawMessage(data)
+		} else {
+			msg.Data, _ = json.Marshal(string(data))
+		}
+	}
+	return json.Marshal(msg)
+}
+
+// GetWS exposes a WebSocket endpoint streaming the same events as the SSE endpoint, each
+// event being sent as a JSON text message. The last event id is given either with the
+// last_event_id query-string parameter or as the first message sent by the client.
+func (daemon *SSEDaemon) GetWS(w http.ResponseWriter, r *http.Request) {
+	daemon.handlers.Add(1)
+	defer daemon.handlers.Done()
+
+	ip := xff.GetRemoteAddr(r)
+	daemon.logger().Infof("WS[%s] connection started", ip)
+
+	leave, ok := daemon.admit(w, r)
+	if !ok {
+		return
+	}
+	defer leave()
+
+	r, ok = daemon.authenticate(w, r, ScopeRead)
+	if !ok {
+		return
+	}
+
+	filter, err := daemon.parseFilter(r)
+	if err != nil {
+		daemon.logger().Warnf("WS[%s] invalid filter: %s", ip, err)
+		writeError(w, 400, "invalid_filter", err.Error())
+		return
+	}
+	if filter, ok = daemon.enforcePolicy(w, r, "WS", ip, filter); !ok {
+		return
+	}
+
+	conn, serr := upgradeWebSocket(w, r)
+	if serr != nil {
+		daemon.logger().Warnf("WS[%s] upgrade failed: %s", ip, serr.message)
+		writeError(w, serr.status, serr.code, serr.message)
+		return
+	}
+	defer conn.conn.Close()
+
+	// Client messages are read in the background so pings are answered and disconnects
+	// are detected while streaming
+	messages := make(chan []byte, 1)
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			msg, err := conn.readMessage()
+			if err == errWSMessageTooLarge {
+				conn.close(wsCloseTooLarge, "message too large")
+			}
+			if err != nil {
+				return
+			}
+			select {
+			case messages <- msg:
+			default:
+				// Only the first message is used, others are ignored
+			}
+		}
+	}()
+
+	lastEventID := r.URL.Query().Get("last_event_id")
+	if _, found := r.URL.Query()["last_event_id"]; !found {
+		timeout := time.NewTimer(wsFirstMessageTimeout)
+		select {
+		case msg := <-messages:
+			lastEventID = strings.TrimSpace(string(msg))
+		case <-timeout.C:
+		case <-gone:
+			daemon.logger().Infof("WS[%s] connection closed", ip)
+			return
+		}
+		timeout.Stop()
+	}
+
+	lastID, startID, serr := daemon.resolveLastID(ip, lastEventID, filter, time.Time{})
+	if serr != nil {
+		conn.close(wsClosePolicy, string(errorBody(serr.code, serr.message)))
+		return
+	}
+
+	release, ok := daemon.ol.reserveTail(startID)
+	if !ok {
+		daemon.logger().Warnf("WS[%s] too many concurrent tails", ip)
+		conn.close(wsCloseTryAgainLater, string(errorBody("too_many_clients", "too many clients")))
+		return
+	}
+	defer release()
+
+	// The stream is registered so it is listed by Connections and can be revoked, see
+	// DisconnectClients
+	stream := newConnection(ip, r)
+	mode := streamMode(lastID, startID)
+	stream.update(func(info *ConnectionInfo) {
+		info.Filter = filter
+		info.LastEventID = lastEventID
+		info.Status = 101
+		info.Mode = mode
+		if principal, found := PrincipalFromContext(r.Context()); found {
+			info.Auth = "ok"
+			info.User = principal.Name
+		}
+	})
+	daemon.register(stream)
+	defer daemon.unregister(stream)
+	daemon.auditStream(AuditStreamStart, stream.snapshot(), mode, "")
+	reason := ""
+	defer func() {
+		if reason == "" {
+			reason = "other"
+		}
+		stream.update(func(info *ConnectionInfo) { info.EndReason = reason })
+		daemon.ol.Stats.StreamsEnded.Add(reason, 1)
+		daemon.auditStream(AuditStreamEnd, stream.snapshot(), mode, reason)
+	}()
+
+	ops := make(chan GenericEvent)
+	stop := make(chan bool)
+	go daemon.tail(lastID, filter, TailOptions{}, ops, stop)
+	defer func() {
+		// Stop the oplog tailer
+		stop <- true
+	}()
+
+	fingerprint := ""
+	if daemon.FilterFingerprint {
+		fingerprint = filter.Fingerprint()
+	}
+
+	daemon.ol.Stats.Clients.Add(1)
+	daemon.ol.Stats.Connections.Add(1)
+	defer daemon.ol.Stats.Clients.Add(-1)
+
+	// Pings replace the SSE heartbeat comments
+	var pingC <-chan time.Time
+	if interval := daemon.keepaliveInterval(); interval > 0 {
+		ping := time.NewTicker(interval)
+		defer ping.Stop()
+		pingC = ping.C
+	}
+
+	for {
+		select {
+		case <-gone:
+			daemon.logger().Infof("WS[%s] connection closed", ip)
+			reason = "client_closed"
+			return
+
+		case <-daemon.quit:
+			daemon.logger().Infof("WS[%s] server shutting down, closing connection", ip)
+			reason = "shutdown"
+			conn.close(wsCloseGoingAway, "shutdown")
+			return
+
+		case <-stream.revoked:
+			daemon.logger().Warnf("WS[%s] connection revoked", ip)
+			reason = "revoked"
+			if msg, err := eventJSON(notice{"error", "revoked"}); err == nil {
+				conn.writeFrame(wsOpText, msg)
+			}
+			conn.close(wsClosePolicy, string(errorBody("revoked", "credentials revoked")))
+			return
+
+		case op := <-ops:
+			msg, err := eventJSON(daemon.wrapEvent(op, fingerprint))
+			if err != nil {
+				daemon.logger().Warnf("WS[%s] can't encode event: %s", ip, err)
+				continue
+			}
+			if msg == nil {
+				continue
+			}
+			daemon.logger().Debugf("WS[%s] sending event", ip)
+			if err := conn.writeFrame(wsOpText, msg); err != nil {
+				daemon.logger().Warnf("WS[%s] write error: %s", ip, err)
+				reason = "write_error"
+				return
+			}
+			switch op.(type) {
+			case *Checkpoint:
+				daemon.ol.Stats.CheckpointsSent.Add(1)
+				stream.sent(op.GetEventID().String(), false)
+			case *Event, *Queued, *Fallback, *Warning:
+				// Technical events don't count as streamed events of the connection
+				daemon.ol.Stats.EventsSent.Add(1)
+				daemon.countSent(op)
+				stream.sent(op.GetEventID().String(), false)
+			default:
+				daemon.ol.Stats.EventsSent.Add(1)
+				daemon.countSent(op)
+				stream.sent(op.GetEventID().String(), true)
+				stream.delivered(op, daemon.observeHead(time.Time{}))
+			}
+			if e, ok := op.(*Event); ok && (e.Event == "end" || e.Event == "retry-later") {
+				daemon.logger().Infof("WS[%s] end of stream reached", ip)
+				reason = "end_of_stream"
+				if e.Event == "retry-later" {
+					reason = "overloaded"
+				}
+				conn.close(wsCloseNormal, e.Event)
+				return
+			}
+
+		case <-pingC:
+			if err := conn.writeFrame(wsOpPing, nil); err != nil {
+				daemon.logger().Warnf("WS[%s] write error: %s", ip, err)
+				reason = "write_error"
+				return
+			}
+		}
+	}
+}
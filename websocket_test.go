@@ -0,0 +1,308 @@
+package oplog
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// testWSClient is a minimal WebSocket client
+type testWSClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialTestWS(t *testing.T, addr, query string) *testWSClient {
+	return dialTestWSAuth(t, addr, query, "", "")
+}
+
+// dialTestWSAuth opens a WebSocket authenticated with the user and password, if any
+func dialTestWSAuth(t *testing.T, addr, query, user, password string) *testWSClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	req, _ := http.NewRequest("GET", "http://"+addr+"/ws"+query, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	if user != "" || password != "" {
+		req.SetBasicAuth(user, password)
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 101 {
+		t.Fatalf("expected status 101, got %d", res.StatusCode)
+	}
+	if res.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("invalid accept key: %s", res.Header.Get("Sec-WebSocket-Accept"))
+	}
+	return &testWSClient{conn, r}
+}
+
+func (c *testWSClient) send(op byte, payload []byte) error {
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | op, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+func (c *testWSClient) read(t *testing.T) (op byte, payload []byte) {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var h [2]byte
+	if _, err := io.ReadFull(c.r, h[:]); err != nil {
+		t.Fatal(err)
+	}
+	n := uint64(h[1] & 0x7f)
+	switch n {
+	case 126:
+		var b [2]byte
+		io.ReadFull(c.r, b[:])
+		n = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		io.ReadFull(c.r, b[:])
+		n = binary.BigEndian.Uint64(b[:])
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		t.Fatal(err)
+	}
+	return h[0] & 0x0f, payload
+}
+
+// testWSTail describes how a tail has been started
+type testWSTail struct {
+	lastID string
+	filter Filter
+}
+
+type testWSMessage struct {
+	ID    string          `json:"id"`
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data"`
+}
+
+func (c *testWSClient) readMessage(t *testing.T) testWSMessage {
+	for {
+		op, payload := c.read(t)
+		if op == wsOpPing {
+			continue
+		}
+		if op != wsOpText {
+			t.Fatalf("expected a text message, got opcode %d: %q", op, payload)
+		}
+		msg := testWSMessage{}
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			t.Fatalf("invalid JSON message: %s: %q", err, payload)
+		}
+		return msg
+	}
+}
+
+// newTestWSDaemon starts a daemon whose tails report their last id and filter, then send
+// a single operation
+func newTestWSDaemon(t *testing.T, started chan<- testWSTail, stopped chan<- struct{}) (*SSEDaemon, string) {
+	daemon, addr := newTestSSEDaemon(t)
+	daemon.tail = func(lastID LastID, filter Filter, opts TailOptions, out chan<- GenericEvent, stop <-chan bool) {
+		defer close(stopped)
+		tail := testWSTail{filter: filter}
+		if lastID != nil {
+			tail.lastID = lastID.String()
+		}
+		started <- tail
+		id := bson.NewObjectId()
+		select {
+		case out <- Operation{ID: &id, Event: "insert", Data: &OperationData{ID: "1", Type: "video"}}:
+		case <-stop:
+			return
+		}
+		<-stop
+	}
+	return daemon, addr
+}
+
+func TestWebSocketFilteredStream(t *testing.T) {
+	started := make(chan testWSTail, 1)
+	stopped := make(chan struct{})
+	daemon, addr := newTestWSDaemon(t, started, stopped)
+	defer daemon.Shutdown(context.Background())
+
+	c := dialTestWS(t, addr, "?types=video,user&parents=user/1&last_event_id=1423995187898")
+	tail := <-started
+	if tail.lastID != "1423995187898" {
+		t.Errorf("invalid last id: %s", tail.lastID)
+	}
+	if strings.Join(tail.filter.Types, ",") != "video,user" || strings.Join(tail.filter.Parents, ",") != "user/1" {
+		t.Errorf("invalid filter: %#v", tail.filter)
+	}
+	msg := c.readMessage(t)
+	if msg.Event != "insert" || !bson.IsObjectIdHex(msg.ID) {
+		t.Errorf("invalid message: %#v", msg)
+	}
+	data := OperationData{}
+	if err := json.Unmarshal(msg.Data, &data); err != nil || data.Type != "video" || data.ID != "1" {
+		t.Errorf("invalid message data: %s", msg.Data)
+	}
+
+	// A client disconnect must stop the tail
+	c.send(wsOpClose, []byte{0x03, 0xe8})
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("tail not stopped on client disconnect")
+	}
+}
+
+func TestWebSocketResumeFirstMessage(t *testing.T) {
+	started := make(chan testWSTail, 1)
+	stopped := make(chan struct{})
+	daemon, addr := newTestWSDaemon(t, started, stopped)
+	defer daemon.Shutdown(context.Background())
+
+	c := dialTestWS(t, addr, "")
+	c.send(wsOpText, []byte("1423995187898"))
+	select {
+	case tail := <-started:
+		if tail.lastID != "1423995187898" {
+			t.Errorf("invalid last id: %s", tail.lastID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("tail not started after the first message")
+	}
+	if msg := c.readMessage(t); msg.Event != "insert" {
+		t.Errorf("invalid message: %#v", msg)
+	}
+
+	// Closing the connection without handshake must stop the tail as well
+	c.conn.Close()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("tail not stopped on client disconnect")
+	}
+}
+
+func TestWebSocketInvalidLastID(t *testing.T) {
+	started := make(chan testWSTail, 1)
+	daemon, addr := newTestWSDaemon(t, started, make(chan struct{}))
+	defer daemon.Shutdown(context.Background())
+
+	c := dialTestWS(t, addr, "?last_event_id=invalid")
+	op, payload := c.read(t)
+	if op != wsOpClose || binary.BigEndian.Uint16(payload) != wsClosePolicy {
+		t.Fatalf("expected a policy close, got opcode %d: %q", op, payload)
+	}
+	if !strings.Contains(string(payload), "invalid_last_id") {
+		t.Errorf("close reason doesn't give the error code: %q", payload)
+	}
+	select {
+	case <-started:
+		t.Error("tail started with an invalid last id")
+	default:
+	}
+}
+
+func TestWebSocketPassword(t *testing.T) {
+	daemon, addr := newTestSSEDaemon(t)
+	defer daemon.Shutdown(context.Background())
+	daemon.Password = "secret"
+
+	req, _ := http.NewRequest("GET", "http://"+addr+"/ws", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 401 {
+		t.Errorf("expected status 401, got %d", res.StatusCode)
+	}
+}
+
+func TestWebSocketRevoked(t *testing.T) {
+	daemon, addr := newTestSSEDaemon(t)
+	defer daemon.Shutdown(context.Background())
+	store := NewCredentialStore(Credentials{
+		"alice": {Password: "a"},
+		"bob":   {Password: "b"},
+	})
+	daemon.Authenticator = store
+
+	stream := func(user, password string) *testWSClient {
+		c := dialTestWSAuth(t, addr, "?last_event_id=1423995187898", user, password)
+		if msg := c.readMessage(t); msg.Event != "insert" {
+			t.Fatalf("invalid message: %#v", msg)
+		}
+		return c
+	}
+	alice := stream("alice", "a")
+	stream("bob", "b")
+	conns := daemon.Connections()
+	if len(conns) != 2 || conns[0].Path != "/ws" || conns[0].User != "alice" {
+		t.Fatalf("streams not registered: %#v", conns)
+	}
+
+	// Removing the user ends its streams with an error message, then a policy close
+	store.Remove("alice")
+	if msg := alice.readMessage(t); msg.Event != "error" || string(msg.Data) != `"revoked"` {
+		t.Errorf("expected a revoked error, got %#v", msg)
+	}
+	op, payload := alice.read(t)
+	if op != wsOpClose || binary.BigEndian.Uint16(payload) != wsClosePolicy || !strings.Contains(string(payload), "revoked") {
+		t.Errorf("expected a policy close, got opcode %d: %q", op, payload)
+	}
+	for deadline := time.Now().Add(time.Second); len(daemon.Connections()) != 1; {
+		if time.Now().After(deadline) {
+			t.Fatalf("revoked stream still registered: %#v", daemon.Connections())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if conns := daemon.Connections(); conns[0].User != "bob" {
+		t.Errorf("expected bob to stay connected: %#v", conns)
+	}
+}
+
+func TestEventJSON(t *testing.T) {
+	tests := []struct {
+		ev   GenericEvent
+		json string
+	}{
+		{&Event{ID: "1", Event: "reset"}, `{"id":"1","event":"reset"}`},
+		{&Fallback{ID: "1", Time: time.Unix(0, 0).UTC()}, `{"id":"1","event":"fallback","data":{"requested_id":"1","time":"1970-01-01T00:00:00Z"}}`},
+		{&Queued{Position: 2}, ``},
+	}
+	for _, test := range tests {
+		msg, err := eventJSON(test.ev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg) != test.json {
+			t.Errorf("expected %s, got %s", test.json, msg)
+		}
+	}
+}